@@ -10,7 +10,7 @@ cd $SDIR
 export VOUCH_ROOT=${GOPATH}/src/github.com/vouch/vouch-proxy/
 
 IMAGE=voucher/vouch-proxy
-GOIMAGE=golang:1.10
+GOIMAGE=golang:1.14
 NAME=vouch-proxy
 HTTPPORT=9090
 GODOC_PORT=5050
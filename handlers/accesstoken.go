@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/vouch/vouch-proxy/handlers/common"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwks"
+)
+
+// accessTokenGroups the values of `oauth.access_token_groups_claim` in the provider's access token
+// Azure AD v1 and Cognito put the groups there rather than in the id_token, an opaque access token has none
+// with `oauth.jwks_url` set the signature must verify, otherwise the token is trusted as it came from the token endpoint
+func accessTokenGroups(accessToken string) []string {
+	if strings.Count(accessToken, ".") != 2 {
+		log.Debug("the access token is opaque, it has no groups")
+		return nil
+	}
+	claims := jwt.MapClaims{}
+	if cfg.GenOAuth.JWKSURL != "" {
+		parser := &jwt.Parser{ValidMethods: jwks.AsymmetricMethods}
+		if _, err := parser.ParseWithClaims(accessToken, claims, providerKeys().Keyfunc); err != nil {
+			log.Warnf("ignoring the groups of the access token, it could not be verified with oauth.jwks_url: %s", err)
+			return nil
+		}
+	} else if _, _, err := new(jwt.Parser).ParseUnverified(accessToken, claims); err != nil {
+		log.Debugf("the access token is not a jwt, it has no groups: %s", err)
+		return nil
+	}
+	groups := common.ClaimStrings(claims, cfg.GenOAuth.AccessTokenGroupsClaim)
+	log.Debugf("groups from the access token claim %s: %s", cfg.GenOAuth.AccessTokenGroupsClaim, groups)
+	return groups
+}
@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/handlers/common"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwks"
+)
+
+func TestAccessTokenGroups(t *testing.T) {
+	setUp()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "idp1",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}}))
+	}))
+	defer ts.Close()
+	logoutKeys = jwks.New(ts.URL)
+
+	claim, jwksURL := cfg.GenOAuth.AccessTokenGroupsClaim, cfg.GenOAuth.JWKSURL
+	cfg.GenOAuth.AccessTokenGroupsClaim = "cognito:groups"
+	defer func() {
+		cfg.GenOAuth.AccessTokenGroupsClaim, cfg.GenOAuth.JWKSURL = claim, jwksURL
+		common.ConfigureUserInfoFields()
+	}()
+
+	sign := func(signer *rsa.PrivateKey) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "robin", "cognito:groups": []string{"admins", "devs"}})
+		token.Header["kid"] = "idp1"
+		ss, _ := token.SignedString(signer)
+		return ss
+	}
+
+	// without a jwks_url the token is taken as it came from the token endpoint
+	assert.Equal(t, []string{"admins", "devs"}, accessTokenGroups(sign(key)))
+	assert.Nil(t, accessTokenGroups("an-opaque-access-token"))
+
+	cfg.GenOAuth.JWKSURL = ts.URL
+	assert.Equal(t, []string{"admins", "devs"}, accessTokenGroups(sign(key)))
+	other, _ := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, accessTokenGroups(sign(other)))
+
+	// keycloak nests the roles
+	cfg.GenOAuth.JWKSURL = ""
+	cfg.GenOAuth.AccessTokenGroupsClaim = "$.realm_access.roles[*]"
+	assert.NoError(t, common.ConfigureUserInfoFields())
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"realm_access": map[string]interface{}{"roles": []string{"ops"}}}).SignedString([]byte("secret"))
+	assert.Equal(t, []string{"ops"}, accessTokenGroups(token))
+}
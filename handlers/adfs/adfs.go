@@ -5,11 +5,12 @@ import (
 	"encoding/json"
 	"github.com/vouch/vouch-proxy/handlers/common"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/httpclient"
+	"github.com/vouch/vouch-proxy/pkg/pii"
 	"github.com/vouch/vouch-proxy/pkg/structs"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"regexp"
 	"strconv"
 	"strings"
 )
@@ -37,7 +38,12 @@ func (Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims *st
 	formData.Set("grant_type", "authorization_code")
 	formData.Set("resource", cfg.GenOAuth.RedirectURL)
 	formData.Set("client_id", cfg.GenOAuth.ClientID)
-	formData.Set("redirect_uri", cfg.GenOAuth.RedirectURL)
+	redirectURI := cfg.GenOAuth.RedirectURL
+	if cb := common.CallbackURL(r); cb != "" {
+		// identical to the redirect_uri of the authorize endpoint
+		redirectURI = cb
+	}
+	formData.Set("redirect_uri", redirectURI)
 	if cfg.GenOAuth.ClientSecret != "" {
 		formData.Set("client_secret", cfg.GenOAuth.ClientSecret)
 	}
@@ -49,11 +55,11 @@ func (Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims *st
 	req.Header.Add("Content-Length", strconv.Itoa(len(formData.Encode())))
 	req.Header.Set("Accept", "application/json")
 
-	client := &http.Client{}
+	client := httpclient.Client()
 	userinfo, err := client.Do(req)
 
 	if err != nil {
-		return err
+		return common.NewTokenExchangeError(err)
 	}
 	defer func() {
 		if err := userinfo.Body.Close(); err != nil {
@@ -62,6 +68,9 @@ func (Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims *st
 	}()
 
 	data, _ := ioutil.ReadAll(userinfo.Body)
+	if userinfo.StatusCode != http.StatusOK {
+		return common.TokenEndpointError(userinfo.Status, data)
+	}
 	tokenRes := adfsTokenRes{}
 
 	if err := json.Unmarshal(data, &tokenRes); err != nil {
@@ -83,11 +92,11 @@ func (Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims *st
 		log.Error(err)
 		return nil
 	}
-	log.Debugf("idToken: %+v", string(idToken))
+	log.Debugf("idToken: %+v", pii.Dump(string(idToken)))
 
 	adfsUser := structs.ADFSUser{}
 	json.Unmarshal([]byte(idToken), &adfsUser)
-	log.Infof("adfs adfsUser: %+v", adfsUser)
+	log.Infof("adfs adfsUser: %+v", pii.Dump(adfsUser))
 	// data contains an access token, refresh token, and id token
 	// Please note that in order for custom claims to work you MUST set allatclaims in ADFS to be passed
 	// https://oktotechnologies.ca/2018/08/26/adfs-openidconnect-configuration/
@@ -96,17 +105,25 @@ func (Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims *st
 		return err
 	}
 	adfsUser.PrepareUserData()
-	var rxEmail = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 
+	var claims map[string]interface{}
+	if err := common.UnmarshalClaims(idToken, &claims); err != nil {
+		log.Error(err)
+		return err
+	}
 	if len(adfsUser.Email) == 0 {
-		// If the email is blank, we will try to determine if the UPN is an email.
-		if rxEmail.MatchString(adfsUser.UPN) {
-			// Set the email from UPN if there is a valid email present.
-			adfsUser.Email = adfsUser.UPN
-		}
+		// If the email is blank, we will try the other claims which may hold it, such as `mail` or the UPN.
+		adfsUser.Email = common.EmailFromClaims(claims)
 	}
 	user.Username = adfsUser.Username
 	user.Email = adfsUser.Email
-	log.Debugf("User Obj: %+v", user)
+	if err = common.MapName(idToken, user); err != nil {
+		return err
+	}
+	// the claim type uris, or whichever claims `oauth.user_info_fields` names
+	if err = common.MapUserInfoFieldsFromMap(claims, user); err != nil {
+		return err
+	}
+	log.Debugf("User Obj: %+v", pii.Dump(user))
 	return nil
 }
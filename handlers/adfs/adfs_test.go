@@ -0,0 +1,69 @@
+package adfs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func init() {
+	cfg.InitForTestPurposesWithProvider("adfs")
+}
+
+// adfsServer the token endpoint, answering with an unsigned id token of the claims
+func adfsServer(t *testing.T, claims map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		payload, _ := json.Marshal(claims)
+		idToken := "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(payload) + "."
+		w.Header().Set("Content-Type", "application/json")
+		assert.Nil(t, json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "at", "token_type": "bearer", "id_token": idToken}))
+	}))
+}
+
+func TestGetUserInfoClaimTypeURIs(t *testing.T) {
+	tokenURL := cfg.GenOAuth.TokenURL
+	defer func() { cfg.GenOAuth.TokenURL = tokenURL }()
+
+	getUserInfo := func(claims map[string]interface{}) *structs.User {
+		ts := adfsServer(t, claims)
+		defer ts.Close()
+		cfg.GenOAuth.TokenURL = ts.URL
+		user := &structs.User{}
+		r := httptest.NewRequest("GET", "http://vouch.example.com/auth?code=abc&state=xyz", nil)
+		assert.Nil(t, Handler{}.GetUserInfo(r, user, &structs.CustomClaims{}, &structs.PTokens{}))
+		return user
+	}
+
+	user := getUserInfo(map[string]interface{}{"upn": "robin@corp.example.com", "email": "robin@example.com"})
+	assert.Equal(t, "robin@corp.example.com", user.Username)
+	assert.Equal(t, "robin@example.com", user.Email)
+
+	user = getUserInfo(map[string]interface{}{
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/upn":          "robin@corp.example.com",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress": "robin@example.com",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/name":         "Robin",
+	})
+	assert.Equal(t, "robin@corp.example.com", user.Username)
+	assert.Equal(t, "robin@example.com", user.Email)
+	assert.Equal(t, "Robin", user.Name)
+
+	// an ADFS with its own claim rules
+	fields := cfg.GenOAuth.UserInfoFields
+	defer func() { cfg.GenOAuth.UserInfoFields = fields }()
+	cfg.GenOAuth.UserInfoFields.Username = "unique_name"
+	cfg.GenOAuth.UserInfoFields.Groups = "http://schemas.microsoft.com/ws/2008/06/identity/claims/role"
+	user = getUserInfo(map[string]interface{}{
+		"upn":         "robin@corp.example.com",
+		"unique_name": "CORP\\robin",
+		"http://schemas.microsoft.com/ws/2008/06/identity/claims/role": []string{"admins", "devs"},
+	})
+	assert.Equal(t, "CORP\\robin", user.Username)
+	assert.Equal(t, []string{"admins", "devs"}, user.TeamMemberships)
+}
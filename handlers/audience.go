@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"net/url"
+	"strings"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwks"
+)
+
+// withAudience add `oauth.audience` to the authorize url in the form of `oauth.audience_param`
+// golang.org/x/oauth2 sets each AuthURLParam once, so a repeated audience can't be one of the AuthCodeOptions
+func withAudience(lURL string) string {
+	if len(cfg.GenOAuth.Audience) == 0 {
+		return lURL
+	}
+	u, err := url.Parse(lURL)
+	if err != nil {
+		log.Error(err)
+		return lURL
+	}
+	q := u.Query()
+	if cfg.GenOAuth.AudienceParam == "repeat" {
+		q.Del("audience")
+		for _, aud := range cfg.GenOAuth.Audience {
+			q.Add("audience", aud)
+		}
+	} else {
+		q.Set("audience", strings.Join(cfg.GenOAuth.Audience, " "))
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// missingAudiences those of `oauth.audience` which the `aud` of the access token doesn't include
+// an opaque access token can't be checked, nothing is missing
+func missingAudiences(accessToken string) []string {
+	if len(cfg.GenOAuth.Audience) == 0 || strings.Count(accessToken, ".") != 2 {
+		return nil
+	}
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(accessToken, claims); err != nil {
+		log.Debugf("the access token is not a jwt, its audience can't be checked: %s", err)
+		return nil
+	}
+	missing := []string{}
+	for _, aud := range cfg.GenOAuth.Audience {
+		if !jwks.AudienceContains(claims["aud"], aud) {
+			missing = append(missing, aud)
+		}
+	}
+	return missing
+}
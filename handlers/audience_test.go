@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"net/url"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func TestWithAudience(t *testing.T) {
+	setUp()
+	defer func() {
+		cfg.GenOAuth.Audience = nil
+		cfg.GenOAuth.AudienceParam = "space"
+	}()
+	lURL := "https://idp.example.com/authorize?client_id=abc&state=xyz"
+	assert.Equal(t, lURL, withAudience(lURL))
+
+	cfg.GenOAuth.Audience = []string{"https://api1.example.com", "https://api2.example.com"}
+	cfg.GenOAuth.AudienceParam = "space"
+	u, err := url.Parse(withAudience(lURL))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://api1.example.com https://api2.example.com"}, u.Query()["audience"])
+	assert.Equal(t, "xyz", u.Query().Get("state"))
+
+	cfg.GenOAuth.AudienceParam = "repeat"
+	u, err = url.Parse(withAudience(lURL))
+	assert.NoError(t, err)
+	assert.Equal(t, cfg.GenOAuth.Audience, u.Query()["audience"])
+}
+
+func TestMissingAudiences(t *testing.T) {
+	setUp()
+	defer func() { cfg.GenOAuth.Audience = nil }()
+	token := func(aud interface{}) string {
+		s, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"aud": aud}).SignedString([]byte("secret"))
+		return s
+	}
+	assert.Empty(t, missingAudiences(token("https://api1.example.com")))
+
+	cfg.GenOAuth.Audience = []string{"https://api1.example.com", "https://api2.example.com"}
+	assert.Empty(t, missingAudiences(token([]string{"https://api1.example.com", "https://api2.example.com", "https://idp.example.com/userinfo"})))
+	assert.Equal(t, []string{"https://api2.example.com"}, missingAudiences(token("https://api1.example.com")))
+	// an opaque access token can't be checked
+	assert.Empty(t, missingAudiences("opaque"))
+}
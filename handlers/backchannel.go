@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/vouch/vouch-proxy/handlers/openid"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/ghactions"
+	"github.com/vouch/vouch-proxy/pkg/jwks"
+	"github.com/vouch/vouch-proxy/pkg/model"
+	"github.com/vouch/vouch-proxy/pkg/pii"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// backChannelLogoutEvent the member of the `events` claim which marks a logout token
+// https://openid.net/specs/openid-connect-backchannel-1_0.html#LogoutToken
+const backChannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+var (
+	logoutKeys     *jwks.Set
+	logoutKeysOnce sync.Once
+)
+
+func providerKeys() *jwks.Set {
+	logoutKeysOnce.Do(func() {
+		if logoutKeys == nil {
+			logoutKeys = jwks.New(cfg.GenOAuth.JWKSURL)
+		}
+	})
+	return logoutKeys
+}
+
+// keySets the JWKS in use
+func keySets() []*jwks.Set {
+	sets := []*jwks.Set{}
+	if cfg.Cfg.BackChannelLogout || (cfg.GenOAuth.AccessTokenGroupsClaim != "" && cfg.GenOAuth.JWKSURL != "") {
+		sets = append(sets, providerKeys())
+	}
+	if cfg.GenOAuth.Provider == cfg.Providers.OIDC && cfg.GenOAuth.UserInfo != "required" {
+		sets = append(sets, openid.KeySet())
+	}
+	if cfg.Cfg.GitHubActions.Enabled {
+		sets = append(sets, ghactions.KeySet())
+	}
+	return sets
+}
+
+// PrefetchKeys fetch the JWKS in use at startup, see `vouch.prefetch`
+func PrefetchKeys() {
+	jwks.Prefetch(time.Duration(cfg.Cfg.Prefetch.Retry)*time.Second, keySets()...)
+}
+
+// RefreshKeys keep fetching the JWKS in use in the background, see `vouch.prefetch.refresh`
+func RefreshKeys() {
+	r := cfg.Cfg.Prefetch.Refresh
+	jwks.Refresh(time.Duration(r.Interval)*time.Second, time.Duration(r.Min)*time.Second, time.Duration(r.Max)*time.Second, keySets()...)
+}
+
+// BackChannelLogoutHandler /backchannel-logout
+// the IdP POSTs a logout token, every session of the matching user is invalidated by bumping the session version
+func BackChannelLogoutHandler(w http.ResponseWriter, r *http.Request) {
+	log.Debug("/backchannel-logout")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method != http.MethodPost {
+		backChannelLogoutError(w, "logout token must be POSTed")
+		return
+	}
+	// fails for a body over vouch.limits.maxBodyBytes
+	if err := r.ParseForm(); err != nil {
+		backChannelLogoutError(w, err.Error())
+		return
+	}
+	claims, err := verifyLogoutToken(r.PostFormValue("logout_token"))
+	if err != nil {
+		log.Warnf("/backchannel-logout rejected logout token: %s", err)
+		backChannelLogoutError(w, err.Error())
+		return
+	}
+
+	usernames := map[string]bool{}
+	for _, subject := range logoutSubjects(claims) {
+		username, err := model.Subject(subject)
+		if err != nil {
+			log.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if username != "" {
+			usernames[username] = true
+		}
+	}
+	for username := range usernames {
+		if _, err := model.IncrSessionVersion(username); err != nil {
+			log.Error(err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		log.Infof("/backchannel-logout invalidated the sessions of %s", pii.Mask(username))
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func backChannelLogoutError(w http.ResponseWriter, description string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	if err := json.NewEncoder(w).Encode(map[string]string{"error": "invalid_request", "error_description": description}); err != nil {
+		log.Error(err)
+	}
+}
+
+// verifyLogoutToken validates the logout token as per
+// https://openid.net/specs/openid-connect-backchannel-1_0.html#Validation
+func verifyLogoutToken(logoutToken string) (jwt.MapClaims, error) {
+	if logoutToken == "" {
+		return nil, errors.New("missing logout_token")
+	}
+	claims := jwt.MapClaims{}
+	parser := &jwt.Parser{ValidMethods: jwks.AsymmetricMethods}
+	if _, err := parser.ParseWithClaims(logoutToken, claims, providerKeys().Keyfunc); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != cfg.GenOAuth.Issuer {
+		return nil, errors.New("logout token iss does not match oauth.issuer")
+	}
+	if !jwks.AudienceContains(claims["aud"], cfg.GenOAuth.ClientID) {
+		return nil, errors.New("logout token aud does not include oauth.client_id")
+	}
+	if _, ok := claims["iat"]; !ok {
+		return nil, errors.New("logout token is missing iat")
+	}
+	sub, _ := claims["sub"].(string)
+	sid, _ := claims["sid"].(string)
+	if sub == "" && sid == "" {
+		return nil, errors.New("logout token must include sub or sid")
+	}
+	events, _ := claims["events"].(map[string]interface{})
+	if _, ok := events[backChannelLogoutEvent]; !ok {
+		return nil, errors.New("logout token events does not include " + backChannelLogoutEvent)
+	}
+	if _, ok := claims["nonce"]; ok {
+		return nil, errors.New("logout token must not include a nonce")
+	}
+	return claims, nil
+}
+
+// logoutSubjects the keys under which recordLogoutSubjects stored the user
+func logoutSubjects(claims jwt.MapClaims) []string {
+	subjects := []string{}
+	if sid, _ := claims["sid"].(string); sid != "" {
+		subjects = append(subjects, "sid:"+sid)
+	}
+	if sub, _ := claims["sub"].(string); sub != "" {
+		subjects = append(subjects, "sub:"+sub)
+	}
+	return subjects
+}
+
+// recordLogoutSubjects remember the user's `sub` and the IdP session `sid` so a later logout token can be matched
+// the id token was just received from the token endpoint so its claims are read without verifying it again
+func recordLogoutSubjects(user structs.User, customClaims structs.CustomClaims, ptokens structs.PTokens) {
+	claims := jwt.MapClaims{}
+	if ptokens.PIdToken != "" {
+		if _, _, err := new(jwt.Parser).ParseUnverified(ptokens.PIdToken, claims); err != nil {
+			log.Debugf("could not read the id token claims: %s", err)
+		}
+	}
+	if _, ok := claims["sub"]; !ok {
+		if sub, ok := customClaims.Claims["sub"].(string); ok {
+			claims["sub"] = sub
+		}
+	}
+	for _, subject := range logoutSubjects(claims) {
+		if err := model.PutSubject(subject, user.Username); err != nil {
+			log.Error(err)
+		}
+	}
+}
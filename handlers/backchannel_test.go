@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwks"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/model"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func TestBackChannelLogoutHandler(t *testing.T) {
+	setUp()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "idp1",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}}))
+	}))
+	defer ts.Close()
+	logoutKeys = jwks.New(ts.URL)
+
+	cfg.Cfg.BackChannelLogout = true
+	cfg.Cfg.AllowAllUsers = true
+	issuer, clientID := cfg.GenOAuth.Issuer, cfg.GenOAuth.ClientID
+	cfg.GenOAuth.Issuer = "https://idp.example.com"
+	cfg.GenOAuth.ClientID = "vouch"
+	defer func() {
+		cfg.Cfg.BackChannelLogout = false
+		cfg.Cfg.AllowAllUsers = false
+		cfg.GenOAuth.Issuer, cfg.GenOAuth.ClientID = issuer, clientID
+	}()
+
+	// login
+	u := structs.User{Username: "logoutuser"}
+	recordLogoutSubjects(u, structs.CustomClaims{Claims: map[string]interface{}{"sub": "248289761001"}}, structs.PTokens{})
+	tokenstring := jwtmanager.CreateUserTokenString(u, structs.CustomClaims{}, structs.PTokens{})
+	validate := func() int {
+		r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+		r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+		w := httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, validate())
+
+	logout := func(claims jwt.MapClaims) *httptest.ResponseRecorder {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "idp1"
+		ss, _ := token.SignedString(key)
+		r := httptest.NewRequest("POST", "http://vouch.domain1/backchannel-logout", strings.NewReader(url.Values{"logout_token": {ss}}.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		BackChannelLogoutHandler(w, r)
+		return w
+	}
+	claims := func() jwt.MapClaims {
+		return jwt.MapClaims{
+			"iss":    "https://idp.example.com",
+			"aud":    []string{"vouch"},
+			"iat":    time.Now().Unix(),
+			"sub":    "248289761001",
+			"events": map[string]interface{}{backChannelLogoutEvent: map[string]interface{}{}},
+		}
+	}
+
+	wrongIssuer := claims()
+	wrongIssuer["iss"] = "https://evil.example.com"
+	assert.Equal(t, http.StatusBadRequest, logout(wrongIssuer).Code)
+	withNonce := claims()
+	withNonce["nonce"] = "abc"
+	assert.Equal(t, http.StatusBadRequest, logout(withNonce).Code)
+	noEvent := claims()
+	delete(noEvent, "events")
+	assert.Equal(t, http.StatusBadRequest, logout(noEvent).Code)
+	assert.Equal(t, http.StatusOK, validate())
+
+	w := logout(claims())
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+	assert.Equal(t, http.StatusUnauthorized, validate())
+
+	// logging in again issues a current session
+	tokenstring = jwtmanager.CreateUserTokenString(u, structs.CustomClaims{}, structs.PTokens{})
+	assert.Equal(t, http.StatusOK, validate())
+
+	sv, _ := model.SessionVersion("logoutuser")
+	assert.Equal(t, 1, sv)
+}
@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/handlers/common"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jsonpath"
+)
+
+// claimsWhiteListMatch the first of the `vouch.claimsWhitelist` claims, in order of their names, which has one of its values
+// returns "" when none do, a claim which is missing is no match
+func claimsWhiteListMatch(claims map[string]interface{}) (claim string, value string) {
+	names := make([]string, 0, len(cfg.Cfg.ClaimsWhiteList))
+	for name := range cfg.Cfg.ClaimsWhiteList {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range claimValues(claims, name) {
+			if containsString(cfg.Cfg.ClaimsWhiteList[name], v) {
+				return name, v
+			}
+		}
+	}
+	return "", ""
+}
+
+// claimValues the values of the claim as strings, whether it is a single value or a list
+// a `$` jsonpath is evaluated as it is for oauth.user_info_fields, `realm_access.roles` is read as the roles of
+// the realm_access object, unless there is a claim of that very name
+func claimValues(claims map[string]interface{}, path string) []string {
+	if jsonpath.IsPath(path) {
+		return common.ClaimStrings(claims, path)
+	}
+	v, ok := claimField(claims, path)
+	if !ok && strings.Contains(path, ".") {
+		v, ok = dottedField(claims, strings.Split(path, "."))
+	}
+	if !ok {
+		return nil
+	}
+	switch c := v.(type) {
+	case []string:
+		return c
+	case []interface{}:
+		values := make([]string, 0, len(c))
+		for _, e := range c {
+			if s := claimString(e); s != "" {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	if s := claimString(v); s != "" {
+		return []string{s}
+	}
+	return nil
+}
+
+func dottedField(m map[string]interface{}, keys []string) (interface{}, bool) {
+	v, ok := claimField(m, keys[0])
+	if !ok || len(keys) == 1 {
+		return v, ok
+	}
+	next, isMap := v.(map[string]interface{})
+	if !isMap {
+		return nil, false
+	}
+	return dottedField(next, keys[1:])
+}
+
+// claimField the key, which the configuration may have lower cased, matches the claim whatever its case
+func claimField(m map[string]interface{}, key string) (interface{}, bool) {
+	if v, ok := m[key]; ok {
+		return v, true
+	}
+	for k, v := range m {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return nil, false
+}
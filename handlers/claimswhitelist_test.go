@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/handlers/common"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func TestVerifyUserClaimsWhiteList(t *testing.T) {
+	setUp()
+	cfg.Cfg.WhiteList, cfg.Cfg.TeamWhiteList = nil, nil
+	cfg.Cfg.ClaimsWhiteList = map[string][]string{
+		"groups":             {"vouch-users", "vouch-admins"},
+		"realm_access.roles": {"vouch"},
+		"department":         {"engineering"},
+	}
+	defer func() { cfg.Cfg.ClaimsWhiteList = nil }()
+
+	for _, tt := range []struct {
+		name   string
+		claims map[string]interface{}
+		ok     bool
+	}{
+		{"in a groups array", map[string]interface{}{"groups": []interface{}{"everyone", "vouch-admins"}}, true},
+		{"in a []string", map[string]interface{}{"groups": []string{"vouch-users"}}, true},
+		{"a string", map[string]interface{}{"department": "engineering"}, true},
+		{"a dotted path", map[string]interface{}{"realm_access": map[string]interface{}{"roles": []interface{}{"vouch"}}}, true},
+		{"a claim named with the dots", map[string]interface{}{"realm_access.roles": "vouch"}, true},
+		{"whatever the case of the claim", map[string]interface{}{"Groups": []interface{}{"vouch-users"}}, true},
+		{"not in the groups", map[string]interface{}{"groups": []interface{}{"everyone"}}, false},
+		{"the value differs in case", map[string]interface{}{"groups": []interface{}{"Vouch-Users"}}, false},
+		{"the path leads nowhere", map[string]interface{}{"realm_access": "vouch"}, false},
+		{"missing", map[string]interface{}{"name": "Test User"}, false},
+		{"no claims", nil, false},
+	} {
+		ok, rule, err := verifyUser(*user, structs.CustomClaims{Claims: tt.claims})
+		assert.Equal(t, tt.ok, ok, tt.name)
+		assert.Equal(t, ruleClaims, rule, tt.name)
+		if tt.ok {
+			assert.Nil(t, err, tt.name)
+		} else {
+			assert.Equal(t, reasonNoClaim, denialOf(err).Reason, tt.name)
+		}
+	}
+}
+
+// the claims reach verifyUser as they do at /auth, through common.MapClaims, without being sent as headers
+func TestVerifyUserClaimsWhiteListMapClaims(t *testing.T) {
+	setUp()
+	cfg.Cfg.Headers.Claims = nil
+	cfg.Cfg.ClaimsWhiteList = map[string][]string{
+		"groups":              {"vouch-users"},
+		"realm_access.roles":  {"vouch"},
+		"$.resource.roles[*]": {"vouch-api"},
+	}
+	defer func() { cfg.Cfg.ClaimsWhiteList, cfg.Cfg.WhiteList = nil, nil }()
+
+	verify := func(claims string) (bool, string) {
+		customClaims := structs.CustomClaims{}
+		assert.Nil(t, common.MapClaims([]byte(claims), &customClaims))
+		assert.NotContains(t, customClaims.Claims, "name")
+		ok, rule, _ := verifyUser(*user, customClaims)
+		return ok, rule
+	}
+
+	ok, rule := verify(`{"name": "Test User", "groups": ["everyone", "vouch-users"]}`)
+	assert.True(t, ok)
+	assert.Equal(t, ruleClaims, rule)
+	ok, _ = verify(`{"name": "Test User", "realm_access": {"roles": ["vouch"]}}`)
+	assert.True(t, ok)
+	ok, _ = verify(`{"name": "Test User", "resource": {"roles": ["vouch-api"]}}`)
+	assert.True(t, ok)
+	ok, _ = verify(`{"name": "Test User", "groups": ["everyone"]}`)
+	assert.False(t, ok)
+
+	// alongside the whiteList, either of them admits
+	cfg.Cfg.WhiteList = []string{"someoneelse"}
+	ok, rule = verify(`{"name": "Test User", "groups": ["vouch-users"]}`)
+	assert.True(t, ok)
+	assert.Equal(t, ruleClaims, rule)
+	ok, rule = verify(`{"name": "Test User", "groups": ["everyone"]}`)
+	assert.False(t, ok)
+	assert.Equal(t, ruleWhiteList, rule)
+	cfg.Cfg.WhiteList = []string{user.Username}
+	ok, rule = verify(`{"name": "Test User"}`)
+	assert.True(t, ok)
+	assert.Equal(t, ruleWhiteList, rule)
+}
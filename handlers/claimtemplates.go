@@ -0,0 +1,119 @@
+package handlers
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// claimTemplate a compiled `vouch.headers.claimtemplates` entry
+type claimTemplate struct {
+	header string
+	tmpl   *template.Template
+}
+
+// claimTemplates by claim
+var claimTemplates = map[string]claimTemplate{}
+
+// userTemplate the compiled `vouch.headers.usertemplate`, nil passes the username as is
+var userTemplate *template.Template
+
+// claimTemplateFuncs are available in every claim template, `.` is the claim's value
+var claimTemplateFuncs = template.FuncMap{
+	// join a list claim: {{ join . "," }}
+	"join": func(v interface{}, sep string) string {
+		return strings.Join(toStrings(v), sep)
+	},
+	// prefix each element of a list claim: {{ join (prefix "myapp:" .) "," }}
+	"prefix": func(p string, v interface{}) []string {
+		strs := toStrings(v)
+		for i := range strs {
+			strs[i] = p + strs[i]
+		}
+		return strs
+	},
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	// stripdomain the user of `user@example.com` or of `CORP\user`
+	"stripdomain": func(v interface{}) string {
+		s := fmt.Sprint(v)
+		if i := strings.LastIndex(s, "\\"); i >= 0 {
+			s = s[i+1:]
+		}
+		if i := strings.Index(s, "@"); i >= 0 {
+			s = s[:i]
+		}
+		return s
+	},
+}
+
+// ConfigureClaimTemplates compile the `vouch.headers.claimtemplates`
+func ConfigureClaimTemplates() error {
+	compiled := map[string]claimTemplate{}
+	for _, ct := range cfg.Cfg.Headers.ClaimTemplates {
+		if ct.Claim == "" {
+			return fmt.Errorf("configuration error: %s.headers.claimtemplates entry is missing the claim", cfg.Branding.LCName)
+		}
+		tmpl, err := template.New(ct.Claim).Funcs(claimTemplateFuncs).Option("missingkey=error").Parse(ct.Template)
+		if err != nil {
+			return fmt.Errorf("configuration error: %s.headers.claimtemplates for claim %s: %s", cfg.Branding.LCName, ct.Claim, err)
+		}
+		header := ct.Header
+		if header == "" {
+			header = cfg.Cfg.Headers.ClaimHeader + ct.Claim
+		}
+		compiled[ct.Claim] = claimTemplate{header: header, tmpl: tmpl}
+	}
+	claimTemplates = compiled
+
+	userTemplate = nil
+	if cfg.Cfg.Headers.UserTemplate != "" {
+		tmpl, err := template.New("user").Funcs(claimTemplateFuncs).Parse(cfg.Cfg.Headers.UserTemplate)
+		if err != nil {
+			return fmt.Errorf("configuration error: %s.headers.usertemplate: %s", cfg.Branding.LCName, err)
+		}
+		userTemplate = tmpl
+	}
+	return nil
+}
+
+// forwardedUser the username as passed upstream in `vouch.headers.user`, rendered through the usertemplate
+// the username in the jwt, which the whitelists are matched against, is left as it is
+func forwardedUser(username string) string {
+	if userTemplate == nil {
+		return username
+	}
+	var b bytes.Buffer
+	if err := userTemplate.Execute(&b, username); err != nil {
+		log.Errorf("%s.headers.usertemplate: %s", cfg.Branding.LCName, err)
+		return ""
+	}
+	return b.String()
+}
+
+// render the claim value through the template
+func (ct claimTemplate) render(v interface{}) (string, error) {
+	var b bytes.Buffer
+	if err := ct.tmpl.Execute(&b, v); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+func toStrings(v interface{}) []string {
+	switch vals := v.(type) {
+	case []string:
+		return append([]string{}, vals...)
+	case []interface{}:
+		strs := make([]string, len(vals))
+		for i, val := range vals {
+			strs[i] = fmt.Sprint(val)
+		}
+		return strs
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// maxLoginFlights bounds the logins remembered for `vouch.session.coalesce`, beyond it a callback asks the provider itself
+const maxLoginFlights = 1024
+
+// coalescedState the state of the login which this browser started less than `vouch.session.coalesce` seconds ago
+// a tab which comes to /login while another tab's login is under way shares its state, rather than replacing it and
+// so failing the other tab's callback with "Invalid session state"
+// an oauth1 login has a request token of its own and a step up must not join an ordinary login, or the other way round
+func coalescedState(r *http.Request, session *sessions.Session) (string, bool) {
+	if cfg.Cfg.Session.Coalesce <= 0 || cfg.GenOAuth.Provider == cfg.Providers.OAuth1 || stepUpRequested(r) {
+		return "", false
+	}
+	if stepUp, _ := session.Values[stepUpSession].(bool); stepUp {
+		return "", false
+	}
+	state, _ := session.Values["state"].(string)
+	issuedAt, ok := session.Values[stateIssuedAt].(int64)
+	if state == "" || !ok || !stateSigned(state) {
+		return "", false
+	}
+	if time.Since(time.Unix(issuedAt, 0)) > time.Duration(cfg.Cfg.Session.Coalesce)*time.Second {
+		return "", false
+	}
+	log.Debugf("/login joining the login of this browser under way since %s", time.Unix(issuedAt, 0))
+	return state, true
+}
+
+// loginFlight one callback's calls to the provider, whose result the other callbacks of the same login share
+type loginFlight struct {
+	done chan struct{}
+	// finished zero while the calls are under way
+	finished     time.Time
+	user         structs.User
+	customClaims structs.CustomClaims
+	ptokens      structs.PTokens
+	err          error
+}
+
+// loginFlights the logins of the last `vouch.session.coalesce` seconds by their state
+// only the callbacks of one browser share a state, the logins of different users never wait for each other
+type loginFlights struct {
+	mu      sync.Mutex
+	flights map[string]*loginFlight
+}
+
+var logins = &loginFlights{flights: map[string]*loginFlight{}}
+
+// userInfo the user of the login with this state, fetched once for all of the callbacks which arrive within
+// `vouch.session.coalesce` seconds. A callback which finds the fetch failed tries its own code.
+func (l *loginFlights) userInfo(state string, fetch func(*structs.User, *structs.CustomClaims, *structs.PTokens) error, user *structs.User, customClaims *structs.CustomClaims, ptokens *structs.PTokens) error {
+	if cfg.Cfg.Session.Coalesce <= 0 {
+		return fetch(user, customClaims, ptokens)
+	}
+	l.mu.Lock()
+	l.prune()
+	f, joined := l.flights[state]
+	if !joined {
+		if len(l.flights) >= maxLoginFlights {
+			l.mu.Unlock()
+			log.Warnf("/auth %d logins under way, not coalescing this one", len(l.flights))
+			return fetch(user, customClaims, ptokens)
+		}
+		f = &loginFlight{done: make(chan struct{})}
+		l.flights[state] = f
+	}
+	l.mu.Unlock()
+
+	if joined {
+		<-f.done
+		if f.err != nil {
+			return fetch(user, customClaims, ptokens)
+		}
+		log.Debugf("/auth using the user of the concurrent callback for the same login")
+	} else {
+		f.err = fetch(&f.user, &f.customClaims, &f.ptokens)
+		l.mu.Lock()
+		f.finished = time.Now()
+		if f.err != nil {
+			delete(l.flights, state)
+		}
+		l.mu.Unlock()
+		close(f.done)
+	}
+	f.copyTo(user, customClaims, ptokens)
+	return f.err
+}
+
+// prune forget the logins which finished over `vouch.session.coalesce` seconds ago, l.mu must be held
+func (l *loginFlights) prune() {
+	window := time.Duration(cfg.Cfg.Session.Coalesce) * time.Second
+	for state, f := range l.flights {
+		if !f.finished.IsZero() && time.Since(f.finished) > window {
+			delete(l.flights, state)
+		}
+	}
+}
+
+// copyTo each callback gets its own copy, the callback goes on to add to the teams and the claims
+func (f *loginFlight) copyTo(user *structs.User, customClaims *structs.CustomClaims, ptokens *structs.PTokens) {
+	*user = f.user
+	user.TeamMemberships = append([]string(nil), f.user.TeamMemberships...)
+	user.Emails = append([]string(nil), f.user.Emails...)
+	*ptokens = f.ptokens
+	if f.customClaims.Claims != nil {
+		customClaims.Claims = make(map[string]interface{}, len(f.customClaims.Claims))
+		for k, v := range f.customClaims.Claims {
+			customClaims.Claims[k] = v
+		}
+	}
+}
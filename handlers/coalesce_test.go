@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func TestLoginCoalesced(t *testing.T) {
+	setUp()
+	defer func() { cfg.Cfg.Session.Coalesce = 0 }()
+
+	// the tabs of one browser, each sending the state cookie which the one before got
+	login := func(cookies []*http.Cookie) (string, int, []*http.Cookie) {
+		r := httptest.NewRequest("GET", "http://vouch.domain1/login?url=http://app.domain1/", nil)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		LoginHandler(w, r)
+		next := httptest.NewRequest("GET", "http://vouch.domain1/auth", nil)
+		for _, c := range w.Result().Cookies() {
+			next.AddCookie(c)
+		}
+		session, err := sessstore.Get(next, cfg.Cfg.Session.Name)
+		assert.Nil(t, err)
+		state, _ := session.Values["state"].(string)
+		failcount, _ := session.Values["http://app.domain1/"].(int)
+		return state, failcount, w.Result().Cookies()
+	}
+
+	first, failcount, cookies := login(nil)
+	assert.Equal(t, 1, failcount)
+	second, _, _ := login(cookies)
+	assert.NotEqual(t, first, second)
+
+	cfg.Cfg.Session.Coalesce = 10
+	first, failcount, cookies = login(nil)
+	second, failcount2, _ := login(cookies)
+	assert.Equal(t, first, second)
+	assert.Equal(t, failcount, failcount2)
+
+	// nor does a step up join the login under way
+	cfg.Cfg.StepUp.Enabled = true
+	defer func() { cfg.Cfg.StepUp.Enabled = false }()
+	r := httptest.NewRequest("GET", "http://vouch.domain1/login?step_up=true&url=http://app.domain1/", nil)
+	for _, c := range cookies {
+		r.AddCookie(c)
+	}
+	session, _ := sessstore.Get(r, cfg.Cfg.Session.Name)
+	_, coalesced := coalescedState(r, session)
+	assert.False(t, coalesced)
+}
+
+func TestLoginFlightsUserInfo(t *testing.T) {
+	setUp()
+	defer func() { cfg.Cfg.Session.Coalesce = 0 }()
+	cfg.Cfg.Session.Coalesce = 10
+	l := &loginFlights{flights: map[string]*loginFlight{}}
+
+	var fetches int32
+	started, release := make(chan struct{}, 10), make(chan struct{})
+	fetch := func(u *structs.User, c *structs.CustomClaims, p *structs.PTokens) error {
+		atomic.AddInt32(&fetches, 1)
+		started <- struct{}{}
+		<-release
+		u.Username = "testuser"
+		u.TeamMemberships = []string{"org1/team1"}
+		c.Claims = map[string]interface{}{"groups": "admins"}
+		p.PAccessToken = "at"
+		return nil
+	}
+
+	// three tabs come back from the provider at once
+	var wg sync.WaitGroup
+	users := make([]structs.User, 3)
+	claims := make([]structs.CustomClaims, 3)
+	for i := range users {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.Nil(t, l.userInfo("state1", fetch, &users[i], &claims[i], &structs.PTokens{}))
+		}(i)
+	}
+	<-started
+	close(release)
+	wg.Wait()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+	for i := range users {
+		assert.Equal(t, "testuser", users[i].Username)
+		assert.Equal(t, "admins", claims[i].Claims["groups"])
+	}
+	// each callback has its own copy to add to
+	claims[0].Claims[structs.ProviderClaim] = "github"
+	assert.Nil(t, claims[1].Claims[structs.ProviderClaim])
+
+	// a late tab of the same login still shares the result, another login fetches its own
+	assert.Nil(t, l.userInfo("state1", fetch, &structs.User{}, &structs.CustomClaims{}, &structs.PTokens{}))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fetches))
+	assert.Nil(t, l.userInfo("state2", fetch, &structs.User{}, &structs.CustomClaims{}, &structs.PTokens{}))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fetches))
+
+	// a failed fetch isn't shared
+	failed := func(u *structs.User, c *structs.CustomClaims, p *structs.PTokens) error {
+		atomic.AddInt32(&fetches, 1)
+		return errors.New("invalid_grant")
+	}
+	assert.Error(t, l.userInfo("state3", failed, &structs.User{}, &structs.CustomClaims{}, &structs.PTokens{}))
+	assert.Nil(t, l.userInfo("state3", fetch, &structs.User{}, &structs.CustomClaims{}, &structs.PTokens{}))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&fetches))
+
+	// disabled, every callback fetches
+	cfg.Cfg.Session.Coalesce = 0
+	assert.Nil(t, l.userInfo("state1", fetch, &structs.User{}, &structs.CustomClaims{}, &structs.PTokens{}))
+	assert.Equal(t, int32(5), atomic.LoadInt32(&fetches))
+}
@@ -0,0 +1,113 @@
+package common
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	securerandom "github.com/theckman/go-securerandom"
+	"golang.org/x/oauth2"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// clientAssertionType the client_assertion_type of private_key_jwt (RFC 7523)
+const clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+// clientAssertionLifetime the assertion is used right away, for a single request
+const clientAssertionLifetime = time.Minute
+
+// clientAssertionKey signs the client_assertion, loaded by ConfigureClientAssertion
+var clientAssertionKey interface{}
+
+// SigningKey read the PEM private key of an RS, PS or ES alg from file
+func SigningKey(alg string, file string) (interface{}, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(alg, "ES") {
+		return jwt.ParseECPrivateKeyFromPEM(pem)
+	}
+	return jwt.ParseRSAPrivateKeyFromPEM(pem)
+}
+
+// ConfigureClientAssertion load the key of `oauth.client_assertion` for `oauth.token_endpoint_auth_method: private_key_jwt`
+func ConfigureClientAssertion() error {
+	if cfg.GenOAuth == nil || cfg.GenOAuth.TokenEndpointAuthMethod != "private_key_jwt" {
+		return nil
+	}
+	ca := cfg.GenOAuth.ClientAssertion
+	key, err := SigningKey(ca.Alg, ca.SigningKeyFile)
+	if err != nil {
+		return fmt.Errorf("oauth.client_assertion.signing_key_file %s is not a %s private key: %s", ca.SigningKeyFile, ca.Alg, err)
+	}
+	clientAssertionKey = key
+	return nil
+}
+
+// ClientAssertion a jwt signed with the client's key which authenticates the client to the token endpoint
+func ClientAssertion() (string, error) {
+	jti, err := securerandom.URLBase64InBytes(32)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(cfg.GenOAuth.ClientAssertion.Alg), jwt.StandardClaims{
+		Issuer:    cfg.GenOAuth.ClientID,
+		Subject:   cfg.GenOAuth.ClientID,
+		Audience:  cfg.GenOAuth.TokenURL,
+		Id:        jti,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(clientAssertionLifetime).Unix(),
+	})
+	if cfg.GenOAuth.ClientAssertion.KeyID != "" {
+		token.Header["kid"] = cfg.GenOAuth.ClientAssertion.KeyID
+	}
+	signed, err := token.SignedString(clientAssertionKey)
+	if err != nil {
+		return "", fmt.Errorf("could not sign the client assertion: %s", err)
+	}
+	return signed, nil
+}
+
+// clientAssertionOptions the client_assertion of private_key_jwt for the token exchange, none for any other method
+func clientAssertionOptions() ([]oauth2.AuthCodeOption, error) {
+	if cfg.GenOAuth.TokenEndpointAuthMethod != "private_key_jwt" {
+		return nil, nil
+	}
+	assertion, err := ClientAssertion()
+	if err != nil {
+		return nil, err
+	}
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("client_assertion_type", clientAssertionType),
+		oauth2.SetAuthURLParam("client_assertion", assertion),
+	}, nil
+}
+
+// ClientCredentials add the client's credentials to the form of another request to the provider, such as a pushed
+// authorization request, the way `oauth.token_endpoint_auth_method` has them sent to the token endpoint
+// basic is true when they belong in the Authorization header instead
+func ClientCredentials(form url.Values) (basic bool, err error) {
+	switch cfg.GenOAuth.TokenEndpointAuthMethod {
+	case "none":
+		return false, nil
+	case "client_secret_post":
+		form.Set("client_secret", cfg.GenOAuth.ClientSecret)
+		return false, nil
+	case "private_key_jwt":
+		assertion, err := ClientAssertion()
+		if err != nil {
+			return false, err
+		}
+		form.Set("client_assertion_type", clientAssertionType)
+		form.Set("client_assertion", assertion)
+		return false, nil
+	default:
+		return cfg.GenOAuth.ClientSecret != "", nil
+	}
+}
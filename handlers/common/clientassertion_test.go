@@ -0,0 +1,108 @@
+package common
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+	"golang.org/x/oauth2"
+)
+
+func TestPrivateKeyJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	f, err := ioutil.TempFile("", "client_assertion")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	assert.NoError(t, pem.Encode(f, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	assert.NoError(t, f.Close())
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		_, _, basic := r.BasicAuth()
+		assert.False(t, basic)
+		assert.Empty(t, r.PostForm.Get("client_secret"))
+		assert.Equal(t, cfg.GenOAuth.ClientID, r.PostForm.Get("client_id"))
+		assert.Equal(t, clientAssertionType, r.PostForm.Get("client_assertion_type"))
+		token, err := jwt.Parse(r.PostForm.Get("client_assertion"), func(token *jwt.Token) (interface{}, error) {
+			assert.Equal(t, "vouch-1", token.Header["kid"])
+			return &key.PublicKey, nil
+		})
+		assert.NoError(t, err)
+		claims := token.Claims.(jwt.MapClaims)
+		assert.Equal(t, cfg.GenOAuth.ClientID, claims["iss"])
+		assert.Equal(t, cfg.GenOAuth.ClientID, claims["sub"])
+		assert.Equal(t, cfg.GenOAuth.TokenURL, claims["aud"])
+		assert.NotEmpty(t, claims["jti"])
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"at","token_type":"bearer"}`))
+	}))
+	defer ts.Close()
+
+	method, ca, tokenURL, client := cfg.GenOAuth.TokenEndpointAuthMethod, cfg.GenOAuth.ClientAssertion, cfg.GenOAuth.TokenURL, cfg.OAuthClient
+	defer func() {
+		cfg.GenOAuth.TokenEndpointAuthMethod, cfg.GenOAuth.ClientAssertion, cfg.GenOAuth.TokenURL, cfg.OAuthClient = method, ca, tokenURL, client
+	}()
+	cfg.GenOAuth.TokenEndpointAuthMethod = "private_key_jwt"
+	cfg.GenOAuth.ClientAssertion.Alg = "RS256"
+	cfg.GenOAuth.ClientAssertion.SigningKeyFile = f.Name()
+	cfg.GenOAuth.ClientAssertion.KeyID = "vouch-1"
+	cfg.GenOAuth.TokenURL = ts.URL
+	cfg.OAuthClient = &oauth2.Config{
+		ClientID: cfg.GenOAuth.ClientID,
+		Endpoint: oauth2.Endpoint{TokenURL: ts.URL, AuthStyle: oauth2.AuthStyleInParams},
+	}
+	assert.NoError(t, ConfigureClientAssertion())
+
+	r := httptest.NewRequest("GET", "http://vouch.example.com/auth?code=abc", nil)
+	err, _, token := PrepareTokensAndClient(r, &structs.PTokens{}, false)
+	assert.NoError(t, err)
+	assert.Equal(t, "at", token.AccessToken)
+
+	form := url.Values{}
+	basic, err := ClientCredentials(form)
+	assert.NoError(t, err)
+	assert.False(t, basic)
+	assert.Equal(t, clientAssertionType, form.Get("client_assertion_type"))
+	assert.NotEmpty(t, form.Get("client_assertion"))
+}
+
+func TestClientCredentials(t *testing.T) {
+	method, secret := cfg.GenOAuth.TokenEndpointAuthMethod, cfg.GenOAuth.ClientSecret
+	defer func() { cfg.GenOAuth.TokenEndpointAuthMethod, cfg.GenOAuth.ClientSecret = method, secret }()
+	cfg.GenOAuth.ClientSecret = "s3cr3t"
+
+	for _, m := range []string{"", "client_secret_basic"} {
+		cfg.GenOAuth.TokenEndpointAuthMethod = m
+		form := url.Values{}
+		basic, err := ClientCredentials(form)
+		assert.NoError(t, err)
+		assert.True(t, basic)
+		assert.Empty(t, form)
+	}
+
+	cfg.GenOAuth.TokenEndpointAuthMethod = "client_secret_post"
+	form := url.Values{}
+	basic, err := ClientCredentials(form)
+	assert.NoError(t, err)
+	assert.False(t, basic)
+	assert.Equal(t, "s3cr3t", form.Get("client_secret"))
+
+	cfg.GenOAuth.TokenEndpointAuthMethod = "none"
+	form = url.Values{}
+	basic, err = ClientCredentials(form)
+	assert.NoError(t, err)
+	assert.False(t, basic)
+	assert.Empty(t, form)
+}
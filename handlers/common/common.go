@@ -1,24 +1,53 @@
 package common
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/domains"
+	"github.com/vouch/vouch-proxy/pkg/httpclient"
+	"github.com/vouch/vouch-proxy/pkg/jsonpath"
+	"github.com/vouch/vouch-proxy/pkg/pii"
 	"github.com/vouch/vouch-proxy/pkg/structs"
 	"golang.org/x/oauth2"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 var (
 	log = cfg.Cfg.Logger
+	// paths the `$` expressions of `oauth.user_info_fields` compiled at startup
+	paths   = map[string]*jsonpath.Path{}
+	rxEmail = regexp.MustCompile("^[a-zA-Z0-9.!#$%&'*+\\/=?^_`{|}~-]+@[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?(?:\\.[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)*$")
 )
 
 func PrepareTokensAndClient(r *http.Request, ptokens *structs.PTokens, setpid bool) (error, *http.Client, *oauth2.Token) {
-	providerToken, err := cfg.OAuthClient.Exchange(context.TODO(), r.URL.Query().Get("code"))
+	opts := []oauth2.AuthCodeOption{}
+	if cb := CallbackURL(r); cb != "" {
+		// must be identical to the redirect_uri sent to the authorization endpoint
+		opts = append(opts, oauth2.SetAuthURLParam("redirect_uri", cb))
+	}
+	assertion, err := clientAssertionOptions()
 	if err != nil {
 		return err, nil, nil
 	}
+	opts = append(opts, assertion...)
+	providerToken, err := cfg.OAuthClient.Exchange(httpclient.Context(context.TODO()), r.URL.Query().Get("code"), opts...)
+	if err != nil {
+		return NewTokenExchangeError(err), nil, nil
+	}
 	ptokens.PAccessToken = providerToken.AccessToken
+	if granted := GrantedScopes(providerToken); granted != nil {
+		if err := CheckScopes(granted); err != nil {
+			return err, nil, nil
+		}
+	}
 
 	if setpid {
 		if providerToken.Extra("id_token") != nil {
@@ -30,12 +59,50 @@ func PrepareTokensAndClient(r *http.Request, ptokens *structs.PTokens, setpid bo
 		}
 	}
 
-	log.Debugf("ptokens: %+v", ptokens)
-
-	client := cfg.OAuthClient.Client(context.TODO(), providerToken)
+	client, providerToken, err := tokenClient(httpclient.Context(context.TODO()), providerToken, ptokens)
+	if err != nil {
+		return NewTokenExchangeError(err), nil, nil
+	}
+	log.Debugf("ptokens: %+v", pii.Dump(ptokens))
 	return err, client, providerToken
 }
 
+// tokenClient the client which calls the provider with the token, an expired token is renewed with its refresh token
+// before the client is built, and again by the client whenever it expires. ptokens.PAccessToken is kept the one in use
+// without a refresh token an expired token fails the first call to the provider, and the login with it, as it always has
+func tokenClient(ctx context.Context, token *oauth2.Token, ptokens *structs.PTokens) (*http.Client, *oauth2.Token, error) {
+	source := &persistingTokenSource{source: cfg.OAuthClient.TokenSource(ctx, token), ptokens: ptokens}
+	if !token.Valid() && token.RefreshToken != "" {
+		log.Debug("the access token has expired, renewing it with the refresh token")
+		renewed, err := source.Token()
+		if err != nil {
+			return nil, nil, err
+		}
+		token = renewed
+	}
+	client := oauth2.NewClient(ctx, oauth2.ReuseTokenSource(token, source))
+	client.Timeout = httpclient.Timeout()
+	return client, token, nil
+}
+
+// persistingTokenSource records each renewed access token in the PTokens of the login
+type persistingTokenSource struct {
+	mu      sync.Mutex
+	source  oauth2.TokenSource
+	ptokens *structs.PTokens
+}
+
+func (s *persistingTokenSource) Token() (*oauth2.Token, error) {
+	t, err := s.source.Token()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	s.ptokens.PAccessToken = t.AccessToken
+	s.mu.Unlock()
+	return t, nil
+}
+
 func MapClaims(claims []byte, customClaims *structs.CustomClaims) error {
 	// Create a struct that contains the claims that we want to store from the config.
 	var f interface{}
@@ -46,12 +113,23 @@ func MapClaims(claims []byte, customClaims *structs.CustomClaims) error {
 	}
 	m := f.(map[string]interface{})
 	for k := range m {
-		var found = false
+		// kept for the check at login, see handlers.accountActive
+		var found = cfg.GenOAuth != nil && cfg.GenOAuth.ActiveClaim != "" && k == cfg.GenOAuth.ActiveClaim
+		// the avatar is taken from the claims for the providers which don't decode it into the user
+		if cfg.GenOAuth != nil && cfg.GenOAuth.PictureClaim != "" && k == cfg.GenOAuth.PictureClaim {
+			found = true
+		}
+		if cfg.GenOAuth != nil && cfg.GenOAuth.TenantClaim != "" && k == cfg.GenOAuth.TenantClaim {
+			found = true
+		}
 		for _, e := range cfg.Cfg.Headers.Claims {
 			if k == e {
 				found = true
 			}
 		}
+		if claimsWhiteListed(k) {
+			found = true
+		}
 		if found == false {
 			delete(m, k)
 		}
@@ -59,3 +137,470 @@ func MapClaims(claims []byte, customClaims *structs.CustomClaims) error {
 	customClaims.Claims = m
 	return nil
 }
+
+// claimsWhiteListed is the claim the top of one of the `vouch.claimsWhitelist` entries, kept for the check at login
+// `realm_access.roles` and `$.realm_access.roles` both need the realm_access claim, a path which starts with a
+// wildcard needs all of them
+func claimsWhiteListed(k string) bool {
+	for entry := range cfg.Cfg.ClaimsWhiteList {
+		root := strings.SplitN(entry, ".", 2)[0]
+		if jsonpath.IsPath(entry) {
+			p, err := jsonpath.Compile(entry)
+			if err != nil {
+				continue
+			}
+			if root = p.Root(); root == "" {
+				return true
+			}
+		}
+		// a claim whose very name is dotted is looked up too
+		if strings.EqualFold(k, entry) || strings.EqualFold(k, root) {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfigureUserInfoFields compile those `oauth.user_info_fields` which are a jsonpath such as `$.data.attributes.email`
+func ConfigureUserInfoFields() error {
+	if cfg.GenOAuth == nil {
+		// the oauth config has not been loaded, as under `go test`
+		return nil
+	}
+	fields := cfg.GenOAuth.UserInfoFields
+	compiled := map[string]*jsonpath.Path{}
+	for _, expr := range []string{fields.Username, fields.Email, fields.Name, fields.ID, fields.Groups, cfg.GenOAuth.AccessTokenGroupsClaim, cfg.GenOAuth.UserInfoError.DescriptionField} {
+		if !jsonpath.IsPath(expr) {
+			continue
+		}
+		p, err := jsonpath.Compile(expr)
+		if err != nil {
+			return fmt.Errorf("configuration error: oauth.user_info_fields, access_token_groups_claim or user_info_error.description_field: %s", err)
+		}
+		compiled[expr] = p
+	}
+	paths = compiled
+	return nil
+}
+
+// MapUserInfoFields populates the user from the userinfo keys configured in `oauth.user_info_fields`
+// fields which aren't configured or aren't found in the userinfo are left untouched
+func MapUserInfoFields(data []byte, user *structs.User) error {
+	var m map[string]interface{}
+	if err := UnmarshalClaims(data, &m); err != nil {
+		log.Error("Error unmarshaling userinfo")
+		return err
+	}
+	return MapUserInfoFieldsFromMap(m, user)
+}
+
+// MapUserInfoFieldsFromMap see MapUserInfoFields
+func MapUserInfoFieldsFromMap(m map[string]interface{}, user *structs.User) error {
+	fields := cfg.GenOAuth.UserInfoFields
+	if v := stringField(m, fields.Username); v != "" {
+		user.Username = v
+	}
+	if v := stringField(m, fields.Email); v != "" {
+		user.Email = v
+	}
+	if v := stringField(m, fields.Name); v != "" {
+		user.Name = v
+	}
+	if v := stringField(m, fields.ID); v != "" {
+		user.ID = structs.NewID(v)
+	}
+	if groups := stringsField(m, fields.Groups); len(groups) > 0 {
+		user.TeamMemberships = append(user.TeamMemberships, groups...)
+	}
+	return nil
+}
+
+// EmailFromClaims returns the first of the `oauth.email_claims` which is present and is an email address
+// a `upn` such as DOMAIN\user is skipped
+func EmailFromClaims(m map[string]interface{}) string {
+	for _, claim := range cfg.GenOAuth.EmailClaims {
+		v := stringField(m, claim)
+		if v == "" {
+			continue
+		}
+		if !rxEmail.MatchString(v) {
+			log.Debugf("claim %s is not an email address: %s", claim, pii.Mask(v))
+			continue
+		}
+		return v
+	}
+	return ""
+}
+
+// EmailsFromClaims the addresses of an `emails` claim, either strings or objects with an `email` or `value`
+// objects which are marked `verified: false` are skipped, a single address which isn't in a list is taken as is
+func EmailsFromClaims(m map[string]interface{}) []string {
+	if single, ok := m["emails"].(string); ok && single != "" {
+		return []string{single}
+	}
+	list, ok := m["emails"].([]interface{})
+	if !ok {
+		return nil
+	}
+	emails := []string{}
+	for _, e := range list {
+		switch v := e.(type) {
+		case string:
+			emails = append(emails, v)
+		case map[string]interface{}:
+			if verified, ok := v["verified"].(bool); ok && !verified {
+				continue
+			}
+			if email := stringField(v, "email"); email != "" {
+				emails = append(emails, email)
+			} else if email := stringField(v, "value"); email != "" {
+				emails = append(emails, email)
+			}
+		}
+	}
+	return emails
+}
+
+// NameFromClaims the `oauth.name_claim`, or with `oauth.compose_name` the given_name and family_name
+func NameFromClaims(m map[string]interface{}) string {
+	if v := stringField(m, cfg.GenOAuth.NameClaim); v != "" {
+		return v
+	}
+	if !cfg.GenOAuth.ComposeName {
+		return ""
+	}
+	return strings.TrimSpace(stringField(m, "given_name") + " " + stringField(m, "family_name"))
+}
+
+// MapName sets the user's Name from the claims, see NameFromClaims
+// the Name is left untouched when the claims don't carry one
+func MapName(data []byte, user *structs.User) error {
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		log.Error("Error unmarshaling claims")
+		return err
+	}
+	if name := NameFromClaims(m); name != "" {
+		user.Name = name
+	}
+	return nil
+}
+
+// stringField a single string found at the key, see scalar
+func stringField(m map[string]interface{}, key string) string {
+	if key == "" {
+		return ""
+	}
+	return scalar(field(m, key))
+}
+
+// scalar a claim which should be a single value, providers send `"email": ["robin@example.com"]` as well
+// as `"email": "robin@example.com"`, of a list the first value which isn't empty is taken
+func scalar(value interface{}) string {
+	list, ok := value.([]interface{})
+	if !ok {
+		return toString(value)
+	}
+	for _, e := range list {
+		if s := toString(e); s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// UnmarshalUser the username, name, email, picture and id of the user from the claims, in place of json.Unmarshal
+// which refuses the whole userinfo when any of them comes as a list, see scalar
+// the id is the `sub` of OIDC, or else an `id`, either of which may be a number or a string
+func UnmarshalUser(data []byte, user *structs.User) error {
+	var m map[string]interface{}
+	if err := UnmarshalClaims(data, &m); err != nil {
+		return err
+	}
+	for key, dst := range map[string]*string{"username": &user.Username, "name": &user.Name, "email": &user.Email, "picture": &user.Picture} {
+		if v := stringField(m, key); v != "" {
+			*dst = v
+		}
+	}
+	for _, key := range []string{"sub", "id"} {
+		if v := stringField(m, key); v != "" {
+			user.ID = structs.NewID(v)
+			break
+		}
+	}
+	return nil
+}
+
+// UnmarshalClaims json.Unmarshal the claims with their numbers as json.Number rather than float64
+// an id above 2^53, such as the snowflakes of Discord and Twitter, keeps all of its digits
+func UnmarshalClaims(data []byte, m *map[string]interface{}) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	return d.Decode(m)
+}
+
+// stringsField a list of strings, or a single string, found at the key
+func stringsField(m map[string]interface{}, key string) []string {
+	if key == "" {
+		return nil
+	}
+	var values []interface{}
+	if jsonpath.IsPath(key) {
+		values = lookupPath(m, key)
+	} else if v, ok := m[key]; ok {
+		values = []interface{}{v}
+	}
+	strs := []string{}
+	for _, v := range values {
+		if list, ok := v.([]interface{}); ok {
+			for _, e := range list {
+				strs = append(strs, toString(e))
+			}
+		} else if s := toString(v); s != "" {
+			strs = append(strs, s)
+		}
+	}
+	return strs
+}
+
+// ClaimStrings the values of the claim, or of those selected by a `$` jsonpath, a list is flattened
+func ClaimStrings(m map[string]interface{}, key string) []string {
+	return stringsField(m, key)
+}
+
+// field the value of the key, or the first value selected by a `$` jsonpath
+func field(m map[string]interface{}, key string) interface{} {
+	if jsonpath.IsPath(key) {
+		if values := lookupPath(m, key); len(values) > 0 {
+			return values[0]
+		}
+		return nil
+	}
+	return m[key]
+}
+
+func lookupPath(m map[string]interface{}, expr string) []interface{} {
+	p, ok := paths[expr]
+	if !ok {
+		var err error
+		if p, err = jsonpath.Compile(expr); err != nil {
+			log.Error(err)
+			return nil
+		}
+	}
+	return p.Get(m)
+}
+
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return v.String()
+		}
+		if f, err := v.Float64(); err == nil {
+			return strconv.FormatFloat(f, 'f', -1, 64)
+		}
+		return v.String()
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// CallbackURL is the redirect_uri for this request, `oauth.redirect_uri` as it is configured,
+// or else built from the request host and `oauth.callback_path`
+// returns "" if callback_path is not configured or the host is not within one of the configured domains
+func CallbackURL(r *http.Request) string {
+	if cfg.GenOAuth.RedirectURI != "" {
+		return cfg.GenOAuth.RedirectURI
+	}
+	if cfg.GenOAuth.CallbackPath == "" {
+		return ""
+	}
+	if domains.Matches(r.Host) == "" {
+		log.Warnf("not building the callback url from Host %s which is not within the configured domains %s", r.Host, cfg.Cfg.Domains)
+		return ""
+	}
+	return RequestScheme(r) + "://" + r.Host + cfg.GenOAuth.CallbackPath
+}
+
+// RequestScheme is the scheme the browser used, honoring a trusted X-Forwarded-Proto
+// and always https with `vouch.forceHttps`
+func RequestScheme(r *http.Request) string {
+	if cfg.Cfg.ForceHTTPS {
+		return "https"
+	}
+	if proto := TrustedHeader(r, "X-Forwarded-Proto"); proto != "" {
+		// the first of a list is the one the client facing proxy saw
+		switch p := strings.ToLower(strings.TrimSpace(strings.Split(proto, ",")[0])); p {
+		case "http", "https":
+			return p
+		default:
+			log.Warnf("ignoring X-Forwarded-Proto %s", proto)
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// TrustedHeader returns the value of the header only if it is listed in `vouch.headers.trustforwarded`
+func TrustedHeader(r *http.Request, header string) string {
+	for _, h := range cfg.Cfg.Headers.TrustForwarded {
+		if strings.EqualFold(h, header) {
+			return r.Header.Get(header)
+		}
+	}
+	return ""
+}
+
+// ErrAccessDenied the error code of a provider whose user declined to authorize the login
+const ErrAccessDenied = "access_denied"
+
+// CallbackError an error returned to the callback by the provider in place of the authorization
+// https://tools.ietf.org/html/rfc6749#section-4.1.2.1
+type CallbackError struct {
+	Code        string
+	Description string
+}
+
+func (e *CallbackError) Error() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Code + ": " + e.Description
+}
+
+// Message the description for the user, or the code if the provider didn't describe the error
+func (e *CallbackError) Message() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Description
+}
+
+// AccessDenied did the user decline at the provider rather than something going wrong
+func (e *CallbackError) AccessDenied() bool {
+	return e.Code == ErrAccessDenied
+}
+
+// CallbackErrorFromQuery the error the provider returned to the callback, nil if there is none
+// OAuth 2.0 and OIDC providers send `error`, an OAuth 1.0a provider sends `denied` and Steam `openid.mode=cancel`
+func CallbackErrorFromQuery(query url.Values) *CallbackError {
+	if code := query.Get("error"); code != "" {
+		return &CallbackError{Code: code, Description: query.Get("error_description")}
+	}
+	if query.Get("denied") != "" || query.Get("openid.mode") == "cancel" {
+		return &CallbackError{Code: ErrAccessDenied}
+	}
+	return nil
+}
+
+// tokenResponseSecrets the fields of a token endpoint response which are never logged
+var tokenResponseSecrets = []string{"access_token", "refresh_token", "id_token", "client_secret", "code"}
+
+// TokenExchangeError the code could not be exchanged for a token at the provider's token endpoint
+// the log gets Error(), with the response body of the token endpoint, the user gets UserMessage()
+type TokenExchangeError struct {
+	// Status of the token endpoint's response, empty if there was no response
+	Status string
+	// Body of the token endpoint's response, with any tokens and secrets redacted
+	Body string
+	err  error
+	// description the error_description, or error, of the response
+	description string
+}
+
+// NewTokenExchangeError from the error of oauth2.Config.Exchange, which carries the response if there was one
+func NewTokenExchangeError(err error) *TokenExchangeError {
+	if re, ok := err.(*oauth2.RetrieveError); ok && re.Response != nil {
+		return TokenEndpointError(re.Response.Status, re.Body)
+	}
+	return &TokenExchangeError{err: err}
+}
+
+// TokenEndpointError from an unsuccessful response of the token endpoint
+func TokenEndpointError(status string, body []byte) *TokenExchangeError {
+	e := &TokenExchangeError{Status: status}
+	// the error fields of https://tools.ietf.org/html/rfc6749#section-5.2, as json or, as GitHub does, form encoded
+	var fields map[string]interface{}
+	if json.Unmarshal(body, &fields) != nil {
+		fields = nil
+		if q, err := url.ParseQuery(string(body)); err == nil && q.Get("error") != "" {
+			fields = make(map[string]interface{})
+			for k := range q {
+				fields[k] = q.Get(k)
+			}
+		}
+	}
+	if fields == nil {
+		e.Body = redactSecret(string(body))
+		return e
+	}
+	for _, k := range tokenResponseSecrets {
+		if _, ok := fields[k]; ok {
+			fields[k] = "REDACTED"
+		}
+	}
+	redacted, _ := json.Marshal(fields)
+	e.Body = redactSecret(string(redacted))
+	e.description, _ = fields["error_description"].(string)
+	if e.description == "" {
+		e.description, _ = fields["error"].(string)
+	}
+	return e
+}
+
+func (e *TokenExchangeError) Error() string {
+	if e.Status == "" {
+		return "token exchange failed: " + redactSecret(e.err.Error())
+	}
+	return fmt.Sprintf("token exchange failed with %s: %s", e.Status, e.Body)
+}
+
+// UserMessage what to tell the user, with `vouch.showTokenExchangeError` the reason given by the provider
+func (e *TokenExchangeError) UserMessage() string {
+	msg := "the login could not be completed with the provider, please try again"
+	if !cfg.Cfg.ShowTokenExchangeError {
+		return msg
+	}
+	switch {
+	case e.description != "":
+		return msg + " (" + redactSecret(e.description) + ")"
+	case e.Status != "":
+		return msg + " (" + e.Status + ")"
+	default:
+		return msg + " (" + redactSecret(e.err.Error()) + ")"
+	}
+}
+
+// redactSecret the client secret should never be echoed by a provider, but make sure it isn't passed on
+func redactSecret(s string) string {
+	if cfg.GenOAuth == nil || cfg.GenOAuth.ClientSecret == "" {
+		return s
+	}
+	return strings.Replace(s, cfg.GenOAuth.ClientSecret, "REDACTED", -1)
+}
+
+// Probe is the url of the provider reachable, any answer short of a 5xx will do
+// an authorize endpoint asked without the parameters of a login answers with an error page, which means it's up
+func Probe(client *http.Client, url string) error {
+	if url == "" {
+		return fmt.Errorf("oauth.provider %s has no url to probe", cfg.GenOAuth.Provider)
+	}
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,372 @@
+package common
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+	"golang.org/x/oauth2"
+)
+
+func init() {
+	cfg.InitForTestPurposesWithProvider("adfs")
+}
+
+func TestEmailFromClaims(t *testing.T) {
+	assert.Equal(t, []string{"email", "mail", "upn"}, cfg.GenOAuth.EmailClaims)
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		want   string
+	}{
+		{"email", map[string]interface{}{"email": "a@example.com", "mail": "b@example.com", "upn": "c@example.com"}, "a@example.com"},
+		{"mail", map[string]interface{}{"mail": "b@example.com", "upn": "c@example.com"}, "b@example.com"},
+		{"upn", map[string]interface{}{"upn": "c@example.com"}, "c@example.com"},
+		{"blank email", map[string]interface{}{"email": "", "mail": "b@example.com"}, "b@example.com"},
+		{"upn not an email", map[string]interface{}{"upn": "CORP\\user"}, ""},
+		{"none", map[string]interface{}{"sub": "123"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, EmailFromClaims(tt.claims))
+		})
+	}
+}
+
+func TestEmailFromClaimsOrder(t *testing.T) {
+	defer func(c []string) { cfg.GenOAuth.EmailClaims = c }(cfg.GenOAuth.EmailClaims)
+	cfg.GenOAuth.EmailClaims = []string{"upn", "email"}
+
+	claims := map[string]interface{}{"email": "a@example.com", "mail": "b@example.com", "upn": "c@example.com"}
+	assert.Equal(t, "c@example.com", EmailFromClaims(claims))
+
+	// claims which aren't configured are never used
+	assert.Equal(t, "", EmailFromClaims(map[string]interface{}{"mail": "b@example.com"}))
+}
+
+func TestNameFromClaims(t *testing.T) {
+	defer func(claim string, compose bool) {
+		cfg.GenOAuth.NameClaim, cfg.GenOAuth.ComposeName = claim, compose
+	}(cfg.GenOAuth.NameClaim, cfg.GenOAuth.ComposeName)
+	assert.Equal(t, "name", cfg.GenOAuth.NameClaim)
+
+	claims := map[string]interface{}{"name": "Ada Lovelace", "displayName": "Ada", "given_name": "Augusta Ada", "family_name": "King"}
+	assert.Equal(t, "Ada Lovelace", NameFromClaims(claims))
+
+	cfg.GenOAuth.NameClaim = "displayName"
+	assert.Equal(t, "Ada", NameFromClaims(claims))
+
+	// name absent
+	claims = map[string]interface{}{"given_name": "Augusta Ada", "family_name": "King"}
+	assert.Equal(t, "", NameFromClaims(claims))
+	cfg.GenOAuth.ComposeName = true
+	assert.Equal(t, "Augusta Ada King", NameFromClaims(claims))
+	assert.Equal(t, "King", NameFromClaims(map[string]interface{}{"family_name": "King"}))
+}
+
+func TestMapName(t *testing.T) {
+	user := &structs.User{Name: "from userinfo"}
+	assert.Nil(t, MapName([]byte(`{"sub": "123"}`), user))
+	assert.Equal(t, "from userinfo", user.Name)
+
+	assert.Nil(t, MapName([]byte(`{"name": "Ada Lovelace"}`), user))
+	assert.Equal(t, "Ada Lovelace", user.Name)
+}
+
+func TestEmailsFromClaims(t *testing.T) {
+	assert.Nil(t, EmailsFromClaims(map[string]interface{}{"email": "a@example.com"}))
+
+	claims := map[string]interface{}{"emails": []interface{}{
+		"a@example.com",
+		map[string]interface{}{"value": "b@example.com", "primary": true},
+		map[string]interface{}{"email": "c@example.com", "verified": true},
+		map[string]interface{}{"email": "d@example.com", "verified": false},
+	}}
+	assert.Equal(t, []string{"a@example.com", "b@example.com", "c@example.com"}, EmailsFromClaims(claims))
+}
+
+func TestRequestScheme(t *testing.T) {
+	trusted := cfg.Cfg.Headers.TrustForwarded
+	defer func() {
+		cfg.Cfg.Headers.TrustForwarded = trusted
+		cfg.Cfg.ForceHTTPS = false
+	}()
+
+	tests := []struct {
+		name    string
+		proto   string
+		tls     bool
+		trusted bool
+		force   bool
+		want    string
+	}{
+		{"plain http", "", false, true, false, "http"},
+		{"tls", "", true, true, false, "https"},
+		// nginx terminates TLS and proxies to Vouch Proxy over http
+		{"forwarded https over http", "https", false, true, false, "https"},
+		{"forwarded list", "HTTPS, http", false, true, false, "https"},
+		{"forwarded http over tls", "http", true, true, false, "http"},
+		{"untrusted forwarded https", "https", false, false, false, "http"},
+		{"bogus forwarded proto", "javascript", false, true, false, "http"},
+		{"forced", "", false, false, true, "https"},
+		{"forced over forwarded http", "http", false, true, true, "https"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.Cfg.Headers.TrustForwarded = nil
+			if tt.trusted {
+				cfg.Cfg.Headers.TrustForwarded = []string{"X-Forwarded-Proto"}
+			}
+			cfg.Cfg.ForceHTTPS = tt.force
+			r := httptest.NewRequest("GET", "http://vouch.example.com/login", nil)
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if tt.proto != "" {
+				r.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			assert.Equal(t, tt.want, RequestScheme(r))
+		})
+	}
+}
+
+func TestMapUserInfoFieldsJSONPath(t *testing.T) {
+	fields := cfg.GenOAuth.UserInfoFields
+	defer func() {
+		cfg.GenOAuth.UserInfoFields = fields
+		assert.Nil(t, ConfigureUserInfoFields())
+	}()
+	cfg.GenOAuth.UserInfoFields.Username = "$.data.attributes.login"
+	cfg.GenOAuth.UserInfoFields.Email = "$.data.attributes['e-mail']"
+	cfg.GenOAuth.UserInfoFields.Name = "name"
+	cfg.GenOAuth.UserInfoFields.ID = "$.data.id"
+	cfg.GenOAuth.UserInfoFields.Groups = "$.data.relationships.groups[*].slug"
+	assert.Nil(t, ConfigureUserInfoFields())
+
+	user := &structs.User{}
+	err := MapUserInfoFields([]byte(`{
+		"name": "Bob",
+		"data": {
+			"id": 42,
+			"attributes": {"login": "bob", "e-mail": "bob@example.com"},
+			"relationships": {"groups": [{"slug": "admins"}, {"slug": "writers"}]}
+		}
+	}`), user)
+	assert.Nil(t, err)
+	assert.Equal(t, "bob", user.Username)
+	assert.Equal(t, "bob@example.com", user.Email)
+	assert.Equal(t, "Bob", user.Name)
+	assert.Equal(t, structs.ID("42"), user.ID)
+	assert.Equal(t, []string{"admins", "writers"}, user.TeamMemberships)
+
+	// a plain key holding a list
+	cfg.GenOAuth.UserInfoFields.Groups = "groups"
+	user = &structs.User{}
+	assert.Nil(t, MapUserInfoFieldsFromMap(map[string]interface{}{"groups": []interface{}{"a", "b"}}, user))
+	assert.Equal(t, []string{"a", "b"}, user.TeamMemberships)
+
+	// a snowflake id keeps all of its digits
+	user = &structs.User{}
+	assert.Nil(t, MapUserInfoFields([]byte(`{"data": {"id": 1234567890123456789}}`), user))
+	assert.Equal(t, structs.ID("1234567890123456789"), user.ID)
+
+	cfg.GenOAuth.UserInfoFields.Email = "$.data[attributes"
+	assert.NotNil(t, ConfigureUserInfoFields())
+}
+
+func TestClaimShapes(t *testing.T) {
+	fields := cfg.GenOAuth.UserInfoFields
+	defer func() { cfg.GenOAuth.UserInfoFields = fields }()
+	cfg.GenOAuth.UserInfoFields.Groups = "groups"
+
+	for _, claims := range []string{
+		`{"email": "robin@example.com", "name": "Robin", "groups": "admins"}`,
+		`{"email": ["robin@example.com"], "name": ["", "Robin"], "groups": ["admins"]}`,
+	} {
+		user := &structs.User{}
+		assert.Nil(t, UnmarshalUser([]byte(claims), user), claims)
+		assert.Nil(t, MapUserInfoFields([]byte(claims), user), claims)
+		assert.Equal(t, "robin@example.com", user.Email, claims)
+		assert.Equal(t, "Robin", user.Name, claims)
+		assert.Equal(t, []string{"admins"}, user.TeamMemberships, claims)
+	}
+
+	m := map[string]interface{}{"email": []interface{}{"robin@example.com", "robin@example.org"}, "emails": "robin@example.org"}
+	assert.Equal(t, "robin@example.com", EmailFromClaims(m))
+	assert.Equal(t, []string{"robin@example.org"}, EmailsFromClaims(m))
+}
+
+func TestUnmarshalUserID(t *testing.T) {
+	tests := map[string]structs.ID{
+		`{"sub": "248289761001"}`: "248289761001",
+		`{"sub": 248289761001}`:   "248289761001",
+		`{"id": 42}`:              "42",
+		// above 2^53, which a float64 would round to 1234567890123456768
+		`{"id": 1234567890123456789}`:                              "1234567890123456789",
+		`{"sub": "6F9619FF-8B86-D011-B42D-00C04FC964FF", "id": 1}`: "6f9619ff-8b86-d011-b42d-00c04fc964ff",
+	}
+	for claims, want := range tests {
+		user := &structs.User{}
+		assert.Nil(t, UnmarshalUser([]byte(claims), user), claims)
+		assert.Equal(t, want, user.ID, claims)
+	}
+}
+
+func TestCallbackErrorFromQuery(t *testing.T) {
+	assert.Nil(t, CallbackErrorFromQuery(url.Values{"code": {"123"}, "state": {"abc"}}))
+
+	e := CallbackErrorFromQuery(url.Values{"error": {"access_denied"}, "error_description": {"user said no"}})
+	assert.True(t, e.AccessDenied())
+	assert.Equal(t, "user said no", e.Message())
+
+	e = CallbackErrorFromQuery(url.Values{"error": {"invalid_scope"}})
+	assert.False(t, e.AccessDenied())
+	assert.Equal(t, "invalid_scope", e.Message())
+
+	assert.True(t, CallbackErrorFromQuery(url.Values{"denied": {"token"}}).AccessDenied())
+	assert.True(t, CallbackErrorFromQuery(url.Values{"openid.mode": {"cancel"}}).AccessDenied())
+	assert.Nil(t, CallbackErrorFromQuery(url.Values{"openid.mode": {"id_res"}}))
+}
+
+func TestMapClaimsKeepsActiveClaim(t *testing.T) {
+	cfg.GenOAuth.ActiveClaim = "active"
+	defer func() { cfg.GenOAuth.ActiveClaim = "" }()
+
+	customClaims := &structs.CustomClaims{}
+	assert.Nil(t, MapClaims([]byte(`{"active":false,"unlisted":"dropped"}`), customClaims))
+	assert.Equal(t, false, customClaims.Claims["active"])
+	assert.NotContains(t, customClaims.Claims, "unlisted")
+}
+
+func TestMapClaimsKeepsPictureClaim(t *testing.T) {
+	cfg.GenOAuth.PictureClaim = "picture"
+	defer func() { cfg.GenOAuth.PictureClaim = "" }()
+
+	customClaims := &structs.CustomClaims{}
+	assert.Nil(t, MapClaims([]byte(`{"picture":"https://example.com/robin.png","unlisted":"dropped"}`), customClaims))
+	assert.Equal(t, "https://example.com/robin.png", customClaims.Claims["picture"])
+	assert.NotContains(t, customClaims.Claims, "unlisted")
+}
+
+func TestTokenExchangeError(t *testing.T) {
+	secret := cfg.GenOAuth.ClientSecret
+	cfg.GenOAuth.ClientSecret = "sup3rs3cr3t"
+	defer func() {
+		cfg.GenOAuth.ClientSecret = secret
+		cfg.Cfg.ShowTokenExchangeError = false
+	}()
+
+	e := TokenEndpointError("401 Unauthorized", []byte(`{"error":"invalid_client","error_description":"bad secret sup3rs3cr3t","access_token":"abc"}`))
+	assert.Contains(t, e.Error(), "401 Unauthorized")
+	assert.Contains(t, e.Error(), "invalid_client")
+	assert.NotContains(t, e.Error(), "sup3rs3cr3t")
+	assert.NotContains(t, e.Error(), "abc")
+	assert.NotContains(t, e.UserMessage(), "bad secret")
+
+	cfg.Cfg.ShowTokenExchangeError = true
+	assert.Contains(t, e.UserMessage(), "(bad secret REDACTED)")
+
+	// GitHub answers form encoded
+	e = TokenEndpointError("200 OK", []byte("error=bad_verification_code&error_description=The+code+is+incorrect"))
+	assert.Contains(t, e.UserMessage(), "(The code is incorrect)")
+
+	e = TokenEndpointError("502 Bad Gateway", []byte("<html>upstream sup3rs3cr3t</html>"))
+	assert.Equal(t, "token exchange failed with 502 Bad Gateway: <html>upstream REDACTED</html>", e.Error())
+	assert.Contains(t, e.UserMessage(), "(502 Bad Gateway)")
+
+	e = NewTokenExchangeError(&oauth2.RetrieveError{Response: &http.Response{Status: "400 Bad Request"}, Body: []byte(`{"error":"invalid_grant"}`)})
+	assert.Equal(t, "400 Bad Request", e.Status)
+	assert.Contains(t, e.UserMessage(), "(invalid_grant)")
+
+	e = NewTokenExchangeError(errors.New("dial tcp: connection refused"))
+	assert.Equal(t, "token exchange failed: dial tcp: connection refused", e.Error())
+}
+
+func TestPrepareTokensAndClientRefresh(t *testing.T) {
+	// the access token of the code has already expired, as it does when the exchange was slow or the clock is off
+	exchanged := `{"access_token":"old","token_type":"bearer","expires_in":1,"refresh_token":"refresh1"}`
+	refreshed := `{"access_token":"new","token_type":"bearer","expires_in":3600}`
+	refreshStatus := http.StatusOK
+	refreshes := 0
+	tokenServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		w.Header().Set("Content-Type", "application/json")
+		switch r.PostForm.Get("grant_type") {
+		case "authorization_code":
+			w.Write([]byte(exchanged))
+		case "refresh_token":
+			refreshes++
+			assert.Equal(t, "refresh1", r.PostForm.Get("refresh_token"))
+			w.WriteHeader(refreshStatus)
+			if refreshStatus != http.StatusOK {
+				w.Write([]byte(`{"error":"invalid_grant"}`))
+				return
+			}
+			w.Write([]byte(refreshed))
+		}
+	}))
+	defer tokenServer.Close()
+	var authorization string
+	apiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+	}))
+	defer apiServer.Close()
+
+	oauthClient := cfg.OAuthClient
+	defer func() { cfg.OAuthClient = oauthClient }()
+	cfg.OAuthClient = &oauth2.Config{
+		ClientID: "vouch",
+		Endpoint: oauth2.Endpoint{TokenURL: tokenServer.URL, AuthStyle: oauth2.AuthStyleInParams},
+	}
+	prepare := func(ptokens *structs.PTokens) (error, *http.Client, *oauth2.Token) {
+		r := httptest.NewRequest("GET", "http://vouch.example.com/auth?code=abc", nil)
+		return PrepareTokensAndClient(r, ptokens, false)
+	}
+
+	ptokens := &structs.PTokens{}
+	err, client, token := prepare(ptokens)
+	assert.NoError(t, err)
+	assert.Equal(t, "new", token.AccessToken)
+	assert.Equal(t, "new", ptokens.PAccessToken)
+	_, err = client.Get(apiServer.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer new", authorization)
+	assert.Equal(t, 1, refreshes)
+
+	// the refresh is refused, once
+	refreshes = 0
+	refreshStatus = http.StatusBadRequest
+	err, client, _ = prepare(&structs.PTokens{})
+	assert.Error(t, err)
+	assert.IsType(t, &TokenExchangeError{}, err)
+	assert.Nil(t, client)
+	assert.Equal(t, 1, refreshes)
+
+	// a token which hasn't expired isn't renewed
+	refreshes = 0
+	exchanged = `{"access_token":"fresh","token_type":"bearer","expires_in":3600,"refresh_token":"refresh1"}`
+	ptokens = &structs.PTokens{}
+	err, client, _ = prepare(ptokens)
+	assert.NoError(t, err)
+	_, err = client.Get(apiServer.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer fresh", authorization)
+	assert.Equal(t, "fresh", ptokens.PAccessToken)
+	assert.Equal(t, 0, refreshes)
+
+	// without a refresh token there is nothing to renew it with, the call fails and the user logs in again
+	exchanged = `{"access_token":"old","token_type":"bearer","expires_in":1}`
+	err, client, token = prepare(&structs.PTokens{})
+	assert.NoError(t, err)
+	assert.Equal(t, "old", token.AccessToken)
+	_, err = client.Get(apiServer.URL)
+	assert.Error(t, err)
+	assert.Equal(t, 0, refreshes)
+}
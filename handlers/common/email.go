@@ -0,0 +1,62 @@
+package common
+
+import (
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/pii"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// the sources of `oauth.email_sources`
+const (
+	EmailSourceIDToken  = "id_token"
+	EmailSourceUserInfo = "userinfo"
+	// EmailSourceAPI a provider specific lookup, such as GitHub's /user/emails
+	EmailSourceAPI = "api"
+)
+
+// EmailSource look up the user's email in one place, an empty email means that source has none
+type EmailSource func() (email string, verified bool, err error)
+
+// ResolveEmail set user.Email from the first of the `oauth.email_sources` which has a verified email
+// a source the provider's handler doesn't offer is skipped, as is one which fails
+// without a verified email from any of them user.Email is left as the handler mapped it
+func ResolveEmail(user *structs.User, sources map[string]EmailSource) {
+	for _, name := range cfg.GenOAuth.EmailSources {
+		source, ok := sources[name]
+		if !ok {
+			log.Debugf("oauth.email_sources %s is not available for provider %s", name, cfg.GenOAuth.Provider)
+			continue
+		}
+		email, verified, err := source()
+		if err != nil {
+			log.Warnf("could not look up the email of %s in %s, trying the next of oauth.email_sources: %s", pii.Mask(user.Username), name, err)
+			continue
+		}
+		if email == "" {
+			log.Debugf("no email for %s in %s", pii.Mask(user.Username), name)
+			continue
+		}
+		if !verified {
+			log.Debugf("skipping the unverified email %s of %s in %s", pii.Mask(email), pii.Mask(user.Username), name)
+			continue
+		}
+		log.Debugf("email %s of %s from %s", pii.Mask(email), pii.Mask(user.Username), name)
+		user.Email = email
+		return
+	}
+	log.Debugf("none of oauth.email_sources %s have a verified email for %s", cfg.GenOAuth.EmailSources, pii.Mask(user.Username))
+}
+
+// VerifiedEmailFromClaims the email of EmailFromClaims, which is verified unless the claims say `email_verified: false`
+// many providers don't send email_verified at all, they only release addresses they have verified
+func VerifiedEmailFromClaims(m map[string]interface{}) (string, bool) {
+	email := EmailFromClaims(m)
+	switch v := m["email_verified"].(type) {
+	case bool:
+		return email, v
+	case string:
+		// Cognito sends it as a string
+		return email, v == "true"
+	}
+	return email, true
+}
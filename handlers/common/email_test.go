@@ -0,0 +1,53 @@
+package common
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func TestResolveEmail(t *testing.T) {
+	defer func() { cfg.GenOAuth.EmailSources = nil }()
+	cfg.GenOAuth.EmailSources = []string{EmailSourceIDToken, EmailSourceUserInfo, EmailSourceAPI}
+
+	found := func(email string, verified bool) EmailSource {
+		return func() (string, bool, error) { return email, verified, nil }
+	}
+	failed := func() (string, bool, error) { return "", false, errors.New("unavailable") }
+
+	tests := []struct {
+		name    string
+		sources map[string]EmailSource
+		want    string
+	}{
+		{"id token", map[string]EmailSource{EmailSourceIDToken: found("idtoken@example.com", true), EmailSourceUserInfo: found("userinfo@example.com", true)}, "idtoken@example.com"},
+		{"id token unverified", map[string]EmailSource{EmailSourceIDToken: found("idtoken@example.com", false), EmailSourceUserInfo: found("userinfo@example.com", true)}, "userinfo@example.com"},
+		{"id token fails", map[string]EmailSource{EmailSourceIDToken: failed, EmailSourceUserInfo: found("userinfo@example.com", true)}, "userinfo@example.com"},
+		{"api", map[string]EmailSource{EmailSourceIDToken: found("", true), EmailSourceUserInfo: found("", true), EmailSourceAPI: found("api@example.com", true)}, "api@example.com"},
+		{"source not offered", map[string]EmailSource{EmailSourceAPI: found("api@example.com", true)}, "api@example.com"},
+		// nothing verified leaves the email as it was mapped
+		{"none", map[string]EmailSource{EmailSourceUserInfo: found("userinfo@example.com", false)}, "mapped@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user := &structs.User{Username: "robin", Email: "mapped@example.com"}
+			ResolveEmail(user, tt.sources)
+			assert.Equal(t, tt.want, user.Email)
+		})
+	}
+}
+
+func TestVerifiedEmailFromClaims(t *testing.T) {
+	email, verified := VerifiedEmailFromClaims(map[string]interface{}{"email": "a@example.com"})
+	assert.Equal(t, "a@example.com", email)
+	assert.True(t, verified)
+
+	_, verified = VerifiedEmailFromClaims(map[string]interface{}{"email": "a@example.com", "email_verified": false})
+	assert.False(t, verified)
+	_, verified = VerifiedEmailFromClaims(map[string]interface{}{"email": "a@example.com", "email_verified": "true"})
+	assert.True(t, verified)
+}
@@ -0,0 +1,61 @@
+package common
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+var (
+	// retryBackoff the wait before the first retry, doubled for each one after
+	retryBackoff = 500 * time.Millisecond
+	// maxRetryWait a Retry-After longer than this is not waited out, the answer is returned as it is
+	maxRetryWait = 10 * time.Second
+	sleep        = time.Sleep
+)
+
+// GetWithRetry get the url, retrying up to `oauth.http_client.retries` times while the provider answers with a 5xx
+// or a 429, waiting as long as its Retry-After asks or else backing off. Any other answer, such as the 404 of
+// someone who isn't a member, is returned straight away
+func GetWithRetry(client *http.Client, url string) (*http.Response, error) {
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := client.Get(url)
+		if err != nil || !retryable(resp.StatusCode) || attempt >= cfg.GenOAuth.HTTPClient.Retries {
+			return resp, err
+		}
+		wait, ok := retryAfter(resp, backoff)
+		if !ok {
+			return resp, nil
+		}
+		resp.Body.Close()
+		log.Debugf("%s answered %s, retrying in %s", url, resp.Status, wait)
+		sleep(wait)
+		backoff *= 2
+	}
+}
+
+func retryable(status int) bool {
+	return status >= http.StatusInternalServerError || status == http.StatusTooManyRequests
+}
+
+// retryAfter how long the Retry-After of the response asks to wait, in seconds or until a date, or else the backoff
+// false when it asks for longer than maxRetryWait
+func retryAfter(resp *http.Response, backoff time.Duration) (time.Duration, bool) {
+	h := resp.Header.Get("Retry-After")
+	if h == "" {
+		return backoff, true
+	}
+	wait := backoff
+	if secs, err := strconv.Atoi(h); err == nil {
+		wait = time.Duration(secs) * time.Second
+	} else if date, err := http.ParseTime(h); err == nil {
+		wait = time.Until(date)
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, wait <= maxRetryWait
+}
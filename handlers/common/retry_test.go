@@ -0,0 +1,116 @@
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+	"golang.org/x/oauth2"
+)
+
+// answering serves the statuses in turn, the last one for good, and the Retry-After with each 5xx and 429
+func answering(retryAfter string, statuses ...int) (*httptest.Server, *int) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		status := statuses[len(statuses)-1]
+		if calls < len(statuses) {
+			status = statuses[calls]
+		}
+		calls++
+		if retryAfter != "" && retryable(status) {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		w.WriteHeader(status)
+	}))
+	return ts, &calls
+}
+
+func TestGetWithRetry(t *testing.T) {
+	var waits []time.Duration
+	defer func(s func(time.Duration), retries int) {
+		sleep, cfg.GenOAuth.HTTPClient.Retries = s, retries
+	}(sleep, cfg.GenOAuth.HTTPClient.Retries)
+	sleep = func(d time.Duration) { waits = append(waits, d) }
+	assert.Equal(t, 2, cfg.GenOAuth.HTTPClient.Retries)
+
+	// a 500 then the answer
+	ts, calls := answering("", http.StatusInternalServerError, http.StatusOK)
+	resp, err := GetWithRetry(http.DefaultClient, ts.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, 2, *calls)
+	assert.Equal(t, []time.Duration{retryBackoff}, waits)
+	ts.Close()
+
+	// a 404 is an answer, not a failure
+	waits = nil
+	ts, calls = answering("", http.StatusNotFound)
+	resp, err = GetWithRetry(http.DefaultClient, ts.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, 1, *calls)
+	assert.Empty(t, waits)
+	ts.Close()
+
+	// the Retry-After of the rate limit takes the place of the backoff
+	waits = nil
+	ts, calls = answering("3", http.StatusTooManyRequests, http.StatusOK)
+	resp, err = GetWithRetry(http.DefaultClient, ts.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []time.Duration{3 * time.Second}, waits)
+	ts.Close()
+
+	// longer than maxRetryWait is given up on
+	waits = nil
+	ts, calls = answering("3600", http.StatusServiceUnavailable)
+	resp, err = GetWithRetry(http.DefaultClient, ts.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, 1, *calls)
+	assert.Empty(t, waits)
+	ts.Close()
+
+	// the backoff doubles until the retries run out
+	waits = nil
+	ts, calls = answering("", http.StatusBadGateway)
+	resp, err = GetWithRetry(http.DefaultClient, ts.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+	assert.Equal(t, 3, *calls)
+	assert.Equal(t, []time.Duration{retryBackoff, 2 * retryBackoff}, waits)
+	ts.Close()
+
+	cfg.GenOAuth.HTTPClient.Retries = 0
+	ts, calls = answering("", http.StatusBadGateway)
+	_, err = GetWithRetry(http.DefaultClient, ts.URL)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, *calls)
+	ts.Close()
+}
+
+func TestRetryAfterDate(t *testing.T) {
+	resp := &http.Response{Header: http.Header{"Retry-After": {time.Now().Add(5 * time.Second).UTC().Format(http.TimeFormat)}}}
+	wait, ok := retryAfter(resp, retryBackoff)
+	assert.True(t, ok)
+	assert.InDelta(t, float64(5*time.Second), float64(wait), float64(time.Second))
+
+	// already past
+	resp.Header.Set("Retry-After", time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat))
+	wait, ok = retryAfter(resp, retryBackoff)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), wait)
+}
+
+func TestTokenClientTimeout(t *testing.T) {
+	assert.Equal(t, 30, cfg.GenOAuth.HTTPClient.Timeout)
+	client, _, err := tokenClient(context.Background(), &oauth2.Token{AccessToken: "abc"}, &structs.PTokens{})
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Second, client.Timeout)
+}
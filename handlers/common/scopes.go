@@ -0,0 +1,73 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/oauth2"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// MissingScopesError the provider didn't grant all of `oauth.required_scopes`
+type MissingScopesError struct {
+	Missing []string
+	Granted []string
+}
+
+func (e *MissingScopesError) Error() string {
+	return fmt.Sprintf("the provider did not grant the scopes %s of oauth.required_scopes, the token has the scopes %s. Check oauth.scopes and the consent given to the app", e.Missing, e.Granted)
+}
+
+// GrantedScopes the `scope` of the token response, nil when the provider left it out
+// which RFC 6749 section 5.1 allows when the scopes granted are those requested
+func GrantedScopes(token *oauth2.Token) []string {
+	if token == nil {
+		return nil
+	}
+	s, ok := token.Extra("scope").(string)
+	if !ok {
+		return nil
+	}
+	return SplitScopes(s)
+}
+
+// SplitScopes a list of scopes separated by spaces, or by commas as GitHub does
+func SplitScopes(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+}
+
+// CheckScopes compare the granted scopes with `oauth.required_scopes`
+// a missing scope is logged by name, and with `oauth.missing_scopes: fail` is a *MissingScopesError
+func CheckScopes(granted []string) error {
+	missing := []string{}
+	for _, scope := range cfg.GenOAuth.RequiredScopes {
+		if !scopeGranted(scope, granted) {
+			missing = append(missing, scope)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	err := &MissingScopesError{Missing: missing, Granted: granted}
+	if cfg.GenOAuth.MissingScopes == "fail" {
+		return err
+	}
+	log.Warn(err)
+	return nil
+}
+
+// scopeGranted a GitHub scope is also granted by a broader one, such as read:org by admin:org
+func scopeGranted(scope string, granted []string) bool {
+	if cfg.GenOAuth.Provider == cfg.Providers.GitHub {
+		return cfg.GitHubScopeGranted(scope, granted)
+	}
+	for _, g := range granted {
+		if g == scope {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func TestGrantedScopes(t *testing.T) {
+	token := &oauth2.Token{AccessToken: "abc"}
+	assert.Nil(t, GrantedScopes(token))
+	assert.Equal(t, []string{"openid", "email"}, GrantedScopes(token.WithExtra(map[string]interface{}{"scope": "openid email"})))
+	assert.Equal(t, []string{"read:org", "user:email"}, GrantedScopes(token.WithExtra(map[string]interface{}{"scope": "read:org,user:email"})))
+	assert.Equal(t, []string{}, GrantedScopes(token.WithExtra(map[string]interface{}{"scope": ""})))
+}
+
+func TestCheckScopes(t *testing.T) {
+	provider := cfg.GenOAuth.Provider
+	defer func() {
+		cfg.GenOAuth.Provider = provider
+		cfg.GenOAuth.RequiredScopes = nil
+		cfg.GenOAuth.MissingScopes = "warn"
+	}()
+	cfg.GenOAuth.Provider = cfg.Providers.OIDC
+	cfg.GenOAuth.RequiredScopes = []string{"openid", "groups"}
+	cfg.GenOAuth.MissingScopes = "warn"
+	assert.Nil(t, CheckScopes([]string{"openid"}))
+
+	cfg.GenOAuth.MissingScopes = "fail"
+	assert.Nil(t, CheckScopes([]string{"openid", "email", "groups"}))
+	err := CheckScopes([]string{"openid", "email"})
+	if assert.IsType(t, &MissingScopesError{}, err) {
+		assert.Equal(t, []string{"groups"}, err.(*MissingScopesError).Missing)
+		assert.Contains(t, err.Error(), "groups")
+	}
+
+	// a broader GitHub scope will do
+	cfg.GenOAuth.Provider = cfg.Providers.GitHub
+	cfg.GenOAuth.RequiredScopes = []string{"read:user", "read:org"}
+	assert.Nil(t, CheckScopes([]string{"user", "admin:org"}))
+	assert.Error(t, CheckScopes([]string{"read:user"}))
+}
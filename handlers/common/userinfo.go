@@ -0,0 +1,63 @@
+package common
+
+import (
+	"encoding/json"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// UserInfoError the provider answered the userinfo request with an error in the body, which some do with a 200
+type UserInfoError struct {
+	Code        string
+	Description string
+}
+
+func (e *UserInfoError) Error() string {
+	if e.Description == "" {
+		return "userinfo returned the error " + e.Code
+	}
+	return "userinfo returned the error " + e.Code + ": " + e.Description
+}
+
+// Message the description for the user, or the code if the provider didn't describe the error
+func (e *UserInfoError) Message() string {
+	if e.Description == "" {
+		return e.Code
+	}
+	return e.Description
+}
+
+// CheckUserInfoError a *UserInfoError when the userinfo has the key `oauth.user_info_error.field`
+// rather than mapping whatever else the body holds into the user. A body which isn't a json object is left to the handler.
+func CheckUserInfoError(data []byte) error {
+	field := cfg.GenOAuth.UserInfoError.Field
+	if field == "" {
+		return nil
+	}
+	var m map[string]interface{}
+	if json.Unmarshal(data, &m) != nil {
+		return nil
+	}
+	e := &UserInfoError{}
+	switch v := m[field].(type) {
+	case nil, bool:
+		if v != true {
+			return nil
+		}
+		e.Code = field
+	case map[string]interface{}:
+		// {"error": {"code": 401, "message": "Invalid Credentials"}} as Google's apis answer
+		e.Code = toString(v["code"])
+		e.Description = toString(v["message"])
+	default:
+		e.Code = scalar(v)
+	}
+	if e.Code == "" && e.Description == "" {
+		return nil
+	}
+	if e.Description == "" {
+		e.Description = stringField(m, cfg.GenOAuth.UserInfoError.DescriptionField)
+	}
+	log.Debugf("userinfo error %s", e)
+	return e
+}
@@ -0,0 +1,56 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func TestCheckUserInfoError(t *testing.T) {
+	field, descriptionField := cfg.GenOAuth.UserInfoError.Field, cfg.GenOAuth.UserInfoError.DescriptionField
+	defer func() {
+		cfg.GenOAuth.UserInfoError.Field, cfg.GenOAuth.UserInfoError.DescriptionField = field, descriptionField
+	}()
+	cfg.GenOAuth.UserInfoError.Field = "error"
+	cfg.GenOAuth.UserInfoError.DescriptionField = "error_description"
+
+	tests := []struct {
+		name    string
+		body    string
+		wantErr *UserInfoError
+	}{
+		{"user", `{"sub": "1", "email": "robin@example.com"}`, nil},
+		{"oauth error", `{"error": "invalid_token", "error_description": "The access token expired"}`, &UserInfoError{"invalid_token", "The access token expired"}},
+		{"code only", `{"error": "invalid_token"}`, &UserInfoError{"invalid_token", ""}},
+		{"nested", `{"error": {"code": 401, "message": "Invalid Credentials"}}`, &UserInfoError{"401", "Invalid Credentials"}},
+		{"flag", `{"error": true, "error_description": "no such user"}`, &UserInfoError{"error", "no such user"}},
+		{"no error", `{"error": null, "sub": "1"}`, nil},
+		{"false", `{"error": false, "sub": "1"}`, nil},
+		{"empty", `{"error": "", "sub": "1"}`, nil},
+		{"not json", `<html>`, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckUserInfoError([]byte(tt.body))
+			if tt.wantErr == nil {
+				assert.Nil(t, err)
+				return
+			}
+			assert.Equal(t, tt.wantErr, err)
+		})
+	}
+
+	// a provider with its own keys
+	cfg.GenOAuth.UserInfoError.Field = "status"
+	cfg.GenOAuth.UserInfoError.DescriptionField = "$.details.reason"
+	assert.Nil(t, ConfigureUserInfoFields())
+	err := CheckUserInfoError([]byte(`{"status": "failed", "details": {"reason": "account locked"}}`))
+	assert.Equal(t, &UserInfoError{"failed", "account locked"}, err)
+	assert.Equal(t, "userinfo returned the error failed: account locked", err.Error())
+	assert.Nil(t, CheckUserInfoError([]byte(`{"error": "ignored"}`)))
+
+	cfg.GenOAuth.UserInfoError.Field = ""
+	assert.Nil(t, CheckUserInfoError([]byte(`{"error": "invalid_token"}`)))
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/clientip"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// authzResult the json body of /debug/authz
+type authzResult struct {
+	Allowed bool   `json:"allowed"`
+	Rule    string `json:"rule"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// DebugAuthzHeader must carry `vouch.debugAuthz.secret`
+var DebugAuthzHeader = "X-" + cfg.Branding.CcName + "-Debug-Secret"
+
+// debugSecretValid does the request carry `vouch.debugAuthz.secret` in the DebugAuthzHeader
+func debugSecretValid(r *http.Request) bool {
+	secret := r.Header.Get(DebugAuthzHeader)
+	return secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(cfg.Cfg.DebugAuthz.Secret)) == 1
+}
+
+// DebugAuthzHandler /debug/authz?user=...&email=...&teams=a,b
+// dry run of the same authorization used at /auth, without a login
+func DebugAuthzHandler(w http.ResponseWriter, r *http.Request) {
+	log.Debug("/debug/authz")
+	if !cfg.Cfg.DebugAuthz.Enabled {
+		http.NotFound(w, r)
+		return
+	}
+	if !debugSecretValid(r) {
+		log.Warnf("/debug/authz missing or invalid %s header from %s", DebugAuthzHeader, clientip.FromRequest(r))
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	q := r.URL.Query()
+	user := structs.User{Username: q.Get("user"), Email: q.Get("email")}
+	if teams := q.Get("teams"); teams != "" {
+		for _, t := range strings.Split(teams, ",") {
+			user.TeamMemberships = append(user.TeamMemberships, strings.TrimSpace(t))
+		}
+	}
+
+	// there are no provider claims without a login, a claimsWhitelist always denies
+	ok, rule, err := verifyUser(user, structs.CustomClaims{})
+	res := authzResult{Allowed: ok, Rule: rule}
+	if err != nil {
+		res.Reason = err.Error()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Error(err)
+	}
+}
+
+// validateResult the json body of /validate when `vouch.debugAuthz.validate` is set
+type validateResult struct {
+	Rule    string      `json:"rule"`
+	Headers http.Header `json:"headers"`
+}
+
+// debugValidate should /validate describe its answer in the body
+// only when enabled and asked for with the secret, the reverse proxy never sees anything but the headers
+func debugValidate(r *http.Request) bool {
+	if !cfg.Cfg.DebugAuthz.Validate || r.Header.Get(DebugAuthzHeader) == "" {
+		return false
+	}
+	if !debugSecretValid(r) {
+		log.Warnf("/validate invalid %s header from %s", DebugAuthzHeader, clientip.FromRequest(r))
+		return false
+	}
+	return true
+}
+
+// validateDebugJSON echo the headers /validate is setting along with the rule which authorized the request
+func validateDebugJSON(w http.ResponseWriter, r *http.Request) {
+	res := validateResult{Rule: validateRule(r), Headers: http.Header{}}
+	for k, v := range w.Header() {
+		res.Headers[k] = v
+	}
+	// the tokens are in the cookie already, there's no need to spread them any further
+	for _, h := range []string{cfg.Cfg.Headers.AccessToken, cfg.Cfg.Headers.IDToken} {
+		if h == "" || res.Headers.Get(h) == "" {
+			continue
+		}
+		res.Headers.Set(h, fmt.Sprintf("(redacted, %d bytes)", len(res.Headers.Get(h))))
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Error(err)
+	}
+}
+
+// validateRule the most specific rule /validate applied, in the order they are checked
+func validateRule(r *http.Request) string {
+	if path := forwardedPath(r); path != "" {
+		for _, p := range pathPolicies {
+			if p.matches(path) {
+				return "pathPolicies " + p.String()
+			}
+		}
+	}
+	if len(cfg.Cfg.MethodTeams) > 0 {
+		if method := forwardedMethod(r); len(requiredTeams(method)) > 0 {
+			return "methodTeams " + strings.ToLower(method)
+		}
+	}
+	if cfg.Cfg.AllowAllUsers {
+		return ruleAllowAllUsers
+	}
+	return ruleDomains
+}
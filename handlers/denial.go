@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/vouch/vouch-proxy/pkg/authz"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// the reasons a login is refused, the keys of `vouch.deniedMessages` and the .Reason of the index template
+const (
+	reasonNoTeam          = "no-team"
+	reasonNotWhiteListed  = "not-whitelisted"
+	reasonNoClaim         = "no-claim"
+	reasonDenylisted      = "denylisted"
+	reasonUnverifiedEmail = "unverified-email"
+	reasonWrongTenant     = "wrong-tenant"
+	reasonWrongDomain     = "wrong-domain"
+)
+
+// DeniedError a login refused by one of the authorization rules, Reason says which in a word
+type DeniedError struct {
+	Reason string
+	Err    error
+}
+
+func (e *DeniedError) Error() string {
+	return e.Err.Error()
+}
+
+func denied(reason string, err error) *DeniedError {
+	return &DeniedError{Reason: reason, Err: err}
+}
+
+// emailDenial the email was not in the domains, or there was no verified email to check in the first place
+func emailDenial(user structs.User, err error) *DeniedError {
+	if user.Email == "" && len(user.Emails) == 0 {
+		return denied(reasonUnverifiedEmail, err)
+	}
+	return denied(reasonWrongDomain, err)
+}
+
+// denialOf the DeniedError of any error refusing the login, the authz webhook's own reason is taken as it is
+func denialOf(err error) *DeniedError {
+	switch e := err.(type) {
+	case *DeniedError:
+		return e
+	case *authz.DeniedError:
+		if e.Reason != "" {
+			return denied(e.Reason, e)
+		}
+		return denied(reasonDenylisted, e)
+	}
+	// such as the authz webhook failing to answer
+	return denied("", err)
+}
+
+// renderDenied log the refused login with its reason and tell the user, in the words of `vouch.deniedMessages` if
+// there are any for the reason, or else with msgf around the details of the rule
+func renderDenied(w http.ResponseWriter, status int, err error, msgf string) {
+	d := denialOf(err)
+	log.Errorf("%s (reason: %s)", d, d.Reason)
+	if d.Reason != "" {
+		metrics.Login(metrics.ResultDenied, d.Reason)
+	} else {
+		metrics.Login(metrics.ResultDenied, "unknown")
+	}
+	msg, ok := cfg.Cfg.DeniedMessages[d.Reason]
+	if !ok || d.Reason == "" {
+		msg = fmt.Sprintf(msgf, d)
+	}
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+	}
+	if err := indexTemplate.Execute(w, &Index{Msg: msg, TestURLs: cfg.Cfg.TestURLs, Testing: cfg.Cfg.Testing, Reason: d.Reason}); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/authz"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func TestVerifyUserDenialReason(t *testing.T) {
+	setUp()
+	reason := func(u structs.User) string {
+		ok, _, err := verifyUser(u, structs.CustomClaims{})
+		assert.False(t, ok)
+		return denialOf(err).Reason
+	}
+	assert.Equal(t, reasonWrongDomain, reason(*user))
+	assert.Equal(t, reasonUnverifiedEmail, reason(structs.User{Username: "testuser"}))
+
+	cfg.Cfg.TeamWhiteList = []string{"org/team"}
+	assert.Equal(t, reasonNoTeam, reason(*user))
+	assert.Equal(t, reasonNoTeam, reason(structs.User{Username: "testuser", TeamMemberships: []string{"org/other"}}))
+
+	cfg.Cfg.WhiteList = []string{"someoneelse"}
+	assert.Equal(t, reasonNotWhiteListed, reason(*user))
+}
+
+func TestDenialOf(t *testing.T) {
+	assert.Equal(t, reasonDenylisted, denialOf(&authz.DeniedError{Username: "bob"}).Reason)
+	assert.Equal(t, reasonWrongTenant, denialOf(&authz.DeniedError{Username: "bob", Reason: reasonWrongTenant}).Reason)
+	// the webhook not answering is no reason to tell the user
+	assert.Equal(t, "", denialOf(errors.New("authz webhook unexpected response status 500")).Reason)
+}
+
+func TestRenderDenied(t *testing.T) {
+	setUp()
+	defer func() { cfg.Cfg.DeniedMessages = nil }()
+	err := denied(reasonNoTeam, errors.New("user.TeamMemberships [] match 0 of the TeamWhiteList"))
+
+	w := httptest.NewRecorder()
+	renderDenied(w, http.StatusForbidden, err, "/auth User is not authorized. %s")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "match 0 of the TeamWhiteList")
+	assert.Contains(t, w.Body.String(), "<code>no-team</code>")
+
+	// the configured message rather than the details
+	cfg.Cfg.DeniedMessages = map[string]string{reasonNoTeam: "Your account is not a member of an authorized team"}
+	w = httptest.NewRecorder()
+	renderDenied(w, http.StatusOK, err, "/auth User is not authorized. %s")
+	assert.Contains(t, w.Body.String(), "Your account is not a member of an authorized team")
+	assert.NotContains(t, w.Body.String(), "TeamWhiteList")
+}
+
+func TestCallbackDeniedLoginMetrics(t *testing.T) {
+	setUp()
+	// the indieauth endpoint tells who the user is, with no email to check against the domains
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"me": "https://testuser.example/"}`))
+	}))
+	defer ts.Close()
+	authURL := cfg.GenOAuth.AuthURL
+	defer func() { cfg.GenOAuth.AuthURL = authURL }()
+	cfg.GenOAuth.AuthURL = ts.URL
+
+	denials := metrics.Logins(metrics.ResultDenied, reasonUnverifiedEmail)
+	successes := metrics.Logins(metrics.ResultSuccess, "")
+
+	r := httptest.NewRequest("GET", "http://vouch.domain1/auth?state=abc&code=123", nil)
+	w := httptest.NewRecorder()
+	session, _ := sessstore.Get(r, cfg.Cfg.Session.Name)
+	session.Values["state"] = "abc"
+	assert.Nil(t, session.Save(r, w))
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	w = httptest.NewRecorder()
+	CallbackHandler(w, r)
+
+	assert.Contains(t, w.Body.String(), "User is not authorized")
+	assert.Equal(t, denials+1, metrics.Logins(metrics.ResultDenied, reasonUnverifiedEmail))
+	assert.Equal(t, successes, metrics.Logins(metrics.ResultSuccess, ""))
+}
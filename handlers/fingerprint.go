@@ -0,0 +1,55 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/clientip"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/pii"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// clientFingerprint a hash of the `vouch.fingerprint.components` of the request
+// it's coarse on purpose, the ip is cut down to its network so that a user isn't logged out by every new address
+func clientFingerprint(r *http.Request) string {
+	parts := []string{}
+	for _, c := range cfg.Cfg.Fingerprint.Components {
+		switch c {
+		case "userAgent":
+			parts = append(parts, "ua="+r.UserAgent())
+		case "ip":
+			parts = append(parts, "ip="+ipNetwork(clientip.FromRequest(r)))
+		}
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	// half of the hash is plenty to tell clients apart and keeps the jwt small
+	return base64.RawURLEncoding.EncodeToString(sum[:16])
+}
+
+// ipNetwork the ip truncated to `vouch.fingerprint.ipv4Prefix` or `ipv6Prefix` bits
+func ipNetwork(addr string) string {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return addr
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(cfg.Cfg.Fingerprint.IPv4Prefix, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(cfg.Cfg.Fingerprint.IPv6Prefix, 128)).String()
+}
+
+// fingerprintMatches was the session minted for the client making this request
+// a session without a fingerprint, minted before `vouch.fingerprint` was configured, doesn't match
+func fingerprintMatches(r *http.Request, claims *jwtmanager.VouchClaims) bool {
+	fp, _ := claims.CustomClaims[structs.FingerprintClaim].(string)
+	if fp == "" || fp != clientFingerprint(r) {
+		log.Warnf("the session of %s is bound to a different client than %s", pii.Mask(claims.Username), clientip.FromRequest(r))
+		return false
+	}
+	return true
+}
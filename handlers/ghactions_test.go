@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+)
+
+func TestValidateRequestHandlerGitHubActions(t *testing.T) {
+	setUp()
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "gh1",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}}))
+	}))
+	defer ts.Close()
+
+	cfg.Cfg.GitHubActions.Enabled = true
+	cfg.Cfg.GitHubActions.JWKSURL = ts.URL
+	cfg.Cfg.GitHubActions.Audience = "https://vouch.domain1"
+	cfg.Cfg.GitHubActions.Repositories = []string{"octo-org/octo-repo"}
+	cfg.Cfg.MethodTeams = map[string][]string{"unsafe": {"org/writers"}}
+	defer func(sites []string) {
+		cfg.Cfg.GitHubActions.Enabled = false
+		cfg.Cfg.MethodTeams = nil
+		jwtmanager.Sites = sites
+	}(jwtmanager.Sites)
+	jwtmanager.Sites = []string{"domain1"}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":              cfg.Cfg.GitHubActions.Issuer,
+		"aud":              cfg.Cfg.GitHubActions.Audience,
+		"exp":              time.Now().Add(time.Minute).Unix(),
+		"sub":              "repo:octo-org/octo-repo:ref:refs/heads/main",
+		"repository":       "octo-org/octo-repo",
+		"job_workflow_ref": "octo-org/octo-repo/.github/workflows/deploy.yml@refs/heads/main",
+	})
+	token.Header["kid"] = "gh1"
+	bearer, err := token.SignedString(key)
+	assert.Nil(t, err)
+
+	validate := func(host string, method string) int {
+		r := httptest.NewRequest("GET", "http://"+host+"/validate", nil)
+		r.Header.Set("Authorization", "Bearer "+bearer)
+		r.Header.Set("X-Forwarded-Method", method)
+		w := httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, validate("app.domain1", "GET"))
+	// the job is no more allowed than a user, a host outside of the domains
+	assert.Equal(t, http.StatusUnauthorized, validate("app.otherdomain", "GET"))
+	// and a method of the methodTeams, as it has no teams
+	assert.Equal(t, http.StatusForbidden, validate("app.domain1", "POST"))
+}
@@ -0,0 +1,138 @@
+package github
+
+import (
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"golang.org/x/oauth2"
+
+	"github.com/vouch/vouch-proxy/handlers/common"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/httpclient"
+)
+
+const (
+	// appJWTLifetime GitHub refuses the jwt of an App which expires more than 10 minutes out
+	appJWTLifetime = 9 * time.Minute
+	// appClockSkew the jwt is dated back this far in case GitHub's clock is behind ours
+	appClockSkew = time.Minute
+	// installationTokenRenewal an installation token, good for an hour, is renewed this long before it expires
+	installationTokenRenewal = 5 * time.Minute
+)
+
+var (
+	// appKey signs the jwt of the App, loaded by ConfigureApp
+	appKey *rsa.PrivateKey
+
+	installationMu sync.Mutex
+	installation   struct {
+		token   string
+		expires time.Time
+	}
+)
+
+// ConfigureApp load the private key of `oauth.github.app`
+func ConfigureApp() error {
+	if cfg.GenOAuth == nil || !cfg.GitHubApp() {
+		return nil
+	}
+	key, err := common.SigningKey("RS256", cfg.GenOAuth.GitHub.App.PrivateKeyFile)
+	if err != nil {
+		return fmt.Errorf("oauth.github.app.private_key_file %s is not an RSA private key: %s", cfg.GenOAuth.GitHub.App.PrivateKeyFile, err)
+	}
+	appKey = key.(*rsa.PrivateKey)
+	installationMu.Lock()
+	installation.token = ""
+	installationMu.Unlock()
+	return nil
+}
+
+// membershipClient the client for the membership lookups, the user's own or one with the installation token of the App
+func membershipClient(client *http.Client) *http.Client {
+	if !cfg.GitHubApp() {
+		return client
+	}
+	return &http.Client{
+		Transport: &oauth2.Transport{Source: installationTokenSource{}, Base: httpclient.Transport()},
+		Timeout:   httpclient.Timeout(),
+	}
+}
+
+// installationTokenSource the token of the App's installation, shared by every login until it's due for renewal
+type installationTokenSource struct{}
+
+func (installationTokenSource) Token() (*oauth2.Token, error) {
+	installationMu.Lock()
+	defer installationMu.Unlock()
+	if installation.token == "" || time.Until(installation.expires) < installationTokenRenewal {
+		token, expires, err := fetchInstallationToken()
+		if err != nil {
+			return nil, err
+		}
+		installation.token, installation.expires = token, expires
+	}
+	return &oauth2.Token{AccessToken: installation.token, Expiry: installation.expires}, nil
+}
+
+// appJWT the jwt which authenticates as the App itself
+// https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app/generating-a-json-web-token-jwt-for-a-github-app
+func appJWT() (string, error) {
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.StandardClaims{
+		Issuer:    cfg.GenOAuth.GitHub.App.AppID,
+		IssuedAt:  now.Add(-appClockSkew).Unix(),
+		ExpiresAt: now.Add(appJWTLifetime).Unix(),
+	})
+	signed, err := token.SignedString(appKey)
+	if err != nil {
+		return "", fmt.Errorf("could not sign the jwt of the GitHub App: %s", err)
+	}
+	return signed, nil
+}
+
+// fetchInstallationToken exchange the jwt of the App for a token of its installation
+// https://docs.github.com/en/rest/apps/apps#create-an-installation-access-token-for-an-app
+func fetchInstallationToken() (token string, expires time.Time, rerr error) {
+	signed, err := appJWT()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	url := strings.NewReplacer(":installation_id", cfg.GenOAuth.GitHub.App.InstallationID).Replace(cfg.GenOAuth.InstallationTokenURL)
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+signed)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	resp, err := httpclient.Client().Do(req)
+	if err != nil {
+		log.Error(err)
+		return "", time.Time{}, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			rerr = err
+		}
+	}()
+	if resp.StatusCode != http.StatusCreated {
+		body, _ := ioutil.ReadAll(resp.Body)
+		log.Errorf("fetchInstallationToken: unexpected status code %d: %s", resp.StatusCode, body)
+		return "", time.Time{}, fmt.Errorf("could not get a token for installation %s of the GitHub App: %s", cfg.GenOAuth.GitHub.App.InstallationID, resp.Status)
+	}
+	it := struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&it); err != nil {
+		return "", time.Time{}, err
+	}
+	log.Debugf("got a token for installation %s of the GitHub App, good until %s", cfg.GenOAuth.GitHub.App.InstallationID, it.ExpiresAt)
+	return it.Token, it.ExpiresAt, nil
+}
@@ -0,0 +1,125 @@
+package github
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func TestTeamMembershipsGitHubApp(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	keyFile, err := ioutil.TempFile("", "github-app")
+	assert.Nil(t, err)
+	defer os.Remove(keyFile.Name())
+	assert.Nil(t, pem.Encode(keyFile, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	keyFile.Close()
+
+	expiresIn := time.Hour
+	mints := 0
+	authorizations := map[string]string{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/app/installations/7654321/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		mints++
+		assert.Equal(t, http.MethodPost, r.Method)
+		// the jwt of the App, signed with its key
+		claims := jwt.StandardClaims{}
+		_, err := jwt.ParseWithClaims(r.Header.Get("Authorization")[len("Bearer "):], &claims, func(token *jwt.Token) (interface{}, error) {
+			assert.Equal(t, jwt.SigningMethodRS256, token.Method)
+			return &key.PublicKey, nil
+		})
+		assert.Nil(t, err)
+		assert.Equal(t, "123456", claims.Issuer)
+		assert.True(t, claims.ExpiresAt <= time.Now().Add(10*time.Minute).Unix())
+		w.WriteHeader(http.StatusCreated)
+		assert.Nil(t, json.NewEncoder(w).Encode(map[string]interface{}{"token": "ghs_installation", "expires_at": time.Now().Add(expiresIn)}))
+	})
+	mux.HandleFunc("/orgs/myorg/teams/myteam/memberships/testuser", func(w http.ResponseWriter, r *http.Request) {
+		authorizations[r.URL.Path] = r.Header.Get("Authorization")
+		w.Write([]byte(`{"state": "active"}`))
+	})
+	mux.HandleFunc("/orgs/otherorg/members/testuser", func(w http.ResponseWriter, r *http.Request) {
+		authorizations[r.URL.Path] = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/user/teams", func(w http.ResponseWriter, r *http.Request) {
+		authorizations[r.URL.Path] = r.Header.Get("Authorization")
+		w.Write([]byte(`[{"slug": "platform-api", "organization": {"login": "myorg"}}]`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	useAPIBaseURL(ts.URL)
+	defer func() {
+		cfg.GenOAuth.GitHub.App.AppID, cfg.GenOAuth.GitHub.App.InstallationID, cfg.GenOAuth.GitHub.App.PrivateKeyFile = "", "", ""
+		cfg.Cfg.TeamWhiteListRegex = nil
+		assert.Nil(t, cfg.CompileWhiteListRegex())
+		useAPIBaseURL("")
+	}()
+	cfg.GenOAuth.GitHub.App.AppID = "123456"
+	cfg.GenOAuth.GitHub.App.InstallationID = "7654321"
+	cfg.GenOAuth.GitHub.App.PrivateKeyFile = keyFile.Name()
+	assert.Nil(t, ConfigureApp())
+	cfg.Cfg.TeamWhiteList = []string{"myorg/myteam", "otherorg"}
+	cfg.Cfg.TeamWhiteListRegex = []string{"myorg/platform-.*"}
+	assert.Nil(t, cfg.CompileWhiteListRegex())
+
+	userToken := &oauth2.Token{AccessToken: "user-token"}
+	userClient := (&oauth2.Config{}).Client(context.Background(), userToken)
+
+	assert.Nil(t, teamMemberships(userClient, user, userToken))
+	assert.Equal(t, []string{"myorg/myteam", "otherorg", "myorg/platform-api"}, user.TeamMemberships)
+	// the memberships are the App's to look up, the user's own teams are theirs
+	assert.Equal(t, "Bearer ghs_installation", authorizations["/orgs/myorg/teams/myteam/memberships/testuser"])
+	assert.Equal(t, "Bearer ghs_installation", authorizations["/orgs/otherorg/members/testuser"])
+	assert.Equal(t, "Bearer user-token", authorizations["/user/teams"])
+	assert.Equal(t, 1, mints)
+
+	// the installation token is kept for the next login
+	user.TeamMemberships = nil
+	assert.Nil(t, teamMemberships(userClient, user, userToken))
+	assert.Equal(t, 1, mints)
+
+	// and renewed once it's about to expire
+	installation.expires = time.Now().Add(time.Minute)
+	user.TeamMemberships = nil
+	assert.Nil(t, teamMemberships(userClient, user, userToken))
+	assert.Equal(t, 2, mints)
+}
+
+func TestTeamMembershipsGitHubAppRefused(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message": "A JSON web token could not be decoded"}`, http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	useAPIBaseURL(ts.URL)
+	defer func() {
+		cfg.GenOAuth.GitHub.App.AppID = ""
+		appKey = nil
+		useAPIBaseURL("")
+	}()
+	cfg.GenOAuth.GitHub.App.AppID = "123456"
+	cfg.GenOAuth.GitHub.App.InstallationID = "7654321"
+	appKey = key
+	installation.token = ""
+	cfg.Cfg.TeamWhiteList = []string{"myorg"}
+
+	assert.NotNil(t, teamMemberships(client, user, token))
+	assert.Empty(t, user.TeamMemberships)
+}
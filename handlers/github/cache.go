@@ -0,0 +1,67 @@
+package github
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// membershipCacheMax the most memberships kept at once, once full a lookup is no longer kept until some expire
+const membershipCacheMax = 10000
+
+// membershipCache the memberships looked up within `vouch.membershipCacheTTL`
+type membershipCache struct {
+	mu      sync.Mutex
+	entries map[membershipKey]cachedMembership
+}
+
+// membershipKey the team is empty for the membership of the org itself
+type membershipKey struct {
+	username, org, team string
+}
+
+type cachedMembership struct {
+	isMember bool
+	expires  time.Time
+}
+
+var memberships = &membershipCache{entries: map[membershipKey]cachedMembership{}}
+
+// withMembershipCache the kept membership of key, or else that of lookup, which is kept unless it failed
+// GitHub logins, orgs and team slugs are case insensitive, and so is the key
+func withMembershipCache(key membershipKey, lookup func() (error, bool)) (error, bool) {
+	if cfg.Cfg.MembershipCacheTTL <= 0 {
+		return lookup()
+	}
+	key = membershipKey{strings.ToLower(key.username), strings.ToLower(key.org), strings.ToLower(key.team)}
+	memberships.mu.Lock()
+	c, ok := memberships.entries[key]
+	memberships.mu.Unlock()
+	if ok && time.Now().Before(c.expires) {
+		return nil, c.isMember
+	}
+
+	err, isMember := lookup()
+	if err != nil {
+		return err, false
+	}
+	now := time.Now()
+	memberships.mu.Lock()
+	defer memberships.mu.Unlock()
+	if len(memberships.entries) >= membershipCacheMax {
+		for k, c := range memberships.entries {
+			if !now.Before(c.expires) {
+				delete(memberships.entries, k)
+			}
+		}
+	}
+	if len(memberships.entries) < membershipCacheMax {
+		memberships.entries[key] = cachedMembership{
+			isMember: isMember,
+			expires:  now.Add(time.Duration(cfg.Cfg.MembershipCacheTTL) * time.Second),
+		}
+	}
+	return nil, isMember
+}
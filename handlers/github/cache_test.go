@@ -0,0 +1,88 @@
+package github
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func TestMembershipCache(t *testing.T) {
+	setUp()
+	defer func() {
+		cfg.Cfg.MembershipCacheTTL = 0
+		memberships.entries = map[membershipKey]cachedMembership{}
+	}()
+	mockResponse(regexMatcher(".*teams/team1.*"), http.StatusOK, map[string]string{}, []byte("{\"state\": \"active\"}"))
+	mockResponse(regexMatcher(".*orgs/myorg/members.*"), http.StatusNotFound, map[string]string{}, []byte(""))
+
+	// disabled
+	getTeamMembershipStateFromGitHub(client, user, "org1", "team1", token)
+	getTeamMembershipStateFromGitHub(client, user, "org1", "team1", token)
+	assert.Equal(t, 2, len(requests))
+	assert.Empty(t, memberships.entries)
+
+	cfg.Cfg.MembershipCacheTTL = 60
+	requests = make([]string, 0)
+	for i := 0; i < 2; i++ {
+		err, isMember := getTeamMembershipStateFromGitHub(client, user, "org1", "team1", token)
+		assert.Nil(t, err)
+		assert.True(t, isMember)
+		err, isMember = getOrgMembershipStateFromGitHub(client, user, "myorg", token)
+		assert.Nil(t, err)
+		assert.False(t, isMember)
+	}
+	assert.Equal(t, []string{
+		"https://api.github.com/orgs/org1/teams/team1/memberships/testuser",
+		"https://api.github.com/orgs/myorg/members/testuser",
+	}, requests)
+
+	// the same membership however it is spelled, but not that of another user
+	getTeamMembershipStateFromGitHub(client, user, "Org1", "Team1", token)
+	assert.Equal(t, 2, len(requests))
+	getTeamMembershipStateFromGitHub(client, &structs.User{Username: "otheruser"}, "org1", "team1", token)
+	assert.Equal(t, 3, len(requests))
+}
+
+func TestMembershipCacheExpiry(t *testing.T) {
+	setUp()
+	cfg.Cfg.MembershipCacheTTL = 60
+	defer func() {
+		cfg.Cfg.MembershipCacheTTL = 0
+		memberships.entries = map[membershipKey]cachedMembership{}
+	}()
+	mockResponse(regexMatcher(".*teams/team1.*"), http.StatusOK, map[string]string{}, []byte("{\"state\": \"active\"}"))
+
+	getTeamMembershipStateFromGitHub(client, user, "org1", "team1", token)
+	for k, c := range memberships.entries {
+		c.expires = time.Now().Add(-time.Second)
+		memberships.entries[k] = c
+	}
+	err, isMember := getTeamMembershipStateFromGitHub(client, user, "org1", "team1", token)
+	assert.Nil(t, err)
+	assert.True(t, isMember)
+	assert.Equal(t, 2, len(requests))
+}
+
+func TestMembershipCacheFailure(t *testing.T) {
+	setUp()
+	cfg.Cfg.MembershipCacheTTL = 60
+	defer func() {
+		cfg.Cfg.MembershipCacheTTL = 0
+		memberships.entries = map[membershipKey]cachedMembership{}
+	}()
+	// one request for each lookup, which is not retried
+	cfg.GenOAuth.HTTPClient.Retries = 0
+	mockResponse(regexMatcher(".*"), http.StatusInternalServerError, map[string]string{}, []byte(""))
+
+	for i := 0; i < 2; i++ {
+		err, _ := getTeamMembershipStateFromGitHub(client, user, "org1", "team1", token)
+		assert.NotNil(t, err)
+	}
+	assert.Equal(t, 2, len(requests))
+	assert.Empty(t, memberships.entries)
+}
@@ -1,15 +1,20 @@
 package github
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"github.com/vouch/vouch-proxy/handlers/common"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/httpclient"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
+	"github.com/vouch/vouch-proxy/pkg/pii"
 	"github.com/vouch/vouch-proxy/pkg/structs"
 	"golang.org/x/oauth2"
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 )
 
 type Handler struct {
@@ -28,8 +33,8 @@ func (me Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims
 		// http.Error(w, err.Error(), http.StatusBadRequest)
 		return err
 	}
-	log.Errorf("ptoken.AccessToken: %s", ptoken.AccessToken)
-	userinfo, err := client.Get(cfg.GenOAuth.UserInfoURL + ptoken.AccessToken)
+	// the client sends the access token in the Authorization header, GitHub no longer takes it in the query
+	userinfo, err := common.GetWithRetry(client, cfg.GenOAuth.UserInfoURL)
 	if err != nil {
 		// http.Error(w, err.Error(), http.StatusBadRequest)
 		return err
@@ -39,8 +44,14 @@ func (me Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims
 			rerr = err
 		}
 	}()
+	if err = checkScopesHeader(userinfo, ptoken); err != nil {
+		return err
+	}
 	data, _ := ioutil.ReadAll(userinfo.Body)
-	log.Infof("github userinfo body: %s", string(data))
+	log.Infof("github userinfo body: %s", pii.Dump(string(data)))
+	if err = common.CheckUserInfoError(data); err != nil {
+		return err
+	}
 	if err = common.MapClaims(data, customClaims); err != nil {
 		log.Error(err)
 		return err
@@ -51,18 +62,54 @@ func (me Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims
 		return err
 	}
 	log.Debug("getUserInfoFromGitHub ghUser")
-	log.Debug(ghUser)
+	log.Debug(pii.Dump(ghUser))
 	log.Debug("getUserInfoFromGitHub user")
-	log.Debug(user)
+	log.Debug(pii.Dump(user))
 
 	ghUser.PrepareUserData()
 	user.Email = ghUser.Email
 	user.Name = ghUser.Name
+	if err = common.MapName(data, user); err != nil {
+		return err
+	}
 	user.Username = ghUser.Username
 	user.ID = ghUser.ID
+	user.Picture = ghUser.Picture
 
-	// user = &ghUser.User
+	if cfg.GenOAuth.GitHub.SecondaryEmails {
+		if err := getVerifiedEmailsFromGitHub(client, user); err != nil {
+			return err
+		}
+	}
+	if len(cfg.GenOAuth.EmailSources) > 0 {
+		profileEmail := ghUser.Email
+		common.ResolveEmail(user, map[string]common.EmailSource{
+			common.EmailSourceUserInfo: func() (string, bool, error) {
+				// only a verified address can be made the public email of the profile
+				return profileEmail, true, nil
+			},
+			common.EmailSourceAPI: func() (string, bool, error) {
+				return primaryEmailFromGitHub(client)
+			},
+		})
+	}
 
+	if err := teamMemberships(client, user, ptoken); err != nil {
+		return err
+	}
+
+	log.Debug("getUserInfoFromGitHub")
+	log.Debug(pii.Dump(user))
+	return nil
+}
+
+// Probe the login depends on the API for the user and the teams more than on the pages of github.com
+func (Handler) Probe(client *http.Client) error {
+	return common.Probe(client, cfg.GenOAuth.GitHub.APIBaseURL)
+}
+
+// teamMemberships add the vouch.teamWhitelist entries the user is a member of to user.TeamMemberships
+func teamMemberships(client *http.Client, user *structs.User, ptoken *oauth2.Token) error {
 	toOrgAndTeam := func(orgAndTeam string) (string, string) {
 		split := strings.Split(orgAndTeam, "/")
 		if len(split) == 1 {
@@ -76,18 +123,39 @@ func (me Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims
 	}
 
 	if len(cfg.Cfg.TeamWhiteList) != 0 {
+		mclient := membershipClient(client)
+		// with max_team_checks set the whitelist is checked in order until enough match or the limit
+		maxChecks := cfg.GenOAuth.GitHub.MaxTeamChecks
+		checked, before := 0, len(user.TeamMemberships)
 		for _, orgAndTeam := range cfg.Cfg.TeamWhiteList {
-			org, team := toOrgAndTeam(orgAndTeam)
+			if maxChecks > 0 && len(user.TeamMemberships) >= MinTeamMatches() {
+				break
+			}
+			if maxChecks > 0 && checked >= maxChecks {
+				log.Warnf("checked %d of %d teams for %s, %d matched, limited by oauth.github.max_team_checks", checked, len(cfg.Cfg.TeamWhiteList), pii.Mask(user.Username), len(user.TeamMemberships)-before)
+				break
+			}
+			checked++
+			lookup := orgAndTeam
+			if cfg.GenOAuth.GitHub.NormalizeTeams {
+				lookup = NormalizeTeam(orgAndTeam)
+			}
+			org, team := toOrgAndTeam(lookup)
 			if org != "" {
 				log.Info(org)
 				var (
 					e        error
 					isMember bool
 				)
-				if team != "" {
-					e, isMember = getTeamMembershipStateFromGitHub(client, user, org, team, ptoken)
+				if cfg.GenOAuth.GitHub.TeamsByID && isTeamID(team) {
+					e, isMember = getTeamMembershipByIDFromGitHub(mclient, user, team)
+				} else if team != "" {
+					e, isMember = getTeamMembershipStateFromGitHub(mclient, user, org, team, ptoken)
+					if e == nil && !isMember && cfg.Cfg.TeamWhiteListIncludeChildTeams {
+						e, isMember = getChildTeamMembershipFromGitHub(mclient, user, org, team, ptoken)
+					}
 				} else {
-					e, isMember = getOrgMembershipStateFromGitHub(client, user, org, ptoken)
+					e, isMember = getOrgMembershipStateFromGitHub(mclient, user, org, ptoken)
 				}
 				if e != nil {
 					return e
@@ -101,25 +169,194 @@ func (me Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims
 			}
 		}
 	}
+	if len(cfg.TeamWhiteListRegex()) != 0 {
+		teams, err := fetchUserTeamsFromGitHub(client)
+		if err != nil {
+			return err
+		}
+		for _, team := range teams {
+			if cfg.GenOAuth.GitHub.NormalizeTeams {
+				team = NormalizeTeam(team)
+			}
+			if cfg.MatchesAny(cfg.TeamWhiteListRegex(), team) && !containsString(user.TeamMemberships, team) {
+				user.TeamMemberships = append(user.TeamMemberships, team)
+			}
+		}
+	}
 
-	log.Debug("getUserInfoFromGitHub")
-	log.Debug(user)
 	return nil
 }
 
+// fetchUserTeamsFromGitHub the `org/team` of each of the teams of the user, for the vouch.teamWhitelistRegex
+// https://docs.github.com/en/rest/teams/teams#list-teams-for-the-authenticated-user
+func fetchUserTeamsFromGitHub(client *http.Client) (teams []string, rerr error) {
+	defer metrics.ObserveProviderCall("user_teams", time.Now())
+	resp, err := common.GetWithRetry(client, cfg.GenOAuth.UserTeamsURL)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			rerr = err
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		log.Errorf("fetchUserTeamsFromGitHub: unexpected status code %d", resp.StatusCode)
+		return nil, errors.New("Unexpected response status " + resp.Status)
+	}
+	ghTeams := []structs.GitHubTeam{}
+	if err := json.NewDecoder(resp.Body).Decode(&ghTeams); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	for _, t := range ghTeams {
+		teams = append(teams, t.Organization.Login+"/"+t.Slug)
+	}
+	return teams, nil
+}
+
+// MinTeamMatches how many of the vouch.teamWhitelist the user must be a member of
+func MinTeamMatches() int {
+	if cfg.Cfg.TeamWhiteListMinMatches > 1 {
+		return cfg.Cfg.TeamWhiteListMinMatches
+	}
+	return 1
+}
+
+// Memberships look up the user's current memberships of the vouch.teamWhitelist with the access token of their login
+func Memberships(username string, accessToken string) ([]string, error) {
+	ptoken := &oauth2.Token{AccessToken: accessToken}
+	client := cfg.OAuthClient.Client(httpclient.Context(context.TODO()), ptoken)
+	client.Timeout = httpclient.Timeout()
+	user := &structs.User{Username: username}
+	if err := teamMemberships(client, user, ptoken); err != nil {
+		return nil, err
+	}
+	return user.TeamMemberships, nil
+}
+
+// NormalizeTeam lower case the org and turn the team into its slug, so that `MyOrg/My Team` is `myorg/my-team`
+// GitHub logins and team slugs are case insensitive
+func NormalizeTeam(orgAndTeam string) string {
+	split := strings.SplitN(orgAndTeam, "/", 2)
+	org := strings.ToLower(strings.TrimSpace(split[0]))
+	if len(split) == 1 {
+		return org
+	}
+	return org + "/" + teamSlug(split[1])
+}
+
+// teamSlug as GitHub derives it from the team name, anything but letters, digits, `-` and `_` becomes a `-`
+func teamSlug(team string) string {
+	var b strings.Builder
+	dash := false
+	for _, c := range strings.ToLower(strings.TrimSpace(team)) {
+		if ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_' {
+			b.WriteRune(c)
+			dash = false
+		} else if !dash {
+			b.WriteRune('-')
+			dash = true
+		}
+	}
+	return strings.Trim(b.String(), "-")
+}
+
+// getVerifiedEmailsFromGitHub requires the user:email scope
+// https://developer.github.com/v3/users/emails/#list-email-addresses-for-a-user
+func getVerifiedEmailsFromGitHub(client *http.Client, user *structs.User) error {
+	ghEmails, err := fetchEmailsFromGitHub(client)
+	if err != nil {
+		return err
+	}
+	for _, e := range ghEmails {
+		if !e.Verified {
+			continue
+		}
+		user.Emails = append(user.Emails, e.Email)
+		if e.Primary && user.Email == "" {
+			// the primary email is only in the profile if it is public
+			user.Email = e.Email
+		}
+	}
+	log.Debugf("getVerifiedEmailsFromGitHub %s has verified emails %s", pii.Mask(user.Username), pii.MaskAll(user.Emails))
+	return nil
+}
+
+// primaryEmailFromGitHub the user's primary email, the `api` of oauth.email_sources
+func primaryEmailFromGitHub(client *http.Client) (string, bool, error) {
+	ghEmails, err := fetchEmailsFromGitHub(client)
+	if err != nil {
+		return "", false, err
+	}
+	for _, e := range ghEmails {
+		if e.Primary {
+			return e.Email, e.Verified, nil
+		}
+	}
+	return "", false, nil
+}
+
+func fetchEmailsFromGitHub(client *http.Client) (ghEmails []structs.GitHubEmail, rerr error) {
+	defer metrics.ObserveProviderCall("emails", time.Now())
+	emailsResp, err := common.GetWithRetry(client, cfg.GenOAuth.UserEmailsURL)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer func() {
+		if err := emailsResp.Body.Close(); err != nil {
+			rerr = err
+		}
+	}()
+	if emailsResp.StatusCode != 200 {
+		log.Errorf("getVerifiedEmailsFromGitHub: unexpected status code %d", emailsResp.StatusCode)
+		return nil, errors.New("Unexpected response status " + emailsResp.Status)
+	}
+	data, _ := ioutil.ReadAll(emailsResp.Body)
+	ghEmails = []structs.GitHubEmail{}
+	if err = json.Unmarshal(data, &ghEmails); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return ghEmails, nil
+}
+
 func getOrgMembershipStateFromGitHub(client *http.Client, user *structs.User, orgId string, ptoken *oauth2.Token) (rerr error, isMember bool) {
+	return withMembershipCache(membershipKey{user.Username, orgId, ""}, func() (error, bool) {
+		return fetchOrgMembershipFromGitHub(client, user, orgId, ptoken)
+	})
+}
+
+func fetchOrgMembershipFromGitHub(client *http.Client, user *structs.User, orgId string, ptoken *oauth2.Token) (rerr error, isMember bool) {
+	defer metrics.ObserveProviderCall("org_membership", time.Now())
+	// the user's own membership is theirs alone to see, not the App's
+	if cfg.GenOAuth.GitHub.OwnOrgMembership && !cfg.GitHubApp() {
+		if isMember, known := getOwnOrgMembershipFromGitHub(client, user, orgId); known {
+			return nil, isMember
+		}
+	}
 	replacements := strings.NewReplacer(":org_id", orgId, ":username", user.Username)
-	orgMembershipResp, err := client.Get(replacements.Replace(cfg.GenOAuth.UserOrgURL) + ptoken.AccessToken)
+	orgMembershipResp, err := common.GetWithRetry(client, replacements.Replace(cfg.GenOAuth.UserOrgURL))
 	if err != nil {
 		log.Error(err)
 		return err, false
 	}
 
+	// GitHub redirects to public_members when the token can't see the private members of the org
+	// the client usually follows the redirect itself
+	publicOnly := orgMembershipResp.Request != nil && strings.Contains(orgMembershipResp.Request.URL.Path, "/public_members/")
 	if orgMembershipResp.StatusCode == 302 {
 		log.Debug("Need to check public membership")
+		publicOnly = true
 		location := orgMembershipResp.Header.Get("Location")
 		if location != "" {
-			orgMembershipResp, err = client.Get(location)
+			orgMembershipResp, err = common.GetWithRetry(client, location)
+			if err != nil {
+				log.Error(err)
+				return err, false
+			}
 		}
 	}
 
@@ -127,6 +364,11 @@ func getOrgMembershipStateFromGitHub(client *http.Client, user *structs.User, or
 		log.Debug("getOrgMembershipStateFromGitHub isMember: true")
 		return nil, true
 	} else if orgMembershipResp.StatusCode == 404 {
+		if publicOnly {
+			if err := privateMembershipHidden(orgMembershipResp, orgId); err != nil {
+				return err, false
+			}
+		}
 		log.Debug("getOrgMembershipStateFromGitHub isMember: false")
 		return nil, false
 	} else {
@@ -135,9 +377,188 @@ func getOrgMembershipStateFromGitHub(client *http.Client, user *structs.User, or
 	}
 }
 
+// getOwnOrgMembershipFromGitHub the state and role of the user's membership of the org, as the user's own token sees it
+// known is false when GitHub doesn't tell, for an org which restricts OAuth app access, and the members check is used instead
+// https://docs.github.com/en/rest/orgs/members#get-an-organization-membership-for-the-authenticated-user
+func getOwnOrgMembershipFromGitHub(client *http.Client, user *structs.User, orgId string) (isMember bool, known bool) {
+	membershipResp, err := common.GetWithRetry(client, strings.NewReplacer(":org_id", orgId).Replace(cfg.GenOAuth.UserOrgMembershipURL))
+	if err != nil {
+		log.Warnf("getOwnOrgMembershipFromGitHub %s, falling back to the members check: %s", orgId, err)
+		return false, false
+	}
+	defer membershipResp.Body.Close()
+	switch membershipResp.StatusCode {
+	case 200:
+		data, _ := ioutil.ReadAll(membershipResp.Body)
+		membership := struct {
+			State string `json:"state"`
+			Role  string `json:"role"`
+		}{}
+		if err = json.Unmarshal(data, &membership); err != nil {
+			log.Warnf("getOwnOrgMembershipFromGitHub %s, falling back to the members check: %s", orgId, err)
+			return false, false
+		}
+		log.Debugf("getOwnOrgMembershipFromGitHub %s is a %s member of %s with role %s", pii.Mask(user.Username), membership.State, orgId, membership.Role)
+		if membership.State == "pending" {
+			return cfg.GenOAuth.GitHub.AcceptPendingMembership, true
+		}
+		return membership.State == "active", true
+	case 404:
+		log.Debug("getOwnOrgMembershipFromGitHub isMember: false")
+		return false, true
+	default:
+		log.Warnf("getOwnOrgMembershipFromGitHub %s: unexpected status code %d, falling back to the members check", orgId, membershipResp.StatusCode)
+		return false, false
+	}
+}
+
+// ErrMissingReadOrg the user's token can't see their private membership of an org in the teamWhitelist
+var ErrMissingReadOrg = errors.New("the GitHub authorization lacks the read:org scope, a private organization membership can't be seen")
+
+// privateMembershipHidden whether the user, not a public member of the org, may still be a private member whom
+// the token isn't allowed to see. That's ErrMissingReadOrg rather than "not a member" when the token lacks read:org.
+func privateMembershipHidden(resp *http.Response, orgId string) error {
+	header, ok := resp.Header["X-Oauth-Scopes"]
+	if !ok {
+		// not GitHub's api, or it didn't say
+		return nil
+	}
+	scopes := []string{}
+	for _, s := range strings.Split(strings.Join(header, ","), ",") {
+		scopes = append(scopes, strings.TrimSpace(s))
+	}
+	if !cfg.GitHubScopeGranted("read:org", scopes) {
+		log.Warnf("cannot see the private members of %s, the token has the scopes %s. Add read:org to oauth.scopes", orgId, scopes)
+		return ErrMissingReadOrg
+	}
+	log.Warnf("cannot see the private members of %s although the token has read:org, the organization may restrict access by OAuth apps", orgId)
+	return nil
+}
+
+// checkScopesHeader check oauth.required_scopes against the X-OAuth-Scopes of the userinfo response
+// when the token response didn't list the scopes, otherwise common.PrepareTokensAndClient has done so
+func checkScopesHeader(resp *http.Response, ptoken *oauth2.Token) error {
+	if common.GrantedScopes(ptoken) != nil {
+		return nil
+	}
+	header, ok := resp.Header["X-Oauth-Scopes"]
+	if !ok {
+		return nil
+	}
+	return common.CheckScopes(common.SplitScopes(strings.Join(header, ",")))
+}
+
 func getTeamMembershipStateFromGitHub(client *http.Client, user *structs.User, orgId string, team string, ptoken *oauth2.Token) (rerr error, isMember bool) {
 	replacements := strings.NewReplacer(":org_id", orgId, ":team_slug", team, ":username", user.Username)
-	membershipStateResp, err := client.Get(replacements.Replace(cfg.GenOAuth.UserTeamURL) + ptoken.AccessToken)
+	return withMembershipCache(membershipKey{user.Username, orgId, team}, func() (error, bool) {
+		return getTeamMembership(client, user, replacements.Replace(cfg.GenOAuth.UserTeamURL), orgId+"/"+team)
+	})
+}
+
+// maxChildTeamDepth how many levels of child teams below a teamWhitelist team are looked through
+const maxChildTeamDepth = 5
+
+// getChildTeamMembershipFromGitHub is the user a member of any of the teams nested below the team, level by level
+// each team is looked up once, a hierarchy which loops back on itself is not followed round again
+func getChildTeamMembershipFromGitHub(client *http.Client, user *structs.User, orgId string, team string, ptoken *oauth2.Token) (rerr error, isMember bool) {
+	seen := map[string]bool{team: true}
+	parents := []string{team}
+	for depth := 1; depth <= maxChildTeamDepth && len(parents) > 0; depth++ {
+		children := []string{}
+		for _, parent := range parents {
+			slugs, err := fetchChildTeamsFromGitHub(client, orgId, parent)
+			if err != nil {
+				return err, false
+			}
+			for _, slug := range slugs {
+				if seen[slug] {
+					continue
+				}
+				seen[slug] = true
+				if err, isMember := getTeamMembershipStateFromGitHub(client, user, orgId, slug, ptoken); err != nil || isMember {
+					if isMember {
+						log.Debugf("%s is a member of %s/%s through its child team %s", pii.Mask(user.Username), orgId, team, slug)
+					}
+					return err, isMember
+				}
+				children = append(children, slug)
+			}
+		}
+		parents = children
+	}
+	if len(parents) > 0 {
+		log.Warnf("stopped looking through the child teams of %s/%s %d levels down", orgId, team, maxChildTeamDepth)
+	}
+	return nil, false
+}
+
+// fetchChildTeamsFromGitHub the slugs of the teams nested directly below the team, none if the team can't be seen
+// https://docs.github.com/en/rest/teams/teams#list-child-teams
+func fetchChildTeamsFromGitHub(client *http.Client, orgId string, team string) (slugs []string, rerr error) {
+	defer metrics.ObserveProviderCall("child_teams", time.Now())
+	replacements := strings.NewReplacer(":org_id", orgId, ":team_slug", team)
+	resp, err := common.GetWithRetry(client, replacements.Replace(cfg.GenOAuth.ChildTeamsURL))
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			rerr = err
+		}
+	}()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		log.Errorf("fetchChildTeamsFromGitHub: unexpected status code %d", resp.StatusCode)
+		return nil, errors.New("Unexpected response status " + resp.Status)
+	}
+	teams := []structs.GitHubTeam{}
+	if err := json.NewDecoder(resp.Body).Decode(&teams); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	for _, t := range teams {
+		slugs = append(slugs, t.Slug)
+	}
+	return slugs, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// getTeamMembershipByIDFromGitHub the user's membership of the team with the numeric id, see oauth.github.teams_by_id
+// https://docs.github.com/en/rest/teams/members#get-team-membership-for-a-user-legacy
+func getTeamMembershipByIDFromGitHub(client *http.Client, user *structs.User, teamID string) (rerr error, isMember bool) {
+	replacements := strings.NewReplacer(":team_id", teamID, ":username", user.Username)
+	// a team id is never the slug of a team of an org, which needs the org with it
+	return withMembershipCache(membershipKey{user.Username, "", teamID}, func() (error, bool) {
+		return getTeamMembership(client, user, replacements.Replace(cfg.GenOAuth.UserTeamByIDURL), "team "+teamID)
+	})
+}
+
+// isTeamID is the team of a teamWhitelist entry its numeric id rather than its slug
+func isTeamID(team string) bool {
+	if team == "" {
+		return false
+	}
+	for _, c := range team {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func getTeamMembership(client *http.Client, user *structs.User, membershipURL string, team string) (rerr error, isMember bool) {
+	defer metrics.ObserveProviderCall("team_membership", time.Now())
+	membershipStateResp, err := common.GetWithRetry(client, membershipURL)
 	if err != nil {
 		log.Error(err)
 		return err, false
@@ -149,7 +570,7 @@ func getTeamMembershipStateFromGitHub(client *http.Client, user *structs.User, o
 	}()
 	if membershipStateResp.StatusCode == 200 {
 		data, _ := ioutil.ReadAll(membershipStateResp.Body)
-		log.Infof("github team membership body: ", string(data))
+		log.Infof("github team membership body: %s", pii.Dump(string(data)))
 		ghTeamState := structs.GitHubTeamMembershipState{}
 		if err = json.Unmarshal(data, &ghTeamState); err != nil {
 			log.Error(err)
@@ -157,6 +578,10 @@ func getTeamMembershipStateFromGitHub(client *http.Client, user *structs.User, o
 		}
 		log.Debug("getTeamMembershipStateFromGitHub ghTeamState")
 		log.Debug(ghTeamState)
+		if ghTeamState.State == "pending" && cfg.GenOAuth.GitHub.AcceptPendingMembership {
+			log.Debugf("getTeamMembershipStateFromGitHub accepting pending membership of %s in %s", pii.Mask(user.Username), team)
+			return nil, true
+		}
 		return nil, ghTeamState.State == "active"
 	} else if membershipStateResp.StatusCode == 404 {
 		log.Debug("getTeamMembershipStateFromGitHub isMember: false")
@@ -1,12 +1,19 @@
 package github
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	mockhttp "github.com/karupanerura/go-mock-http-response"
 	"github.com/stretchr/testify/assert"
+	"github.com/vouch/vouch-proxy/handlers/common"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
 	"github.com/vouch/vouch-proxy/pkg/domains"
 	"github.com/vouch/vouch-proxy/pkg/structs"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 	"golang.org/x/oauth2"
 	"net/http"
 	"regexp"
@@ -31,6 +38,7 @@ func (c *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	for _, p := range mockedResponses {
 		if p.matcher(req) {
 			requests = append(requests, req.URL.String())
+			authorizations = append(authorizations, req.Header.Get("Authorization"))
 			return p.response.MakeResponse(req), nil
 		}
 	}
@@ -70,7 +78,9 @@ var (
 	token           = &oauth2.Token{AccessToken: "123"}
 	mockedResponses = []FunResponsePair{}
 	requests        []string
-	client          = &http.Client{Transport: &Transport{}}
+	authorizations  []string
+	// the token is added by the oauth2 transport, as it is for the client of PrepareTokensAndClient
+	client = (&oauth2.Config{}).Client(context.WithValue(context.Background(), oauth2.HTTPClient, &http.Client{Transport: &Transport{}}), token)
 )
 
 func init() {
@@ -89,6 +99,7 @@ func setUp() {
 
 	mockedResponses = []FunResponsePair{}
 	requests = make([]string, 0)
+	authorizations = make([]string, 0)
 
 	user = &structs.User{Username: "testuser", Email: "test@example.com"}
 }
@@ -113,6 +124,24 @@ func TestGetTeamMembershipStateFromGitHubInactive(t *testing.T) {
 	assert.False(t, isMember)
 }
 
+func TestGetTeamMembershipStateFromGitHubPending(t *testing.T) {
+	setUp()
+	mockResponse(regexMatcher(".*"), http.StatusOK, map[string]string{}, []byte("{\"state\": \"pending\"}"))
+
+	err, isMember := getTeamMembershipStateFromGitHub(client, user, "org1", "team1", token)
+
+	assert.Nil(t, err)
+	assert.False(t, isMember)
+
+	cfg.GenOAuth.GitHub.AcceptPendingMembership = true
+	defer func() { cfg.GenOAuth.GitHub.AcceptPendingMembership = false }()
+
+	err, isMember = getTeamMembershipStateFromGitHub(client, user, "org1", "team1", token)
+
+	assert.Nil(t, err)
+	assert.True(t, isMember)
+}
+
 func TestGetTeamMembershipStateFromGitHubNotAMember(t *testing.T) {
 	setUp()
 	mockResponse(regexMatcher(".*"), http.StatusNotFound, map[string]string{}, []byte(""))
@@ -123,6 +152,59 @@ func TestGetTeamMembershipStateFromGitHubNotAMember(t *testing.T) {
 	assert.False(t, isMember)
 }
 
+func TestGetTeamMembershipStateFromGitHubRetried(t *testing.T) {
+	setUp()
+	// GitHub fails the first lookup, and asks for no wait before the next
+	failures := 1
+	mockResponse(func(r *http.Request) bool {
+		failures--
+		return failures >= 0
+	}, http.StatusBadGateway, map[string]string{"Retry-After": "0"}, []byte(""))
+	mockResponse(regexMatcher(".*"), http.StatusOK, map[string]string{}, []byte("{\"state\": \"active\"}"))
+
+	err, isMember := getTeamMembershipStateFromGitHub(client, user, "org1", "team1", token)
+
+	assert.Nil(t, err)
+	assert.True(t, isMember)
+	assert.Len(t, requests, 2)
+
+	// not a member is the answer, there's nothing to retry
+	setUp()
+	mockResponse(regexMatcher(".*"), http.StatusNotFound, map[string]string{"Retry-After": "0"}, []byte(""))
+
+	err, isMember = getTeamMembershipStateFromGitHub(client, user, "org1", "team1", token)
+
+	assert.Nil(t, err)
+	assert.False(t, isMember)
+	assert.Len(t, requests, 1)
+}
+
+func TestGetVerifiedEmailsFromGitHub(t *testing.T) {
+	setUp()
+	user.Email = ""
+	mockResponse(urlEquals(cfg.GenOAuth.UserEmailsURL), http.StatusOK, map[string]string{}, []byte(`[
+		{"email": "secondary@example.org", "primary": false, "verified": true},
+		{"email": "primary@example.com", "primary": true, "verified": true},
+		{"email": "unverified@example.net", "primary": false, "verified": false}
+	]`))
+
+	err := getVerifiedEmailsFromGitHub(client, user)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"secondary@example.org", "primary@example.com"}, user.Emails)
+	assert.Equal(t, "primary@example.com", user.Email)
+}
+
+func TestGetVerifiedEmailsFromGitHubWithoutScope(t *testing.T) {
+	setUp()
+	mockResponse(urlEquals(cfg.GenOAuth.UserEmailsURL), http.StatusNotFound, map[string]string{}, []byte(""))
+
+	err := getVerifiedEmailsFromGitHub(client, user)
+
+	assert.NotNil(t, err)
+	assert.Empty(t, user.Emails)
+}
+
 func TestGetOrgMembershipStateFromGitHubNotFound(t *testing.T) {
 	setUp()
 	mockResponse(regexMatcher(".*"), http.StatusNotFound, map[string]string{}, []byte(""))
@@ -132,10 +214,139 @@ func TestGetOrgMembershipStateFromGitHubNotFound(t *testing.T) {
 	assert.Nil(t, err)
 	assert.False(t, isMember)
 
-	expectedOrgMembershipUrl := "https://api.github.com/orgs/myorg/members/" + user.Username + "?access_token=" + token.AccessToken
+	expectedOrgMembershipUrl := "https://api.github.com/orgs/myorg/members/" + user.Username
 	assertUrlCalled(t, expectedOrgMembershipUrl)
 }
 
+func TestGetUserInfoChildTeams(t *testing.T) {
+	setUp()
+	defer func() { cfg.Cfg.TeamWhiteListIncludeChildTeams = false }()
+	userInfoContent, _ := json.Marshal(structs.GitHubUser{Login: "myusername"})
+	mockResponse(urlEquals(cfg.GenOAuth.UserInfoURL), http.StatusOK, map[string]string{}, userInfoContent)
+	// parent > child > grandchild, the user is a member of the grandchild alone
+	mockResponse(regexMatcher(".*teams/grandchild/memberships.*"), http.StatusOK, map[string]string{}, []byte("{\"state\": \"active\"}"))
+	mockResponse(regexMatcher(".*memberships.*"), http.StatusNotFound, map[string]string{}, []byte(""))
+	mockResponse(regexMatcher(".*teams/parent/teams.*"), http.StatusOK, map[string]string{}, []byte(`[{"id": 2, "slug": "child"}]`))
+	mockResponse(regexMatcher(".*teams/child/teams.*"), http.StatusOK, map[string]string{}, []byte(`[{"id": 3, "slug": "grandchild"}]`))
+	mockResponse(regexMatcher(".*teams/grandchild/teams.*"), http.StatusOK, map[string]string{}, []byte(`[]`))
+
+	handler := Handler{PrepareTokensAndClient: func(_ *http.Request, _ *structs.PTokens, _ bool) (error, *http.Client, *oauth2.Token) {
+		return nil, client, token
+	}}
+	cfg.Cfg.TeamWhiteList = []string{"org/parent"}
+
+	err := handler.GetUserInfo(nil, user, &structs.CustomClaims{}, &structs.PTokens{})
+	assert.Nil(t, err)
+	assert.Empty(t, user.TeamMemberships)
+	assert.Equal(t, 1, len(requests)-1)
+
+	requests = make([]string, 0)
+	user = &structs.User{}
+	cfg.Cfg.TeamWhiteListIncludeChildTeams = true
+	err = handler.GetUserInfo(nil, user, &structs.CustomClaims{}, &structs.PTokens{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"org/parent"}, user.TeamMemberships)
+	assertUrlCalled(t, "https://api.github.com/orgs/org/teams/parent/teams?per_page=100")
+	assertUrlCalled(t, "https://api.github.com/orgs/org/teams/grandchild/memberships/myusername")
+}
+
+func TestGetChildTeamMembershipFromGitHubCycle(t *testing.T) {
+	setUp()
+	mockResponse(regexMatcher(".*memberships.*"), http.StatusNotFound, map[string]string{}, []byte(""))
+	mockResponse(regexMatcher(".*teams/parent/teams.*"), http.StatusOK, map[string]string{}, []byte(`[{"id": 2, "slug": "child"}]`))
+	mockResponse(regexMatcher(".*teams/child/teams.*"), http.StatusOK, map[string]string{}, []byte(`[{"id": 1, "slug": "parent"}, {"id": 2, "slug": "child"}]`))
+
+	err, isMember := getChildTeamMembershipFromGitHub(client, user, "org", "parent", token)
+	assert.Nil(t, err)
+	assert.False(t, isMember)
+	// the child teams of parent and child, and the membership of child, each once
+	assert.Equal(t, 3, len(requests))
+}
+
+func TestGetChildTeamMembershipFromGitHubMaxDepth(t *testing.T) {
+	setUp()
+	mockResponse(regexMatcher(".*memberships.*"), http.StatusNotFound, map[string]string{}, []byte(""))
+	// team0 > team1 > ... > team9
+	for i := 0; i < 9; i++ {
+		mockResponse(regexMatcher(fmt.Sprintf(".*teams/team%d/teams.*", i)), http.StatusOK, map[string]string{}, []byte(fmt.Sprintf(`[{"slug": "team%d"}]`, i+1)))
+	}
+
+	err, isMember := getChildTeamMembershipFromGitHub(client, user, "org", "team0", token)
+	assert.Nil(t, err)
+	assert.False(t, isMember)
+	// the child teams and the membership of each of the levels down to team5
+	assert.Equal(t, 2*maxChildTeamDepth, len(requests))
+	assertUrlCalled(t, "https://api.github.com/orgs/org/teams/team5/memberships/"+user.Username)
+}
+
+func TestGetUserInfoTeamWhiteListRegex(t *testing.T) {
+	setUp()
+	defer func() {
+		cfg.Cfg.TeamWhiteListRegex = nil
+		assert.Nil(t, cfg.CompileWhiteListRegex())
+	}()
+	userInfoContent, _ := json.Marshal(structs.GitHubUser{Login: "myusername"})
+	mockResponse(urlEquals(cfg.GenOAuth.UserInfoURL), http.StatusOK, map[string]string{}, userInfoContent)
+	mockResponse(regexMatcher(".*teams/exact/memberships.*"), http.StatusOK, map[string]string{}, []byte("{\"state\": \"active\"}"))
+	mockResponse(urlEquals(cfg.GenOAuth.UserTeamsURL), http.StatusOK, map[string]string{}, []byte(`[
+		{"slug": "platform-api", "organization": {"login": "MyOrg"}},
+		{"slug": "platform-web", "organization": {"login": "myorg"}},
+		{"slug": "marketing", "organization": {"login": "myorg"}},
+		{"slug": "platform-api", "organization": {"login": "otherorg"}}
+	]`))
+
+	handler := Handler{PrepareTokensAndClient: func(_ *http.Request, _ *structs.PTokens, _ bool) (error, *http.Client, *oauth2.Token) {
+		return nil, client, token
+	}}
+	cfg.Cfg.TeamWhiteList = []string{"myorg/exact"}
+	cfg.Cfg.TeamWhiteListRegex = []string{"myorg/platform-.*"}
+	assert.Nil(t, cfg.CompileWhiteListRegex())
+
+	err := handler.GetUserInfo(nil, user, &structs.CustomClaims{}, &structs.PTokens{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"myorg/exact", "myorg/platform-api", "myorg/platform-web"}, user.TeamMemberships)
+	assertUrlCalled(t, "https://api.github.com/user/teams?per_page=100")
+}
+
+func TestProbe(t *testing.T) {
+	setUp()
+	mockResponse(urlEquals("https://api.github.com"), http.StatusOK, map[string]string{}, []byte("{}"))
+	assert.Nil(t, Handler{}.Probe(client))
+
+	setUp()
+	mockResponse(urlEquals("https://api.github.com"), http.StatusServiceUnavailable, map[string]string{}, []byte(""))
+	assert.NotNil(t, Handler{}.Probe(client))
+
+	down := &http.Client{Transport: &Transport{MockError: errors.New("connection refused")}}
+	assert.NotNil(t, Handler{}.Probe(down))
+}
+
+// useAPIBaseURL the API urls built from the base url, as they are for GitHub Enterprise Server
+func useAPIBaseURL(base string) {
+	cfg.GenOAuth.GitHub.APIBaseURL = base
+	cfg.GenOAuth.UserInfoURL, cfg.GenOAuth.UserTeamURL, cfg.GenOAuth.UserOrgURL = "", "", ""
+	cfg.GenOAuth.UserEmailsURL, cfg.GenOAuth.UserOrgMembershipURL, cfg.GenOAuth.UserTeamByIDURL = "", "", ""
+	cfg.GenOAuth.ChildTeamsURL, cfg.GenOAuth.UserTeamsURL, cfg.GenOAuth.InstallationTokenURL = "", "", ""
+	setUp()
+}
+
+func TestGitHubEnterpriseAPIBaseURL(t *testing.T) {
+	defer useAPIBaseURL("")
+	for _, base := range []string{"https://github.mycorp.com/api/v3", "https://github.mycorp.com/api/v3/"} {
+		useAPIBaseURL(base)
+		mockResponse(regexMatcher(".*"), http.StatusNotFound, map[string]string{}, []byte(""))
+
+		getOrgMembershipStateFromGitHub(client, user, "myorg", token)
+		getTeamMembershipStateFromGitHub(client, user, "myorg", "myteam", token)
+		getVerifiedEmailsFromGitHub(client, user)
+
+		assertUrlCalled(t, "https://github.mycorp.com/api/v3/orgs/myorg/members/"+user.Username)
+		assertUrlCalled(t, "https://github.mycorp.com/api/v3/orgs/myorg/teams/myteam/memberships/"+user.Username)
+		assertUrlCalled(t, "https://github.mycorp.com/api/v3/user/emails")
+		assert.Equal(t, "https://github.mycorp.com/api/v3/user", cfg.GenOAuth.UserInfoURL)
+	}
+}
+
 func TestGetOrgMembershipStateFromGitHubNoOrgAccess(t *testing.T) {
 	setUp()
 	location := "https://api.github.com/orgs/myorg/public_members/" + user.Username
@@ -148,11 +359,74 @@ func TestGetOrgMembershipStateFromGitHubNoOrgAccess(t *testing.T) {
 	assert.Nil(t, err)
 	assert.True(t, isMember)
 
-	expectedOrgMembershipUrl := "https://api.github.com/orgs/myorg/members/" + user.Username + "?access_token=" + token.AccessToken
+	expectedOrgMembershipUrl := "https://api.github.com/orgs/myorg/members/" + user.Username
 	assertUrlCalled(t, expectedOrgMembershipUrl)
 
 	expectedOrgPublicMembershipUrl := "https://api.github.com/orgs/myorg/public_members/" + user.Username
 	assertUrlCalled(t, expectedOrgPublicMembershipUrl)
+	// the token goes in the header, also of the request which follows the 302
+	assert.Equal(t, []string{"Bearer 123", "Bearer 123"}, authorizations)
+}
+
+func TestGetOrgMembershipStateFromGitHubWithoutReadOrg(t *testing.T) {
+	setUp()
+	location := "https://api.github.com/orgs/myorg/public_members/" + user.Username
+	mockResponse(regexMatcher(".*orgs/myorg/members.*"), http.StatusFound, map[string]string{"Location": location}, []byte(""))
+	mockResponse(regexMatcher(".*orgs/myorg/public_members.*"), http.StatusNotFound, map[string]string{"X-OAuth-Scopes": "read:user, user:email"}, []byte(""))
+
+	// a private member, whom the token can't see
+	err, isMember := getOrgMembershipStateFromGitHub(client, user, "myorg", token)
+	assert.Equal(t, ErrMissingReadOrg, err)
+	assert.False(t, isMember)
+}
+
+func TestGetOrgMembershipStateFromGitHubNotAPublicMember(t *testing.T) {
+	setUp()
+	location := "https://api.github.com/orgs/myorg/public_members/" + user.Username
+	mockResponse(regexMatcher(".*orgs/myorg/members.*"), http.StatusFound, map[string]string{"Location": location}, []byte(""))
+	mockResponse(regexMatcher(".*orgs/myorg/public_members.*"), http.StatusNotFound, map[string]string{"X-OAuth-Scopes": "read:org, read:user"}, []byte(""))
+
+	// the token could have seen a private membership, so the user isn't a member
+	err, isMember := getOrgMembershipStateFromGitHub(client, user, "myorg", token)
+	assert.Nil(t, err)
+	assert.False(t, isMember)
+}
+
+func TestGetOwnOrgMembershipFromGitHub(t *testing.T) {
+	setUp()
+	cfg.GenOAuth.GitHub.OwnOrgMembership = true
+	defer func() {
+		cfg.GenOAuth.GitHub.OwnOrgMembership = false
+		cfg.GenOAuth.GitHub.AcceptPendingMembership = false
+	}()
+	mockResponse(urlEquals("https://api.github.com/user/memberships/orgs/activeorg"), http.StatusOK, map[string]string{}, []byte(`{"state": "active", "role": "admin"}`))
+	mockResponse(urlEquals("https://api.github.com/user/memberships/orgs/pendingorg"), http.StatusOK, map[string]string{}, []byte(`{"state": "pending", "role": "member"}`))
+	mockResponse(urlEquals("https://api.github.com/user/memberships/orgs/otherorg"), http.StatusNotFound, map[string]string{}, []byte(""))
+	mockResponse(urlEquals("https://api.github.com/user/memberships/orgs/restrictedorg"), http.StatusForbidden, map[string]string{}, []byte(""))
+	mockResponse(regexMatcher(".*orgs/restrictedorg/members.*"), http.StatusNoContent, map[string]string{}, []byte(""))
+
+	err, isMember := getOrgMembershipStateFromGitHub(client, user, "activeorg", token)
+	assert.Nil(t, err)
+	assert.True(t, isMember)
+	assert.Equal(t, []string{"https://api.github.com/user/memberships/orgs/activeorg"}, requests)
+
+	err, isMember = getOrgMembershipStateFromGitHub(client, user, "pendingorg", token)
+	assert.Nil(t, err)
+	assert.False(t, isMember)
+	cfg.GenOAuth.GitHub.AcceptPendingMembership = true
+	err, isMember = getOrgMembershipStateFromGitHub(client, user, "pendingorg", token)
+	assert.Nil(t, err)
+	assert.True(t, isMember)
+
+	err, isMember = getOrgMembershipStateFromGitHub(client, user, "otherorg", token)
+	assert.Nil(t, err)
+	assert.False(t, isMember)
+
+	// the org restricts OAuth app access, the members check decides
+	err, isMember = getOrgMembershipStateFromGitHub(client, user, "restrictedorg", token)
+	assert.Nil(t, err)
+	assert.True(t, isMember)
+	assertUrlCalled(t, "https://api.github.com/orgs/restrictedorg/members/testuser")
 }
 
 func TestGetUserInfo(t *testing.T) {
@@ -163,14 +437,14 @@ func TestGetUserInfo(t *testing.T) {
 			Username:   "test",
 			CreatedOn:  123,
 			Email:      "email@example.com",
-			ID:         1,
+			ID:         "1",
 			LastUpdate: 123,
 			Name:       "name",
 		},
 		Login:   "myusername",
 		Picture: "avatar-url",
 	})
-	mockResponse(urlEquals(cfg.GenOAuth.UserInfoURL+token.AccessToken), http.StatusOK, map[string]string{}, userInfoContent)
+	mockResponse(urlEquals(cfg.GenOAuth.UserInfoURL), http.StatusOK, map[string]string{}, userInfoContent)
 
 	cfg.Cfg.TeamWhiteList = append(cfg.Cfg.TeamWhiteList, "myOtherOrg", "myorg/myteam")
 
@@ -184,8 +458,161 @@ func TestGetUserInfo(t *testing.T) {
 
 	assert.Nil(t, err)
 	assert.Equal(t, "myusername", user.Username)
+	assert.Equal(t, structs.ID("1"), user.ID)
 	assert.Equal(t, []string{"myOtherOrg", "myorg/myteam"}, user.TeamMemberships)
 
-	expectedTeamMembershipUrl := "https://api.github.com/orgs/myorg/teams/myteam/memberships/myusername?access_token=" + token.AccessToken
+	expectedTeamMembershipUrl := "https://api.github.com/orgs/myorg/teams/myteam/memberships/myusername"
 	assertUrlCalled(t, expectedTeamMembershipUrl)
 }
+
+func TestGetUserInfoMissingScopes(t *testing.T) {
+	setUp()
+	defer func() {
+		cfg.GenOAuth.RequiredScopes = nil
+		cfg.GenOAuth.MissingScopes = "warn"
+	}()
+	cfg.Cfg.TeamWhiteList = []string{"myorg/myteam"}
+	cfg.GenOAuth.RequiredScopes = []string{"read:user", "read:org"}
+	cfg.GenOAuth.MissingScopes = "fail"
+	userInfoContent, _ := json.Marshal(structs.GitHubUser{Login: "myusername"})
+	mockResponse(urlEquals(cfg.GenOAuth.UserInfoURL), http.StatusOK, map[string]string{"X-OAuth-Scopes": "read:user"}, userInfoContent)
+
+	handler := Handler{PrepareTokensAndClient: func(_ *http.Request, _ *structs.PTokens, _ bool) (error, *http.Client, *oauth2.Token) {
+		return nil, client, token
+	}}
+	err := handler.GetUserInfo(nil, user, &structs.CustomClaims{}, &structs.PTokens{})
+	if assert.IsType(t, &common.MissingScopesError{}, err) {
+		assert.Equal(t, []string{"read:org"}, err.(*common.MissingScopesError).Missing)
+	}
+}
+
+func TestNormalizeTeam(t *testing.T) {
+	tests := map[string]string{
+		"myorg/myteam":      "myorg/myteam",
+		"myOrg/MyTeam":      "myorg/myteam",
+		"ORG/team":          "org/team",
+		"myorg/My Team":     "myorg/my-team",
+		"myorg/my-team":     "myorg/my-team",
+		"MyOrg/ My  Team! ": "myorg/my-team",
+		"myorg/my_team":     "myorg/my_team",
+		"MyOrg":             "myorg",
+	}
+	for entry, want := range tests {
+		assert.Equal(t, want, NormalizeTeam(entry), entry)
+	}
+}
+
+func TestGetUserInfoNormalizedTeams(t *testing.T) {
+	setUp()
+
+	userInfoContent, _ := json.Marshal(structs.GitHubUser{Login: "myusername"})
+	mockResponse(urlEquals(cfg.GenOAuth.UserInfoURL), http.StatusOK, map[string]string{}, userInfoContent)
+	mockResponse(regexMatcher(".*orgs/myorg/teams/my-team/.*"), http.StatusOK, map[string]string{}, []byte("{\"state\": \"active\"}"))
+	mockResponse(regexMatcher(".*orgs/otherorg/members/.*"), http.StatusNoContent, map[string]string{}, []byte(""))
+
+	cfg.Cfg.TeamWhiteList = []string{"MyOrg/My Team", "OtherOrg"}
+
+	handler := Handler{PrepareTokensAndClient: func(_ *http.Request, _ *structs.PTokens, _ bool) (error, *http.Client, *oauth2.Token) {
+		return nil, client, token
+	}}
+	err := handler.GetUserInfo(nil, user, &structs.CustomClaims{}, &structs.PTokens{})
+
+	assert.Nil(t, err)
+	// the memberships are recorded as written in the teamWhiteList
+	assert.Equal(t, []string{"MyOrg/My Team", "OtherOrg"}, user.TeamMemberships)
+	assertUrlCalled(t, "https://api.github.com/orgs/myorg/teams/my-team/memberships/myusername")
+	assertUrlCalled(t, "https://api.github.com/orgs/otherorg/members/myusername")
+}
+
+func TestGetUserInfoMaxTeamChecks(t *testing.T) {
+	setUp()
+	cfg.GenOAuth.GitHub.MaxTeamChecks = 2
+	defer func() { cfg.GenOAuth.GitHub.MaxTeamChecks = 0 }()
+
+	userInfoContent, _ := json.Marshal(structs.GitHubUser{Login: "myusername"})
+	mockResponse(urlEquals(cfg.GenOAuth.UserInfoURL), http.StatusOK, map[string]string{}, userInfoContent)
+	mockResponse(regexMatcher(".*teams/team2.*"), http.StatusOK, map[string]string{}, []byte("{\"state\": \"active\"}"))
+	mockResponse(regexMatcher(".*teams.*"), http.StatusNotFound, map[string]string{}, []byte(""))
+
+	handler := Handler{PrepareTokensAndClient: func(_ *http.Request, _ *structs.PTokens, _ bool) (error, *http.Client, *oauth2.Token) {
+		return nil, client, token
+	}}
+
+	// stops at the first match
+	cfg.Cfg.TeamWhiteList = []string{"org/team1", "org/team2", "org/team3"}
+	err := handler.GetUserInfo(nil, user, &structs.CustomClaims{}, &structs.PTokens{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"org/team2"}, user.TeamMemberships)
+	assert.Equal(t, 2, len(requests)-1)
+
+	// stops at the limit
+	requests = make([]string, 0)
+	user = &structs.User{}
+	cfg.Cfg.TeamWhiteList = []string{"org/team1", "org/team3", "org/team2"}
+	err = handler.GetUserInfo(nil, user, &structs.CustomClaims{}, &structs.PTokens{})
+	assert.Nil(t, err)
+	assert.Empty(t, user.TeamMemberships)
+	assert.Equal(t, 2, len(requests)-1)
+
+	// the warning counts the teams which matched before the limit
+	core, logs := observer.New(zapcore.WarnLevel)
+	defer func(l *zap.SugaredLogger) { log = l }(log)
+	log = zap.New(core).Sugar()
+	cfg.Cfg.TeamWhiteListMinMatches = 2
+	defer func() { cfg.Cfg.TeamWhiteListMinMatches = 0 }()
+	requests = make([]string, 0)
+	user = &structs.User{}
+	cfg.Cfg.TeamWhiteList = []string{"org/team2", "org/team1", "org/team3"}
+	err = handler.GetUserInfo(nil, user, &structs.CustomClaims{}, &structs.PTokens{})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"org/team2"}, user.TeamMemberships)
+	if assert.Equal(t, 1, logs.Len()) {
+		assert.Contains(t, logs.All()[0].Message, "checked 2 of 3 teams for myusername, 1 matched")
+	}
+}
+
+func TestGetUserInfoTeamsByID(t *testing.T) {
+	setUp()
+	cfg.GenOAuth.GitHub.TeamsByID = true
+	defer func() { cfg.GenOAuth.GitHub.TeamsByID = false }()
+
+	userInfoContent, _ := json.Marshal(structs.GitHubUser{Login: "myusername"})
+	mockResponse(urlEquals(cfg.GenOAuth.UserInfoURL), http.StatusOK, map[string]string{}, userInfoContent)
+	mockResponse(regexMatcher(".*/teams/1234567/memberships/.*"), http.StatusOK, map[string]string{}, []byte("{\"state\": \"active\"}"))
+	mockResponse(regexMatcher(".*orgs/myorg/teams/team2/.*"), http.StatusOK, map[string]string{}, []byte("{\"state\": \"active\"}"))
+
+	cfg.Cfg.TeamWhiteList = []string{"myorg/1234567", "myorg/team2"}
+
+	handler := Handler{PrepareTokensAndClient: func(_ *http.Request, _ *structs.PTokens, _ bool) (error, *http.Client, *oauth2.Token) {
+		return nil, client, token
+	}}
+	err := handler.GetUserInfo(nil, user, &structs.CustomClaims{}, &structs.PTokens{})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"myorg/1234567", "myorg/team2"}, user.TeamMemberships)
+	assertUrlCalled(t, "https://api.github.com/teams/1234567/memberships/myusername")
+	assertUrlCalled(t, "https://api.github.com/orgs/myorg/teams/team2/memberships/myusername")
+}
+
+func TestGetUserInfoEmailSources(t *testing.T) {
+	setUp()
+	cfg.GenOAuth.EmailSources = []string{"userinfo", "api"}
+	defer func() { cfg.GenOAuth.EmailSources = nil }()
+
+	// the profile has no public email
+	userInfoContent, _ := json.Marshal(structs.GitHubUser{Login: "myusername"})
+	mockResponse(urlEquals(cfg.GenOAuth.UserInfoURL), http.StatusOK, map[string]string{}, userInfoContent)
+	mockResponse(urlEquals(cfg.GenOAuth.UserEmailsURL), http.StatusOK, map[string]string{}, []byte(`[
+		{"email": "secondary@example.org", "primary": false, "verified": true},
+		{"email": "primary@example.com", "primary": true, "verified": true}
+	]`))
+
+	handler := Handler{PrepareTokensAndClient: func(_ *http.Request, _ *structs.PTokens, _ bool) (error, *http.Client, *oauth2.Token) {
+		return nil, client, token
+	}}
+	err := handler.GetUserInfo(nil, user, &structs.CustomClaims{}, &structs.PTokens{})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "primary@example.com", user.Email)
+	assertUrlCalled(t, cfg.GenOAuth.UserEmailsURL)
+}
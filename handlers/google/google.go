@@ -1,9 +1,9 @@
 package google
 
 import (
-	"encoding/json"
 	"github.com/vouch/vouch-proxy/handlers/common"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/pii"
 	"github.com/vouch/vouch-proxy/pkg/structs"
 	"io/ioutil"
 	"net/http"
@@ -30,15 +30,21 @@ func (Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims *st
 		}
 	}()
 	data, _ := ioutil.ReadAll(userinfo.Body)
-	log.Infof("google userinfo body: ", string(data))
+	log.Infof("google userinfo body: %s", pii.Dump(string(data)))
+	if err = common.CheckUserInfoError(data); err != nil {
+		return err
+	}
 	if err = common.MapClaims(data, customClaims); err != nil {
 		log.Error(err)
 		return err
 	}
-	if err = json.Unmarshal(data, user); err != nil {
+	if err = common.UnmarshalUser(data, user); err != nil {
 		log.Error(err)
 		return err
 	}
+	if err = common.MapName(data, user); err != nil {
+		return err
+	}
 	user.PrepareUserData()
 
 	return nil
@@ -1,13 +1,18 @@
 package handlers
 
 import (
+	"encoding/json"
 	"fmt"
 	"html/template"
+	"net"
 	"net/http"
+	"net/url"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/vouch/vouch-proxy/handlers/adfs"
 	"github.com/vouch/vouch-proxy/handlers/common"
@@ -16,20 +21,28 @@ import (
 	"github.com/vouch/vouch-proxy/handlers/homeassistant"
 	"github.com/vouch/vouch-proxy/handlers/indieauth"
 	"github.com/vouch/vouch-proxy/handlers/nextcloud"
+	"github.com/vouch/vouch-proxy/handlers/oauth1"
 	"github.com/vouch/vouch-proxy/handlers/openid"
 	"github.com/vouch/vouch-proxy/handlers/openstax"
+	"github.com/vouch/vouch-proxy/handlers/steam"
 
 	"go.uber.org/zap"
 
 	securerandom "github.com/theckman/go-securerandom"
 
-	"github.com/gorilla/sessions"
+	"github.com/vouch/vouch-proxy/pkg/authz"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/clientip"
 	"github.com/vouch/vouch-proxy/pkg/cookie"
 	"github.com/vouch/vouch-proxy/pkg/domains"
+	"github.com/vouch/vouch-proxy/pkg/ghactions"
 	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/lockout"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
 	"github.com/vouch/vouch-proxy/pkg/model"
+	"github.com/vouch/vouch-proxy/pkg/pii"
 	"github.com/vouch/vouch-proxy/pkg/structs"
+	"golang.org/x/net/publicsuffix"
 	"golang.org/x/oauth2"
 )
 
@@ -38,6 +51,10 @@ type Index struct {
 	Msg      string
 	TestURLs []string
 	Testing  bool
+	// RetryURL offered as a link to log in again
+	RetryURL string
+	// Reason the login was refused, one of the denial reasons
+	Reason string
 }
 
 // AuthError sets the values to return to nginx
@@ -53,6 +70,8 @@ type Handler interface {
 
 const (
 	base64Bytes = 32
+	// session key holding the OAuth 1.0a request token secret
+	oauth1TokenSecret = "oauth1TokenSecret"
 )
 
 var (
@@ -60,15 +79,74 @@ var (
 	indexTemplate = template.Must(template.ParseFiles(filepath.Join(cfg.RootDir, "templates/index.tmpl")))
 
 	// http://www.gorillatoolkit.org/pkg/sessions
-	sessstore = sessions.NewCookieStore([]byte(cfg.Cfg.Session.Key))
+	sessstore = newStateCarrier()
 
 	log     = cfg.Cfg.Logger
 	fastlog = cfg.Cfg.FastLogger
 )
 
 func init() {
-	sessstore.Options.HttpOnly = cfg.Cfg.Cookie.HTTPOnly
-	sessstore.Options.Secure = cfg.Cfg.Cookie.Secure
+	if err := ConfigureClaimTemplates(); err != nil {
+		log.Fatal(err)
+	}
+	if err := ConfigurePathPolicies(); err != nil {
+		log.Fatal(err)
+	}
+	if err := common.ConfigureUserInfoFields(); err != nil {
+		log.Fatal(err)
+	}
+	if err := clientip.Configure(); err != nil {
+		log.Fatal(err)
+	}
+	if err := ConfigureRequestObject(); err != nil {
+		log.Fatal(err)
+	}
+	if err := common.ConfigureClientAssertion(); err != nil {
+		log.Fatal(err)
+	}
+	if err := github.ConfigureApp(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkDefaultPostLoginURL(); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkCallbackURLs(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// checkCallbackURLs the host of each `oauth.callback_url` must be in one of the domains where the cookie is set
+// as wildcard, case and IDN aware as the domains of the cookie, which cfg can't match them against itself
+func checkCallbackURLs() error {
+	if cfg.Cfg.AllowAllUsers || cfg.GenOAuth == nil {
+		return nil
+	}
+	cbs := cfg.GenOAuth.RedirectURLs
+	if cfg.GenOAuth.RedirectURL != "" {
+		cbs = append([]string{cfg.GenOAuth.RedirectURL}, cbs...)
+	}
+	for _, cb := range cbs {
+		u, err := url.Parse(cb)
+		if err != nil || domains.Matches(u.Host) == "" {
+			return fmt.Errorf("configuration error: oauth.callback_url (%s) must be within the configured domain where the cookie will be set %s", cb, cfg.Cfg.Domains)
+		}
+	}
+	return nil
+}
+
+// checkDefaultPostLoginURL the `vouch.defaultPostLoginUrl` must be an absolute url on one of the domains
+func checkDefaultPostLoginURL() error {
+	if cfg.Cfg.DefaultPostLoginURL == "" {
+		return nil
+	}
+	u, err := url.Parse(cfg.Cfg.DefaultPostLoginURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("configuration error: %s.defaultPostLoginUrl %s must be an absolute http or https url", cfg.Branding.LCName, cfg.Cfg.DefaultPostLoginURL)
+	}
+	if len(cfg.Cfg.Domains) > 0 && domains.Matches(u.Host) == "" {
+		return fmt.Errorf("configuration error: %s.defaultPostLoginUrl %s is not on one of the domains %s", cfg.Branding.LCName, cfg.Cfg.DefaultPostLoginURL, cfg.Cfg.Domains)
+	}
+	return nil
 }
 
 func loginURL(r *http.Request, state string) string {
@@ -83,48 +161,90 @@ func loginURL(r *http.Request, state string) string {
 		domain := domains.Matches(r.Host)
 		log.Debugf("looking for redirect URL matching  %v", domain)
 		for i, v := range cfg.GenOAuth.RedirectURLs {
+			if cfg.GenOAuth.RedirectURI != "" {
+				// the override is the redirect_uri of every request
+				break
+			}
 			if strings.Contains(v, domain) {
 				log.Debugf("redirect value matched at [%d]=%v", i, v)
 				cfg.OAuthClient.RedirectURL = v
 				break
 			}
 		}
+		opts := []oauth2.AuthCodeOption{}
 		if cfg.OAuthopts != nil {
-			lurl = cfg.OAuthClient.AuthCodeURL(state, cfg.OAuthopts)
-		} else {
-			lurl = cfg.OAuthClient.AuthCodeURL(state)
+			opts = append(opts, cfg.OAuthopts)
+		}
+		if cb := common.CallbackURL(r); cb != "" {
+			log.Debugf("redirect_uri built from request host: %s", cb)
+			opts = append(opts, oauth2.SetAuthURLParam("redirect_uri", cb))
+		}
+		if stepUpRequested(r) {
+			// the IdP must not answer from its own session
+			opts = append(opts, oauth2.SetAuthURLParam("prompt", "login"))
 		}
+		if maxAge := reauthMaxAge(); maxAge != "" {
+			opts = append(opts, oauth2.SetAuthURLParam("max_age", maxAge))
+		}
+		lurl = withAudience(cfg.OAuthClient.AuthCodeURL(state, opts...))
 	}
 	// log.Debugf("loginUrl %s", url)
 	return lurl
 }
 
-// FindJWT look for JWT in Cookie, JWT Header, Authorization Header (OAuth2 Bearer Token)
-// and Query String in that order
+// FindJWT look for JWT in Cookie, JWT Header, Authorization Header (OAuth2 Bearer Token, if cfg.Cfg.AllowBearerToken)
+// and Query String in that order, with `vouch.session.source_precedence: header` the headers come before the Cookie
 func FindJWT(r *http.Request) string {
-	jwt, err := cookie.Cookie(r)
-	if err == nil {
-		log.Debugf("jwt from cookie: %s", jwt)
-		return jwt
+	if jwts := findJWTs(r); len(jwts) > 0 {
+		return jwts[0]
 	}
-	jwt = r.Header.Get(cfg.Cfg.Headers.JWT)
-	if jwt != "" {
-		log.Debugf("jwt from header %s: %s", cfg.Cfg.Headers.JWT, jwt)
-		return jwt
+	return ""
+}
+
+// findJWTs every jwt the request carries, in the order of FindJWT
+func findJWTs(r *http.Request) []string {
+	var fromCookie, fromHeader string
+	if jwt, err := cookie.ValidCookie(r, validJWT); err == nil {
+		log.Debugf("jwt from cookie: %s", pii.Dump(jwt))
+		fromCookie = jwt
 	}
-	auth := r.Header.Get("Authorization")
-	if auth != "" {
-		s := strings.SplitN(auth, " ", 2)
-		if len(s) == 2 {
-			jwt = s[1]
-			log.Debugf("jwt from authorization header: %s", jwt)
-			return jwt
+	if jwt := r.Header.Get(cfg.Cfg.Headers.JWT); jwt != "" {
+		log.Debugf("jwt from header %s: %s", cfg.Cfg.Headers.JWT, pii.Dump(jwt))
+		fromHeader = jwt
+	} else if cfg.Cfg.AllowBearerToken {
+		if jwt := bearerToken(r); jwt != "" {
+			log.Debugf("jwt from authorization header: %s", pii.Dump(jwt))
+			fromHeader = jwt
 		}
 	}
-	jwt = r.URL.Query().Get(cfg.Cfg.Headers.QueryString)
-	if jwt != "" {
-		log.Debugf("jwt from querystring %s: %s", cfg.Cfg.Headers.QueryString, jwt)
-		return jwt
+	ordered := []string{fromCookie, fromHeader}
+	if cfg.Cfg.Session.SourcePrecedence == "header" {
+		ordered = []string{fromHeader, fromCookie}
+	}
+	if jwt := r.URL.Query().Get(cfg.Cfg.Headers.QueryString); jwt != "" {
+		log.Debugf("jwt from querystring %s: %s", cfg.Cfg.Headers.QueryString, pii.Dump(jwt))
+		ordered = append(ordered, jwt)
+	}
+	jwts := []string{}
+	for _, jwt := range ordered {
+		if jwt != "" {
+			jwts = append(jwts, jwt)
+		}
+	}
+	return jwts
+}
+
+// validJWT does the jwt validate, for choosing between cookies of the same name
+func validJWT(jwt string) error {
+	_, err := ClaimsFromJWT(jwt)
+	return err
+}
+
+// bearerToken the token of an `Authorization: Bearer <token>` header
+func bearerToken(r *http.Request) string {
+	s := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+	if len(s) == 2 && strings.EqualFold(s[0], "Bearer") {
+		return strings.TrimSpace(s[1])
 	}
 	return ""
 }
@@ -132,6 +252,9 @@ func FindJWT(r *http.Request) string {
 // ClaimsFromJWT parse the jwt and return the claims
 func ClaimsFromJWT(jwt string) (jwtmanager.VouchClaims, error) {
 	var claims jwtmanager.VouchClaims
+	if cached, ok := jwtmanager.CachedClaims(jwt); ok {
+		return cached, nil
+	}
 
 	jwtParsed, err := jwtmanager.ParseTokenString(jwt)
 	if err != nil {
@@ -146,7 +269,8 @@ func ClaimsFromJWT(jwt string) (jwtmanager.VouchClaims, error) {
 		// if claims == &jwtmanager.VouchClaims{} {
 		return claims, err
 	}
-	log.Debugf("JWT Claims: %+v", claims)
+	log.Debugf("JWT Claims: %+v", pii.Dump(claims))
+	jwtmanager.CacheClaims(jwt, claims)
 	return claims, nil
 }
 
@@ -154,28 +278,62 @@ func ClaimsFromJWT(jwt string) (jwtmanager.VouchClaims, error) {
 // TODO this should use the handler interface
 func ValidateRequestHandler(w http.ResponseWriter, r *http.Request) {
 	fastlog.Debug("/validate")
+	if r.Method == http.MethodHead {
+		w = headWriter{w}
+	}
 
 	// TODO: collapse all of the `if !cfg.Cfg.PublicAccess` calls
 	// perhaps using an `ok=false` pattern
-	jwt := FindJWT(r)
+	ip := clientip.FromRequest(r)
+	if lockout.Locked(ip) {
+		log.Warnf("/validate %s is locked out after repeated invalid jwts", ip)
+		http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		return
+	}
+
+	// machine identities skip the browser flow entirely
+	if cfg.Cfg.GitHubActions.Enabled {
+		if bearer := bearerToken(r); bearer != "" && ghactions.IsActionsToken(bearer) {
+			validateGitHubActions(w, r, bearer, ip)
+			return
+		}
+	}
+
+	jwts := findJWTs(r)
 	// if jwt != "" {
-	if jwt == "" {
+	if len(jwts) == 0 {
 		// If the module is configured to allow public access with no authentication, return 200 now
 		if cfg.Cfg.PublicAccess {
 			w.Header().Add(cfg.Cfg.Headers.User, "")
 			log.Debugf("no jwt found, but public access is '%v', returning ok200", cfg.Cfg.PublicAccess)
 			ok200(w, r)
 		} else {
-			error401(w, r, AuthError{Error: "no jwt found in request"})
+			validateDenied(w, r, AuthError{Error: "no jwt found in request"})
 		}
 		return
 	}
 
-	claims, err := ClaimsFromJWT(jwt)
+	if cfg.Cfg.Session.SourcePrecedence != "cookie_then_header" {
+		// only the jwt which takes precedence is tried
+		jwts = jwts[:1]
+	}
+	var (
+		jwt    string
+		claims jwtmanager.VouchClaims
+		err    error
+	)
+	for _, jwt = range jwts {
+		if claims, err = ClaimsFromJWT(jwt); err == nil {
+			break
+		}
+	}
 	if err != nil {
+		// a jwt which doesn't verify may be tampered with
+		lockout.Fail(ip)
+		lockout.Delay()
 		// no email in jwt
 		if !cfg.Cfg.PublicAccess {
-			error401(w, r, AuthError{err.Error(), jwt})
+			validateDenied(w, r, AuthError{err.Error(), jwt})
 		} else {
 			w.Header().Add(cfg.Cfg.Headers.User, "")
 		}
@@ -185,19 +343,44 @@ func ValidateRequestHandler(w http.ResponseWriter, r *http.Request) {
 	if claims.Username == "" {
 		// no email in jwt
 		if !cfg.Cfg.PublicAccess {
-			error401(w, r, AuthError{"no Username found in jwt", jwt})
+			validateDenied(w, r, AuthError{"no Username found in jwt", jwt})
 		} else {
 			w.Header().Add(cfg.Cfg.Headers.User, "")
 		}
 		return
 	}
 	fastlog.Info("jwt cookie",
-		zap.String("username", claims.Username))
+		zap.String("username", pii.Mask(claims.Username)))
+
+	if !jwtmanager.SessionIsCurrent(&claims) {
+		if !cfg.Cfg.PublicAccess {
+			validateDenied(w, r, AuthError{"session has been superseded by a newer login or logged out at the provider", jwt})
+		} else {
+			w.Header().Add(cfg.Cfg.Headers.User, "")
+		}
+		return
+	}
+
+	if len(cfg.Cfg.Fingerprint.Components) > 0 && !fingerprintMatches(r, &claims) {
+		if !cfg.Cfg.PublicAccess {
+			validateDenied(w, r, AuthError{"session is bound to a different client, see vouch.fingerprint", jwt})
+		} else {
+			w.Header().Add(cfg.Cfg.Headers.User, "")
+		}
+		return
+	}
+
+	if cfg.Cfg.TeamRecheck.Interval > 0 {
+		if err := recheckTeams(&claims); err != nil {
+			validateDenied(w, r, AuthError{err.Error(), jwt})
+			return
+		}
+	}
 
 	if !cfg.Cfg.AllowAllUsers {
 		if !jwtmanager.SiteInClaims(r.Host, &claims) {
 			if !cfg.Cfg.PublicAccess {
-				error401(w, r, AuthError{
+				validateDenied(w, r, AuthError{
 					fmt.Sprintf("http header 'Host: %s' not authorized for configured `vouch.domains` (is Host being sent properly?)", r.Host),
 					jwt})
 			} else {
@@ -206,6 +389,26 @@ func ValidateRequestHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 	}
+	if len(cfg.Cfg.MethodTeams) > 0 {
+		if err := methodAllowed(r, &claims); err != nil {
+			// the user is authenticated, a 401 would only send them back to the login
+			log.Error(err)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+	if len(pathPolicies) > 0 {
+		if err := pathAllowed(r, &claims); err != nil {
+			log.Error(err)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+	staleLogin := len(cfg.Cfg.Headers.Sensitive.Headers) > 0 && !loginIsFresh(&claims)
+	if staleLogin && cfg.Cfg.Headers.Sensitive.Stale == "reauth" {
+		validateDenied(w, r, AuthError{fmt.Sprintf("the login of %s is older than headers.sensitive.maxauthage, logging in again", pii.Mask(claims.Username)), jwt})
+		return
+	}
 	if len(cfg.Cfg.Headers.Claims) > 0 {
 		log.Debug("Found claims in config, finding specific keys...")
 		// Run through all the claims found
@@ -215,20 +418,30 @@ func ValidateRequestHandler(w http.ResponseWriter, r *http.Request) {
 				// Check for matching claim
 				if cv == k {
 					log.Debug("Found matching claim key: ", k)
+					if ct, ok := claimTemplates[k]; ok {
+						val, err := ct.render(v)
+						if err != nil {
+							log.Errorf("omitting header %s, claim template for %s failed: %s", ct.header, k, err)
+							continue
+						}
+						w.Header().Add(ct.header, headerValue(val))
+						log.Debug("Adding header for claim template: ", k, " Name: ", ct.header, " Value: ", pii.Dump(val))
+						continue
+					}
 					customHeader := strings.Join([]string{cfg.Cfg.Headers.ClaimHeader, k}, "")
 					// convert to string
 					val := fmt.Sprint(v)
 					if reflect.TypeOf(val).Kind() == reflect.String {
 						// if val, ok := v.(string); ok {
-						w.Header().Add(customHeader, val)
-						log.Debug("Adding header for claim: ", k, " Name: ", customHeader, " Value: ", val)
+						w.Header().Add(customHeader, headerValue(val))
+						log.Debug("Adding header for claim: ", k, " Name: ", customHeader, " Value: ", pii.Dump(val))
 					} else if val, ok := v.([]interface{}); ok {
 						strs := make([]string, len(val))
 						for i, v := range val {
 							strs[i] = fmt.Sprintf("\"%s\"", v)
 						}
-						log.Debug("Adding header for claim: ", k, " Name: ", customHeader, " Value: ", strings.Join(strs, ","))
-						w.Header().Add(customHeader, strings.Join(strs, ","))
+						log.Debug("Adding header for claim: ", k, " Name: ", customHeader, " Value: ", pii.Dump(strings.Join(strs, ",")))
+						w.Header().Add(customHeader, headerValue(strings.Join(strs, ",")))
 					} else {
 						log.Errorf("Couldn't parse header type for %s %+v.  Please submit an issue.", k, v)
 					}
@@ -237,11 +450,11 @@ func ValidateRequestHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	w.Header().Add(cfg.Cfg.Headers.User, claims.Username)
+	w.Header().Add(cfg.Cfg.Headers.User, headerValue(forwardedUser(claims.Username)))
 	w.Header().Add(cfg.Cfg.Headers.Success, "true")
 
 	if cfg.Cfg.Headers.AccessToken != "" {
-		if claims.PAccessToken != "" {
+		if claims.PAccessToken != "" && forwardAccessToken(r.Host) {
 			w.Header().Add(cfg.Cfg.Headers.AccessToken, claims.PAccessToken)
 		}
 	}
@@ -251,15 +464,63 @@ func ValidateRequestHandler(w http.ResponseWriter, r *http.Request) {
 
 		}
 	}
+	if cfg.Cfg.Headers.Provider != "" {
+		if provider, ok := claims.CustomClaims[structs.ProviderClaim].(string); ok {
+			w.Header().Add(cfg.Cfg.Headers.Provider, provider)
+		}
+	}
+	if cfg.Cfg.Headers.Teams != "" {
+		if teams := claimTeams(&claims); len(teams) > 0 {
+			w.Header().Add(cfg.Cfg.Headers.Teams, headerValue(strings.Join(teams, ",")))
+		}
+	}
+	if cfg.Cfg.Headers.Roles != "" {
+		if roles := claimRoles(&claims); len(roles) > 0 {
+			w.Header().Add(cfg.Cfg.Headers.Roles, headerValue(strings.Join(roles, ",")))
+		}
+	}
+	if cfg.Cfg.Headers.Tenant != "" {
+		if tenant, ok := claims.CustomClaims[structs.TenantClaim].(string); ok {
+			w.Header().Add(cfg.Cfg.Headers.Tenant, headerValue(tenant))
+		}
+	}
+	// which of the vouch.domains the request is for, for an upstream serving several of them
+	if cfg.Cfg.Headers.Domain != "" && len(cfg.Cfg.Domains) > 0 {
+		if domain := domains.Matches(r.Host); domain != "" {
+			w.Header().Add(cfg.Cfg.Headers.Domain, domain)
+		}
+	}
+	if cfg.Cfg.Headers.Picture != "" {
+		if picture, ok := claims.CustomClaims[structs.PictureClaim].(string); ok {
+			w.Header().Add(cfg.Cfg.Headers.Picture, headerValue(picture))
+		}
+	}
+	// how long the upstream may cache this answer
+	if cfg.Cfg.Headers.ExpiresIn != "" && claims.ExpiresAt > 0 {
+		expiresIn := claims.ExpiresAt - time.Now().Unix()
+		if expiresIn < 0 {
+			expiresIn = 0
+		}
+		w.Header().Add(cfg.Cfg.Headers.ExpiresIn, strconv.FormatInt(expiresIn, 10))
+	}
+	if staleLogin {
+		omitSensitiveHeaders(w)
+	}
 	// fastlog.Debugf("response headers %+v", w.Header())
 	// fastlog.Debug("response header",
 	// 	zap.String(cfg.Cfg.Headers.User, w.Header().Get(cfg.Cfg.Headers.User)))
+	// the identity headers of the user
 	fastlog.Debug("response header",
-		zap.Any("all headers", w.Header()))
+		zap.Any("all headers", pii.Dump(w.Header())))
 
 	// good to go!!
-	if cfg.Cfg.Testing {
+	if debugValidate(r) {
+		validateDebugJSON(w, r)
+	} else if cfg.Cfg.Testing {
 		renderIndex(w, "user authorized "+claims.Username)
+	} else if acceptsJSON(r) {
+		// the headers are already set, SPAs may also want them in the body
+		okJSON(w, &claims)
 	} else {
 		ok200(w, r)
 	}
@@ -290,6 +551,46 @@ func ValidateRequestHandler(w http.ResponseWriter, r *http.Request) {
 	}()
 }
 
+// validateGitHubActions /validate for a GitHub Actions OIDC token
+func validateGitHubActions(w http.ResponseWriter, r *http.Request, bearer string, ip string) {
+	claims, err := ghactions.Verify(bearer)
+	if err != nil {
+		lockout.Fail(ip)
+		lockout.Delay()
+		error401(w, r, AuthError{Error: err.Error()})
+		return
+	}
+	fastlog.Info("github actions token",
+		zap.String("repository", claims.Repository),
+		zap.String("job_workflow_ref", claims.JobWorkflowRef))
+	// the job is held to the domains, methodTeams and pathPolicies as a user is, without any teams of its own
+	vc := jwtmanager.VouchClaims{Username: claims.Subject, Sites: jwtmanager.Sites}
+	if !cfg.Cfg.AllowAllUsers && !jwtmanager.SiteInClaims(r.Host, &vc) {
+		error401(w, r, AuthError{Error: fmt.Sprintf("http header 'Host: %s' not authorized for configured `vouch.domains`", r.Host)})
+		return
+	}
+	if len(cfg.Cfg.MethodTeams) > 0 {
+		if err := methodAllowed(r, &vc); err != nil {
+			log.Error(err)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+	if len(pathPolicies) > 0 {
+		if err := pathAllowed(r, &vc); err != nil {
+			log.Error(err)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
+	}
+	w.Header().Add(cfg.Cfg.Headers.User, headerValue(claims.Subject))
+	w.Header().Add(cfg.Cfg.Headers.Success, "true")
+	if cfg.Cfg.Headers.Provider != "" {
+		w.Header().Add(cfg.Cfg.Headers.Provider, "github-actions")
+	}
+	ok200(w, r)
+}
+
 // LogoutHandler /logout
 // currently performs a 302 redirect to Google
 func LogoutHandler(w http.ResponseWriter, r *http.Request) {
@@ -297,15 +598,15 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 	cookie.ClearCookie(w, r)
 
 	log.Debug("saving session")
-	sessstore.MaxAge(-1)
 	session, err := sessstore.Get(r, cfg.Cfg.Session.Name)
 	if err != nil {
 		log.Error(err)
 	}
-	if err = session.Save(r, w); err != nil {
+	// expire the login state cookie of this response alone, the store's MaxAge is shared with concurrent logins
+	session.Options.MaxAge = -1
+	if err = saveLoginState(r, w, session); err != nil {
 		log.Error(err)
 	}
-	sessstore.MaxAge(300)
 
 	var requestedURL = r.URL.Query().Get("url")
 	if requestedURL != "" {
@@ -316,8 +617,12 @@ func LogoutHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // HealthcheckHandler /healthcheck
-// just returns 200 '{ "ok": true }'
+// just returns 200 '{ "ok": true }', or with ?probe=true whether the provider is reachable, see probeHealthcheck
 func HealthcheckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("probe") == "true" {
+		probeHealthcheck(w)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	if _, err := fmt.Fprintf(w, "{ \"ok\": true }"); err != nil {
 		log.Error(err)
@@ -347,13 +652,20 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		log.Warnf("couldn't find existing encrypted secure cookie with name %s: %s (probably fine)", cfg.Cfg.Session.Name, err)
 	}
 
-	state, err := generateStateNonce()
-	if err != nil {
-		log.Error(err)
-	}
+	state, coalesced := coalescedState(r, session)
+	if !coalesced {
+		nonce, err := generateStateNonce()
+		if err != nil {
+			log.Error(err)
+		}
+		state = signState(nonce)
 
-	// set the state variable in the session
-	session.Values["state"] = state
+		// set the state variable in the session
+		session.Values["state"] = state
+		session.Values[stateIssuedAt] = time.Now().Unix()
+		session.Values[stateHost] = loginHost(r)
+	}
+	session.Values[stepUpSession] = stepUpRequested(r)
 	log.Debugf("session state set to %s", session.Values["state"])
 
 	// increment the failure counter for this domain
@@ -362,6 +674,14 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	// it sets the ultimate destination
 	// https://vouch.yoursite.com/login?url=
 	var requestedURL = r.URL.Query().Get("url")
+	if requestedURL == "" {
+		// perhaps the proxy forwarded the original request
+		requestedURL = requestedURLFromHeaders(r)
+	}
+	if requestedURL == "" && cfg.Cfg.DefaultPostLoginURL != "" {
+		log.Debugf("/login without a url, landing at %s.defaultPostLoginUrl %s", cfg.Branding.LCName, cfg.Cfg.DefaultPostLoginURL)
+		requestedURL = cfg.Cfg.DefaultPostLoginURL
+	}
 	if requestedURL == "" {
 		renderIndex(w, "/login no destination URL requested")
 		log.Error("no destination URL requested")
@@ -378,11 +698,32 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		failcount = session.Values[requestedURL].(int)
 		log.Debugf("failcount for %s is %d", requestedURL, failcount)
 	}
-	failcount++
+	// the tabs joining one login aren't a redirect loop
+	if !coalesced {
+		failcount++
+	}
 	session.Values[requestedURL] = failcount
 
+	// OAuth 1.0a providers must issue a request token before the user can be sent to them
+	var oauth1Token string
+	if cfg.GenOAuth.Provider == cfg.Providers.OAuth1 && failcount <= 2 {
+		callback := common.CallbackURL(r)
+		if callback == "" {
+			callback = cfg.GenOAuth.RedirectURL
+		}
+		// the provider appends oauth_token and oauth_verifier, state is checked at /auth like any other provider
+		token, secret, err := oauth1.RequestToken(callback + "?state=" + url.QueryEscape(state))
+		if err != nil {
+			log.Error(err)
+			renderIndex(w, "/login could not obtain an oauth1 request token")
+			return
+		}
+		oauth1Token = token
+		session.Values[oauth1TokenSecret] = secret
+	}
+
 	log.Debug("saving session")
-	if err = session.Save(r, w); err != nil {
+	if err = saveLoginState(r, w, session); err != nil {
 		log.Error(err)
 	}
 
@@ -391,68 +732,377 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 		renderIndex(w, "/login too many redirects for "+requestedURL+" - "+vouchError)
 	} else {
 		// bounce to oauth provider for login
-		var lURL = loginURL(r, state)
-		log.Debugf("redirecting to oauthURL %s", lURL)
+		var lURL string
+		if oauth1Token != "" {
+			lURL = oauth1.AuthorizeURL(oauth1Token)
+		} else if cfg.GenOAuth.Provider == cfg.Providers.Steam {
+			callback := common.CallbackURL(r)
+			if callback == "" {
+				callback = cfg.GenOAuth.RedirectURL
+			}
+			// Steam returns the assertion to openid.return_to, which carries the state
+			if lURL, err = steam.LoginURL(callback + "?state=" + url.QueryEscape(state)); err != nil {
+				log.Error(err)
+				renderIndex(w, "/login could not build the steam login url")
+				return
+			}
+		} else {
+			lURL = loginURL(r, state)
+			if cfg.GenOAuth.RequestObject.Enabled {
+				if lURL, err = requestObjectURL(lURL); err != nil {
+					log.Error(err)
+					renderIndex(w, "/login could not build the request object")
+					return
+				}
+			}
+			if cfg.GenOAuth.PARURL != "" {
+				if lURL, err = pushAuthorizationRequest(lURL); err != nil {
+					log.Error(err)
+					renderIndex(w, "/login could not push the authorization request to the provider")
+					return
+				}
+			}
+		}
+		if cfg.Cfg.LogAuthorizeURL {
+			logAuthorizeURL(lURL)
+		} else {
+			log.Debugf("redirecting to oauthURL %s", lURL)
+		}
 		redirect302(w, r, lURL)
 	}
 }
 
+// authorizeURLSecrets the parameters of an authorize url which are never logged
+// the state only matters for whether it's there, PKCE sends the code_challenge but never the code_verifier
+// and a request object carries all of those
+var authorizeURLSecrets = []string{"state", "client_secret", "code_verifier", "nonce", "oauth_token", "request"}
+
+// logAuthorizeURL log the url the user is being sent to at the provider, see `vouch.logAuthorizeURL`
+// for chasing a redirect_uri the provider won't accept
+func logAuthorizeURL(lURL string) {
+	u, statePresent, err := redactAuthorizeURL(lURL)
+	if err != nil {
+		log.Errorf("could not parse the authorize url for logging: %s", err)
+		return
+	}
+	q := u.Query()
+	log.Infow("/login redirecting to the provider",
+		"authorize_url", u.String(),
+		"redirect_uri", q.Get("redirect_uri"),
+		"scope", q.Get("scope"),
+		"state_present", statePresent)
+}
+
+// redactAuthorizeURL the authorize url with the authorizeURLSecrets replaced, and whether it carries a state
+func redactAuthorizeURL(lURL string) (*url.URL, bool, error) {
+	u, err := url.Parse(lURL)
+	if err != nil {
+		return nil, false, err
+	}
+	q := u.Query()
+	statePresent := q.Get("state") != ""
+	for _, p := range authorizeURLSecrets {
+		if _, ok := q[p]; ok {
+			q.Set(p, "REDACTED")
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u, statePresent, nil
+}
+
 func renderIndex(w http.ResponseWriter, msg string) {
 	if err := indexTemplate.Execute(w, &Index{Msg: msg, TestURLs: cfg.Cfg.TestURLs, Testing: cfg.Cfg.Testing}); err != nil {
 		log.Error(err)
 	}
 }
 
+// accessDenied the user declined to authorize the login at the provider, which is not an error of Vouch Proxy
+// they are sent to `vouch.accessDenied.redirect` or shown `vouch.accessDenied.message` with a link to try again
+func accessDenied(w http.ResponseWriter, r *http.Request, requestedURL string, cbErr *common.CallbackError) {
+	if cfg.Cfg.AccessDenied.Redirect != "" {
+		redirect302(w, r, cfg.Cfg.AccessDenied.Redirect)
+		return
+	}
+	msg := cfg.Cfg.AccessDenied.Message
+	if cbErr.Description != "" {
+		msg += " (" + cbErr.Description + ")"
+	}
+	retryURL := "/login"
+	if requestedURL != "" {
+		retryURL += "?url=" + url.QueryEscape(requestedURL)
+	}
+	w.WriteHeader(http.StatusForbidden)
+	if err := indexTemplate.Execute(w, &Index{Msg: msg, TestURLs: cfg.Cfg.TestURLs, Testing: cfg.Cfg.Testing, RetryURL: retryURL}); err != nil {
+		log.Error(err)
+	}
+}
+
 // VerifyUser validates that the domains match for the user
 // func VerifyUser(u structs.User) (ok bool, err error) {
 func VerifyUser(u interface{}) (ok bool, err error) {
+	// TODO: how do we manage the user?
+	user := u.(structs.User)
+	ok, _, err = verifyUser(user, structs.CustomClaims{})
+	return ok, err
+}
+
+// the authorization rules of verifyUser, reported by /debug/authz
+const (
+	ruleAllowAllUsers = "allowAllUsers"
+	ruleWhiteList     = "whiteList"
+	ruleTeamWhiteList = "teamWhiteList"
+	ruleClaims        = "claimsWhiteList"
+	ruleDomains       = "domains"
+	ruleNoDomains     = "no domains configured"
+)
+
+// verifyUser returns which rule decided the outcome, the claims are those of the provider for the claimsWhitelist
+func verifyUser(user structs.User, customClaims structs.CustomClaims) (ok bool, rule string, err error) {
 	// (w http.ResponseWriter, req http.Request)
 	// is Hd google specific? probably yes
 	// TODO rewrite / abstract this validation
 	ok = false
 
-	// TODO: how do we manage the user?
-	user := u.(structs.User)
-
 	if cfg.Cfg.AllowAllUsers {
 		ok = true
+		rule = ruleAllowAllUsers
 		log.Debugf("skipping verify user since cfg.Cfg.AllowAllUsers is %t", cfg.Cfg.AllowAllUsers)
 		// if we're not allowing all users, and we have domains configured and this email isn't in one of those domains...
-	} else if len(cfg.Cfg.WhiteList) != 0 {
-		for _, wl := range cfg.Cfg.WhiteList {
+	} else if cfg.HasWhiteList() || cfg.HasTeamWhiteList() || len(cfg.Cfg.ClaimsWhiteList) != 0 {
+		ok, rule, err = verifyWhiteLists(user, customClaims)
+	} else if len(cfg.Cfg.Domains) != 0 && !emailUnderManagement(user) {
+		rule = ruleDomains
+		err = emailDenial(user, fmt.Errorf("Email %s is not within a "+cfg.Branding.CcName+" managed domain", pii.Mask(user.Email)))
+		// } else if !domains.IsUnderManagement(user.HostDomain) {
+		// 	err = fmt.Errorf("HostDomain %s is not within a vouch managed domain", u.HostDomain)
+	} else {
+		ok = true
+		if len(cfg.Cfg.Domains) != 0 {
+			rule = ruleDomains
+		} else {
+			rule = ruleNoDomains
+			log.Debug("no domains configured")
+		}
+	}
+	return ok, rule, err
+}
+
+// verifyWhiteLists the whiteList, or else the teamWhitelist, and alongside them the claimsWhitelist, any match admits
+// the rule is the one which admitted the user, or the first of them which is configured
+func verifyWhiteLists(user structs.User, customClaims structs.CustomClaims) (ok bool, rule string, err error) {
+	if cfg.HasWhiteList() {
+		rule = ruleWhiteList
+		for _, wl := range cfg.CurrentWhiteList() {
 			if user.Username == wl {
-				log.Debugf("found user.Username in WhiteList: %s", user.Username)
+				log.Debugf("found user.Username in WhiteList: %s", pii.Mask(user.Username))
+				ok = true
+				break
+			}
+			if containsString(user.Emails, wl) {
+				log.Debugf("found the verified email %s of %s in WhiteList", pii.Mask(wl), pii.Mask(user.Username))
 				ok = true
 				break
 			}
 		}
 
-		if !ok {
-			err = fmt.Errorf("user.Username not found in WhiteList: %s", user.Username)
-		}
-	} else if len(cfg.Cfg.TeamWhiteList) != 0 {
-		for _, team := range user.TeamMemberships {
-			for _, wl := range cfg.Cfg.TeamWhiteList {
-				if team == wl {
-					log.Debugf("found user.TeamWhiteList in TeamWhiteList: %s for user %s", wl, user.Username)
-					ok = true
-					break
-				}
+		if !ok && cfg.MatchesAny(cfg.WhiteListRegex(), user.Username) {
+			log.Debugf("user.Username %s matches the WhiteListRegex", pii.Mask(user.Username))
+			ok = true
+		}
+		for _, email := range user.Emails {
+			if !ok && cfg.MatchesAny(cfg.WhiteListRegex(), email) {
+				log.Debugf("the verified email %s of %s matches the WhiteListRegex", pii.Mask(email), pii.Mask(user.Username))
+				ok = true
 			}
 		}
 
 		if !ok {
-			err = fmt.Errorf("user.TeamMemberships %s not found in TeamWhiteList: %s for user %s", user.TeamMemberships, cfg.Cfg.TeamWhiteList, user.Username)
+			err = denied(reasonNotWhiteListed, fmt.Errorf("user.Username not found in WhiteList: %s", pii.Mask(user.Username)))
+		}
+	} else if cfg.HasTeamWhiteList() {
+		rule = ruleTeamWhiteList
+		ok = inTeamWhiteList(user.TeamMemberships)
+		if !ok && len(user.TeamMemberships) == 0 {
+			err = denied(reasonNoTeam, noGroupsError(user))
+		} else if ok {
+			log.Debugf("found user.TeamMemberships %s in TeamWhiteList for user %s", user.TeamMemberships, pii.Mask(user.Username))
+		} else {
+			err = denied(reasonNoTeam, fmt.Errorf("user.TeamMemberships %s match %d of the TeamWhiteList: %s for user %s, %d required", user.TeamMemberships, teamWhiteListMatches(user.TeamMemberships), cfg.Cfg.TeamWhiteList, pii.Mask(user.Username), github.MinTeamMatches()))
 		}
-	} else if len(cfg.Cfg.Domains) != 0 && !domains.IsUnderManagement(user.Email) {
-		err = fmt.Errorf("Email %s is not within a "+cfg.Branding.CcName+" managed domain", user.Email)
-		// } else if !domains.IsUnderManagement(user.HostDomain) {
-		// 	err = fmt.Errorf("HostDomain %s is not within a vouch managed domain", u.HostDomain)
-	} else {
-		ok = true
-		log.Debug("no domains configured")
 	}
-	return ok, err
+	if ok || len(cfg.Cfg.ClaimsWhiteList) == 0 {
+		return ok, rule, err
+	}
+	if claim, value := claimsWhiteListMatch(customClaims.Claims); claim != "" {
+		log.Debugf("found %s %s of %s in the ClaimsWhiteList", claim, value, pii.Mask(user.Username))
+		return true, ruleClaims, nil
+	}
+	if rule == "" {
+		rule = ruleClaims
+	}
+	if err == nil {
+		err = denied(reasonNoClaim, fmt.Errorf("none of the claims of %s have a value of the ClaimsWhiteList", pii.Mask(user.Username)))
+	}
+	return false, rule, err
+}
+
+// accountActive check the `oauth.active_claim`, an account is only inactive if the claim says so
+// a boolean false or the string "false" is inactive, an absent claim is not
+func accountActive(customClaims structs.CustomClaims) error {
+	claim := cfg.GenOAuth.ActiveClaim
+	if claim == "" {
+		return nil
+	}
+	v, ok := customClaims.Claims[claim]
+	if !ok {
+		return nil
+	}
+	switch active := v.(type) {
+	case bool:
+		if !active {
+			return denied(reasonDenylisted, fmt.Errorf("the account is deactivated, claim %s is false", claim))
+		}
+	case string:
+		if strings.EqualFold(active, "false") {
+			return denied(reasonDenylisted, fmt.Errorf("the account is deactivated, claim %s is false", claim))
+		}
+	}
+	return nil
+}
+
+// allowedEmailDomain is the user's email, or one of their verified emails, in the `oauth.allowed_email_domains`
+func allowedEmailDomain(user structs.User) error {
+	if len(cfg.GenOAuth.AllowedEmailDomains) == 0 {
+		return nil
+	}
+	for _, email := range append([]string{user.Email}, user.Emails...) {
+		at := strings.LastIndex(email, "@")
+		if at < 0 {
+			continue
+		}
+		for _, d := range cfg.GenOAuth.AllowedEmailDomains {
+			if strings.EqualFold(email[at+1:], strings.TrimPrefix(d, "@")) {
+				return nil
+			}
+		}
+	}
+	return emailDenial(user, fmt.Errorf("email %s is not in one of the oauth.allowed_email_domains %s", pii.Mask(user.Email), cfg.GenOAuth.AllowedEmailDomains))
+}
+
+// tenantFromEmail the pseudo tenant of an email address, as configured in `oauth.tenant_from_email`
+//
+//	domain  alice@mail.acme.co.uk -> mail.acme.co.uk
+//	org     alice@mail.acme.co.uk -> acme, the label in front of the public suffix
+func tenantFromEmail(email string) string {
+	at := strings.LastIndex(email, "@")
+	if at < 0 || at == len(email)-1 {
+		return ""
+	}
+	domain := strings.ToLower(email[at+1:])
+	if cfg.GenOAuth.TenantFromEmail != "org" {
+		return domain
+	}
+	registered, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		log.Debugf("no tenant for %s: %s", pii.Mask(email), err)
+		return ""
+	}
+	return strings.SplitN(registered, ".", 2)[0]
+}
+
+// noGroupsError the login was refused for want of any groups at all, more likely a configuration problem such as a
+// missing scope or a misnamed groups claim than a user who isn't a member
+func noGroupsError(user structs.User) error {
+	source := "the provider's groups claim"
+	switch {
+	case cfg.GenOAuth.Provider == cfg.Providers.GitHub:
+		source = "the GitHub organizations and teams, which need the read:org scope"
+	case cfg.GenOAuth.UserInfoFields.Groups != "" && cfg.GenOAuth.AccessTokenGroupsClaim != "":
+		source = fmt.Sprintf("oauth.user_info_fields.groups %s and oauth.access_token_groups_claim %s", cfg.GenOAuth.UserInfoFields.Groups, cfg.GenOAuth.AccessTokenGroupsClaim)
+	case cfg.GenOAuth.UserInfoFields.Groups != "":
+		source = "oauth.user_info_fields.groups " + cfg.GenOAuth.UserInfoFields.Groups
+	case cfg.GenOAuth.AccessTokenGroupsClaim != "":
+		source = "oauth.access_token_groups_claim " + cfg.GenOAuth.AccessTokenGroupsClaim
+	}
+	return fmt.Errorf("authorization requires membership of one of the TeamWhiteList %s but the provider returned no groups for user %s, check oauth.scopes %s and %s", cfg.Cfg.TeamWhiteList, pii.Mask(user.Username), cfg.GenOAuth.Scopes, source)
+}
+
+// allowedTenant is the user's tenant one of the `oauth.allowed_tenants`
+func allowedTenant(user structs.User) error {
+	if len(cfg.GenOAuth.AllowedTenants) == 0 {
+		return nil
+	}
+	if user.Tenant == "" {
+		return denied(reasonWrongTenant, fmt.Errorf("no tenant was found for %s, logins are limited to the tenants %s", pii.Mask(user.Username), cfg.GenOAuth.AllowedTenants))
+	}
+	for _, t := range cfg.GenOAuth.AllowedTenants {
+		if strings.EqualFold(user.Tenant, t) {
+			return nil
+		}
+	}
+	return denied(reasonWrongTenant, fmt.Errorf("logins from tenant %s are not allowed, only from the tenants %s", user.Tenant, cfg.GenOAuth.AllowedTenants))
+}
+
+// claimString a claim which is a string, or a number such as a numeric org id
+func claimString(v interface{}) string {
+	switch c := v.(type) {
+	case string:
+		return c
+	case float64:
+		return strconv.FormatFloat(c, 'f', -1, 64)
+	}
+	return ""
+}
+
+// inTeamWhiteList are enough of the memberships in the TeamWhiteList, one unless `vouch.teamWhitelistMinMatches` says more
+func inTeamWhiteList(memberships []string) bool {
+	return teamWhiteListMatches(memberships) >= github.MinTeamMatches()
+}
+
+// teamWhiteListMatches how many of the TeamWhiteList entries the memberships match
+func teamWhiteListMatches(memberships []string) int {
+	matches := 0
+	for _, wl := range cfg.Cfg.TeamWhiteList {
+		for _, team := range memberships {
+			if team == wl || (cfg.GenOAuth.GitHub.NormalizeTeams && github.NormalizeTeam(team) == github.NormalizeTeam(wl)) {
+				matches++
+				break
+			}
+		}
+	}
+	// each pattern is one entry, however many of the memberships it matches
+	for _, rx := range cfg.TeamWhiteListRegex() {
+		for _, team := range memberships {
+			if rx.MatchString(team) {
+				matches++
+				break
+			}
+		}
+	}
+	return matches
+}
+
+// emailUnderManagement is the primary or any of the verified emails of the user within the domains?
+func emailUnderManagement(user structs.User) bool {
+	if domains.IsUnderManagement(user.Email) {
+		return true
+	}
+	for _, email := range user.Emails {
+		if domains.IsUnderManagement(email) {
+			log.Debugf("the verified email %s of %s is within a managed domain", pii.Mask(email), pii.Mask(user.Username))
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
 }
 
 // CallbackHandler /auth
@@ -463,7 +1113,17 @@ func CallbackHandler(w http.ResponseWriter, r *http.Request) {
 	log.Debug("/auth")
 	// Handle the exchange code to initiate a transport.
 
-	session, err := sessstore.Get(r, cfg.Cfg.Session.Name)
+	// any other parameters the provider appends to the callback are ignored
+	query := r.URL.Query()
+	queryState := query.Get("state")
+	if queryState == "" {
+		log.Errorf("/auth callback is missing the state parameter: %s", r.URL.RawQuery)
+		w.WriteHeader(http.StatusBadRequest)
+		renderIndex(w, "/auth callback is missing the state parameter.")
+		return
+	}
+
+	session, err := loginState(r, queryState)
 	if err != nil {
 		log.Errorf("/auth could not find session store %s", cfg.Cfg.Session.Name)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -471,19 +1131,47 @@ func CallbackHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// is the nonce "state" valid?
-	queryState := r.URL.Query().Get("state")
 	if session.Values["state"] != queryState {
+		if cookiesBlocked(r, queryState) {
+			log.Warnf("/auth the browser at %s returned without the %s session cookie set by /login, cookies appear to be blocked", clientip.FromRequest(r), cfg.Cfg.Session.Name)
+			renderCookiesBlocked(w, r)
+			return
+		}
 		log.Errorf("/auth Invalid session state: stored %s, returned %s", session.Values["state"], queryState)
+		lockout.Delay()
 		renderIndex(w, "/auth Invalid session state.")
 		return
 	}
+	if loginTimedOut(session) {
+		log.Warnf("/auth callback for state %s arrived after %s.session.login_timeout of %d seconds", queryState, cfg.Branding.LCName, cfg.Cfg.Session.LoginTimeout)
+		w.WriteHeader(http.StatusForbidden)
+		renderIndex(w, "login timed out, please retry.")
+		return
+	}
+	if callbackHostMismatch(r, session) {
+		log.Errorf("/auth callback for state %s arrived on host %s, the login started on %v, see %s.session.callback_host", queryState, r.Host, session.Values[stateHost], cfg.Branding.LCName)
+		lockout.Delay()
+		w.WriteHeader(http.StatusForbidden)
+		renderIndex(w, "/auth callback host does not match the login host.")
+		return
+	}
 
-	errorState := r.URL.Query().Get("error")
-	if errorState != "" {
-		errorDescription := r.URL.Query().Get("error_description")
-		log.Warn("/auth Error state: ", errorState, ", Error description: ", errorDescription)
+	if cbErr := common.CallbackErrorFromQuery(query); cbErr != nil {
+		log.Warnf("/auth error returned by the provider: %s", cbErr)
+		if cbErr.AccessDenied() {
+			requestedURL, _ := session.Values["requestedURL"].(string)
+			accessDenied(w, r, requestedURL, cbErr)
+			return
+		}
 		w.WriteHeader(http.StatusForbidden)
-		renderIndex(w, "FORBIDDEN: "+errorDescription)
+		renderIndex(w, "FORBIDDEN: "+cbErr.Message())
+		return
+	}
+
+	if missing := missingCallbackParams(query); len(missing) > 0 {
+		log.Errorf("/auth callback is missing %s: %s", strings.Join(missing, ", "), r.URL.RawQuery)
+		w.WriteHeader(http.StatusBadRequest)
+		renderIndex(w, "/auth callback is missing "+strings.Join(missing, ", "))
 		return
 	}
 
@@ -491,31 +1179,132 @@ func CallbackHandler(w http.ResponseWriter, r *http.Request) {
 	customClaims := structs.CustomClaims{}
 	ptokens := structs.PTokens{}
 
-	if err := getUserInfo(r, &user, &customClaims, &ptokens); err != nil {
+	fetch := func(u *structs.User, c *structs.CustomClaims, p *structs.PTokens) error {
+		return getUserInfo(r, u, c, p)
+	}
+	if err := logins.userInfo(queryState, fetch, &user, &customClaims, &ptokens); err != nil {
 		log.Error(err)
+		lockout.Delay()
+		metrics.Login(metrics.ResultError, providerFailure(err))
+		if te, ok := err.(*common.TokenExchangeError); ok {
+			w.WriteHeader(http.StatusBadRequest)
+			renderIndex(w, "/auth "+te.UserMessage())
+			return
+		}
+		if ue, ok := err.(*common.UserInfoError); ok {
+			w.WriteHeader(http.StatusBadRequest)
+			renderIndex(w, "/auth the provider could not tell who you are: "+ue.Message())
+			return
+		}
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	log.Debugf("/auth Claims from userinfo: %+v", customClaims)
+	log.Debugf("/auth Claims from userinfo: %+v", pii.Dump(customClaims))
+	// remember who minted this session, returned at /validate in cfg.Cfg.Headers.Provider
+	if customClaims.Claims == nil {
+		customClaims.Claims = make(map[string]interface{})
+	}
+	customClaims.Claims[structs.ProviderClaim] = cfg.GenOAuth.Provider
+	if len(cfg.Cfg.Fingerprint.Components) > 0 {
+		customClaims.Claims[structs.FingerprintClaim] = clientFingerprint(r)
+	}
+	if user.Picture == "" {
+		user.Picture, _ = customClaims.Claims[cfg.GenOAuth.PictureClaim].(string)
+	}
+	// MapClaims only kept the claim for the Picture, it isn't passed on unless it's one of the headers.claims
+	if !containsString(cfg.Cfg.Headers.Claims, cfg.GenOAuth.PictureClaim) {
+		delete(customClaims.Claims, cfg.GenOAuth.PictureClaim)
+	}
+	if cfg.Cfg.Headers.Picture != "" && user.Picture != "" {
+		customClaims.Claims[structs.PictureClaim] = user.Picture
+	}
+	if cfg.GenOAuth.TenantClaim != "" {
+		user.Tenant = claimString(customClaims.Claims[cfg.GenOAuth.TenantClaim])
+		if !containsString(cfg.Cfg.Headers.Claims, cfg.GenOAuth.TenantClaim) {
+			delete(customClaims.Claims, cfg.GenOAuth.TenantClaim)
+		}
+	}
+	if user.Tenant == "" && cfg.GenOAuth.TenantFromEmail != "" {
+		user.Tenant = tenantFromEmail(user.Email)
+	}
+	if user.Tenant != "" {
+		customClaims.Claims[structs.TenantClaim] = user.Tenant
+	}
 	//getProviderJWT(r, &user)
 	log.Debug("/auth CallbackHandler")
-	log.Debugf("/auth %+v", user)
+	log.Debugf("/auth %+v", pii.Dump(user))
 
-	if ok, err := VerifyUser(user); !ok {
-		log.Error(err)
-		renderIndex(w, fmt.Sprintf("/auth User is not authorized. %s Please try again.", err))
+	if cfg.GenOAuth.AccessTokenGroupsClaim != "" {
+		user.TeamMemberships = append(user.TeamMemberships, accessTokenGroups(ptokens.PAccessToken)...)
+	}
+	// the IdP may leave out an API the client isn't granted, the upstream will refuse the token rather than Vouch Proxy
+	if missing := missingAudiences(ptokens.PAccessToken); len(missing) > 0 {
+		log.Warnf("the access token of %s is not for the oauth.audience %s, the IdP narrowed the audience", pii.Mask(user.Username), missing)
+	}
+
+	// a deactivated account is denied whatever the whitelists or the authz webhook say
+	if err := accountActive(customClaims); err != nil {
+		lockout.Delay()
+		renderDenied(w, http.StatusOK, err, "/auth User is not authorized. %s Please try again.")
+		return
+	}
+
+	if err := allowedEmailDomain(user); err != nil {
+		lockout.Delay()
+		renderDenied(w, http.StatusOK, err, "/auth User is not authorized. %s Please try again.")
+		return
+	}
+
+	if err := allowedTenant(user); err != nil {
+		lockout.Delay()
+		renderDenied(w, http.StatusForbidden, err, "/auth User is not authorized. %s")
 		return
 	}
 
+	if cfg.Cfg.Authz.WebhookURL != "" {
+		if ok, err := authz.Check(&user, &customClaims); !ok {
+			lockout.Delay()
+			renderDenied(w, http.StatusOK, err, "/auth User is not authorized. %s Please try again.")
+			return
+		}
+	}
+
+	if cfg.Cfg.Authz.WebhookURL == "" || cfg.Cfg.Authz.Mode != authz.ModeReplace {
+		if ok, _, err := verifyUser(user, customClaims); !ok {
+			lockout.Delay()
+			renderDenied(w, http.StatusOK, err, "/auth User is not authorized. %s Please try again.")
+			return
+		}
+	}
+
 	// SUCCESS!! they are authorized
+	metrics.Login(metrics.ResultSuccess, "")
+	if cfg.Cfg.StoreTeams || len(cfg.Cfg.MethodTeams) > 0 || len(cfg.Cfg.PathPolicies) > 0 {
+		// including any teams from the authz webhook, checked against vouch.methodTeams and vouch.pathPolicies at /validate
+		// and passed as headers.teams without asking the provider again
+		customClaims.Claims[structs.TeamsClaim] = user.TeamMemberships
+	}
+	// the provider independent roles of the memberships, once the authz webhook has had its say
+	if roles := mapRoles(user.TeamMemberships); len(roles) > 0 {
+		customClaims.Claims[structs.RolesClaim] = roles
+	}
 
 	// store the user in the database
 	if err = model.PutUser(user); err != nil {
 		log.Error(err)
 	}
 
+	if cfg.Cfg.BackChannelLogout {
+		recordLogoutSubjects(user, customClaims, ptokens)
+	}
+
 	// issue the jwt
-	tokenstring := jwtmanager.CreateUserTokenString(user, customClaims, ptokens)
+	tokenstring, err := jwtmanager.CreateUserToken(user, customClaims, ptokens)
+	if err != nil {
+		log.Error(err)
+		renderIndex(w, "/auth could not issue the jwt")
+		return
+	}
 	cookie.SetCookie(w, r, tokenstring)
 
 	// get the originally requested URL so we can send them on their way
@@ -524,7 +1313,15 @@ func CallbackHandler(w http.ResponseWriter, r *http.Request) {
 		// clear out the session value
 		session.Values["requestedURL"] = ""
 		session.Values[requestedURL] = 0
-		if err = session.Save(r, w); err != nil {
+		if stepUp, _ := session.Values[stepUpSession].(bool); stepUp && cfg.Cfg.StepUp.Enabled {
+			session.Values[stepUpSession] = false
+			if requestedURL, err = withStepUpToken(requestedURL, user.Username, ptokens.PIdToken); err != nil {
+				log.Error(err)
+				renderIndex(w, "/auth could not issue the step up token")
+				return
+			}
+		}
+		if err = saveLoginState(r, w, session); err != nil {
 			log.Error(err)
 		}
 
@@ -536,6 +1333,7 @@ func CallbackHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func getUserInfo(r *http.Request, user *structs.User, customClaims *structs.CustomClaims, ptokens *structs.PTokens) error {
+	defer metrics.ObserveProviderCall("get_user_info", time.Now())
 	return getHandler().GetUserInfo(r, user, customClaims, ptokens)
 }
 
@@ -557,23 +1355,130 @@ func getHandler() Handler {
 		return nextcloud.Handler{}
 	case cfg.Providers.OIDC:
 		return openid.Handler{}
+	case cfg.Providers.OAuth1:
+		return oauth1.Handler{RequestTokenSecret: oauth1RequestTokenSecret}
+	case cfg.Providers.Steam:
+		return steam.Handler{}
 	default:
 		log.Error("we don't know how to look up the user info")
 		return nil
 	}
 }
 
+// providerFailure the reason of vouch_logins_total for a login which the provider couldn't complete
+func providerFailure(err error) string {
+	switch err.(type) {
+	case *common.TokenExchangeError:
+		return "token-exchange"
+	case *common.UserInfoError:
+		return "user-info"
+	}
+	return "provider-error"
+}
+
+// missingCallbackParams the parameters the provider is required to return to /auth on success
+func missingCallbackParams(query url.Values) []string {
+	required := []string{"code"}
+	if cfg.GenOAuth.Provider == cfg.Providers.OAuth1 {
+		required = []string{"oauth_token", "oauth_verifier"}
+	} else if cfg.GenOAuth.Provider == cfg.Providers.Steam {
+		// a cancelled login has only openid.mode, which the handler reports
+		required = []string{"openid.mode"}
+	}
+	missing := []string{}
+	for _, p := range required {
+		if query.Get(p) == "" {
+			missing = append(missing, p)
+		}
+	}
+	return missing
+}
+
+// forwardAccessToken may the provider's access token be passed to the host?
+// true for every host unless `vouch.headers.forward_access_token_hosts` is configured
+func forwardAccessToken(host string) bool {
+	if len(cfg.Cfg.Headers.ForwardAccessTokenHosts) == 0 {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, allowed := range cfg.Cfg.Headers.ForwardAccessTokenHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, ".") && (strings.HasSuffix(host, allowed) || host == allowed[1:])) {
+			return true
+		}
+	}
+	log.Debugf("not forwarding the access token to %s which is not in %s.headers.forward_access_token_hosts", host, cfg.Branding.LCName)
+	return false
+}
+
+// oauth1RequestTokenSecret the secret stored in the session at /login while awaiting the callback
+func oauth1RequestTokenSecret(r *http.Request) string {
+	session, err := loginState(r, r.URL.Query().Get("state"))
+	if err != nil {
+		log.Error(err)
+		return ""
+	}
+	if secret, ok := session.Values[oauth1TokenSecret].(string); ok {
+		return secret
+	}
+	return ""
+}
+
 // the standard error
 // this is captured by nginx, which converts the 401 into 302 to the login page
+// with `vouch.loginRedirect` the client is told where to log in instead
 func error401(w http.ResponseWriter, r *http.Request, ae AuthError) {
 	log.Error(ae.Error)
-	cookie.ClearCookie(w, r)
+	if clearOn401(ae) {
+		cookie.ClearCookie(w, r)
+	}
+	switch cfg.Cfg.LoginRedirect {
+	case "header":
+		// a SPA can send the user there itself, rather than its fetch following a 302 to the IdP
+		w.Header().Set(cfg.Cfg.Headers.LoginURL, vouchLoginURL(r))
+	case "redirect":
+		http.Redirect(w, r, vouchLoginURL(r), http.StatusFound)
+		return
+	}
 	// w.Header().Set("X-Vouch-Error", ae.Error)
 	http.Error(w, ae.Error, http.StatusUnauthorized)
 	// TODO put this back in place if multiple auth mechanism are available
 	// c.HTML(http.StatusBadRequest, "error.tmpl", gin.H{"message": errStr})
 }
 
+// clearOn401 should the cookie be cleared along with the 401?
+// with `vouch.cookie.onInvalid: ignore` a jwt which doesn't validate is left in place, and
+// a jwt issued by another Vouch Proxy sharing the cookie name is never cleared
+func clearOn401(ae AuthError) bool {
+	if ae.JWT == "" {
+		return true
+	}
+	if cfg.Cfg.Cookie.OnInvalid == "ignore" {
+		return false
+	}
+	if iss, err := jwtmanager.UnverifiedIssuer(ae.JWT); err == nil && iss != cfg.Cfg.JWT.Issuer {
+		log.Debugf("not clearing the cookie of a jwt issued by %s", iss)
+		return false
+	}
+	return true
+}
+
+// validateDenied the answer of /validate to a request without a valid session
+// on one of the `vouch.optionalAuthPaths` the request is let through anonymously instead of being sent to log in
+func validateDenied(w http.ResponseWriter, r *http.Request, ae AuthError) {
+	if path := forwardedPath(r); optionalAuthPath(path) {
+		log.Debugf("%s, %s is an optionalAuthPath, letting the request through anonymously", ae.Error, path)
+		w.Header().Add(cfg.Cfg.Headers.User, "")
+		w.Header().Add(cfg.Cfg.Headers.Anonymous, "true")
+		ok200(w, r)
+		return
+	}
+	error401(w, r, ae)
+}
+
 func error401na(w http.ResponseWriter, r *http.Request) {
 	error401(w, r, AuthError{Error: "not authorized"})
 }
@@ -587,6 +1492,59 @@ func redirect302(w http.ResponseWriter, r *http.Request, rURL string) {
 	http.Redirect(w, r, rURL, http.StatusFound)
 }
 
+// validateResponse the json body of /validate for `Accept: application/json`
+type validateResponse struct {
+	Username  string                 `json:"username"`
+	Claims    map[string]interface{} `json:"claims,omitempty"`
+	ExpiresAt int64                  `json:"expiresAt,omitempty"`
+}
+
+// acceptsJSON does the Accept header ask for application/json
+func acceptsJSON(r *http.Request) bool {
+	for _, mr := range strings.Split(r.Header.Get("Accept"), ",") {
+		parts := strings.Split(mr, ";")
+		if strings.TrimSpace(strings.ToLower(parts[0])) != "application/json" {
+			continue
+		}
+		for _, p := range parts[1:] {
+			// `q=0` means not acceptable
+			if q := strings.TrimSpace(p); strings.HasPrefix(q, "q=") {
+				if f, err := strconv.ParseFloat(q[2:], 64); err == nil && f == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// okJSON the user info along with only those claims which are also passed as headers
+func okJSON(w http.ResponseWriter, claims *jwtmanager.VouchClaims) {
+	resp := validateResponse{Username: claims.Username, ExpiresAt: claims.ExpiresAt}
+	for _, cv := range cfg.Cfg.Headers.Claims {
+		if v, ok := claims.CustomClaims[cv]; ok {
+			if resp.Claims == nil {
+				resp.Claims = make(map[string]interface{})
+			}
+			resp.Claims[cv] = v
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		log.Error(err)
+	}
+}
+
+// headWriter answers a HEAD request with the status and headers a GET would get, but without the body
+type headWriter struct {
+	http.ResponseWriter
+}
+
+func (headWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
 func ok200(w http.ResponseWriter, r *http.Request) {
 	_, err := w.Write([]byte("200 OK\n"))
 	if err != nil {
@@ -1,21 +1,46 @@
 package handlers
 
 import (
+	"encoding/json"
+	"fmt"
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/assert"
+	"github.com/vouch/vouch-proxy/handlers/github"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
 	"github.com/vouch/vouch-proxy/pkg/domains"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/model"
 	"github.com/vouch/vouch-proxy/pkg/structs"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 	"golang.org/x/oauth2"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 var (
 	user  *structs.User
 	token = &oauth2.Token{AccessToken: "123"}
+
+	// ValidateRequestHandler records the site in the db
+	testdb = "/tmp/handlers-test.db"
 )
 
 func init() {
+	os.Remove(testdb)
+	model.Db, _ = model.OpenDB(testdb)
 	setUp()
+	// the package level sessstore was created before the test config was loaded
+	sessstore = newStateCarrier()
 }
 
 func setUp() {
@@ -40,6 +65,160 @@ func TestVerifyUserPositiveUserInWhiteList(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestAccountActive(t *testing.T) {
+	setUp()
+	cfg.GenOAuth.ActiveClaim = "account_enabled"
+	defer func() { cfg.GenOAuth.ActiveClaim = "" }()
+
+	for _, tt := range []struct {
+		name   string
+		claims map[string]interface{}
+		active bool
+	}{
+		{"present true", map[string]interface{}{"account_enabled": true}, true},
+		{"present false", map[string]interface{}{"account_enabled": false}, false},
+		{"present as a string", map[string]interface{}{"account_enabled": "False"}, false},
+		{"absent", map[string]interface{}{"active": false}, true},
+		{"no claims", nil, true},
+	} {
+		err := accountActive(structs.CustomClaims{Claims: tt.claims})
+		assert.Equal(t, tt.active, err == nil, tt.name)
+	}
+
+	cfg.GenOAuth.ActiveClaim = ""
+	assert.Nil(t, accountActive(structs.CustomClaims{Claims: map[string]interface{}{"account_enabled": false}}))
+}
+
+func TestAllowedEmailDomain(t *testing.T) {
+	setUp()
+	assert.Nil(t, allowedEmailDomain(structs.User{Email: "robin@elsewhere.com"}))
+
+	cfg.GenOAuth.AllowedEmailDomains = []string{"example.com", "@example.org"}
+	defer func() { cfg.GenOAuth.AllowedEmailDomains = nil }()
+	assert.Nil(t, allowedEmailDomain(structs.User{Email: "robin@Example.com"}))
+	assert.Nil(t, allowedEmailDomain(structs.User{Email: "robin@example.org"}))
+	assert.Nil(t, allowedEmailDomain(structs.User{Email: "robin@elsewhere.com", Emails: []string{"robin@example.com"}}))
+	assert.NotNil(t, allowedEmailDomain(structs.User{Email: "robin@sub.example.com"}))
+	assert.NotNil(t, allowedEmailDomain(structs.User{Email: "robin@example.com.evil.com"}))
+	assert.NotNil(t, allowedEmailDomain(structs.User{Username: "robin"}))
+}
+
+func TestAllowedTenant(t *testing.T) {
+	setUp()
+	assert.Nil(t, allowedTenant(structs.User{Username: "robin"}))
+
+	cfg.GenOAuth.TenantClaim = "tid"
+	cfg.GenOAuth.AllowedTenants = []string{"72f988bf-86f1-41af-91ab-2d7cd011db47"}
+	defer func() {
+		cfg.GenOAuth.TenantClaim = ""
+		cfg.GenOAuth.AllowedTenants = nil
+	}()
+	assert.Nil(t, allowedTenant(structs.User{Username: "robin", Tenant: "72F988BF-86F1-41AF-91AB-2D7CD011DB47"}))
+	assert.NotNil(t, allowedTenant(structs.User{Username: "robin", Tenant: "00000000-0000-0000-0000-000000000000"}))
+	assert.NotNil(t, allowedTenant(structs.User{Username: "robin"}))
+}
+
+func TestTenantFromEmail(t *testing.T) {
+	setUp()
+	cfg.GenOAuth.TenantFromEmail = "domain"
+	defer func() { cfg.GenOAuth.TenantFromEmail = "" }()
+	assert.Equal(t, "mail.acme.co.uk", tenantFromEmail("alice@Mail.Acme.co.uk"))
+	assert.Equal(t, "", tenantFromEmail("alice"))
+
+	cfg.GenOAuth.TenantFromEmail = "org"
+	assert.Equal(t, "acme", tenantFromEmail("alice@acme.com"))
+	assert.Equal(t, "acme", tenantFromEmail("alice@mail.acme.co.uk"))
+	assert.Equal(t, "", tenantFromEmail("alice@co.uk"))
+	assert.Equal(t, "", tenantFromEmail("alice@"))
+}
+
+func TestValidateRequestHandlerTenant(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	defer func() { cfg.Cfg.AllowAllUsers = false }()
+
+	tokenstring := jwtmanager.CreateUserTokenString(structs.User{Username: "testuser"},
+		structs.CustomClaims{Claims: map[string]interface{}{structs.TenantClaim: "72f988bf-86f1-41af-91ab-2d7cd011db47"}}, structs.PTokens{})
+	r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+	r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+	w := httptest.NewRecorder()
+	ValidateRequestHandler(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "72f988bf-86f1-41af-91ab-2d7cd011db47", w.Header().Get("X-Vouch-Tenant"))
+}
+
+func TestVerifyUserTeamWhiteListMinMatches(t *testing.T) {
+	setUp()
+	cfg.Cfg.WhiteList = nil
+	cfg.Cfg.TeamWhiteList = []string{"org/a", "org/b", "org/c"}
+	cfg.Cfg.TeamWhiteListMinMatches = 2
+	defer func() {
+		cfg.Cfg.TeamWhiteList = nil
+		cfg.Cfg.TeamWhiteListMinMatches = 0
+	}()
+
+	for _, tt := range []struct {
+		teams []string
+		ok    bool
+	}{
+		{nil, false},
+		{[]string{"org/a"}, false},
+		// memberships outside the whitelist, or listed twice, don't count
+		{[]string{"org/a", "org/z", "org/a"}, false},
+		{[]string{"org/a", "org/c"}, true},
+		{[]string{"org/a", "org/b", "org/c"}, true},
+	} {
+		u := *user
+		u.TeamMemberships = tt.teams
+		ok, _ := VerifyUser(u)
+		assert.Equal(t, tt.ok, ok, "%v", tt.teams)
+	}
+
+	cfg.Cfg.TeamWhiteListMinMatches = 0
+	u := *user
+	u.TeamMemberships = []string{"org/b"}
+	ok, _ := VerifyUser(u)
+	assert.True(t, ok)
+}
+
+func TestVerifyUserWhiteListRegex(t *testing.T) {
+	setUp()
+	defer func() {
+		cfg.Cfg.WhiteListRegex, cfg.Cfg.TeamWhiteListRegex, cfg.Cfg.TeamWhiteList = nil, nil, nil
+		assert.Nil(t, cfg.CompileWhiteListRegex())
+	}()
+	cfg.Cfg.WhiteList = []string{"someoneelse"}
+	cfg.Cfg.WhiteListRegex = []string{"test.*"}
+	assert.Nil(t, cfg.CompileWhiteListRegex())
+
+	u := *user
+	ok, _ := VerifyUser(u)
+	assert.True(t, ok)
+	u.Username = "mytest"
+	ok, err := VerifyUser(u)
+	assert.False(t, ok)
+	assert.Equal(t, reasonNotWhiteListed, denialOf(err).Reason)
+
+	cfg.Cfg.WhiteList, cfg.Cfg.WhiteListRegex = nil, nil
+	cfg.Cfg.TeamWhiteList = []string{"org/exact"}
+	cfg.Cfg.TeamWhiteListRegex = []string{"org/platform-.*"}
+	assert.Nil(t, cfg.CompileWhiteListRegex())
+	for _, tt := range []struct {
+		teams []string
+		ok    bool
+	}{
+		{[]string{"org/exact"}, true},
+		{[]string{"org/platform-api", "org/platform-web"}, true},
+		{[]string{"org/platform"}, false},
+		{[]string{"other/platform-api"}, false},
+	} {
+		u := *user
+		u.TeamMemberships = tt.teams
+		ok, _ := VerifyUser(u)
+		assert.Equal(t, tt.ok, ok, "%v", tt.teams)
+	}
+}
+
 func TestVerifyUserPositiveAllowAllUsers(t *testing.T) {
 	setUp()
 	cfg.Cfg.AllowAllUsers = true
@@ -59,6 +238,27 @@ func TestVerifyUserPositiveByEmail(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestVerifyUserPositiveBySecondaryEmail(t *testing.T) {
+	setUp()
+	cfg.Cfg.WhiteList = append(cfg.Cfg.WhiteList, "alias@example.org")
+
+	ok, err := VerifyUser(*user)
+	assert.False(t, ok)
+	assert.NotNil(t, err)
+
+	user.Emails = []string{"test@example.com", "alias@example.org"}
+	ok, err = VerifyUser(*user)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+
+	cfg.Cfg.WhiteList = make([]string, 0)
+	cfg.Cfg.Domains = append(cfg.Cfg.Domains, "example.org")
+	domains.Refresh()
+	ok, err = VerifyUser(*user)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+}
+
 func TestVerifyUserPositiveByTeam(t *testing.T) {
 	setUp()
 	cfg.Cfg.TeamWhiteList = append(cfg.Cfg.TeamWhiteList, "org1/team2", "org1/team1")
@@ -70,6 +270,21 @@ func TestVerifyUserPositiveByTeam(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestVerifyUserPositiveByNormalizedTeam(t *testing.T) {
+	setUp()
+	cfg.Cfg.TeamWhiteList = append(cfg.Cfg.TeamWhiteList, "myOrg/My Team")
+	user.TeamMemberships = append(user.TeamMemberships, "MYORG/my-team")
+
+	ok, _ := VerifyUser(*user)
+	assert.False(t, ok)
+
+	cfg.GenOAuth.GitHub.NormalizeTeams = true
+	defer func() { cfg.GenOAuth.GitHub.NormalizeTeams = false }()
+	ok, err := VerifyUser(*user)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+}
+
 func TestVerifyUserNegativeByTeam(t *testing.T) {
 	setUp()
 	cfg.Cfg.TeamWhiteList = append(cfg.Cfg.TeamWhiteList, "org1/team1")
@@ -79,6 +294,20 @@ func TestVerifyUserNegativeByTeam(t *testing.T) {
 	assert.NotNil(t, err)
 }
 
+func TestVerifyUserNoGroups(t *testing.T) {
+	setUp()
+	cfg.Cfg.TeamWhiteList = append(cfg.Cfg.TeamWhiteList, "org1/team1")
+
+	// a configuration problem rather than a user who isn't a member
+	ok, err := VerifyUser(structs.User{Username: "testuser"})
+	assert.False(t, ok)
+	assert.Contains(t, err.Error(), "returned no groups")
+
+	ok, err = VerifyUser(structs.User{Username: "testuser", TeamMemberships: []string{"org2/team2"}})
+	assert.False(t, ok)
+	assert.NotContains(t, err.Error(), "returned no groups")
+}
+
 func TestVerifyUserPositiveNoDomainsConfigured(t *testing.T) {
 	setUp()
 	cfg.Cfg.Domains = make([]string, 0)
@@ -97,3 +326,1379 @@ func TestVerifyUserNegative(t *testing.T) {
 	assert.False(t, ok)
 	assert.NotNil(t, err)
 }
+
+func TestRequestedURLFromHeaders(t *testing.T) {
+	setUp()
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    string
+	}{
+		{"none", map[string]string{}, ""},
+		{"full", map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "app.domain1", "X-Forwarded-Uri": "/path?a=1&b=2"}, "https://app.domain1/path?a=1&b=2"},
+		{"non default port", map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "app.domain1", "X-Forwarded-Port": "8443", "X-Forwarded-Uri": "/"}, "https://app.domain1:8443/"},
+		{"default port dropped", map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "app.domain1", "X-Forwarded-Port": "443", "X-Forwarded-Uri": "/"}, "https://app.domain1/"},
+		{"port already in host", map[string]string{"X-Forwarded-Proto": "http", "X-Forwarded-Host": "app.domain1:8080", "X-Forwarded-Port": "80", "X-Forwarded-Uri": "/"}, "http://app.domain1:8080/"},
+		// only a host of vouch.domains, the headers may be the client's own
+		{"not one of the domains", map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example.com", "X-Forwarded-Uri": "/"}, ""},
+		{"ipv6 is not one of the domains", map[string]string{"X-Forwarded-Proto": "http", "X-Forwarded-Host": "[2001:db8::1]", "X-Forwarded-Port": "8080", "X-Forwarded-Uri": "/x"}, ""},
+		{"requested uri header not one of the domains", map[string]string{cfg.Cfg.Headers.Redirect: "https://evil.example.com/"}, ""},
+		{"encoded query kept verbatim", map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "app.domain1", "X-Forwarded-Uri": "/s?q=a%20b%26c&r=%2F"}, "https://app.domain1/s?q=a%20b%26c&r=%2F"},
+		{"requested uri header", map[string]string{cfg.Cfg.Headers.Redirect: "https://app.domain1:8443/p?q=1"}, "https://app.domain1:8443/p?q=1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://vouch.domain1/login", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			assert.Equal(t, tt.want, requestedURLFromHeaders(r))
+		})
+	}
+}
+
+func TestHostWithPort(t *testing.T) {
+	assert.Equal(t, "app.domain1:8443", hostWithPort("app.domain1", "8443", "https"))
+	assert.Equal(t, "app.domain1", hostWithPort("app.domain1", "443", "https"))
+	assert.Equal(t, "app.domain1:8080", hostWithPort("app.domain1:8080", "80", "http"))
+	assert.Equal(t, "[2001:db8::1]:8080", hostWithPort("[2001:db8::1]", "8080", "http"))
+	assert.Equal(t, "[2001:db8::1]:8443", hostWithPort("[2001:db8::1]:8443", "443", "https"))
+}
+
+func TestRequestedURLFromHeadersUntrusted(t *testing.T) {
+	setUp()
+	cfg.Cfg.Headers.TrustForwarded = []string{"X-Forwarded-Uri"}
+	r := httptest.NewRequest("GET", "http://vouch.domain1/login", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	r.Header.Set("X-Forwarded-Host", "evil.example.com")
+	r.Header.Set("X-Forwarded-Uri", "/path")
+	assert.Equal(t, "http://vouch.domain1/path", requestedURLFromHeaders(r))
+}
+
+func TestValidateRequestHandlerLoginRedirect(t *testing.T) {
+	setUp()
+	defer func(redirectURL string) {
+		cfg.Cfg.LoginRedirect = "none"
+		cfg.Cfg.LoginURL = ""
+		cfg.GenOAuth.RedirectURL = redirectURL
+	}(cfg.GenOAuth.RedirectURL)
+	cfg.GenOAuth.RedirectURL = "https://vouch.domain1/auth"
+
+	validate := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+		r.Header.Set(cfg.Cfg.Headers.Redirect, "https://app.domain1/page")
+		w := httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		return w
+	}
+	loginURL := "https://vouch.domain1/login?url=" + url.QueryEscape("https://app.domain1/page")
+
+	// default, nginx turns the 401 into the redirect
+	w := validate()
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Empty(t, w.Header().Get(cfg.Cfg.Headers.LoginURL))
+
+	cfg.Cfg.LoginRedirect = "header"
+	w = validate()
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, loginURL, w.Header().Get(cfg.Cfg.Headers.LoginURL))
+
+	cfg.Cfg.LoginRedirect = "redirect"
+	w = validate()
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, loginURL, w.Header().Get("Location"))
+
+	cfg.Cfg.LoginURL = "https://login.domain1/login"
+	w = validate()
+	assert.Equal(t, "https://login.domain1/login?url="+url.QueryEscape("https://app.domain1/page"), w.Header().Get("Location"))
+}
+
+func TestRedactAuthorizeURL(t *testing.T) {
+	u, statePresent, err := redactAuthorizeURL("https://idp.example.com/authorize?client_id=vouch&redirect_uri=https%3A%2F%2Fvouch.example.com%2Fauth&scope=openid+email&state=s3cr3t&code_challenge=abc&code_challenge_method=S256&code_verifier=xyz")
+	assert.NoError(t, err)
+	assert.True(t, statePresent)
+	q := u.Query()
+	assert.Equal(t, "idp.example.com", u.Host)
+	assert.Equal(t, "https://vouch.example.com/auth", q.Get("redirect_uri"))
+	assert.Equal(t, "openid email", q.Get("scope"))
+	assert.Equal(t, "abc", q.Get("code_challenge"))
+	assert.Equal(t, "REDACTED", q.Get("state"))
+	assert.Equal(t, "REDACTED", q.Get("code_verifier"))
+	assert.NotContains(t, u.String(), "s3cr3t")
+
+	u, statePresent, err = redactAuthorizeURL("https://idp.example.com/authorize?client_id=vouch")
+	assert.NoError(t, err)
+	assert.False(t, statePresent)
+	assert.Equal(t, "", u.Query().Get("state"))
+}
+
+func TestLoginURLWithCallbackPath(t *testing.T) {
+	cfg.InitForTestPurposesWithProvider("oidc")
+	cfg.Cfg.Domains = []string{"domain1"}
+	domains.Refresh()
+	cfg.GenOAuth.CallbackPath = "/oauth2/callback"
+	defer func() { cfg.GenOAuth.CallbackPath = "" }()
+
+	r := httptest.NewRequest("GET", "http://vouch.domain1/login", nil)
+	assert.Contains(t, loginURL(r, "state"), "redirect_uri="+url.QueryEscape("http://vouch.domain1/oauth2/callback"))
+
+	r = httptest.NewRequest("GET", "http://vouch.domain1/login", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	assert.Contains(t, loginURL(r, "state"), "redirect_uri="+url.QueryEscape("https://vouch.domain1/oauth2/callback"))
+
+	cfg.Cfg.ForceHTTPS = true
+	r = httptest.NewRequest("GET", "http://vouch.domain1/login", nil)
+	assert.Contains(t, loginURL(r, "state"), "redirect_uri="+url.QueryEscape("https://vouch.domain1/oauth2/callback"))
+	cfg.Cfg.ForceHTTPS = false
+
+	// hosts outside of the configured domains get the configured callback_url
+	r = httptest.NewRequest("GET", "http://vouch.evil.com/login", nil)
+	assert.NotContains(t, loginURL(r, "state"), "evil.com")
+}
+
+func TestLoginURLWithRedirectURI(t *testing.T) {
+	cfg.InitForTestPurposesWithProvider("oidc")
+	cfg.Cfg.Domains = []string{"domain1"}
+	domains.Refresh()
+	cfg.GenOAuth.RedirectURI = "https://vouch.example.com/auth"
+	cfg.GenOAuth.RedirectURLs = []string{"http://vouch.domain1/auth"}
+	configured := cfg.OAuthClient.RedirectURL
+	defer func() {
+		cfg.GenOAuth.RedirectURI = ""
+		cfg.GenOAuth.RedirectURLs = nil
+	}()
+
+	// no matter the Host, nor the callback_urls
+	for _, host := range []string{"http://vouch.domain1/login", "http://app.domain1/login", "http://vouch.evil.com/login"} {
+		r := httptest.NewRequest("GET", host, nil)
+		assert.Contains(t, loginURL(r, "state"), "redirect_uri="+url.QueryEscape("https://vouch.example.com/auth"), host)
+	}
+	assert.Equal(t, configured, cfg.OAuthClient.RedirectURL)
+}
+
+func TestValidateRequestHandlerInvalidCookie(t *testing.T) {
+	setUp()
+	// signed with a key which isn't ours, such as one which has since been rotated
+	badToken := func(issuer string) string {
+		claims := jwtmanager.VouchClaims{Username: "testuser", StandardClaims: jwt.StandardClaims{Issuer: issuer, ExpiresAt: time.Now().Add(time.Hour).Unix()}}
+		ss, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("some other key"))
+		assert.Nil(t, err)
+		return ss
+	}
+	validate := func(val string) []*http.Cookie {
+		r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+		r.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: val})
+		// another cookie which only shares the prefix
+		r.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name + "Other", Value: "x"})
+		w := httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		return w.Result().Cookies()
+	}
+
+	cleared := validate(badToken(cfg.Cfg.JWT.Issuer))
+	assert.Len(t, cleared, 1)
+	assert.Equal(t, cfg.Cfg.Cookie.Name, cleared[0].Name)
+	assert.Equal(t, -1, cleared[0].MaxAge)
+
+	// corrupted
+	assert.Len(t, validate("not.a.jwt"), 1)
+
+	// another Vouch Proxy's cookie
+	assert.Empty(t, validate(badToken("another-vouch")))
+
+	cfg.Cfg.Cookie.OnInvalid = "ignore"
+	defer func() { cfg.Cfg.Cookie.OnInvalid = "clear" }()
+	assert.Empty(t, validate(badToken(cfg.Cfg.JWT.Issuer)))
+}
+
+func TestValidateRequestHandlerAcceptJSON(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	defer func() { cfg.Cfg.AllowAllUsers = false }()
+	u := structs.User{Username: "testuser", Email: "test@example.com"}
+	tokenstring := jwtmanager.CreateUserTokenString(u, structs.CustomClaims{}, structs.PTokens{})
+
+	validate := func(accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+		r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+		if accept != "" {
+			r.Header.Set("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		return w
+	}
+
+	plain := validate("*/*")
+	assert.Equal(t, http.StatusOK, plain.Code)
+	assert.Equal(t, "200 OK\n", plain.Body.String())
+
+	js := validate("text/html;q=0.9, application/json")
+	assert.Equal(t, http.StatusOK, js.Code)
+	assert.Equal(t, "application/json", js.Header().Get("Content-Type"))
+	assert.Contains(t, js.Body.String(), `"username":"testuser"`)
+
+	// the headers are identical either way
+	assert.Equal(t, plain.Header().Get(cfg.Cfg.Headers.User), js.Header().Get(cfg.Cfg.Headers.User))
+	assert.Equal(t, plain.Header().Get(cfg.Cfg.Headers.Success), js.Header().Get(cfg.Cfg.Headers.Success))
+
+	assert.Equal(t, "200 OK\n", validate("application/json;q=0").Body.String())
+}
+
+func TestDebugAuthzHandler(t *testing.T) {
+	setUp()
+	cfg.Cfg.WhiteList = []string{"testuser"}
+	cfg.Cfg.DebugAuthz.Enabled = true
+	cfg.Cfg.DebugAuthz.Secret = "s3cr3t"
+	defer func() {
+		cfg.Cfg.DebugAuthz.Enabled = false
+		cfg.Cfg.DebugAuthz.Secret = ""
+	}()
+
+	authz := func(query string, secret string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://vouch.domain1/debug/authz?"+query, nil)
+		if secret != "" {
+			r.Header.Set(DebugAuthzHeader, secret)
+		}
+		w := httptest.NewRecorder()
+		DebugAuthzHandler(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusForbidden, authz("user=testuser", "").Code)
+	assert.Equal(t, http.StatusForbidden, authz("user=testuser", "wrong").Code)
+
+	w := authz("user=testuser", "s3cr3t")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"allowed":true,"rule":"whiteList"}`, w.Body.String())
+
+	w = authz("user=someoneelse", "s3cr3t")
+	assert.Contains(t, w.Body.String(), `"allowed":false`)
+	assert.Contains(t, w.Body.String(), "not found in WhiteList")
+
+	cfg.Cfg.DebugAuthz.Enabled = false
+	assert.Equal(t, http.StatusNotFound, authz("user=testuser", "s3cr3t").Code)
+}
+
+func TestValidateRequestHandlerDebugBody(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	cfg.Cfg.DebugAuthz.Secret = "s3cr3t"
+	cfg.Cfg.DebugAuthz.Validate = true
+	cfg.Cfg.Headers.IDToken = "X-Vouch-IdP-IdToken"
+	defer func() {
+		cfg.Cfg.AllowAllUsers = false
+		cfg.Cfg.DebugAuthz.Secret = ""
+		cfg.Cfg.DebugAuthz.Validate = false
+		cfg.Cfg.Headers.IDToken = ""
+	}()
+	tokenstring := jwtmanager.CreateUserTokenString(structs.User{Username: "testuser"}, structs.CustomClaims{}, structs.PTokens{PIdToken: "eyJ.id.token"})
+
+	validate := func(secret string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+		r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+		if secret != "" {
+			r.Header.Set(DebugAuthzHeader, secret)
+		}
+		w := httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		return w
+	}
+
+	w := validate("s3cr3t")
+	assert.Equal(t, http.StatusOK, w.Code)
+	res := validateResult{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &res))
+	assert.Equal(t, ruleAllowAllUsers, res.Rule)
+	assert.Equal(t, "testuser", res.Headers.Get(cfg.Cfg.Headers.User))
+	assert.Equal(t, "eyJ.id.token", w.Header().Get(cfg.Cfg.Headers.IDToken))
+	assert.Equal(t, "(redacted, 12 bytes)", res.Headers.Get(cfg.Cfg.Headers.IDToken))
+
+	// a wrong secret, or none at all, gets the usual answer
+	assert.NotContains(t, validate("wrong").Body.String(), `"rule"`)
+	assert.NotContains(t, validate("").Body.String(), `"rule"`)
+
+	cfg.Cfg.DebugAuthz.Validate = false
+	assert.NotContains(t, validate("s3cr3t").Body.String(), `"rule"`)
+}
+
+func TestValidateRequestHandlerSensitiveHeaders(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	cfg.Cfg.Headers.IDToken = "X-Vouch-IdP-IdToken"
+	cfg.Cfg.Headers.Sensitive.Headers = []string{"X-Vouch-IdP-IdToken"}
+	cfg.Cfg.Headers.Sensitive.MaxAuthAge = 300
+	cfg.Cfg.Headers.Sensitive.Stale = "omit"
+	defer func() {
+		cfg.Cfg.AllowAllUsers = false
+		cfg.Cfg.Headers.IDToken = ""
+		cfg.Cfg.Headers.Sensitive.Headers = nil
+		cfg.Cfg.Headers.Sensitive.MaxAuthAge = 0
+		cfg.Cfg.Headers.Sensitive.Stale = "omit"
+	}()
+	// the IdP remembered a user who authenticated an hour ago
+	staleIDToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"auth_time": time.Now().Add(-time.Hour).Unix()}).SignedString([]byte("idp"))
+	validate := func(idToken string) *httptest.ResponseRecorder {
+		tokenstring := jwtmanager.CreateUserTokenString(structs.User{Username: "testuser"}, structs.CustomClaims{}, structs.PTokens{PIdToken: idToken})
+		r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+		r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+		w := httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		return w
+	}
+
+	w := validate("eyJ.id.token")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "eyJ.id.token", w.Header().Get("X-Vouch-IdP-IdToken"))
+
+	w = validate(staleIDToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "testuser", w.Header().Get(cfg.Cfg.Headers.User))
+	assert.Empty(t, w.Header().Get("X-Vouch-IdP-IdToken"))
+
+	cfg.Cfg.Headers.Sensitive.Stale = "reauth"
+	assert.Equal(t, http.StatusUnauthorized, validate(staleIDToken).Code)
+	assert.Equal(t, "300", reauthMaxAge())
+}
+
+func TestValidateRequestHandlerDomainHeader(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	defer func() { cfg.Cfg.AllowAllUsers = false }()
+	tokenstring := jwtmanager.CreateUserTokenString(structs.User{Username: "testuser"}, structs.CustomClaims{}, structs.PTokens{})
+
+	validate := func(host string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://"+host+"/validate", nil)
+		r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+		w := httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		return w
+	}
+	w := validate("app.domain1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "domain1", w.Header().Get("X-Vouch-Domain"))
+
+	// allowAllUsers lets in a host outside the vouch.domains
+	w = validate("app.example.com")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("X-Vouch-Domain"))
+}
+
+// validateSites the status of /validate at each of the hosts, for a jwt issued with the domains as the Sites
+func validateSites(t *testing.T, ds []string, hosts map[string]int) {
+	cfg.Cfg.Domains = ds
+	domains.Refresh()
+	jwtmanager.Sites = domains.Sites()
+	defer func() { jwtmanager.Sites = domains.Sites() }()
+	tokenstring := jwtmanager.CreateUserTokenString(structs.User{Username: "testuser"}, structs.CustomClaims{}, structs.PTokens{})
+
+	for host, status := range hosts {
+		r := httptest.NewRequest("GET", "http://"+host+"/validate", nil)
+		r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+		w := httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		assert.Equal(t, status, w.Code, "%s with the domains %s", host, ds)
+	}
+}
+
+func TestValidateRequestHandlerSites(t *testing.T) {
+	setUp()
+	defer setUp()
+	validateSites(t, []string{"example.com"}, map[string]int{
+		"example.com":          http.StatusOK,
+		"app.example.com":      http.StatusOK,
+		"app.example.com:8443": http.StatusOK,
+		"example.com.evil.com": http.StatusUnauthorized,
+		"evilexample.com":      http.StatusUnauthorized,
+	})
+	for _, wildcard := range []string{"*.example.com", ".example.com"} {
+		validateSites(t, []string{wildcard}, map[string]int{
+			"app.example.com": http.StatusOK,
+			"example.com":     http.StatusUnauthorized,
+			"evilexample.com": http.StatusUnauthorized,
+		})
+	}
+	// the Sites of a jwt issued before they were normalized, as the domains were configured
+	claims := &jwtmanager.VouchClaims{Sites: []string{"*.example.com"}}
+	assert.True(t, jwtmanager.SiteInClaims("app.example.com", claims))
+	assert.False(t, jwtmanager.SiteInClaims("example.com", claims))
+}
+
+func TestValidateRequestHandlerSitesCase(t *testing.T) {
+	setUp()
+	defer setUp()
+	validateSites(t, []string{"Example.COM"}, map[string]int{
+		"example.com":     http.StatusOK,
+		"APP.Example.com": http.StatusOK,
+		"evilexample.com": http.StatusUnauthorized,
+	})
+	// the Sites of a jwt issued before they were lower cased
+	assert.True(t, jwtmanager.SiteInClaims("app.example.com", &jwtmanager.VouchClaims{Sites: []string{"Example.COM"}}))
+}
+
+func TestValidateRequestHandlerSitesIDN(t *testing.T) {
+	setUp()
+	defer setUp()
+	// browsers send the Host of an international domain as punycode
+	validateSites(t, []string{"bücher.example"}, map[string]int{
+		"xn--bcher-kva.example":     http.StatusOK,
+		"app.xn--bcher-kva.example": http.StatusOK,
+		"bucher.example":            http.StatusUnauthorized,
+	})
+	validateSites(t, []string{"xn--mnchen-3ya.example"}, map[string]int{
+		"xn--mnchen-3ya.example": http.StatusOK,
+	})
+	// the Sites of a jwt issued before they were converted to punycode
+	assert.True(t, jwtmanager.SiteInClaims("xn--bcher-kva.example", &jwtmanager.VouchClaims{Sites: []string{"bücher.example"}}))
+	assert.True(t, jwtmanager.SiteInClaims("münchen.example", &jwtmanager.VouchClaims{Sites: []string{"xn--mnchen-3ya.example"}}))
+}
+
+func TestCheckCallbackURLs(t *testing.T) {
+	setUp()
+	callbackURL := cfg.GenOAuth.RedirectURL
+	defer func() {
+		cfg.GenOAuth.RedirectURL = callbackURL
+		setUp()
+	}()
+	cfg.Cfg.Domains = []string{"*.example.com"}
+	domains.Refresh()
+	cfg.GenOAuth.RedirectURL = "https://vouch.example.com/auth"
+	assert.Nil(t, checkCallbackURLs())
+	cfg.GenOAuth.RedirectURL = "https://vouch.example.com.evil.com/auth"
+	assert.NotNil(t, checkCallbackURLs())
+	cfg.GenOAuth.RedirectURL = "https://evil.com/auth?vouch.example.com"
+	assert.NotNil(t, checkCallbackURLs())
+}
+
+func TestValidateRequestHandlerProviderHeader(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	defer func() { cfg.Cfg.AllowAllUsers = false }()
+	u := structs.User{Username: "testuser", Email: "test@example.com"}
+	customClaims := structs.CustomClaims{Claims: map[string]interface{}{structs.ProviderClaim: "github"}}
+	tokenstring := jwtmanager.CreateUserTokenString(u, customClaims, structs.PTokens{})
+
+	r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+	r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+	w := httptest.NewRecorder()
+	ValidateRequestHandler(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "github", w.Header().Get(cfg.Cfg.Headers.Provider))
+}
+
+func TestValidateRequestHandlerOptionalAuthPaths(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	cfg.Cfg.OptionalAuthPaths = []string{"/blog/*"}
+	defer func() {
+		cfg.Cfg.AllowAllUsers = false
+		cfg.Cfg.OptionalAuthPaths = nil
+	}()
+	tokenstring := jwtmanager.CreateUserTokenString(structs.User{Username: "testuser"}, structs.CustomClaims{}, structs.PTokens{})
+
+	validate := func(uri, jwt string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+		r.Header.Set("X-Forwarded-Uri", uri)
+		if jwt != "" {
+			r.Header.Set(cfg.Cfg.Headers.JWT, jwt)
+		}
+		w := httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		return w
+	}
+
+	w := validate("/blog/post?id=1", "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get("X-Vouch-Anonymous"))
+	assert.Equal(t, "", w.Header().Get(cfg.Cfg.Headers.User))
+
+	w = validate("/blog/post", "not.a.jwt")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "true", w.Header().Get("X-Vouch-Anonymous"))
+
+	w = validate("/blog/post", tokenstring)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", w.Header().Get("X-Vouch-Anonymous"))
+	assert.Equal(t, "testuser", w.Header().Get(cfg.Cfg.Headers.User))
+
+	assert.Equal(t, http.StatusUnauthorized, validate("/admin", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, validate("", "").Code)
+}
+
+func TestValidateRequestHandlerExpiresIn(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	defer func() { cfg.Cfg.AllowAllUsers = false }()
+	tokenstring := jwtmanager.CreateUserTokenString(structs.User{Username: "testuser"}, structs.CustomClaims{}, structs.PTokens{})
+
+	r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+	r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+	w := httptest.NewRecorder()
+	ValidateRequestHandler(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	expiresIn, err := strconv.Atoi(w.Header().Get("X-Vouch-Expires-In"))
+	assert.Nil(t, err)
+	assert.InDelta(t, cfg.Cfg.JWT.MaxAge*60, expiresIn, 5)
+}
+
+func TestValidateRequestHandlerForwardAccessTokenHosts(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	cfg.Cfg.Headers.AccessToken = "X-Vouch-IdP-AccessToken"
+	cfg.Cfg.Headers.ForwardAccessTokenHosts = []string{"api.domain1", ".internal.domain1"}
+	defer func() {
+		cfg.Cfg.AllowAllUsers = false
+		cfg.Cfg.Headers.AccessToken = ""
+		cfg.Cfg.Headers.ForwardAccessTokenHosts = nil
+	}()
+	u := structs.User{Username: "testuser", Email: "test@example.com"}
+	tokenstring := jwtmanager.CreateUserTokenString(u, structs.CustomClaims{}, structs.PTokens{PAccessToken: "at"})
+
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"api.domain1", "at"},
+		{"API.domain1:8443", "at"},
+		{"svc.internal.domain1", "at"},
+		{"internal.domain1", "at"},
+		{"vouch.domain1", ""},
+		{"evilinternal.domain1", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://"+tt.host+"/validate", nil)
+		r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+		w := httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code, tt.host)
+		assert.Equal(t, tt.want, w.Header().Get(cfg.Cfg.Headers.AccessToken), tt.host)
+	}
+}
+
+func TestValidateRequestHandlerMethodTeams(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	cfg.Cfg.MethodTeams = map[string][]string{
+		"delete": {"org/admins"},
+		"unsafe": {"org/writers", "org/admins"},
+	}
+	defer func() {
+		cfg.Cfg.AllowAllUsers = false
+		cfg.Cfg.MethodTeams = nil
+	}()
+
+	validate := func(teams []string, method string) int {
+		u := structs.User{Username: "testuser", Email: "test@example.com"}
+		customClaims := structs.CustomClaims{Claims: map[string]interface{}{structs.TeamsClaim: teams}}
+		tokenstring := jwtmanager.CreateUserTokenString(u, customClaims, structs.PTokens{})
+		r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+		r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+		if method != "" {
+			r.Header.Set("X-Forwarded-Method", method)
+		}
+		w := httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		return w.Code
+	}
+
+	tests := []struct {
+		name   string
+		teams  []string
+		method string
+		want   int
+	}{
+		{"safe method is unrestricted", nil, "GET", http.StatusOK},
+		{"unsafe method without team", []string{"org/readers"}, "POST", http.StatusForbidden},
+		{"unsafe method with team", []string{"org/writers"}, "post", http.StatusOK},
+		{"method listed itself", []string{"org/writers"}, "DELETE", http.StatusForbidden},
+		{"method listed itself with team", []string{"org/admins"}, "DELETE", http.StatusOK},
+		{"missing header fails closed", []string{"org/readers"}, "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, validate(tt.teams, tt.method))
+		})
+	}
+}
+
+func TestValidateRequestHandlerPathPolicies(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	cfg.Cfg.PathPolicies = []cfg.PathPolicy{
+		{Prefix: "/admin/*", Teams: []string{"org/admins"}},
+		{Regex: `^/reports/[0-9]+$`, Teams: []string{"org/analysts", "org/admins"}},
+		{Prefix: "/", Teams: []string{"org/everyone"}},
+	}
+	assert.Nil(t, ConfigurePathPolicies())
+	defer func() {
+		cfg.Cfg.AllowAllUsers = false
+		cfg.Cfg.PathPolicies = nil
+		assert.Nil(t, ConfigurePathPolicies())
+	}()
+
+	validate := func(teams []string, uri string) int {
+		u := structs.User{Username: "testuser", Email: "test@example.com"}
+		customClaims := structs.CustomClaims{Claims: map[string]interface{}{structs.TeamsClaim: teams}}
+		tokenstring := jwtmanager.CreateUserTokenString(u, customClaims, structs.PTokens{})
+		r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+		r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+		if uri != "" {
+			r.Header.Set("X-Forwarded-Uri", uri)
+		}
+		w := httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		return w.Code
+	}
+
+	tests := []struct {
+		name  string
+		teams []string
+		uri   string
+		want  int
+	}{
+		{"prefix without team", []string{"org/everyone"}, "/admin/users", http.StatusForbidden},
+		{"prefix with team", []string{"org/admins"}, "/admin/users?page=2", http.StatusOK},
+		{"regex with team", []string{"org/analysts"}, "/reports/42", http.StatusOK},
+		{"regex does not match, next policy", []string{"org/analysts"}, "/reports/all", http.StatusForbidden},
+		{"first match wins", []string{"org/everyone"}, "/admin/", http.StatusForbidden},
+		{"catch all", []string{"org/everyone"}, "/index.html", http.StatusOK},
+		{"missing header fails closed", []string{"org/admins"}, "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, validate(tt.teams, tt.uri))
+		})
+	}
+
+	cfg.Cfg.PathPolicies = []cfg.PathPolicy{{Prefix: "/admin/", Regex: "^/admin/", Teams: []string{"org/admins"}}}
+	assert.NotNil(t, ConfigurePathPolicies())
+	cfg.Cfg.PathPolicies = []cfg.PathPolicy{{Regex: "(", Teams: []string{"org/admins"}}}
+	assert.NotNil(t, ConfigurePathPolicies())
+	cfg.Cfg.PathPolicies = []cfg.PathPolicy{{Prefix: "/admin/"}}
+	assert.NotNil(t, ConfigurePathPolicies())
+}
+
+func TestCallbackHandlerMissingParams(t *testing.T) {
+	setUp()
+	for _, tt := range []struct {
+		query  string
+		status int
+		msg    string
+	}{
+		{"code=123", http.StatusBadRequest, "missing the state parameter"},
+		{"state=abc&error=access_denied&error_description=user+said+no", http.StatusForbidden, "You declined to authorize the login (user said no)"},
+		{"state=abc&error=access_denied", http.StatusForbidden, `<a href="/login">try again</a>`},
+		{"state=abc&error=server_error&error_description=try+later", http.StatusForbidden, "FORBIDDEN: try later"},
+		{"state=abc&error=temporarily_unavailable", http.StatusForbidden, "FORBIDDEN: temporarily_unavailable"},
+		{"state=abc&session_state=benign", http.StatusBadRequest, "missing code"},
+	} {
+		r := httptest.NewRequest("GET", "http://vouch.domain1/auth?"+tt.query, nil)
+		// a session with a matching state
+		w := httptest.NewRecorder()
+		session, _ := sessstore.Get(r, cfg.Cfg.Session.Name)
+		session.Values["state"] = "abc"
+		assert.Nil(t, session.Save(r, w))
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+
+		w = httptest.NewRecorder()
+		CallbackHandler(w, r)
+		assert.Equal(t, tt.status, w.Code, tt.query)
+		assert.Contains(t, w.Body.String(), tt.msg, tt.query)
+	}
+}
+
+func TestCallbackHandlerAccessDeniedRedirect(t *testing.T) {
+	setUp()
+	cfg.Cfg.AccessDenied.Redirect = "https://example.com/declined"
+	defer func() { cfg.Cfg.AccessDenied.Redirect = "" }()
+
+	r := httptest.NewRequest("GET", "http://vouch.domain1/auth?state=abc&error=access_denied", nil)
+	w := httptest.NewRecorder()
+	session, _ := sessstore.Get(r, cfg.Cfg.Session.Name)
+	session.Values["state"] = "abc"
+	assert.Nil(t, session.Save(r, w))
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+
+	w = httptest.NewRecorder()
+	CallbackHandler(w, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "https://example.com/declined", w.Header().Get("Location"))
+}
+
+func TestStateCarrier(t *testing.T) {
+	setUp()
+	dir, err := ioutil.TempDir("", "vouch-sessions")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(store, path string) {
+		cfg.Cfg.Session.Store, cfg.Cfg.Session.Path = store, path
+		sessstore = newStateCarrier()
+	}(cfg.Cfg.Session.Store, cfg.Cfg.Session.Path)
+
+	for _, store := range []string{"cookie", "filesystem"} {
+		cfg.Cfg.Session.Store, cfg.Cfg.Session.Path = store, dir
+		sessstore = newStateCarrier()
+
+		r := httptest.NewRequest("GET", "http://vouch.domain1/auth?state=abc", nil)
+		w := httptest.NewRecorder()
+		session, _ := sessstore.Get(r, cfg.Cfg.Session.Name)
+		session.Values["state"] = "abc"
+		assert.Nil(t, session.Save(r, w), store)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+
+		// the state is found, the callback goes on to complain about the missing code
+		w = httptest.NewRecorder()
+		CallbackHandler(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code, store)
+		assert.Contains(t, w.Body.String(), "missing code", store)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1)
+}
+
+func TestLoginStateCookie(t *testing.T) {
+	setUp()
+	defer func() {
+		cfg.Cfg.Session.Cookie.Secure = false
+		sessstore = newStateCarrier()
+	}()
+	cfg.Cfg.Session.Cookie.Secure = true
+	sessstore = newStateCarrier()
+
+	r := httptest.NewRequest("GET", "http://vouch.domain1/login?url=http://vouch.domain1/app", nil)
+	w := httptest.NewRecorder()
+	LoginHandler(w, r)
+
+	var stateCookie string
+	for _, c := range w.Header()["Set-Cookie"] {
+		if strings.HasPrefix(c, cfg.Cfg.Session.Name+"=") {
+			stateCookie = c
+		}
+	}
+	assert.Contains(t, stateCookie, "HttpOnly")
+	assert.Contains(t, stateCookie, "Secure")
+	assert.Contains(t, stateCookie, "SameSite=Lax")
+	assert.Contains(t, stateCookie, "Max-Age=300")
+}
+
+func TestStateCookieAttributes(t *testing.T) {
+	setUp()
+	defer func() {
+		cfg.Cfg.Session.Cookie.Path = "/"
+		sessstore = newStateCarrier()
+	}()
+	cfg.Cfg.Session.Cookie.Path = "/vouch"
+	sessstore = newStateCarrier()
+	stateCookie := func(w *httptest.ResponseRecorder) string {
+		for _, c := range w.Header()["Set-Cookie"] {
+			if strings.HasPrefix(c, cfg.Cfg.Session.Name+"=") {
+				return c
+			}
+		}
+		return ""
+	}
+
+	// the logout expires the login state cookie without changing the store for the logins which follow
+	w := httptest.NewRecorder()
+	LogoutHandler(w, httptest.NewRequest("GET", "http://vouch.domain1/logout", nil))
+	assert.Contains(t, stateCookie(w), "Max-Age=0")
+	assert.Contains(t, stateCookie(w), "Path=/vouch")
+
+	w = httptest.NewRecorder()
+	LoginHandler(w, httptest.NewRequest("GET", "http://vouch.domain1/login?url=http://vouch.domain1/app", nil))
+	assert.Contains(t, stateCookie(w), "Max-Age=300")
+	assert.Contains(t, stateCookie(w), "Path=/vouch")
+}
+
+func TestDefaultPostLoginURL(t *testing.T) {
+	setUp()
+	defer func() { cfg.Cfg.DefaultPostLoginURL = "" }()
+
+	w := httptest.NewRecorder()
+	LoginHandler(w, httptest.NewRequest("GET", "http://vouch.domain1/login", nil))
+	assert.Contains(t, w.Body.String(), "no destination URL requested")
+
+	cfg.Cfg.DefaultPostLoginURL = "https://app.vouch.domain1/"
+	assert.Nil(t, checkDefaultPostLoginURL())
+	r := httptest.NewRequest("GET", "http://vouch.domain1/login", nil)
+	w = httptest.NewRecorder()
+	LoginHandler(w, r)
+	assert.Equal(t, http.StatusFound, w.Code)
+	session, _ := sessstore.Get(r, cfg.Cfg.Session.Name)
+	assert.Equal(t, "https://app.vouch.domain1/", session.Values["requestedURL"])
+
+	cfg.Cfg.DefaultPostLoginURL = "https://evil.example.com/"
+	assert.NotNil(t, checkDefaultPostLoginURL())
+	cfg.Cfg.DefaultPostLoginURL = "/welcome"
+	assert.NotNil(t, checkDefaultPostLoginURL())
+}
+
+func TestLoginTimeout(t *testing.T) {
+	setUp()
+	cfg.Cfg.Session.LoginTimeout = 60
+	defer func() { cfg.Cfg.Session.LoginTimeout = 0 }()
+
+	callback := func(values map[interface{}]interface{}) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://vouch.domain1/auth?state=abc", nil)
+		w := httptest.NewRecorder()
+		session, _ := sessstore.Get(r, cfg.Cfg.Session.Name)
+		for k, v := range values {
+			session.Values[k] = v
+		}
+		assert.Nil(t, session.Save(r, w))
+		r = httptest.NewRequest("GET", "http://vouch.domain1/auth?state=abc", nil)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		w = httptest.NewRecorder()
+		CallbackHandler(w, r)
+		return w
+	}
+
+	// in time, the callback goes on to complain about the missing code
+	w := callback(map[interface{}]interface{}{"state": "abc", stateIssuedAt: time.Now().Add(-30 * time.Second).Unix()})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "missing code")
+
+	w = callback(map[interface{}]interface{}{"state": "abc", stateIssuedAt: time.Now().Add(-90 * time.Second).Unix()})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "login timed out, please retry.")
+
+	// stored without the time
+	w = callback(map[interface{}]interface{}{"state": "abc"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestCallbackHost(t *testing.T) {
+	setUp()
+	defer func() { cfg.Cfg.Session.CallbackHost = true }()
+
+	callback := func(loginHost, callbackHost string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://"+loginHost+"/login?url=http://app.domain1/", nil)
+		w := httptest.NewRecorder()
+		LoginHandler(w, r)
+		session, _ := sessstore.Get(r, cfg.Cfg.Session.Name)
+		state := session.Values["state"].(string)
+
+		r = httptest.NewRequest("GET", "http://"+callbackHost+"/auth?state="+url.QueryEscape(state), nil)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		w = httptest.NewRecorder()
+		CallbackHandler(w, r)
+		return w
+	}
+
+	// on the same host the callback goes on to complain about the missing code
+	w := callback("vouch.domain1", "Vouch.Domain1")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "missing code")
+
+	w = callback("vouch.domain1", "other.domain1")
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "callback host does not match the login host")
+
+	cfg.Cfg.Session.CallbackHost = false
+	w = callback("vouch.domain1", "other.domain1")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "missing code")
+}
+
+func TestCallbackCookiesBlocked(t *testing.T) {
+	setUp()
+	defer func() { cfg.Cfg.Session.CookiesBlockedURL = "" }()
+	callback := func(state string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://vouch.domain1/auth?state="+url.QueryEscape(state), nil)
+		w := httptest.NewRecorder()
+		CallbackHandler(w, r)
+		return w
+	}
+
+	state := signState("abc")
+	assert.True(t, stateSigned(state))
+	w := callback(state)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "cookies appear to be blocked")
+
+	// a state this Vouch Proxy didn't sign is just invalid
+	for _, forged := range []string{"abc", "abc.0123456789abcdef0123456789abcdef", state + "x"} {
+		assert.False(t, stateSigned(forged), forged)
+		assert.Contains(t, callback(forged).Body.String(), "Invalid session state", forged)
+	}
+
+	cfg.Cfg.Session.CookiesBlockedURL = "https://vouch.domain1/cookies.html"
+	w = callback(state)
+	assert.Equal(t, http.StatusFound, w.Code)
+	assert.Equal(t, "https://vouch.domain1/cookies.html", w.Header().Get("Location"))
+}
+
+func TestLoginStateRetried(t *testing.T) {
+	setUp()
+	dir, err := ioutil.TempDir("", "vouch-sessions")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	defer func(store, path string) {
+		cfg.Cfg.Session.Store, cfg.Cfg.Session.Path = store, path
+		cfg.Cfg.Session.StateAttempts, cfg.Cfg.Session.StateBackoff = 1, 100
+		sessstore = newStateCarrier()
+	}(cfg.Cfg.Session.Store, cfg.Cfg.Session.Path)
+	cfg.Cfg.Session.Store, cfg.Cfg.Session.Path = "filesystem", dir
+	cfg.Cfg.Session.StateBackoff = 20
+	sessstore = newStateCarrier()
+
+	// the callback reaches an instance which sees the state written at /login only a little later
+	callback := func(attempts int) int {
+		cfg.Cfg.Session.StateAttempts = attempts
+		r := httptest.NewRequest("GET", "http://vouch.domain1/auth?state=abc", nil)
+		w := httptest.NewRecorder()
+		session, _ := sessstore.Get(r, cfg.Cfg.Session.Name)
+		session.Values["state"] = "abc"
+		assert.Nil(t, session.Save(r, w))
+		// a new request, the session saved above is not in its registry
+		r = httptest.NewRequest("GET", "http://vouch.domain1/auth?state=abc", nil)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		file := filepath.Join(dir, "session_"+session.ID)
+		assert.Nil(t, os.Rename(file, file+".lagging"))
+		done := make(chan struct{})
+		go func() {
+			time.Sleep(30 * time.Millisecond)
+			os.Rename(file+".lagging", file)
+			close(done)
+		}()
+
+		w = httptest.NewRecorder()
+		CallbackHandler(w, r)
+		<-done
+		return w.Code
+	}
+	assert.Equal(t, http.StatusInternalServerError, callback(1))
+	// read again after 20ms and 40ms more, the callback goes on to complain about the missing code
+	assert.Equal(t, http.StatusBadRequest, callback(3))
+}
+
+func TestValidateRequestHandlerFingerprint(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	defer func() {
+		cfg.Cfg.AllowAllUsers, cfg.Cfg.PublicAccess = false, false
+		cfg.Cfg.Fingerprint.Components = nil
+	}()
+
+	request := func(userAgent, remoteAddr string) *http.Request {
+		r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+		r.Header.Set("User-Agent", userAgent)
+		r.RemoteAddr = remoteAddr
+		return r
+	}
+	validate := func(tokenstring, userAgent, remoteAddr string) int {
+		r := request(userAgent, remoteAddr)
+		r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+		w := httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		return w.Code
+	}
+
+	cfg.Cfg.Fingerprint.Components = []string{"userAgent", "ip"}
+	login := request("Firefox", "192.0.2.10:41000")
+	tokenstring := jwtmanager.CreateUserTokenString(structs.User{Username: "testuser"},
+		structs.CustomClaims{Claims: map[string]interface{}{structs.FingerprintClaim: clientFingerprint(login)}}, structs.PTokens{})
+	assert.Equal(t, http.StatusOK, validate(tokenstring, "Firefox", "192.0.2.10:41000"))
+	// the same /24
+	assert.Equal(t, http.StatusOK, validate(tokenstring, "Firefox", "192.0.2.99:41000"))
+	assert.Equal(t, http.StatusUnauthorized, validate(tokenstring, "curl", "192.0.2.10:41000"))
+	assert.Equal(t, http.StatusUnauthorized, validate(tokenstring, "Firefox", "198.51.100.10:41000"))
+
+	// a session from before fingerprint was configured
+	unbound := jwtmanager.CreateUserTokenString(structs.User{Username: "testuser"}, structs.CustomClaims{}, structs.PTokens{})
+	assert.Equal(t, http.StatusUnauthorized, validate(unbound, "Firefox", "192.0.2.10:41000"))
+
+	// with publicAccess the request is let through as anonymous, as for any other invalid session
+	cfg.Cfg.PublicAccess = true
+	r := request("curl", "192.0.2.10:41000")
+	r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+	w := httptest.NewRecorder()
+	ValidateRequestHandler(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "", w.Header().Get(cfg.Cfg.Headers.User))
+	assert.Empty(t, w.Header().Get(cfg.Cfg.Headers.Success))
+
+	// a roaming mobile user keeps the session with userAgent alone
+	cfg.Cfg.Fingerprint.Components = []string{"userAgent"}
+	tokenstring = jwtmanager.CreateUserTokenString(structs.User{Username: "testuser"},
+		structs.CustomClaims{Claims: map[string]interface{}{structs.FingerprintClaim: clientFingerprint(login)}}, structs.PTokens{})
+	assert.Equal(t, http.StatusOK, validate(tokenstring, "Firefox", "198.51.100.10:41000"))
+}
+
+func TestValidateRequestHandlerPicture(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	cfg.Cfg.Headers.Picture = "X-Vouch-Picture"
+	defer func() {
+		cfg.Cfg.AllowAllUsers = false
+		cfg.Cfg.Headers.Picture = ""
+	}()
+
+	tokenstring := jwtmanager.CreateUserTokenString(structs.User{Username: "testuser"},
+		structs.CustomClaims{Claims: map[string]interface{}{structs.PictureClaim: "https://example.com/robin.png"}}, structs.PTokens{})
+	r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+	r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+	w := httptest.NewRecorder()
+	ValidateRequestHandler(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "https://example.com/robin.png", w.Header().Get("X-Vouch-Picture"))
+}
+
+func TestValidateRequestHandlerTeams(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	cfg.Cfg.Headers.Teams = "X-Vouch-Teams"
+	defer func() {
+		cfg.Cfg.AllowAllUsers = false
+		cfg.Cfg.Headers.Teams = ""
+	}()
+
+	validate := func(customClaims structs.CustomClaims) *httptest.ResponseRecorder {
+		tokenstring := jwtmanager.CreateUserTokenString(structs.User{Username: "testuser"}, customClaims, structs.PTokens{})
+		r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+		r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+		w := httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		return w
+	}
+
+	w := validate(structs.CustomClaims{Claims: map[string]interface{}{structs.TeamsClaim: []string{"myOrg/admins", "myOrg/writers"}}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "myOrg/admins,myOrg/writers", w.Header().Get("X-Vouch-Teams"))
+
+	// the teams weren't recorded at login
+	w = validate(structs.CustomClaims{})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("X-Vouch-Teams"))
+}
+
+func TestValidateRequestHandlerDuplicateCookies(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	defer func() {
+		cfg.Cfg.AllowAllUsers = false
+		cfg.Cfg.Cookie.Duplicates = "first_valid"
+	}()
+	tokenstring := jwtmanager.CreateUserTokenString(structs.User{Username: "testuser"}, structs.CustomClaims{}, structs.PTokens{})
+
+	// a stale cookie for the old cookie.domain arrives before the current one
+	validate := func() int {
+		r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+		r.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: "eyJhbGciOiJIUzI1NiJ9.e30.c3RhbGU"})
+		r.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: tokenstring})
+		w := httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusOK, validate())
+
+	cfg.Cfg.Cookie.Duplicates = "first"
+	assert.Equal(t, http.StatusUnauthorized, validate())
+}
+
+func TestFindJWTBearer(t *testing.T) {
+	setUp()
+	r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+	r.Header.Set("Authorization", "Bearer eyJjwt")
+	assert.Equal(t, "", FindJWT(r))
+
+	cfg.Cfg.AllowBearerToken = true
+	defer func() { cfg.Cfg.AllowBearerToken = false }()
+	assert.Equal(t, "eyJjwt", FindJWT(r))
+
+	r.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	assert.Equal(t, "", FindJWT(r))
+}
+
+func TestValidateRequestHandlerHead(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	defer func() { cfg.Cfg.AllowAllUsers = false }()
+	tokenstring := jwtmanager.CreateUserTokenString(structs.User{Username: "testuser"}, structs.CustomClaims{}, structs.PTokens{})
+
+	for _, method := range []string{"GET", "HEAD"} {
+		r := httptest.NewRequest(method, "http://vouch.domain1/validate", nil)
+		r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+		w := httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		assert.Equal(t, http.StatusOK, w.Code, method)
+		assert.Equal(t, "testuser", w.Header().Get(cfg.Cfg.Headers.User), method)
+		if method == "HEAD" {
+			assert.Equal(t, 0, w.Body.Len())
+		} else {
+			assert.NotEqual(t, 0, w.Body.Len())
+		}
+
+		// without a jwt
+		r = httptest.NewRequest(method, "http://vouch.domain1/validate", nil)
+		w = httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		assert.Equal(t, http.StatusUnauthorized, w.Code, method)
+		if method == "HEAD" {
+			assert.Equal(t, 0, w.Body.Len())
+		}
+	}
+}
+
+func TestValidateRequestHandlerSourcePrecedence(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	defer func() {
+		cfg.Cfg.AllowAllUsers = false
+		cfg.Cfg.Session.SourcePrecedence = "cookie"
+	}()
+	valid := jwtmanager.CreateUserTokenString(structs.User{Username: "testuser"}, structs.CustomClaims{}, structs.PTokens{})
+	invalid := "not.a.jwt"
+
+	validate := func(fromCookie, fromHeader string) int {
+		r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+		r.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name, Value: fromCookie})
+		r.Header.Set(cfg.Cfg.Headers.JWT, fromHeader)
+		w := httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		return w.Code
+	}
+
+	tests := []struct {
+		precedence string
+		cookie     string
+		header     string
+		want       int
+	}{
+		{"cookie", invalid, valid, http.StatusUnauthorized},
+		{"cookie", valid, invalid, http.StatusOK},
+		{"header", invalid, valid, http.StatusOK},
+		{"header", valid, invalid, http.StatusUnauthorized},
+		{"cookie_then_header", invalid, valid, http.StatusOK},
+		{"cookie_then_header", valid, invalid, http.StatusOK},
+		{"cookie_then_header", invalid, invalid, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		cfg.Cfg.Session.SourcePrecedence = tt.precedence
+		assert.Equal(t, tt.want, validate(tt.cookie, tt.header), "%s cookie=%s header=%s", tt.precedence, tt.cookie, tt.header)
+	}
+}
+
+func TestValidateRequestHandlerTeamRecheck(t *testing.T) {
+	setUp()
+	// skips the check of the Host against the sites in the jwt, the teams are rechecked regardless
+	cfg.Cfg.AllowAllUsers = true
+	cfg.Cfg.TeamWhiteList = []string{"org/team"}
+	memberships := []string{"org/team"}
+	lookups := 0
+	lookupMemberships = func(username string, accessToken string) ([]string, error) {
+		lookups++
+		assert.Equal(t, "testuser", username)
+		assert.Equal(t, "ghtoken", accessToken)
+		return memberships, nil
+	}
+	defer func() {
+		cfg.Cfg.AllowAllUsers = false
+		cfg.Cfg.TeamWhiteList = nil
+		cfg.Cfg.TeamRecheck.Interval = 0
+		lookupMemberships = github.Memberships
+		teamRechecks = make(map[string]teamRecheck)
+	}()
+
+	validate := func(tokenstring string) int {
+		r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+		r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+		w := httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		return w.Code
+	}
+	u := structs.User{Username: "testuser", Email: "test@example.com"}
+	ptokens := structs.PTokens{PAccessToken: "ghtoken"}
+
+	// issued before the recheck was enabled, so never checked
+	stale := jwtmanager.CreateUserTokenString(u, structs.CustomClaims{}, ptokens)
+	cfg.Cfg.TeamRecheck.Interval = 60
+	fresh := jwtmanager.CreateUserTokenString(u, structs.CustomClaims{}, ptokens)
+
+	assert.Equal(t, http.StatusOK, validate(fresh))
+	assert.Equal(t, 0, lookups)
+
+	assert.Equal(t, http.StatusOK, validate(stale))
+	assert.Equal(t, http.StatusOK, validate(stale))
+	assert.Equal(t, 1, lookups, "the recheck is cached for the interval")
+
+	// removed from the team
+	memberships = nil
+	teamRechecks = make(map[string]teamRecheck)
+	assert.Equal(t, http.StatusUnauthorized, validate(stale))
+	assert.Equal(t, http.StatusOK, validate(fresh))
+	assert.Equal(t, 2, lookups)
+}
+
+func TestLimitRequestBody(t *testing.T) {
+	setUp()
+	cfg.Cfg.Limits.MaxBodyBytes = 10
+	defer func() { cfg.Cfg.Limits.MaxBodyBytes = 64 * 1024 }()
+
+	var readErr error
+	h := LimitRequestBody(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = ioutil.ReadAll(r.Body)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "http://vouch.example.com/backchannel-logout", strings.NewReader("0123456789")))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NoError(t, readErr)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("POST", "http://vouch.example.com/backchannel-logout", strings.NewReader("0123456789a")))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+
+	// without a Content-Length the body is cut off at the limit
+	r := httptest.NewRequest("POST", "http://vouch.example.com/backchannel-logout", strings.NewReader("0123456789a"))
+	r.ContentLength = -1
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Error(t, readErr)
+}
+
+func TestTimeoutRequests(t *testing.T) {
+	setUp()
+	cfg.Cfg.Limits.RequestTimeout = 1
+	defer func() { cfg.Cfg.Limits.RequestTimeout = 14 }()
+
+	// the handler runs until its context is cancelled
+	h := TimeoutRequests(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ws" {
+			w.WriteHeader(http.StatusSwitchingProtocols)
+			return
+		}
+		<-r.Context().Done()
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://vouch.example.com/auth", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "http://vouch.example.com/ws", nil))
+	assert.Equal(t, http.StatusSwitchingProtocols, w.Code)
+}
+
+func TestClaimTemplates(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	cfg.Cfg.Headers.Claims = []string{"groups", "email"}
+	cfg.Cfg.Headers.ClaimTemplates = []cfg.ClaimTemplate{
+		{Claim: "groups", Header: "X-Vouch-Groups", Template: `{{ join (prefix "myapp:" .) "," }}`},
+		{Claim: "email", Template: `{{ .missing }}`},
+	}
+	defer func() {
+		cfg.Cfg.AllowAllUsers = false
+		cfg.Cfg.Headers.Claims = nil
+		cfg.Cfg.Headers.ClaimTemplates = nil
+		assert.Nil(t, ConfigureClaimTemplates())
+	}()
+	assert.Nil(t, ConfigureClaimTemplates())
+
+	u := structs.User{Username: "testuser"}
+	customClaims := structs.CustomClaims{Claims: map[string]interface{}{"groups": []interface{}{"admins", "users"}, "email": "test@example.com"}}
+	tokenstring := jwtmanager.CreateUserTokenString(u, customClaims, structs.PTokens{})
+
+	r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+	r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+	w := httptest.NewRecorder()
+	ValidateRequestHandler(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "myapp:admins,myapp:users", w.Header().Get("X-Vouch-Groups"))
+	assert.Empty(t, w.Header().Get(cfg.Cfg.Headers.ClaimHeader+"groups"))
+	// a template which fails to evaluate omits the header
+	assert.Empty(t, w.Header().Get(cfg.Cfg.Headers.ClaimHeader+"email"))
+
+	cfg.Cfg.Headers.ClaimTemplates[0].Template = "{{ join . "
+	assert.NotNil(t, ConfigureClaimTemplates())
+}
+
+func TestUserTemplate(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	cfg.Cfg.Headers.UserTemplate = `corp\{{ stripdomain . }}`
+	defer func() {
+		cfg.Cfg.AllowAllUsers = false
+		cfg.Cfg.Headers.UserTemplate = ""
+		assert.Nil(t, ConfigureClaimTemplates())
+	}()
+	assert.Nil(t, ConfigureClaimTemplates())
+
+	tokenstring := jwtmanager.CreateUserTokenString(structs.User{Username: "alice@example.com"}, structs.CustomClaims{}, structs.PTokens{})
+	r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+	r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+	w := httptest.NewRecorder()
+	ValidateRequestHandler(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `corp\alice`, w.Header().Get(cfg.Cfg.Headers.User))
+	assert.Equal(t, `corp\alice`, forwardedUser(`OLDCORP\alice`))
+
+	cfg.Cfg.Headers.UserTemplate = "{{ stripdomain "
+	assert.NotNil(t, ConfigureClaimTemplates())
+}
+
+// observeLogs the entries of the log and the fastlog from now on, until the returned func puts them back
+func observeLogs() (*observer.ObservedLogs, func()) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	l, fl := log, fastlog
+	fastlog = zap.New(core)
+	log = fastlog.Sugar()
+	return logs, func() { log, fastlog = l, fl }
+}
+
+// logged everything of the entries, as they'd be written to the log
+func logged(logs *observer.ObservedLogs) string {
+	var b strings.Builder
+	for _, e := range logs.All() {
+		fmt.Fprintf(&b, "%s %v\n", e.Message, e.ContextMap())
+	}
+	return b.String()
+}
+
+func TestValidateRequestHandlerMaskPII(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	cfg.Cfg.MaskPII = true
+	cfg.Cfg.Headers.Claims = []string{"email"}
+	defer func() {
+		cfg.Cfg.AllowAllUsers = false
+		cfg.Cfg.MaskPII = false
+		cfg.Cfg.Headers.Claims = nil
+	}()
+	logs, restore := observeLogs()
+	defer restore()
+
+	u := structs.User{Username: "alice@example.com", Email: "alice@example.com"}
+	customClaims := structs.CustomClaims{Claims: map[string]interface{}{"email": "alice@example.com"}}
+	tokenstring := jwtmanager.CreateUserTokenString(u, customClaims, structs.PTokens{})
+	r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+	r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+	w := httptest.NewRecorder()
+	ValidateRequestHandler(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "alice@example.com", w.Header().Get(cfg.Cfg.Headers.User))
+
+	assert.NotEmpty(t, logs.All())
+	assert.NotContains(t, logged(logs), "alice@example.com")
+	// nor the jwt, which carries it
+	assert.NotContains(t, logged(logs), tokenstring)
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// headerValue a value of the user's identity for a header, with anything but printable ascii encoded as
+// `vouch.headers.encoding` says. Plain ascii is always passed as it is.
+func headerValue(v string) string {
+	if printableASCII(v) {
+		return v
+	}
+	switch cfg.Cfg.Headers.Encoding {
+	case "rfc8187":
+		return rfc8187(v)
+	case "percent":
+		return percentEncode(v, isHeaderByte)
+	case "transliterate":
+		if t := transliterate(v); printableASCII(t) {
+			return t
+		}
+		// there's no ascii for CJK and the like, it is sent in the form an upstream can decode
+		return rfc8187(v)
+	}
+	return v
+}
+
+func printableASCII(v string) bool {
+	for i := 0; i < len(v); i++ {
+		if v[i] < 0x20 || v[i] >= 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// isHeaderByte printable ascii, but for the `%` of the percent encoding itself
+func isHeaderByte(b byte) bool {
+	return b >= 0x20 && b < 0x7f && b != '%'
+}
+
+// isAttrChar the attr-char of https://tools.ietf.org/html/rfc8187#section-3.2.1
+func isAttrChar(b byte) bool {
+	return b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || strings.IndexByte("!#$&+-.^_`|~", b) >= 0
+}
+
+// rfc8187 the ext-value, the charset UTF-8 and an empty language before the percent encoded value
+func rfc8187(v string) string {
+	return "UTF-8''" + percentEncode(v, isAttrChar)
+}
+
+func percentEncode(v string, keep func(byte) bool) string {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		if keep(v[i]) {
+			b.WriteByte(v[i])
+		} else {
+			fmt.Fprintf(&b, "%%%02X", v[i])
+		}
+	}
+	return b.String()
+}
+
+// latin the letters which don't decompose into an ascii letter and a mark
+var latin = strings.NewReplacer("ß", "ss", "æ", "ae", "Æ", "AE", "œ", "oe", "Œ", "OE", "ø", "o", "Ø", "O",
+	"ł", "l", "Ł", "L", "đ", "d", "Đ", "D", "ð", "d", "Ð", "D", "þ", "th", "Þ", "Th", "ı", "i")
+
+// transliterate `José` to `Jose`, what can't be made ascii is left as it is
+func transliterate(v string) string {
+	var b strings.Builder
+	for _, r := range norm.NFKD.String(latin.Replace(v)) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
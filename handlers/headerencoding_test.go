@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func TestHeaderValue(t *testing.T) {
+	defer func() { cfg.Cfg.Headers.Encoding = "none" }()
+	tests := []struct {
+		encoding string
+		value    string
+		want     string
+	}{
+		{"none", "José", "José"},
+		{"rfc8187", "testuser", "testuser"},
+		{"rfc8187", "José Müller", "UTF-8''Jos%C3%A9%20M%C3%BCller"},
+		{"rfc8187", "山田", "UTF-8''%E5%B1%B1%E7%94%B0"},
+		{"percent", "José 50%", "Jos%C3%A9 50%25"},
+		{"percent", "50%", "50%"},
+		{"transliterate", "José Müller", "Jose Muller"},
+		{"transliterate", "Łukasz Straße", "Lukasz Strasse"},
+		{"transliterate", "山田", "UTF-8''%E5%B1%B1%E7%94%B0"},
+	}
+	for _, tt := range tests {
+		cfg.Cfg.Headers.Encoding = tt.encoding
+		assert.Equal(t, tt.want, headerValue(tt.value), tt.encoding+" "+tt.value)
+	}
+}
+
+func TestValidateRequestHandlerUnicodeUser(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	defer func() {
+		cfg.Cfg.AllowAllUsers = false
+		cfg.Cfg.Headers.Encoding = "none"
+	}()
+	customClaims := structs.CustomClaims{Claims: map[string]interface{}{structs.TenantClaim: "Société Générale"}}
+	tokenstring := jwtmanager.CreateUserTokenString(structs.User{Username: "山田太郎"}, customClaims, structs.PTokens{})
+
+	var w *httptest.ResponseRecorder
+	for _, encoding := range []string{"rfc8187", "percent", "transliterate"} {
+		cfg.Cfg.Headers.Encoding = encoding
+		r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+		r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+		w = httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		for _, h := range []string{cfg.Cfg.Headers.User, cfg.Cfg.Headers.Tenant} {
+			v := w.Header().Get(h)
+			assert.NotEmpty(t, v, encoding+" "+h)
+			assert.True(t, printableASCII(v), encoding+" "+h+": "+v)
+		}
+	}
+	assert.Equal(t, "Societe Generale", w.Header().Get(cfg.Cfg.Headers.Tenant))
+}
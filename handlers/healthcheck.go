@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vouch/vouch-proxy/handlers/common"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/httpclient"
+)
+
+// Prober a Handler which has its own idea of whether its provider is reachable, see /healthcheck?probe=true
+// a Handler which isn't a Prober is probed at its oauth.auth_url by common.Probe
+type Prober interface {
+	Probe(client *http.Client) error
+}
+
+// probeInterval how long the result of a probe answers /healthcheck?probe=true, so that the endpoint, which
+// anyone may call, can't be used to flood the provider
+const probeInterval = 10 * time.Second
+
+// probeResult the json body of /healthcheck?probe=true
+type probeResult struct {
+	OK       bool      `json:"ok"`
+	Provider string    `json:"provider"`
+	Checked  time.Time `json:"checked"`
+	Error    string    `json:"error,omitempty"`
+}
+
+var (
+	probeMu   sync.Mutex
+	lastProbe probeResult
+)
+
+// probeProvider the last result, or a new one once probeInterval has passed since
+func probeProvider() probeResult {
+	probeMu.Lock()
+	defer probeMu.Unlock()
+	if lastProbe.Provider == cfg.GenOAuth.Provider && time.Since(lastProbe.Checked) < probeInterval {
+		return lastProbe
+	}
+	client := httpclient.Client()
+	client.Timeout = 5 * time.Second
+	var err error
+	if p, ok := getHandler().(Prober); ok {
+		err = p.Probe(client)
+	} else {
+		err = common.Probe(client, cfg.GenOAuth.AuthURL)
+	}
+	lastProbe = probeResult{OK: err == nil, Provider: cfg.GenOAuth.Provider, Checked: time.Now().UTC()}
+	if err != nil {
+		log.Warnf("/healthcheck the provider %s is not reachable: %s", cfg.GenOAuth.Provider, err)
+		lastProbe.Error = err.Error()
+	}
+	return lastProbe
+}
+
+// probeHealthcheck /healthcheck?probe=true, a 503 if the provider can't be reached
+func probeHealthcheck(w http.ResponseWriter) {
+	res := probeProvider()
+	w.Header().Set("Content-Type", "application/json")
+	if !res.OK {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/handlers/github"
+	"github.com/vouch/vouch-proxy/handlers/openid"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+var (
+	_ Prober = github.Handler{}
+	_ Prober = openid.Handler{}
+)
+
+func TestHealthcheckHandlerProbe(t *testing.T) {
+	setUp()
+	status := http.StatusOK
+	probes := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes++
+		w.WriteHeader(status)
+	}))
+	defer ts.Close()
+	authURL := cfg.GenOAuth.AuthURL
+	defer func() {
+		cfg.GenOAuth.AuthURL = authURL
+		lastProbe = probeResult{}
+	}()
+	cfg.GenOAuth.AuthURL = ts.URL + "/auth"
+	lastProbe = probeResult{}
+
+	healthcheck := func(target string) (*httptest.ResponseRecorder, probeResult) {
+		w := httptest.NewRecorder()
+		HealthcheckHandler(w, httptest.NewRequest("GET", target, nil))
+		res := probeResult{}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w, res
+	}
+
+	// the provider isn't asked without ?probe=true
+	w, _ := healthcheck("http://vouch.domain1/healthcheck")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, `{ "ok": true }`, w.Body.String())
+	assert.Equal(t, 0, probes)
+
+	// an error page of the authorize endpoint is an answer
+	status = http.StatusBadRequest
+	w, res := healthcheck("http://vouch.domain1/healthcheck?probe=true")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, res.OK)
+	assert.Equal(t, cfg.Providers.IndieAuth, res.Provider)
+	assert.Equal(t, 1, probes)
+
+	// the last result is reused until probeInterval is up
+	status = http.StatusBadGateway
+	healthcheck("http://vouch.domain1/healthcheck?probe=true")
+	assert.Equal(t, 1, probes)
+
+	lastProbe = probeResult{}
+	w, res = healthcheck("http://vouch.domain1/healthcheck?probe=true")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.False(t, res.OK)
+	assert.Contains(t, res.Error, "502 Bad Gateway")
+
+	lastProbe = probeResult{}
+	ts.Close()
+	w, res = healthcheck("http://vouch.domain1/healthcheck?probe=true")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.False(t, res.OK)
+	assert.NotEmpty(t, res.Error)
+}
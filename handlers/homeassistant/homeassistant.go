@@ -2,6 +2,7 @@ package homeassistant
 
 import (
 	"github.com/vouch/vouch-proxy/handlers/common"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
 	"github.com/vouch/vouch-proxy/pkg/structs"
 	"net/http"
 )
@@ -17,5 +18,13 @@ func (Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims *st
 	ptokens.PAccessToken = providerToken.Extra("access_token").(string)
 	// Home assistant does not provide an API to query username, so we statically set it to "homeassistant"
 	user.Username = "homeassistant"
-	return nil
+	// unless `oauth.user_info_fields` points at values found in the token response
+	fields := cfg.GenOAuth.UserInfoFields
+	m := map[string]interface{}{}
+	for _, k := range []string{fields.Username, fields.Email, fields.Name, fields.ID} {
+		if k != "" {
+			m[k] = providerToken.Extra(k)
+		}
+	}
+	return common.MapUserInfoFieldsFromMap(m, user)
 }
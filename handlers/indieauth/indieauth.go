@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"github.com/vouch/vouch-proxy/handlers/common"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/httpclient"
+	"github.com/vouch/vouch-proxy/pkg/pii"
 	"github.com/vouch/vouch-proxy/pkg/structs"
 	"io/ioutil"
 	"mime/multipart"
@@ -35,7 +37,11 @@ func (Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims *st
 	if fw, err = w.CreateFormField("redirect_uri"); err != nil {
 		return err
 	}
-	if _, err = fw.Write([]byte(cfg.GenOAuth.RedirectURL)); err != nil {
+	redirectURI := cfg.GenOAuth.RedirectURL
+	if cfg.GenOAuth.RedirectURI != "" {
+		redirectURI = cfg.GenOAuth.RedirectURI
+	}
+	if _, err = fw.Write([]byte(redirectURI)); err != nil {
 		return err
 	}
 	// v.Set("client_id", cfg.GenOAuth.ClientID)
@@ -59,7 +65,7 @@ func (Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims *st
 	// v := url.Values{}
 	// userinfo, err := client.PostForm(cfg.GenOAuth.UserInfoURL, v)
 
-	client := &http.Client{}
+	client := httpclient.Client()
 	userinfo, err := client.Do(req)
 
 	if err != nil {
@@ -73,7 +79,10 @@ func (Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims *st
 	}()
 
 	data, _ := ioutil.ReadAll(userinfo.Body)
-	log.Infof("indieauth userinfo body: %s", string(data))
+	log.Infof("indieauth userinfo body: %s", pii.Dump(string(data)))
+	if err = common.CheckUserInfoError(data); err != nil {
+		return err
+	}
 	if err = common.MapClaims(data, customClaims); err != nil {
 		log.Error(err)
 		return err
@@ -85,6 +94,6 @@ func (Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims *st
 	}
 	iaUser.PrepareUserData()
 	user.Username = iaUser.Username
-	log.Debug(user)
+	log.Debug(pii.Dump(user))
 	return nil
 }
@@ -0,0 +1,42 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// LimitRequestBody bound every request body at `vouch.limits.maxBodyBytes`
+// a declared Content-Length over the limit is answered with a 413 before the handler runs,
+// a chunked body is cut off at the limit, so the handler fails to read it
+func LimitRequestBody(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > cfg.Cfg.Limits.MaxBodyBytes {
+			log.Warnf("%s request body of %d bytes exceeds %s.limits.maxBodyBytes", r.URL.Path, r.ContentLength, cfg.Branding.LCName)
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if r.Body != nil {
+			r.Body = http.MaxBytesReader(w, r.Body, cfg.Cfg.Limits.MaxBodyBytes)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// TimeoutRequests answer with a 503 any request still running after `vouch.limits.requestTimeout` seconds
+// the handler's context is cancelled, the websocket at /ws is long lived and is left alone
+func TimeoutRequests(h http.Handler) http.Handler {
+	if cfg.Cfg.Limits.RequestTimeout <= 0 {
+		return h
+	}
+	timeout := time.Duration(cfg.Cfg.Limits.RequestTimeout) * time.Second
+	th := http.TimeoutHandler(h, timeout, http.StatusText(http.StatusServiceUnavailable))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/ws" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		th.ServeHTTP(w, r)
+	})
+}
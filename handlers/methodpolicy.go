@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/pii"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+const unsafeMethods = "unsafe"
+
+// forwardedMethod the method of the original request, as sent by the reverse proxy in X-Forwarded-Method
+// an absent header is treated as an unsafe method so that a proxy which doesn't send it fails closed
+func forwardedMethod(r *http.Request) string {
+	m := strings.ToUpper(strings.TrimSpace(r.Header.Get("X-Forwarded-Method")))
+	if m == "" {
+		log.Debugf("no X-Forwarded-Method header, applying the %s policy", unsafeMethods)
+		return unsafeMethods
+	}
+	return m
+}
+
+func isSafeMethod(m string) bool {
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// requiredTeams the teams configured in `vouch.methodTeams` for the method, nil if the method is unrestricted
+// viper lower cases the keys of the map
+func requiredTeams(method string) []string {
+	if teams, ok := cfg.Cfg.MethodTeams[strings.ToLower(method)]; ok {
+		return teams
+	}
+	if !isSafeMethod(method) {
+		return cfg.Cfg.MethodTeams[unsafeMethods]
+	}
+	return nil
+}
+
+// methodAllowed is the user in the claims a member of one of the teams required for the forwarded method?
+func methodAllowed(r *http.Request, claims *jwtmanager.VouchClaims) error {
+	method := forwardedMethod(r)
+	required := requiredTeams(method)
+	if len(required) == 0 {
+		return nil
+	}
+	teams := claimTeams(claims)
+	for _, team := range required {
+		for _, t := range teams {
+			if t == team {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%s requires membership of one of %s, %s is a member of %s", method, required, pii.Mask(claims.Username), teams)
+}
+
+// claimTeams the teams recorded in the jwt at login, see structs.TeamsClaim
+func claimTeams(claims *jwtmanager.VouchClaims) []string {
+	var teams []string
+	switch v := claims.CustomClaims[structs.TeamsClaim].(type) {
+	case []interface{}:
+		for _, t := range v {
+			if s, ok := t.(string); ok {
+				teams = append(teams, s)
+			}
+		}
+	case []string:
+		teams = v
+	}
+	return teams
+}
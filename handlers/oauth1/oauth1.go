@@ -0,0 +1,211 @@
+package oauth1
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	securerandom "github.com/theckman/go-securerandom"
+
+	"github.com/vouch/vouch-proxy/handlers/common"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/httpclient"
+	"github.com/vouch/vouch-proxy/pkg/pii"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// Handler OAuth 1.0a as per https://tools.ietf.org/html/rfc5849
+// such as OpenStreetMap or Twitter
+type Handler struct {
+	// RequestTokenSecret returns the secret of the request token issued at /login
+	RequestTokenSecret func(*http.Request) string
+}
+
+var (
+	log = cfg.Cfg.Logger
+	// now is replaced in testing
+	now = time.Now
+)
+
+// RequestToken obtain a temporary request token from `oauth.request_token_url`
+// the user will return to callback after authorizing it
+func RequestToken(callback string) (token string, secret string, err error) {
+	vals, err := signedPost(cfg.GenOAuth.RequestTokenURL, map[string]string{"oauth_callback": callback}, "")
+	if err != nil {
+		return "", "", err
+	}
+	if vals.Get("oauth_callback_confirmed") != "true" {
+		return "", "", errors.New("oauth1 request token: callback not confirmed by provider")
+	}
+	return vals.Get("oauth_token"), vals.Get("oauth_token_secret"), nil
+}
+
+// AuthorizeURL where to send the user to authorize the request token
+func AuthorizeURL(token string) string {
+	sep := "?"
+	if strings.Contains(cfg.GenOAuth.AuthURL, "?") {
+		sep = "&"
+	}
+	return cfg.GenOAuth.AuthURL + sep + "oauth_token=" + url.QueryEscape(token)
+}
+
+// GetUserInfo exchange the verified request token for an access token and fetch the user from `oauth.user_info_url`
+func (me Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims *structs.CustomClaims, ptokens *structs.PTokens) (rerr error) {
+	token := r.URL.Query().Get("oauth_token")
+	verifier := r.URL.Query().Get("oauth_verifier")
+	if token == "" || verifier == "" {
+		return errors.New("oauth1 callback is missing oauth_token or oauth_verifier")
+	}
+
+	vals, err := signedPost(cfg.GenOAuth.TokenURL, map[string]string{"oauth_token": token, "oauth_verifier": verifier}, me.RequestTokenSecret(r))
+	if err != nil {
+		return err
+	}
+	accessToken := vals.Get("oauth_token")
+	accessSecret := vals.Get("oauth_token_secret")
+	if accessToken == "" {
+		return errors.New("oauth1 access token response did not include oauth_token")
+	}
+	ptokens.PAccessToken = accessToken
+
+	req, err := http.NewRequest("GET", cfg.GenOAuth.UserInfoURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorizationHeader("GET", req.URL, map[string]string{"oauth_token": accessToken}, nil, accessSecret))
+	req.Header.Set("Accept", "application/json")
+	userinfo, err := httpclient.Client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := userinfo.Body.Close(); err != nil {
+			rerr = err
+		}
+	}()
+	data, _ := ioutil.ReadAll(userinfo.Body)
+	if userinfo.StatusCode != http.StatusOK {
+		return fmt.Errorf("oauth1 user info: unexpected response status %s", userinfo.Status)
+	}
+	log.Infof("oauth1 userinfo body: %s", pii.Dump(string(data)))
+	if err = common.CheckUserInfoError(data); err != nil {
+		return err
+	}
+	if err = common.MapClaims(data, customClaims); err != nil {
+		log.Error(err)
+		return err
+	}
+	if err = common.MapUserInfoFields(data, user); err != nil {
+		log.Error(err)
+		return err
+	}
+	user.PrepareUserData()
+	return nil
+}
+
+// signedPost POST to the endpoint with a signed Authorization header, returns the form encoded response
+func signedPost(endpoint string, oauthParams map[string]string, tokenSecret string) (url.Values, error) {
+	req, err := http.NewRequest("POST", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authorizationHeader("POST", req.URL, oauthParams, nil, tokenSecret))
+	resp, err := httpclient.Client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oauth1 %s: unexpected response status %s: %s", endpoint, resp.Status, string(body))
+	}
+	return url.ParseQuery(string(body))
+}
+
+// authorizationHeader builds the `Authorization: OAuth ...` header value using HMAC-SHA1
+// https://tools.ietf.org/html/rfc5849#section-3.5.1
+func authorizationHeader(method string, u *url.URL, oauthParams map[string]string, form url.Values, tokenSecret string) string {
+	nonce, err := securerandom.URLBase64InBytes(32)
+	if err != nil {
+		log.Error(err)
+	}
+	params := map[string]string{
+		"oauth_consumer_key":     cfg.GenOAuth.ClientID,
+		"oauth_nonce":            strings.Trim(nonce, "="),
+		"oauth_signature_method": "HMAC-SHA1",
+		"oauth_timestamp":        strconv.FormatInt(now().Unix(), 10),
+		"oauth_version":          "1.0",
+	}
+	for k, v := range oauthParams {
+		params[k] = v
+	}
+	params["oauth_signature"] = signature(method, u, params, form, cfg.GenOAuth.ClientSecret, tokenSecret)
+
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf(`%s="%s"`, encode(k), encode(params[k]))
+	}
+	return "OAuth " + strings.Join(parts, ", ")
+}
+
+// signature https://tools.ietf.org/html/rfc5849#section-3.4
+func signature(method string, u *url.URL, oauthParams map[string]string, form url.Values, consumerSecret string, tokenSecret string) string {
+	type pair struct{ k, v string }
+	pairs := []pair{}
+	for k, v := range oauthParams {
+		pairs = append(pairs, pair{encode(k), encode(v)})
+	}
+	for _, vals := range []url.Values{u.Query(), form} {
+		for k, vs := range vals {
+			for _, v := range vs {
+				pairs = append(pairs, pair{encode(k), encode(v)})
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i].k == pairs[j].k {
+			return pairs[i].v < pairs[j].v
+		}
+		return pairs[i].k < pairs[j].k
+	})
+	normalized := make([]string, len(pairs))
+	for i, p := range pairs {
+		normalized[i] = p.k + "=" + p.v
+	}
+
+	baseURL := strings.ToLower(u.Scheme) + "://" + strings.ToLower(u.Host) + u.EscapedPath()
+	base := strings.ToUpper(method) + "&" + encode(baseURL) + "&" + encode(strings.Join(normalized, "&"))
+
+	mac := hmac.New(sha1.New, []byte(encode(consumerSecret)+"&"+encode(tokenSecret)))
+	mac.Write([]byte(base))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// encode percent encodes everything but the unreserved characters
+// https://tools.ietf.org/html/rfc5849#section-3.6
+func encode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,38 @@
+package oauth1
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+// the example from https://developer.twitter.com/en/docs/authentication/oauth-1-0a/creating-a-signature
+func TestSignature(t *testing.T) {
+	u, _ := url.Parse("https://api.twitter.com/1.1/statuses/update.json?include_entities=true")
+	form := url.Values{"status": {"Hello Ladies + Gentlemen, a signed OAuth request!"}}
+	params := map[string]string{
+		"oauth_consumer_key":     "xvz1evFS4wEEPTGEFPHBog",
+		"oauth_nonce":            "kYjzVBB8Y0ZFabxSWbWovY3uYSQ2pTgmZeNu2VS4cg",
+		"oauth_signature_method": "HMAC-SHA1",
+		"oauth_timestamp":        "1318622958",
+		"oauth_token":            "370773112-GmHxMAgYyLbNEtIKZeRNFsMKPR9EyMZeS9weJAEb",
+		"oauth_version":          "1.0",
+	}
+	sig := signature("POST", u, params, form, "kAcSOqF21Fu85e7zjz7ZN2U4ZRhfV3WpwPAoE3Z7kBw", "LswwdoUaIvS8ltyTt5jkRh4J50vUPVVHtR2YPi5kE")
+	assert.Equal(t, "hCtSmYh+iHYCEqBWrE7C7hYmtUk=", sig)
+}
+
+func TestEncode(t *testing.T) {
+	assert.Equal(t, "Ladies%20%2B%20Gentlemen", encode("Ladies + Gentlemen"))
+	assert.Equal(t, "An%20encoded%20string%21", encode("An encoded string!"))
+	assert.Equal(t, "Dogs%2C%20Cats%20%26%20Mice", encode("Dogs, Cats & Mice"))
+	assert.Equal(t, "~-._", encode("~-._"))
+	assert.Equal(t, "%E2%98%83", encode("☃"))
+}
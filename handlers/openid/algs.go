@@ -0,0 +1,96 @@
+package openid
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/httpclient"
+	"github.com/vouch/vouch-proxy/pkg/jwks"
+)
+
+// discoveryRetry how long a failed fetch of the discovery document holds off the next
+const discoveryRetry = time.Minute
+
+var (
+	algsMu sync.Mutex
+	// discoveredAlgs the id_token_signing_alg_values_supported of `oauth.discovery_url`, nil until fetched
+	discoveredAlgs  []string
+	discoveryFailed time.Time
+)
+
+// signingAlgs the algs an id token may be signed with
+// `oauth.id_token_signing_algs`, or else those the provider advertises at `oauth.discovery_url`,
+// or else any a JWKS can verify. Whatever the provider advertises, HMAC and `none` are never among them
+func signingAlgs() []string {
+	if len(cfg.GenOAuth.IDTokenSigningAlgs) > 0 {
+		return cfg.GenOAuth.IDTokenSigningAlgs
+	}
+	if cfg.GenOAuth.DiscoveryURL == "" {
+		return jwks.AsymmetricMethods
+	}
+	algsMu.Lock()
+	defer algsMu.Unlock()
+	if discoveredAlgs != nil {
+		return discoveredAlgs
+	}
+	if time.Since(discoveryFailed) < discoveryRetry {
+		return jwks.AsymmetricMethods
+	}
+	advertised, err := fetchSigningAlgs(cfg.GenOAuth.DiscoveryURL)
+	if err != nil {
+		log.Warnf("could not read the id token algs of oauth.discovery_url, accepting %s: %s", jwks.AsymmetricMethods, err)
+		discoveryFailed = time.Now()
+		return jwks.AsymmetricMethods
+	}
+	discoveredAlgs = []string{}
+	for _, alg := range advertised {
+		if containsString(jwks.AsymmetricMethods, alg) {
+			discoveredAlgs = append(discoveredAlgs, alg)
+		}
+	}
+	log.Debugf("id tokens may be signed with %s, as advertised at %s", discoveredAlgs, cfg.GenOAuth.DiscoveryURL)
+	return discoveredAlgs
+}
+
+// fetchSigningAlgs the id_token_signing_alg_values_supported of the openid configuration at url
+// https://openid.net/specs/openid-connect-discovery-1_0.html#ProviderMetadata
+func fetchSigningAlgs(url string) ([]string, error) {
+	client := httpclient.Client()
+	client.Timeout = 10 * time.Second
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", url, resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	doc := struct {
+		IDTokenSigningAlgs []string `json:"id_token_signing_alg_values_supported"`
+	}{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.IDTokenSigningAlgs) == 0 {
+		return nil, fmt.Errorf("%s does not list id_token_signing_alg_values_supported", url)
+	}
+	return doc.IDTokenSigningAlgs, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,89 @@
+package openid
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwks"
+)
+
+func TestVerifyIDTokenSigningAlgs(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	advertised := []string{"RS256", "HS256", "none"}
+	discoveries := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		discoveries++
+		assert.Nil(t, json.NewEncoder(w).Encode(map[string]interface{}{"id_token_signing_alg_values_supported": advertised}))
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "idp1",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}}))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	issuer, clientID, discoveryURL := cfg.GenOAuth.Issuer, cfg.GenOAuth.ClientID, cfg.GenOAuth.DiscoveryURL
+	defer func() {
+		cfg.GenOAuth.Issuer, cfg.GenOAuth.ClientID, cfg.GenOAuth.DiscoveryURL = issuer, clientID, discoveryURL
+		cfg.GenOAuth.IDTokenSigningAlgs = nil
+		discoveredAlgs = nil
+	}()
+	cfg.GenOAuth.Issuer = "https://idp.example.com"
+	cfg.GenOAuth.ClientID = "vouch"
+	cfg.GenOAuth.DiscoveryURL = ts.URL + "/.well-known/openid-configuration"
+	discoveredAlgs = nil
+	idTokenKeys = jwks.New(ts.URL + "/jwks")
+
+	sign := func(method jwt.SigningMethod, key interface{}) string {
+		token := jwt.NewWithClaims(method, jwt.MapClaims{
+			"iss": "https://idp.example.com",
+			"aud": "vouch",
+			"exp": time.Now().Add(time.Minute).Unix(),
+			"sub": "248289761001",
+		})
+		token.Header["kid"] = "idp1"
+		ss, err := token.SignedString(key)
+		assert.Nil(t, err)
+		return ss
+	}
+	// the public key, which an HMAC verifier confused for the secret would accept
+	pub, _ := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+	_, err := verifyIDToken(sign(jwt.SigningMethodRS256, key))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"RS256"}, discoveredAlgs)
+
+	_, err = verifyIDToken(sign(jwt.SigningMethodHS256, pub))
+	assert.Error(t, err)
+	_, err = verifyIDToken(sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType))
+	assert.Error(t, err)
+	// not advertised
+	_, err = verifyIDToken(sign(jwt.SigningMethodRS384, key))
+	assert.Error(t, err)
+	assert.Equal(t, 1, discoveries)
+
+	// the configured algs take the place of those advertised
+	cfg.GenOAuth.IDTokenSigningAlgs = []string{"RS384"}
+	_, err = verifyIDToken(sign(jwt.SigningMethodRS384, key))
+	assert.Nil(t, err)
+	_, err = verifyIDToken(sign(jwt.SigningMethodRS256, key))
+	assert.Error(t, err)
+	_, err = verifyIDToken(sign(jwt.SigningMethodHS256, pub))
+	assert.Error(t, err)
+}
@@ -2,43 +2,221 @@ package openid
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
 	"github.com/vouch/vouch-proxy/handlers/common"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwks"
+	"github.com/vouch/vouch-proxy/pkg/pii"
 	"github.com/vouch/vouch-proxy/pkg/structs"
-	"io/ioutil"
-	"net/http"
 )
 
 type Handler struct{}
 
 var (
 	log = cfg.Cfg.Logger
+
+	// idTokenKeys verifies the id token when `oauth.userinfo` is optional or skip
+	idTokenKeys     *jwks.Set
+	idTokenKeysOnce sync.Once
 )
 
+// KeySet the JWKS of the provider which verifies the id token
+func KeySet() *jwks.Set {
+	idTokenKeysOnce.Do(func() {
+		if idTokenKeys == nil {
+			idTokenKeys = jwks.New(cfg.GenOAuth.JWKSURL)
+		}
+	})
+	return idTokenKeys
+}
+
+// Probe the openid configuration at `oauth.discovery_url` must be served, the auth_url answering at all will do otherwise
+func (Handler) Probe(client *http.Client) error {
+	if cfg.GenOAuth.DiscoveryURL == "" {
+		return common.Probe(client, cfg.GenOAuth.AuthURL)
+	}
+	resp, err := client.Get(cfg.GenOAuth.DiscoveryURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", cfg.GenOAuth.DiscoveryURL, resp.Status)
+	}
+	return nil
+}
+
 func (Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims *structs.CustomClaims, ptokens *structs.PTokens) (rerr error) {
-	err, client, _ := common.PrepareTokensAndClient(r, ptokens, true)
+	// a plain OAuth 2.0 provider has no id token to keep
+	err, client, _ := common.PrepareTokensAndClient(r, ptokens, !cfg.GenOAuth.OAuth2Only)
 	if err != nil {
 		return err
 	}
-	userinfo, err := client.Get(cfg.GenOAuth.UserInfoURL)
+	if cfg.GenOAuth.UserInfo != "skip" {
+		data, err := fetchUserInfo(client)
+		if err == nil {
+			log.Infof("OpenID userinfo body: %s", pii.Dump(string(data)))
+			if err := mapUser(data, user, customClaims); err != nil {
+				return err
+			}
+			resolveEmail(user, ptokens, data)
+			return nil
+		}
+		if cfg.GenOAuth.UserInfo == "required" {
+			return err
+		}
+		log.Warnf("OpenID userinfo failed, using the claims of the id token: %s", err)
+	}
+
+	claims, err := verifyIDToken(ptokens.PIdToken)
 	if err != nil {
 		return err
 	}
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return err
+	}
+	log.Debugf("OpenID id token claims: %s", pii.Dump(string(data)))
+	if err = mapUser(data, user, customClaims); err != nil {
+		return err
+	}
+	resolveEmail(user, ptokens, nil)
+	if user.Username == "" && user.Email == "" {
+		return errors.New("the id token does not identify the user, it has neither a username nor an email")
+	}
+	return nil
+}
+
+func fetchUserInfo(client *http.Client) (data []byte, rerr error) {
+	userinfo, err := client.Get(cfg.GenOAuth.UserInfoURL)
+	if err != nil {
+		return nil, err
+	}
 	defer func() {
 		if err := userinfo.Body.Close(); err != nil {
 			rerr = err
 		}
 	}()
-	data, _ := ioutil.ReadAll(userinfo.Body)
-	log.Infof("OpenID userinfo body: %s", string(data))
-	if err = common.MapClaims(data, customClaims); err != nil {
+	if userinfo.StatusCode < 200 || userinfo.StatusCode > 299 {
+		return nil, fmt.Errorf("userinfo returned %s", userinfo.Status)
+	}
+	if data, err = ioutil.ReadAll(userinfo.Body); err != nil {
+		return nil, err
+	}
+	if err = common.CheckUserInfoError(data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// mapUser populate the user and the custom claims from the userinfo or id token claims
+func mapUser(data []byte, user *structs.User, customClaims *structs.CustomClaims) error {
+	if err := common.MapClaims(data, customClaims); err != nil {
 		log.Error(err)
 		return err
 	}
-	if err = json.Unmarshal(data, user); err != nil {
+	if err := common.UnmarshalUser(data, user); err != nil {
 		log.Error(err)
 		return err
 	}
+	var claims map[string]interface{}
+	if err := common.UnmarshalClaims(data, &claims); err != nil {
+		log.Error(err)
+		return err
+	}
+	if user.Email == "" {
+		user.Email = common.EmailFromClaims(claims)
+	}
+	user.Emails = common.EmailsFromClaims(claims)
+	if name := common.NameFromClaims(claims); name != "" {
+		user.Name = name
+	}
+	// for providers which nest the user in their userinfo
+	if err := common.MapUserInfoFieldsFromMap(claims, user); err != nil {
+		return err
+	}
 	user.PrepareUserData()
 	return nil
 }
+
+// resolveEmail look for a verified email in the id token and the userinfo in the order of `oauth.email_sources`
+// userinfo is nil when it wasn't fetched
+func resolveEmail(user *structs.User, ptokens *structs.PTokens, userinfo []byte) {
+	if len(cfg.GenOAuth.EmailSources) == 0 {
+		return
+	}
+	sources := map[string]common.EmailSource{}
+	if !cfg.GenOAuth.OAuth2Only {
+		sources[common.EmailSourceIDToken] = func() (string, bool, error) {
+			claims, err := verifyIDToken(ptokens.PIdToken)
+			if err != nil {
+				return "", false, err
+			}
+			email, verified := common.VerifiedEmailFromClaims(claims)
+			return email, verified, nil
+		}
+	}
+	if userinfo != nil {
+		sources[common.EmailSourceUserInfo] = func() (string, bool, error) {
+			var claims map[string]interface{}
+			if err := json.Unmarshal(userinfo, &claims); err != nil {
+				return "", false, err
+			}
+			email, verified := common.VerifiedEmailFromClaims(claims)
+			return email, verified, nil
+		}
+	}
+	common.ResolveEmail(user, sources)
+}
+
+// verifyAzp the authorized party must be the client_id when it is given, and it must be given for several audiences
+func verifyAzp(claims jwt.MapClaims) error {
+	if cfg.GenOAuth.SkipAzpCheck {
+		return nil
+	}
+	azp, present := claims["azp"]
+	if !present {
+		if auds, ok := claims["aud"].([]interface{}); ok && len(auds) > 1 {
+			return errors.New("id token has several audiences but no azp, see oauth.skip_azp_check")
+		}
+		return nil
+	}
+	if s, _ := azp.(string); s != cfg.GenOAuth.ClientID {
+		return fmt.Errorf("id token azp %v is not oauth.client_id", azp)
+	}
+	return nil
+}
+
+// verifyIDToken checks the signature, iss, aud and exp of the id token
+// https://openid.net/specs/openid-connect-core-1_0.html#IDTokenValidation
+func verifyIDToken(idToken string) (jwt.MapClaims, error) {
+	if idToken == "" {
+		return nil, errors.New("the provider did not return an id token")
+	}
+	claims := jwt.MapClaims{}
+	// an HS256 or `none` token for a provider which signs with RS256 is refused before its signature is looked at
+	parser := &jwt.Parser{ValidMethods: signingAlgs()}
+	if _, err := parser.ParseWithClaims(idToken, claims, KeySet().Keyfunc); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != cfg.GenOAuth.Issuer {
+		return nil, errors.New("id token iss does not match oauth.issuer")
+	}
+	if !jwks.AudienceContains(claims["aud"], cfg.GenOAuth.ClientID) {
+		return nil, errors.New("id token aud does not include oauth.client_id")
+	}
+	if err := verifyAzp(claims); err != nil {
+		return nil, err
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("id token is missing exp")
+	}
+	return claims, nil
+}
@@ -0,0 +1,228 @@
+package openid
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/oauth2"
+
+	"github.com/vouch/vouch-proxy/handlers/common"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwks"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func init() {
+	cfg.InitForTestPurposesWithProvider("oidc")
+}
+
+func TestGetUserInfoUserInfoModes(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	idToken := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   "https://idp.example.com",
+		"aud":   "vouch",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"sub":   "248289761001",
+		"email": "idtoken@example.com",
+	})
+	idToken.Header["kid"] = "idp1"
+	signedIDToken, _ := idToken.SignedString(key)
+
+	userinfoStatus := http.StatusOK
+	userinfoCalled := false
+	userinfoError := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		assert.Nil(t, json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "at", "token_type": "Bearer", "id_token": signedIDToken,
+		}))
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, r *http.Request) {
+		userinfoCalled = true
+		w.WriteHeader(userinfoStatus)
+		if userinfoError {
+			assert.Nil(t, json.NewEncoder(w).Encode(map[string]string{"error": "invalid_token", "error_description": "The access token expired"}))
+			return
+		}
+		if userinfoStatus == http.StatusOK {
+			assert.Nil(t, json.NewEncoder(w).Encode(map[string]string{"sub": "248289761001", "email": "userinfo@example.com"}))
+		}
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "idp1",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}}))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	oauthClient, userInfoURL, issuer, clientID, mode := cfg.OAuthClient, cfg.GenOAuth.UserInfoURL, cfg.GenOAuth.Issuer, cfg.GenOAuth.ClientID, cfg.GenOAuth.UserInfo
+	defer func() {
+		cfg.OAuthClient, cfg.GenOAuth.UserInfoURL, cfg.GenOAuth.Issuer, cfg.GenOAuth.ClientID, cfg.GenOAuth.UserInfo = oauthClient, userInfoURL, issuer, clientID, mode
+	}()
+	cfg.OAuthClient = &oauth2.Config{ClientID: "vouch", Endpoint: oauth2.Endpoint{TokenURL: ts.URL + "/token"}}
+	cfg.GenOAuth.UserInfoURL = ts.URL + "/userinfo"
+	cfg.GenOAuth.Issuer = "https://idp.example.com"
+	cfg.GenOAuth.ClientID = "vouch"
+	idTokenKeys = jwks.New(ts.URL + "/jwks")
+
+	getUserInfo := func() (*structs.User, error) {
+		userinfoCalled = false
+		user := &structs.User{}
+		r := httptest.NewRequest("GET", "http://vouch.example.com/auth?code=abc&state=xyz", nil)
+		err := Handler{}.GetUserInfo(r, user, &structs.CustomClaims{}, &structs.PTokens{})
+		return user, err
+	}
+
+	tests := []struct {
+		name           string
+		mode           string
+		userinfoStatus int
+		wantEmail      string
+		wantErr        bool
+		wantCalled     bool
+	}{
+		{"required", "required", http.StatusOK, "userinfo@example.com", false, true},
+		{"required userinfo fails", "required", http.StatusInternalServerError, "", true, true},
+		{"optional", "optional", http.StatusOK, "userinfo@example.com", false, true},
+		{"optional userinfo fails", "optional", http.StatusInternalServerError, "idtoken@example.com", false, true},
+		{"skip", "skip", http.StatusOK, "idtoken@example.com", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.GenOAuth.UserInfo = tt.mode
+			userinfoStatus = tt.userinfoStatus
+			user, err := getUserInfo()
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.Nil(t, err)
+				assert.Equal(t, tt.wantEmail, user.Email)
+			}
+			assert.Equal(t, tt.wantCalled, userinfoCalled)
+		})
+	}
+
+	// oauth.email_sources prefers the id token even though the userinfo was fetched
+	cfg.GenOAuth.UserInfo = "required"
+	userinfoStatus = http.StatusOK
+	cfg.GenOAuth.EmailSources = []string{"id_token", "userinfo"}
+	user, err := getUserInfo()
+	cfg.GenOAuth.EmailSources = nil
+	assert.Nil(t, err)
+	assert.Equal(t, "idtoken@example.com", user.Email)
+
+	// an error in the body of a 200 is a failed userinfo, not a user without a name
+	userinfoError = true
+	_, err = getUserInfo()
+	if assert.IsType(t, &common.UserInfoError{}, err) {
+		assert.Equal(t, "The access token expired", err.(*common.UserInfoError).Message())
+	}
+	cfg.GenOAuth.UserInfo = "optional"
+	user, err = getUserInfo()
+	assert.Nil(t, err)
+	assert.Equal(t, "idtoken@example.com", user.Email)
+	cfg.GenOAuth.UserInfo = "required"
+	userinfoError = false
+
+	// a plain OAuth 2.0 provider, the id token isn't kept
+	cfg.GenOAuth.OAuth2Only = true
+	ptokens := &structs.PTokens{}
+	user = &structs.User{}
+	err = Handler{}.GetUserInfo(httptest.NewRequest("GET", "http://vouch.example.com/auth?code=abc&state=xyz", nil), user, &structs.CustomClaims{}, ptokens)
+	cfg.GenOAuth.OAuth2Only = false
+	assert.Nil(t, err)
+	assert.Equal(t, "userinfo@example.com", user.Email)
+	assert.Equal(t, "", ptokens.PIdToken)
+
+	// with vouch.maskPII the email of the userinfo body is kept out of the log
+	core, logs := observer.New(zapcore.DebugLevel)
+	defer func(l *zap.SugaredLogger) { log, cfg.Cfg.MaskPII = l, false }(log)
+	log = zap.New(core).Sugar()
+	cfg.Cfg.MaskPII = true
+	user, err = getUserInfo()
+	assert.Nil(t, err)
+	assert.Equal(t, "userinfo@example.com", user.Email)
+	assert.NotEmpty(t, logs.All())
+	for _, e := range logs.All() {
+		assert.NotContains(t, fmt.Sprintf("%s %v", e.Message, e.ContextMap()), "userinfo@example.com")
+	}
+
+	// an id token for someone else's client is not accepted
+	cfg.GenOAuth.UserInfo = "skip"
+	cfg.GenOAuth.ClientID = "other"
+	_, err = getUserInfo()
+	assert.Error(t, err)
+}
+
+func TestVerifyIDTokenAzp(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "idp1",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}}))
+	}))
+	defer ts.Close()
+	idTokenKeys = jwks.New(ts.URL)
+
+	issuer, clientID := cfg.GenOAuth.Issuer, cfg.GenOAuth.ClientID
+	defer func() {
+		cfg.GenOAuth.Issuer, cfg.GenOAuth.ClientID = issuer, clientID
+		cfg.GenOAuth.SkipAzpCheck = false
+	}()
+	cfg.GenOAuth.Issuer = "https://idp.example.com"
+	cfg.GenOAuth.ClientID = "vouch"
+
+	sign := func(aud interface{}, azp string) string {
+		claims := jwt.MapClaims{"iss": "https://idp.example.com", "aud": aud, "exp": time.Now().Add(time.Minute).Unix(), "sub": "248289761001"}
+		if azp != "" {
+			claims["azp"] = azp
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		token.Header["kid"] = "idp1"
+		ss, _ := token.SignedString(key)
+		return ss
+	}
+
+	tests := []struct {
+		name    string
+		aud     interface{}
+		azp     string
+		wantErr bool
+	}{
+		{"single aud without azp", "vouch", "", false},
+		{"single aud in a list without azp", []string{"vouch"}, "", false},
+		{"single aud with azp", "vouch", "vouch", false},
+		{"single aud with another azp", "vouch", "other", true},
+		{"multi aud with azp", []string{"vouch", "api"}, "vouch", false},
+		{"multi aud without azp", []string{"vouch", "api"}, "", true},
+		{"multi aud with another azp", []string{"vouch", "api"}, "api", true},
+	}
+	for _, tt := range tests {
+		_, err := verifyIDToken(sign(tt.aud, tt.azp))
+		assert.Equal(t, tt.wantErr, err != nil, tt.name)
+	}
+
+	// a non-conformant IdP
+	cfg.GenOAuth.SkipAzpCheck = true
+	_, err := verifyIDToken(sign([]string{"vouch", "api"}, ""))
+	assert.Nil(t, err)
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"github.com/vouch/vouch-proxy/handlers/common"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/pii"
 	"github.com/vouch/vouch-proxy/pkg/structs"
 	"io/ioutil"
 	"net/http"
@@ -30,7 +31,10 @@ func (Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims *st
 		}
 	}()
 	data, _ := ioutil.ReadAll(userinfo.Body)
-	log.Infof("OpenStax userinfo body: %s", string(data))
+	log.Infof("OpenStax userinfo body: %s", pii.Dump(string(data)))
+	if err = common.CheckUserInfoError(data); err != nil {
+		return err
+	}
 	if err = common.MapClaims(data, customClaims); err != nil {
 		log.Error(err)
 		return err
@@ -46,6 +50,10 @@ func (Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims *st
 	user.Name = oxUser.Name
 	user.Username = oxUser.Username
 	user.ID = oxUser.ID
+	if err = common.MapUserInfoFields(data, user); err != nil {
+		log.Error(err)
+		return err
+	}
 	user.PrepareUserData()
 	return nil
 }
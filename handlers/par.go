@@ -0,0 +1,67 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/handlers/common"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/httpclient"
+)
+
+// parResponse the answer of the pushed_authorization_request_endpoint
+type parResponse struct {
+	RequestURI string `json:"request_uri"`
+	ExpiresIn  int    `json:"expires_in"`
+}
+
+// pushAuthorizationRequest POST the parameters of the authorize url to `oauth.par_url` (RFC 9126)
+// and return the authorize url carrying only the client_id and the request_uri the provider answered with
+func pushAuthorizationRequest(lURL string) (string, error) {
+	u, err := url.Parse(lURL)
+	if err != nil {
+		return "", err
+	}
+	form := u.Query()
+	form.Set("client_id", cfg.GenOAuth.ClientID)
+	basic, err := common.ClientCredentials(form)
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest("POST", cfg.GenOAuth.PARURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if basic {
+		req.SetBasicAuth(url.QueryEscape(cfg.GenOAuth.ClientID), url.QueryEscape(cfg.GenOAuth.ClientSecret))
+	}
+	resp, err := httpclient.Client().Do(req)
+	if err != nil {
+		return "", fmt.Errorf("pushed authorization request to %s: %s", cfg.GenOAuth.PARURL, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("pushed authorization request to %s: %s", cfg.GenOAuth.PARURL, err)
+	}
+	// 201 Created, though some providers answer 200
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("pushed authorization request to %s answered %d: %s", cfg.GenOAuth.PARURL, resp.StatusCode, body)
+	}
+	var par parResponse
+	if err := json.Unmarshal(body, &par); err != nil {
+		return "", fmt.Errorf("pushed authorization request to %s: %s", cfg.GenOAuth.PARURL, err)
+	}
+	if par.RequestURI == "" {
+		return "", fmt.Errorf("pushed authorization request to %s answered without a request_uri", cfg.GenOAuth.PARURL)
+	}
+	log.Debugf("pushed the authorization request, request_uri %s expires in %d seconds", par.RequestURI, par.ExpiresIn)
+	u.RawQuery = url.Values{"client_id": {cfg.GenOAuth.ClientID}, "request_uri": {par.RequestURI}}.Encode()
+	return u.String(), nil
+}
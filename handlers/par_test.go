@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func TestPushAuthorizationRequest(t *testing.T) {
+	setUp()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		id, secret, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, url.QueryEscape(cfg.GenOAuth.ClientID), id)
+		assert.Equal(t, url.QueryEscape(cfg.GenOAuth.ClientSecret), secret)
+		assert.NoError(t, r.ParseForm())
+		if r.PostForm.Get("state") != "abc" {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"error":"invalid_request"}`)
+			return
+		}
+		assert.Equal(t, "https://vouch.example.com/auth", r.PostForm.Get("redirect_uri"))
+		assert.Equal(t, cfg.GenOAuth.ClientID, r.PostForm.Get("client_id"))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprint(w, `{"request_uri":"urn:ietf:params:oauth:request_uri:6esc_11ACC5bwc014ltc14eY22c","expires_in":60}`)
+	}))
+	defer ts.Close()
+	parURL, secret := cfg.GenOAuth.PARURL, cfg.GenOAuth.ClientSecret
+	cfg.GenOAuth.PARURL, cfg.GenOAuth.ClientSecret = ts.URL, "s3cr3t:/"
+	defer func() { cfg.GenOAuth.PARURL, cfg.GenOAuth.ClientSecret = parURL, secret }()
+
+	lURL, err := pushAuthorizationRequest("https://idp.example.com/authorize?redirect_uri=https%3A%2F%2Fvouch.example.com%2Fauth&response_type=code&scope=openid&state=abc")
+	assert.NoError(t, err)
+	u, _ := url.Parse(lURL)
+	assert.Equal(t, "idp.example.com", u.Host)
+	assert.Equal(t, url.Values{
+		"client_id":   {cfg.GenOAuth.ClientID},
+		"request_uri": {"urn:ietf:params:oauth:request_uri:6esc_11ACC5bwc014ltc14eY22c"},
+	}, u.Query())
+
+	_, err = pushAuthorizationRequest("https://idp.example.com/authorize?response_type=code&state=wrong")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid_request")
+}
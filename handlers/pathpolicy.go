@@ -0,0 +1,111 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/pii"
+)
+
+// pathPolicy a compiled `vouch.pathPolicies` entry
+type pathPolicy struct {
+	prefix string
+	rx     *regexp.Regexp
+	teams  []string
+}
+
+// pathPolicies in the configured order
+var pathPolicies []pathPolicy
+
+// ConfigurePathPolicies compile the `vouch.pathPolicies`
+func ConfigurePathPolicies() error {
+	compiled := []pathPolicy{}
+	for i, pp := range cfg.Cfg.PathPolicies {
+		if (pp.Prefix == "") == (pp.Regex == "") {
+			return fmt.Errorf("configuration error: %s.pathPolicies[%d] needs exactly one of prefix or regex", cfg.Branding.LCName, i)
+		}
+		if len(pp.Teams) == 0 {
+			return fmt.Errorf("configuration error: %s.pathPolicies[%d] has no teams", cfg.Branding.LCName, i)
+		}
+		p := pathPolicy{teams: pp.Teams}
+		if pp.Regex != "" {
+			rx, err := regexp.Compile(pp.Regex)
+			if err != nil {
+				return fmt.Errorf("configuration error: %s.pathPolicies[%d] regex: %s", cfg.Branding.LCName, i, err)
+			}
+			p.rx = rx
+		} else {
+			// `/admin/*` reads naturally in the config, it is the same as the prefix `/admin/`
+			p.prefix = strings.TrimSuffix(pp.Prefix, "*")
+		}
+		compiled = append(compiled, p)
+	}
+	pathPolicies = compiled
+	return nil
+}
+
+func (p pathPolicy) matches(path string) bool {
+	if p.rx != nil {
+		return p.rx.MatchString(path)
+	}
+	return strings.HasPrefix(path, p.prefix)
+}
+
+// String the prefix or regex as configured
+func (p pathPolicy) String() string {
+	if p.rx != nil {
+		return p.rx.String()
+	}
+	return p.prefix + "*"
+}
+
+// forwardedPath the path of the original request, as sent by the reverse proxy in X-Forwarded-Uri
+func forwardedPath(r *http.Request) string {
+	uri := strings.TrimSpace(r.Header.Get("X-Forwarded-Uri"))
+	if i := strings.IndexAny(uri, "?#"); i >= 0 {
+		uri = uri[:i]
+	}
+	return uri
+}
+
+// optionalAuthPath is the path one of the `vouch.optionalAuthPaths`, a trailing * is ignored as in the pathPolicies
+func optionalAuthPath(path string) bool {
+	if path == "" {
+		return false
+	}
+	for _, prefix := range cfg.Cfg.OptionalAuthPaths {
+		if strings.HasPrefix(path, strings.TrimSuffix(prefix, "*")) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathAllowed is the user in the claims a member of one of the teams of the first policy matching the forwarded path?
+// a path which matches no policy has already been authorized by the whitelists at login
+func pathAllowed(r *http.Request, claims *jwtmanager.VouchClaims) error {
+	path := forwardedPath(r)
+	if path == "" {
+		// without the path there is no telling which policy applies, fail closed
+		return fmt.Errorf("%s.pathPolicies are configured but the reverse proxy did not send X-Forwarded-Uri", cfg.Branding.LCName)
+	}
+	for _, p := range pathPolicies {
+		if !p.matches(path) {
+			continue
+		}
+		teams := claimTeams(claims)
+		for _, team := range p.teams {
+			for _, t := range teams {
+				if t == team {
+					return nil
+				}
+			}
+		}
+		return fmt.Errorf("%s requires membership of one of %s, %s is a member of %s", path, p.teams, pii.Mask(claims.Username), teams)
+	}
+	return nil
+}
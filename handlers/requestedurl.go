@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/handlers/common"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/domains"
+)
+
+// requestedURLFromHeaders reconstructs the url originally requested by the browser from the forwarded headers
+// set by the reverse proxy. Only the headers listed in `vouch.headers.trustforwarded` are considered.
+// Returns "" if none of the trusted headers are present, they only describe this request, or the host they name is
+// not one of `vouch.domains`, since a client may send the headers itself if the proxy doesn't overwrite them.
+func requestedURLFromHeaders(r *http.Request) string {
+	if u := common.TrustedHeader(r, cfg.Cfg.Headers.Redirect); u != "" {
+		if pu, err := url.Parse(u); err == nil && pu.IsAbs() {
+			return inDomains(u, pu.Host)
+		}
+	}
+
+	proto := common.TrustedHeader(r, "X-Forwarded-Proto")
+	fHost := common.TrustedHeader(r, "X-Forwarded-Host")
+	port := common.TrustedHeader(r, "X-Forwarded-Port")
+	uri := common.TrustedHeader(r, "X-Forwarded-Uri")
+	if proto == "" && fHost == "" && port == "" && uri == "" {
+		return ""
+	}
+
+	scheme := common.RequestScheme(r)
+	host := r.Host
+	if fHost != "" {
+		// X-Forwarded-Host may be a list if there are several proxies, the first one is the client facing
+		host = strings.TrimSpace(strings.Split(fHost, ",")[0])
+	}
+	if port != "" {
+		host = hostWithPort(host, port, scheme)
+	}
+	if uri == "" {
+		uri = r.URL.RequestURI()
+	}
+	if !strings.HasPrefix(uri, "/") {
+		uri = "/" + uri
+	}
+	if host == r.Host && uri == r.URL.RequestURI() {
+		// that's just this request to Vouch Proxy itself
+		return ""
+	}
+	return inDomains(scheme+"://"+host+uri, host)
+}
+
+// inDomains the url if its host is one of `vouch.domains`, otherwise ""
+func inDomains(u string, host string) string {
+	if domains.Matches(host) == "" {
+		log.Warnf("ignoring the forwarded url %s, its host %s is not one of %s.domains", u, host, cfg.Branding.LCName)
+		return ""
+	}
+	return u
+}
+
+// hostWithPort adds the port to the host unless the host already carries one or the port is the default for the scheme
+func hostWithPort(host, port, scheme string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	if (scheme == "https" && port == "443") || (scheme == "http" && port == "80") {
+		return host
+	}
+	// IPv6 literals arrive as [::1], JoinHostPort adds the brackets back
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// vouchLoginURL the /login of this Vouch Proxy with the requested url, if it is known
+// `vouch.loginUrl`, or the host of oauth.callback_url
+func vouchLoginURL(r *http.Request) string {
+	login := cfg.Cfg.LoginURL
+	if login == "" {
+		if cb, err := url.Parse(cfg.GenOAuth.RedirectURL); err == nil && cb.Host != "" {
+			login = cb.Scheme + "://" + cb.Host + "/login"
+		} else {
+			login = "/login"
+		}
+	}
+	if requested := requestedURLFromHeaders(r); requested != "" {
+		sep := "?"
+		if strings.Contains(login, "?") {
+			sep = "&"
+		}
+		login += sep + "url=" + url.QueryEscape(requested)
+	}
+	return login
+}
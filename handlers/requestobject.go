@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/vouch/vouch-proxy/handlers/common"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// requestObjectLifetime how long the provider may accept the request object, the user is redirected right away
+const requestObjectLifetime = 5 * time.Minute
+
+// requestObjectKey signs the request object, loaded by ConfigureRequestObject
+var requestObjectKey interface{}
+
+// ConfigureRequestObject load the key of `oauth.request_object`
+func ConfigureRequestObject() error {
+	if cfg.GenOAuth == nil || !cfg.GenOAuth.RequestObject.Enabled {
+		return nil
+	}
+	ro := cfg.GenOAuth.RequestObject
+	if ro.Alg == "HS256" {
+		requestObjectKey = []byte(cfg.GenOAuth.ClientSecret)
+		return nil
+	}
+	var err error
+	if requestObjectKey, err = common.SigningKey(ro.Alg, ro.SigningKeyFile); err != nil {
+		return fmt.Errorf("oauth.request_object.signing_key_file %s is not a %s private key: %s", ro.SigningKeyFile, ro.Alg, err)
+	}
+	return nil
+}
+
+// requestObjectURL move the parameters of the authorize url into a signed request object (RFC 9101)
+// client_id, response_type and scope stay in the query as well, as OpenID Connect requires
+func requestObjectURL(lURL string) (string, error) {
+	u, err := url.Parse(lURL)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	claims := jwt.MapClaims{}
+	for k, v := range q {
+		claims[k] = q.Get(k)
+		if len(v) > 1 {
+			// a repeated `audience`
+			claims[k] = v
+		}
+	}
+	jti, err := generateStateNonce()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims["iss"] = cfg.GenOAuth.ClientID
+	claims["aud"] = cfg.GenOAuth.Issuer
+	claims["iat"] = now.Unix()
+	claims["nbf"] = now.Unix()
+	claims["exp"] = now.Add(requestObjectLifetime).Unix()
+	claims["jti"] = jti
+
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(cfg.GenOAuth.RequestObject.Alg), claims)
+	if cfg.GenOAuth.RequestObject.KeyID != "" {
+		token.Header["kid"] = cfg.GenOAuth.RequestObject.KeyID
+	}
+	signed, err := token.SignedString(requestObjectKey)
+	if err != nil {
+		return "", fmt.Errorf("could not sign the request object: %s", err)
+	}
+
+	outer := url.Values{"client_id": {cfg.GenOAuth.ClientID}, "request": {signed}}
+	for _, k := range []string{"response_type", "scope"} {
+		if v := q.Get(k); v != "" {
+			outer.Set(k, v)
+		}
+	}
+	u.RawQuery = outer.Encode()
+	return u.String(), nil
+}
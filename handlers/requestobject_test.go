@@ -0,0 +1,61 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func TestRequestObjectURL(t *testing.T) {
+	setUp()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	f, err := ioutil.TempFile("", "request_object")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	assert.NoError(t, pem.Encode(f, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	assert.NoError(t, f.Close())
+
+	ro, issuer := cfg.GenOAuth.RequestObject, cfg.GenOAuth.Issuer
+	defer func() { cfg.GenOAuth.RequestObject, cfg.GenOAuth.Issuer = ro, issuer }()
+	cfg.GenOAuth.RequestObject.Enabled = true
+	cfg.GenOAuth.RequestObject.Alg = "RS256"
+	cfg.GenOAuth.RequestObject.SigningKeyFile = f.Name()
+	cfg.GenOAuth.RequestObject.KeyID = "vouch-1"
+	cfg.GenOAuth.Issuer = "https://idp.example.com"
+	assert.NoError(t, ConfigureRequestObject())
+
+	lURL, err := requestObjectURL("https://idp.example.com/authorize?client_id=" + cfg.GenOAuth.ClientID +
+		"&redirect_uri=https%3A%2F%2Fvouch.example.com%2Fauth&response_type=code&scope=openid+email&state=abc")
+	assert.NoError(t, err)
+	u, err := url.Parse(lURL)
+	assert.NoError(t, err)
+	q := u.Query()
+	assert.Equal(t, "idp.example.com", u.Host)
+	assert.Equal(t, "code", q.Get("response_type"))
+	assert.Equal(t, "openid email", q.Get("scope"))
+	assert.Empty(t, q.Get("state"))
+	assert.Empty(t, q.Get("redirect_uri"))
+
+	token, err := jwt.Parse(q.Get("request"), func(token *jwt.Token) (interface{}, error) {
+		assert.Equal(t, "vouch-1", token.Header["kid"])
+		return &key.PublicKey, nil
+	})
+	assert.NoError(t, err)
+	claims := token.Claims.(jwt.MapClaims)
+	assert.Equal(t, "abc", claims["state"])
+	assert.Equal(t, "https://vouch.example.com/auth", claims["redirect_uri"])
+	assert.Equal(t, cfg.GenOAuth.ClientID, claims["iss"])
+	assert.Equal(t, "https://idp.example.com", claims["aud"])
+	assert.NotEmpty(t, claims["jti"])
+}
@@ -0,0 +1,50 @@
+package handlers
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// mapRoles the `vouch.roles` of a user with the memberships, in order of their names
+// a role is given for any one of its memberships, whatever the case the provider spells it in
+func mapRoles(memberships []string) []string {
+	roles := []string{}
+	for role, teams := range cfg.Cfg.Roles {
+		if memberOfAny(memberships, teams) {
+			roles = append(roles, role)
+		}
+	}
+	sort.Strings(roles)
+	return roles
+}
+
+func memberOfAny(memberships, teams []string) bool {
+	for _, m := range memberships {
+		for _, t := range teams {
+			if strings.EqualFold(m, t) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimRoles the roles recorded in the jwt at login
+func claimRoles(claims *jwtmanager.VouchClaims) []string {
+	var roles []string
+	switch v := claims.CustomClaims[structs.RolesClaim].(type) {
+	case []interface{}:
+		for _, r := range v {
+			if s, ok := r.(string); ok {
+				roles = append(roles, s)
+			}
+		}
+	case []string:
+		roles = v
+	}
+	return roles
+}
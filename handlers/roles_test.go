@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func TestMapRoles(t *testing.T) {
+	setUp()
+	defer func() { cfg.Cfg.Roles = nil }()
+	assert.Empty(t, mapRoles([]string{"myOrg/admins"}))
+
+	cfg.Cfg.Roles = map[string][]string{
+		"admin":  {"myOrg/admins", "app-admins", "Administrator"},
+		"editor": {"myOrg/writers"},
+	}
+	// GitHub, Okta and Azure spell the admins three ways
+	assert.Equal(t, []string{"admin"}, mapRoles([]string{"myOrg/admins"}))
+	assert.Equal(t, []string{"admin"}, mapRoles([]string{"app-admins"}))
+	assert.Equal(t, []string{"admin"}, mapRoles([]string{"administrator"}))
+	assert.Equal(t, []string{"admin", "editor"}, mapRoles([]string{"myOrg/writers", "Administrator"}))
+	assert.Empty(t, mapRoles([]string{"myOrg/readers"}))
+}
+
+func TestValidateRequestHandlerRoles(t *testing.T) {
+	setUp()
+	cfg.Cfg.AllowAllUsers = true
+	defer func() { cfg.Cfg.AllowAllUsers = false }()
+
+	validate := func(customClaims structs.CustomClaims) *httptest.ResponseRecorder {
+		tokenstring := jwtmanager.CreateUserTokenString(structs.User{Username: "testuser"}, customClaims, structs.PTokens{})
+		r := httptest.NewRequest("GET", "http://vouch.domain1/validate", nil)
+		r.Header.Set(cfg.Cfg.Headers.JWT, tokenstring)
+		w := httptest.NewRecorder()
+		ValidateRequestHandler(w, r)
+		return w
+	}
+
+	w := validate(structs.CustomClaims{Claims: map[string]interface{}{structs.RolesClaim: []string{"admin", "editor"}}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "admin,editor", w.Header().Get("X-Vouch-Roles"))
+
+	w = validate(structs.CustomClaims{})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Header().Get("X-Vouch-Roles"))
+}
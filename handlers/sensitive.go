@@ -0,0 +1,37 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+)
+
+// loginIsFresh did the user authenticate at the provider within `vouch.headers.sensitive.maxauthage`
+// a jwt issued before the maxauthage was configured has no auth_time and is stale
+func loginIsFresh(claims *jwtmanager.VouchClaims) bool {
+	maxAge := time.Duration(cfg.Cfg.Headers.Sensitive.MaxAuthAge) * time.Second
+	return claims.AuthTime > 0 && time.Since(time.Unix(claims.AuthTime, 0)) <= maxAge
+}
+
+// omitSensitiveHeaders remove the `vouch.headers.sensitive.headers` from the answer of /validate
+func omitSensitiveHeaders(w http.ResponseWriter) {
+	for _, h := range cfg.Cfg.Headers.Sensitive.Headers {
+		if w.Header().Get(h) != "" {
+			log.Debugf("omitting the sensitive header %s, the login is older than headers.sensitive.maxauthage", h)
+			w.Header().Del(h)
+		}
+	}
+}
+
+// reauthMaxAge the OpenID Connect `max_age` of the authorize url when a stale login is sent to log in again
+// without it an IdP which still has a session would answer with the same old auth_time
+func reauthMaxAge() string {
+	s := cfg.Cfg.Headers.Sensitive
+	if len(s.Headers) == 0 || s.Stale != "reauth" {
+		return ""
+	}
+	return strconv.Itoa(s.MaxAuthAge)
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/cookie"
+)
+
+// StateCarrier holds the login state (the oauth `state`, the requested url and the oauth1 token secret)
+// between /login and /auth, selected by `vouch.session.store`
+// any gorilla sessions.Store with a MaxAge can carry it, such as a third party redis store
+type StateCarrier interface {
+	sessions.Store
+	MaxAge(age int)
+}
+
+// newStateCarrier the carrier for `vouch.session.store`
+// cookie    - the state itself travels in a signed cookie, for stateless deployments
+// filesystem - only a signed session id is sent to the browser, the state stays on this instance
+func newStateCarrier() StateCarrier {
+	key := []byte(cfg.Cfg.Session.Key)
+	var carrier StateCarrier
+	switch cfg.Cfg.Session.Store {
+	case "filesystem":
+		fs := sessions.NewFilesystemStore(cfg.Cfg.Session.Path, key)
+		fs.Options = stateOptions()
+		carrier = fs
+	default:
+		cs := sessions.NewCookieStore(key)
+		cs.Options = stateOptions()
+		carrier = cs
+	}
+	// also limits the age of the signed value, not only the cookie's
+	carrier.MaxAge(cfg.Cfg.Session.Cookie.MaxAge)
+	return carrier
+}
+
+// stateOptions the gorilla sessions options of cookie.StateAttributes
+func stateOptions() *sessions.Options {
+	a := cookie.StateAttributes()
+	return &sessions.Options{
+		Path:     a.Path,
+		MaxAge:   a.MaxAge,
+		Secure:   a.Secure,
+		HttpOnly: a.HTTPOnly,
+	}
+}
+
+// saveLoginState save the session, its cookie gets the `vouch.session.cookie.sameSite` attribute
+// which gorilla sessions leaves to net/http, and net/http of older go versions can't set
+func saveLoginState(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	before := len(w.Header()["Set-Cookie"])
+	if err := session.Save(r, w); err != nil {
+		return err
+	}
+	cookie.AppendSameSite(w, before, cookie.StateAttributes().SameSite)
+	return nil
+}
+
+// session key holding the unix time at which /login stored the state
+const stateIssuedAt = "stateIssuedAt"
+
+// loginTimedOut has `vouch.session.login_timeout` passed since /login stored the state
+// a state without the time is treated as timed out
+func loginTimedOut(session *sessions.Session) bool {
+	if cfg.Cfg.Session.LoginTimeout <= 0 {
+		return false
+	}
+	issuedAt, ok := session.Values[stateIssuedAt].(int64)
+	if !ok {
+		return true
+	}
+	return time.Since(time.Unix(issuedAt, 0)) > time.Duration(cfg.Cfg.Session.LoginTimeout)*time.Second
+}
+
+// session key holding the host /login was requested on
+const stateHost = "stateHost"
+
+// loginHost the host of the request, as it is recorded in and compared against the login state
+func loginHost(r *http.Request) string {
+	return strings.ToLower(r.Host)
+}
+
+// callbackHostMismatch with `vouch.session.callback_host` has the callback arrived on another host than /login
+// the cookie scopes of the two hosts may differ, the jwt cookie would be set for a host the login never started on
+// the session is signed, a state without the host can only have been stored before the host was recorded
+func callbackHostMismatch(r *http.Request, session *sessions.Session) bool {
+	if !cfg.Cfg.Session.CallbackHost {
+		return false
+	}
+	host, ok := session.Values[stateHost].(string)
+	return ok && host != loginHost(r)
+}
+
+// loginState the session carrying the login state which /login stored for this state
+// a miss is read again from the store up to `vouch.session.state_attempts` times in all, backing off by
+// `state_backoff` milliseconds, for a store shared between instances which hasn't caught up with /login yet
+func loginState(r *http.Request, state string) (*sessions.Session, error) {
+	session, err := sessstore.Get(r, cfg.Cfg.Session.Name)
+	for attempt := 1; attempt < cfg.Cfg.Session.StateAttempts && (err != nil || session.Values["state"] != state); attempt++ {
+		time.Sleep(time.Duration(attempt*cfg.Cfg.Session.StateBackoff) * time.Millisecond)
+		log.Debugf("/auth login state not found, reading it again (attempt %d of %d)", attempt+1, cfg.Cfg.Session.StateAttempts)
+		// the store's Get would answer from the request's registry, New reads the store itself
+		session, err = sessstore.New(r, cfg.Cfg.Session.Name)
+	}
+	return session, err
+}
+
+// signState append a mac of the nonce to the state, keyed with `vouch.session.key`
+// /auth can then tell a state this Vouch Proxy sent to the provider from a forged or stale one
+// even when the browser has not returned the session cookie which holds it
+func signState(nonce string) string {
+	return nonce + "." + stateMAC(nonce)
+}
+
+func stateMAC(nonce string) string {
+	mac := hmac.New(sha256.New, []byte(cfg.Cfg.Session.Key))
+	mac.Write([]byte("state:" + nonce))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// stateSigned was the state made by signState
+func stateSigned(state string) bool {
+	i := strings.LastIndex(state, ".")
+	if i < 0 {
+		return false
+	}
+	return hmac.Equal([]byte(state[i+1:]), []byte(stateMAC(state[:i])))
+}
+
+// cookiesBlocked did /login send the user to the provider with this state, but the browser came back without the session cookie
+// that's a browser refusing cookies, or one which was sent to /login on a different domain
+func cookiesBlocked(r *http.Request, state string) bool {
+	if _, err := r.Cookie(cfg.Cfg.Session.Name); err != http.ErrNoCookie {
+		return false
+	}
+	return stateSigned(state)
+}
+
+// renderCookiesBlocked answer the callback of a browser which appears to block cookies, see `vouch.session.cookies_blocked_url`
+func renderCookiesBlocked(w http.ResponseWriter, r *http.Request) {
+	if cfg.Cfg.Session.CookiesBlockedURL != "" {
+		redirect302(w, r, cfg.Cfg.Session.CookiesBlockedURL)
+		return
+	}
+	w.WriteHeader(http.StatusBadRequest)
+	renderIndex(w, "/auth cookies appear to be blocked. Please allow cookies for "+r.Host+" and try again.")
+}
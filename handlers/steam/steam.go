@@ -0,0 +1,194 @@
+package steam
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/handlers/common"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/httpclient"
+	"github.com/vouch/vouch-proxy/pkg/pii"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// Handler Steam login, which is OpenID 2.0 rather than OAuth
+// https://openid.net/specs/openid-authentication-2_0.html
+// https://partner.steamgames.com/doc/features/auth#website
+type Handler struct{}
+
+const (
+	openIDNS         = "http://specs.openid.net/auth/2.0"
+	identifierSelect = "http://specs.openid.net/auth/2.0/identifier_select"
+)
+
+var (
+	log = cfg.Cfg.Logger
+	// the claimed_id asserted by Steam is the user's 64 bit SteamID
+	rxClaimedID = regexp.MustCompile(`^https?://steamcommunity\.com/openid/id/([0-9]{17})$`)
+)
+
+// playerSummaries the response of ISteamUser/GetPlayerSummaries
+// https://developer.valvesoftware.com/wiki/Steam_Web_API#GetPlayerSummaries_.28v0002.29
+type playerSummaries struct {
+	Response struct {
+		Players []json.RawMessage `json:"players"`
+	} `json:"response"`
+}
+
+// LoginURL send the user to Steam, who will be returned to returnTo with the signed assertion
+func LoginURL(returnTo string) (string, error) {
+	u, err := url.Parse(returnTo)
+	if err != nil {
+		return "", err
+	}
+	params := url.Values{
+		"openid.ns":         {openIDNS},
+		"openid.mode":       {"checkid_setup"},
+		"openid.return_to":  {returnTo},
+		"openid.realm":      {u.Scheme + "://" + u.Host},
+		"openid.identity":   {identifierSelect},
+		"openid.claimed_id": {identifierSelect},
+	}
+	sep := "?"
+	if strings.Contains(cfg.GenOAuth.AuthURL, "?") {
+		sep = "&"
+	}
+	return cfg.GenOAuth.AuthURL + sep + params.Encode(), nil
+}
+
+// GetUserInfo verify the positive assertion with Steam and set the SteamID as the username
+func (Handler) GetUserInfo(r *http.Request, user *structs.User, customClaims *structs.CustomClaims, ptokens *structs.PTokens) error {
+	query := r.URL.Query()
+	switch mode := query.Get("openid.mode"); mode {
+	case "id_res":
+	case "cancel":
+		return errors.New("steam: the user cancelled the login")
+	default:
+		return fmt.Errorf("steam: unexpected openid.mode %s", mode)
+	}
+
+	if err := checkReturnTo(r, query.Get("openid.return_to")); err != nil {
+		return err
+	}
+	if query.Get("openid.op_endpoint") != cfg.GenOAuth.AuthURL {
+		return fmt.Errorf("steam: assertion from unexpected op_endpoint %s", query.Get("openid.op_endpoint"))
+	}
+	steamID, err := steamIDFromClaimedID(query.Get("openid.claimed_id"))
+	if err != nil {
+		return err
+	}
+	if err := verifyAssertion(query); err != nil {
+		return err
+	}
+
+	user.Username = steamID
+	if cfg.GenOAuth.Steam.APIKey == "" {
+		return common.MapClaims([]byte(`{"steamid":"`+steamID+`"}`), customClaims)
+	}
+	return getPlayerSummary(steamID, user, customClaims)
+}
+
+// checkReturnTo the assertion must have been made for the url of this request
+// https://openid.net/specs/openid-authentication-2_0.html#verify_return_to
+func checkReturnTo(r *http.Request, returnTo string) error {
+	rt, err := url.Parse(returnTo)
+	if err != nil || returnTo == "" {
+		return fmt.Errorf("steam: invalid openid.return_to %s", returnTo)
+	}
+	if rt.Scheme != common.RequestScheme(r) || !strings.EqualFold(rt.Host, r.Host) || rt.Path != r.URL.Path {
+		return fmt.Errorf("steam: openid.return_to %s does not match this request", returnTo)
+	}
+	query := r.URL.Query()
+	for k, vs := range rt.Query() {
+		if len(vs) == 0 || query.Get(k) != vs[0] {
+			return fmt.Errorf("steam: openid.return_to parameter %s does not match this request", k)
+		}
+	}
+	return nil
+}
+
+func steamIDFromClaimedID(claimedID string) (string, error) {
+	m := rxClaimedID.FindStringSubmatch(claimedID)
+	if m == nil {
+		return "", fmt.Errorf("steam: openid.claimed_id %s is not a SteamID", claimedID)
+	}
+	return m[1], nil
+}
+
+// verifyAssertion ask Steam to check the signature of the assertion
+// https://openid.net/specs/openid-authentication-2_0.html#verifying_signatures
+func verifyAssertion(query url.Values) error {
+	form := url.Values{}
+	for k, vs := range query {
+		if strings.HasPrefix(k, "openid.") {
+			form[k] = vs
+		}
+	}
+	form.Set("openid.mode", "check_authentication")
+
+	resp, err := httpclient.Client().PostForm(cfg.GenOAuth.AuthURL, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("steam check_authentication: unexpected response status %s", resp.Status)
+	}
+	// the response is key-value form encoded, one `key:value` per line
+	for _, line := range strings.Split(string(body), "\n") {
+		if strings.TrimSpace(line) == "is_valid:true" {
+			return nil
+		}
+	}
+	log.Debugf("steam check_authentication response: %s", pii.Dump(string(body)))
+	return errors.New("steam: the assertion could not be verified")
+}
+
+// getPlayerSummary fetch the profile from the Steam Web API, the personaname becomes the user's name
+func getPlayerSummary(steamID string, user *structs.User, customClaims *structs.CustomClaims) (rerr error) {
+	sep := "?"
+	if strings.Contains(cfg.GenOAuth.UserInfoURL, "?") {
+		sep = "&"
+	}
+	params := url.Values{"key": {cfg.GenOAuth.Steam.APIKey}, "steamids": {steamID}}
+	resp, err := httpclient.Client().Get(cfg.GenOAuth.UserInfoURL + sep + params.Encode())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			rerr = err
+		}
+	}()
+	data, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("steam player summary: unexpected response status %s", resp.Status)
+	}
+	summaries := playerSummaries{}
+	if err = json.Unmarshal(data, &summaries); err != nil {
+		return err
+	}
+	if len(summaries.Response.Players) == 0 {
+		return fmt.Errorf("steam player summary: no player found for %s", steamID)
+	}
+	player := summaries.Response.Players[0]
+	log.Debugf("steam player summary: %s", pii.Dump(string(player)))
+	if err = common.MapClaims(player, customClaims); err != nil {
+		return err
+	}
+	p := struct {
+		PersonaName string `json:"personaname"`
+	}{}
+	if err = json.Unmarshal(player, &p); err != nil {
+		return err
+	}
+	user.Name = p.PersonaName
+	return nil
+}
@@ -0,0 +1,130 @@
+package steam
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+const testSteamID = "76561197960435530"
+
+func init() {
+	cfg.InitForTestPurposesWithProvider("steam")
+}
+
+// steamServer answers check_authentication and GetPlayerSummaries
+func steamServer(t *testing.T, valid bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/openid/login":
+			assert.NoError(t, r.ParseForm())
+			assert.Equal(t, "check_authentication", r.PostForm.Get("openid.mode"))
+			assert.Equal(t, "sig", r.PostForm.Get("openid.sig"))
+			fmt.Fprintf(w, "ns:%s\nis_valid:%t\n", openIDNS, valid)
+		case "/GetPlayerSummaries":
+			assert.Equal(t, "apikey", r.URL.Query().Get("key"))
+			assert.Equal(t, testSteamID, r.URL.Query().Get("steamids"))
+			fmt.Fprintf(w, `{"response":{"players":[{"steamid":"%s","personaname":"Robin"}]}}`, testSteamID)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+}
+
+func assertionRequest(opEndpoint string) *http.Request {
+	q := url.Values{
+		"state":                 {"abc"},
+		"openid.ns":             {openIDNS},
+		"openid.mode":           {"id_res"},
+		"openid.op_endpoint":    {opEndpoint},
+		"openid.claimed_id":     {"https://steamcommunity.com/openid/id/" + testSteamID},
+		"openid.identity":       {"https://steamcommunity.com/openid/id/" + testSteamID},
+		"openid.return_to":      {"http://vouch.example.com/auth?state=abc"},
+		"openid.response_nonce": {"2020-01-01T00:00:00Zabc"},
+		"openid.assoc_handle":   {"1234567890"},
+		"openid.signed":         {"signed,op_endpoint,claimed_id,identity,return_to,response_nonce,assoc_handle"},
+		"openid.sig":            {"sig"},
+	}
+	return httptest.NewRequest("GET", "http://vouch.example.com/auth?"+q.Encode(), nil)
+}
+
+func TestLoginURL(t *testing.T) {
+	authURL := cfg.GenOAuth.AuthURL
+	cfg.GenOAuth.AuthURL = "https://steamcommunity.com/openid/login"
+	defer func() { cfg.GenOAuth.AuthURL = authURL }()
+
+	lURL, err := LoginURL("https://vouch.example.com/auth?state=abc")
+	assert.NoError(t, err)
+	u, _ := url.Parse(lURL)
+	assert.Equal(t, "steamcommunity.com", u.Host)
+	assert.Equal(t, "checkid_setup", u.Query().Get("openid.mode"))
+	assert.Equal(t, "https://vouch.example.com/auth?state=abc", u.Query().Get("openid.return_to"))
+	assert.Equal(t, "https://vouch.example.com", u.Query().Get("openid.realm"))
+	assert.Equal(t, identifierSelect, u.Query().Get("openid.claimed_id"))
+}
+
+func TestGetUserInfo(t *testing.T) {
+	ts := steamServer(t, true)
+	defer ts.Close()
+	authURL, userInfoURL := cfg.GenOAuth.AuthURL, cfg.GenOAuth.UserInfoURL
+	cfg.GenOAuth.AuthURL = ts.URL + "/openid/login"
+	cfg.GenOAuth.UserInfoURL = ts.URL + "/GetPlayerSummaries"
+	defer func() {
+		cfg.GenOAuth.AuthURL, cfg.GenOAuth.UserInfoURL = authURL, userInfoURL
+		cfg.GenOAuth.Steam.APIKey = ""
+	}()
+
+	user := &structs.User{}
+	customClaims := &structs.CustomClaims{}
+	err := Handler{}.GetUserInfo(assertionRequest(cfg.GenOAuth.AuthURL), user, customClaims, &structs.PTokens{})
+	assert.NoError(t, err)
+	assert.Equal(t, testSteamID, user.Username)
+	assert.Equal(t, "", user.Name)
+
+	cfg.GenOAuth.Steam.APIKey = "apikey"
+	user = &structs.User{}
+	err = Handler{}.GetUserInfo(assertionRequest(cfg.GenOAuth.AuthURL), user, customClaims, &structs.PTokens{})
+	assert.NoError(t, err)
+	assert.Equal(t, testSteamID, user.Username)
+	assert.Equal(t, "Robin", user.Name)
+}
+
+func TestGetUserInfoRejected(t *testing.T) {
+	ts := steamServer(t, false)
+	defer ts.Close()
+	authURL := cfg.GenOAuth.AuthURL
+	cfg.GenOAuth.AuthURL = ts.URL + "/openid/login"
+	defer func() { cfg.GenOAuth.AuthURL = authURL }()
+
+	// Steam does not vouch for the signature
+	err := Handler{}.GetUserInfo(assertionRequest(cfg.GenOAuth.AuthURL), &structs.User{}, &structs.CustomClaims{}, &structs.PTokens{})
+	assert.Error(t, err)
+
+	// asserted by someone other than Steam
+	err = Handler{}.GetUserInfo(assertionRequest("https://evil.example.com/openid/login"), &structs.User{}, &structs.CustomClaims{}, &structs.PTokens{})
+	assert.Error(t, err)
+
+	// returned to a different url
+	r := assertionRequest(cfg.GenOAuth.AuthURL)
+	r.Host = "evil.example.com"
+	err = Handler{}.GetUserInfo(r, &structs.User{}, &structs.CustomClaims{}, &structs.PTokens{})
+	assert.Error(t, err)
+}
+
+func TestSteamIDFromClaimedID(t *testing.T) {
+	id, err := steamIDFromClaimedID("https://steamcommunity.com/openid/id/" + testSteamID)
+	assert.NoError(t, err)
+	assert.Equal(t, testSteamID, id)
+
+	_, err = steamIDFromClaimedID("https://steamcommunity.com.evil.example.com/openid/id/" + testSteamID)
+	assert.Error(t, err)
+	_, err = steamIDFromClaimedID("https://steamcommunity.com/openid/id/123")
+	assert.Error(t, err)
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/domains"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/model"
+	"github.com/vouch/vouch-proxy/pkg/pii"
+)
+
+// session key remembering that /login was asked for a step up
+const stepUpSession = "stepUp"
+
+// stepUpRequested was /login called with `step_up=true`, see `vouch.stepUp`
+func stepUpRequested(r *http.Request) bool {
+	return cfg.Cfg.StepUp.Enabled && r.URL.Query().Get("step_up") == "true"
+}
+
+// withStepUpToken add the step up token to the url the user returns to, as `vouch.stepUp.param`
+// the token is only sent to a host of `vouch.domains`, and only valid for that host
+func withStepUpToken(requestedURL string, username string, idToken string) (string, error) {
+	u, err := url.Parse(requestedURL)
+	if err != nil {
+		return "", err
+	}
+	if domains.Matches(u.Host) == "" {
+		return "", fmt.Errorf("refusing to send a step up token to %s, which is not one of %s.domains", u.Host, cfg.Branding.LCName)
+	}
+	token, err := jwtmanager.CreateStepUpTokenString(username, idToken, u.Hostname())
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set(cfg.Cfg.StepUp.Param, token)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// stepUpResult the json body of /stepup/verify
+type stepUpResult struct {
+	Valid     bool   `json:"valid"`
+	Username  string `json:"username,omitempty"`
+	AuthTime  int64  `json:"auth_time,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// StepUpVerifyHandler /stepup/verify?token=...&host=...
+// the app checks the step up token it was given, which it can't verify itself as it is signed with the jwt key
+// `host` is the app's own, the token is only valid for the host it was sent to and only the first time it is checked
+func StepUpVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	log.Debug("/stepup/verify")
+	res := stepUpResult{}
+	claims, err := verifyStepUpToken(r.FormValue("token"), r.FormValue("host"))
+	if err != nil {
+		log.Infof("/stepup/verify invalid step up token: %s", err)
+		res.Reason = err.Error()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+	} else {
+		log.Debugf("/stepup/verify valid step up token of %s", pii.Mask(claims.Username))
+		res = stepUpResult{Valid: true, Username: claims.Username, AuthTime: claims.AuthTime, ExpiresAt: claims.ExpiresAt}
+		w.Header().Set("Content-Type", "application/json")
+	}
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		log.Error(err)
+	}
+}
+
+// verifyStepUpToken parse the step up token for the host and record its jti, refusing it the second time
+func verifyStepUpToken(token string, host string) (*jwtmanager.StepUpClaims, error) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	claims, err := jwtmanager.ParseStepUpToken(token, host)
+	if err != nil {
+		return nil, err
+	}
+	fresh, err := model.UseStepUpToken(claims.Id, claims.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, errors.New("step up token was already used")
+	}
+	return claims, nil
+}
@@ -0,0 +1,101 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/domains"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func verifyStepUp(t *testing.T, token string, host string) (int, stepUpResult) {
+	r := httptest.NewRequest("GET", "http://vouch.domain1/stepup/verify?token="+url.QueryEscape(token)+"&host="+url.QueryEscape(host), nil)
+	rr := httptest.NewRecorder()
+	StepUpVerifyHandler(rr, r)
+	res := stepUpResult{}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &res))
+	return rr.Code, res
+}
+
+func TestStepUp(t *testing.T) {
+	setUp()
+	cfg.Cfg.StepUp.Enabled = true
+	cfg.Cfg.StepUp.MaxAge = 300
+	cfg.Cfg.StepUp.Param = "vouch_step_up"
+	defer func() { cfg.Cfg.StepUp.Enabled = false }()
+
+	lURL, err := withStepUpToken("https://app.domain1/transfer?amount=10", "testuser", "")
+	assert.NoError(t, err)
+	u, err := url.Parse(lURL)
+	assert.NoError(t, err)
+	assert.Equal(t, "10", u.Query().Get("amount"))
+
+	stepUp := u.Query().Get("vouch_step_up")
+
+	// the token is only good for the host it was sent to
+	code, res := verifyStepUp(t, stepUp, "other.domain1")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.False(t, res.Valid)
+
+	code, res = verifyStepUp(t, stepUp, "App.domain1:443")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, res.Valid)
+	assert.Equal(t, "testuser", res.Username)
+	assert.InDelta(t, time.Now().Unix(), res.AuthTime, 5)
+	assert.InDelta(t, time.Now().Add(300*time.Second).Unix(), res.ExpiresAt, 5)
+
+	// and only once
+	code, res = verifyStepUp(t, stepUp, "app.domain1")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.Equal(t, "step up token was already used", res.Reason)
+
+	// it isn't sent to a host outside of vouch.domains
+	_, err = withStepUpToken("https://attacker.example/", "testuser", "")
+	assert.Error(t, err)
+
+	// a session token isn't proof of a fresh login
+	session := jwtmanager.CreateUserTokenString(structs.User{Username: "testuser"}, structs.CustomClaims{}, structs.PTokens{})
+	code, res = verifyStepUp(t, session, "app.domain1")
+	assert.Equal(t, http.StatusUnauthorized, code)
+	assert.False(t, res.Valid)
+	assert.NotEmpty(t, res.Reason)
+
+	// nor is a token signed elsewhere
+	foreign, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwtmanager.StepUpClaims{
+		Username:       "testuser",
+		AuthTime:       time.Now().Unix(),
+		StandardClaims: jwt.StandardClaims{Id: "jti", Audience: "app.domain1", Issuer: cfg.Cfg.JWT.Issuer, ExpiresAt: time.Now().Add(time.Minute).Unix()},
+	}).SignedString([]byte("not the key"))
+	code, _ = verifyStepUp(t, foreign, "app.domain1")
+	assert.Equal(t, http.StatusUnauthorized, code)
+
+	// an expired one
+	cfg.Cfg.StepUp.MaxAge = -1
+	expired, err := jwtmanager.CreateStepUpTokenString("testuser", "", "app.domain1")
+	assert.NoError(t, err)
+	code, _ = verifyStepUp(t, expired, "app.domain1")
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestLoginURLStepUp(t *testing.T) {
+	cfg.InitForTestPurposesWithProvider("oidc")
+	cfg.Cfg.Domains = []string{"domain1"}
+	domains.Refresh()
+	defer func() { cfg.Cfg.StepUp.Enabled = false }()
+	r := httptest.NewRequest("GET", "http://vouch.domain1/login?step_up=true&url=https://app.domain1/", nil)
+	assert.NotContains(t, loginURL(r, "state"), "prompt=login")
+
+	cfg.Cfg.StepUp.Enabled = true
+	assert.Contains(t, loginURL(r, "state"), "prompt=login")
+	r = httptest.NewRequest("GET", "http://vouch.domain1/login?url=https://app.domain1/", nil)
+	assert.NotContains(t, loginURL(r, "state"), "prompt=login")
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/vouch/vouch-proxy/handlers/github"
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/pii"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// teamRecheck the memberships of a user as last looked up at /validate
+type teamRecheck struct {
+	teams     []string
+	checkedAt time.Time
+}
+
+var (
+	teamRechecksMu sync.Mutex
+	teamRechecks   = make(map[string]teamRecheck)
+	// replaced in tests
+	lookupMemberships = github.Memberships
+)
+
+// recheckTeams look up the memberships again once `vouch.teamRecheck.interval` has passed since the jwt was issued
+// the lookup is shared by all of the user's requests for the next interval, so a busy user costs one API call per interval
+// the user is refused if they are no longer a member of the teamWhitelist, or if the lookup fails
+func recheckTeams(claims *jwtmanager.VouchClaims) error {
+	interval := time.Duration(cfg.Cfg.TeamRecheck.Interval) * time.Second
+	if time.Since(time.Unix(claims.TeamsCheckedAt, 0)) < interval {
+		return nil
+	}
+
+	teamRechecksMu.Lock()
+	rc, ok := teamRechecks[claims.Username]
+	teamRechecksMu.Unlock()
+	if !ok || time.Since(rc.checkedAt) >= interval {
+		teams, err := lookupMemberships(claims.Username, claims.PAccessToken)
+		if err != nil {
+			return fmt.Errorf("could not recheck the team memberships of %s: %s", pii.Mask(claims.Username), err)
+		}
+		log.Debugf("rechecked the team memberships of %s: %s", pii.Mask(claims.Username), teams)
+		rc = teamRecheck{teams: teams, checkedAt: time.Now()}
+		teamRechecksMu.Lock()
+		for username, c := range teamRechecks {
+			if time.Since(c.checkedAt) >= interval {
+				delete(teamRechecks, username)
+			}
+		}
+		teamRechecks[claims.Username] = rc
+		teamRechecksMu.Unlock()
+	}
+
+	if !inTeamWhiteList(rc.teams) {
+		return fmt.Errorf("%s is no longer a member of any of the teamWhitelist %s", pii.Mask(claims.Username), cfg.Cfg.TeamWhiteList)
+	}
+	// the method and path policies see the current memberships rather than those at login
+	if _, ok := claims.CustomClaims[structs.TeamsClaim]; ok {
+		claims.CustomClaims[structs.TeamsClaim] = rc.teams
+	}
+	if len(cfg.Cfg.Roles) > 0 && claims.CustomClaims != nil {
+		claims.CustomClaims[structs.RolesClaim] = mapRoles(rc.teams)
+	}
+	return nil
+}
@@ -15,6 +15,11 @@ import (
 
 	"github.com/vouch/vouch-proxy/handlers"
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/cors"
+	"github.com/vouch/vouch-proxy/pkg/httpclient"
+	"github.com/vouch/vouch-proxy/pkg/inflight"
+	"github.com/vouch/vouch-proxy/pkg/jwtmanager"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
 	"github.com/vouch/vouch-proxy/pkg/timelog"
 	tran "github.com/vouch/vouch-proxy/pkg/transciever"
 )
@@ -55,20 +60,61 @@ func main() {
 		"listen", listen,
 		"oauth.provider", cfg.GenOAuth.Provider)
 
+	httpclient.Version = version
+	if err := httpclient.Configure(); err != nil {
+		logger.Fatal(err)
+	}
+	if err := jwtmanager.Configure(); err != nil {
+		logger.Fatal(err)
+	}
+	if cfg.Cfg.Prefetch.Enabled {
+		handlers.PrefetchKeys()
+	}
+	if cfg.Cfg.Prefetch.Refresh.Enabled {
+		handlers.RefreshKeys()
+	}
+	if cfg.Cfg.WhiteListRefresh.Interval > 0 {
+		go cfg.RefreshWhiteListFile()
+	}
+
 	muxR := mux.NewRouter()
 
-	authH := http.HandlerFunc(handlers.ValidateRequestHandler)
-	muxR.HandleFunc("/validate", timelog.TimeLog(authH))
-	muxR.HandleFunc("/_external-auth-{id}", timelog.TimeLog(authH))
+	// counted, and limited by vouch.validateConcurrency
+	authH := inflight.Default.Handler(http.HandlerFunc(handlers.ValidateRequestHandler))
+	// a preflight from one of vouch.cors.allowedOrigins is answered before it takes a slot
+	muxR.HandleFunc("/validate", timelog.TimeLog(cors.AllowOrigins(authH)))
+	muxR.HandleFunc("/_external-auth-{id}", timelog.TimeLog(cors.AllowOrigins(authH)))
 
 	loginH := http.HandlerFunc(handlers.LoginHandler)
-	muxR.HandleFunc("/login", timelog.TimeLog(loginH))
+	muxR.HandleFunc("/login", timelog.TimeLog(cors.AllowOrigins(loginH)))
 
 	logoutH := http.HandlerFunc(handlers.LogoutHandler)
-	muxR.HandleFunc("/logout", timelog.TimeLog(logoutH))
+	muxR.HandleFunc("/logout", timelog.TimeLog(cors.AllowOrigins(logoutH)))
 
 	callH := http.HandlerFunc(handlers.CallbackHandler)
 	muxR.HandleFunc("/auth", timelog.TimeLog(callH))
+	if cfg.GenOAuth.CallbackPath != "" && cfg.GenOAuth.CallbackPath != "/auth" {
+		muxR.HandleFunc(cfg.GenOAuth.CallbackPath, timelog.TimeLog(callH))
+	}
+
+	if cfg.Cfg.BackChannelLogout {
+		backChannelLogoutH := http.HandlerFunc(handlers.BackChannelLogoutHandler)
+		muxR.HandleFunc("/backchannel-logout", timelog.TimeLog(backChannelLogoutH))
+	}
+
+	if cfg.Cfg.StepUp.Enabled {
+		stepUpVerifyH := http.HandlerFunc(handlers.StepUpVerifyHandler)
+		muxR.HandleFunc("/stepup/verify", timelog.TimeLog(stepUpVerifyH))
+	}
+
+	if cfg.Cfg.DebugAuthz.Enabled {
+		debugAuthzH := http.HandlerFunc(handlers.DebugAuthzHandler)
+		muxR.HandleFunc("/debug/authz", timelog.TimeLog(debugAuthzH))
+	}
+
+	if cfg.Cfg.Metrics.Enabled {
+		muxR.HandleFunc("/metrics", metrics.Handler)
+	}
 
 	healthH := http.HandlerFunc(handlers.HealthcheckHandler)
 	muxR.HandleFunc("/healthcheck", timelog.TimeLog(healthH))
@@ -95,14 +141,25 @@ func main() {
 	// http.Handle("/socket.io/", tran.Server)
 
 	srv := &http.Server{
-		Handler: muxR,
+		Handler: handlers.LimitRequestBody(handlers.TimeoutRequests(muxR)),
 		Addr:    listen,
 		// Good practice: enforce timeouts for servers you create!
 		WriteTimeout: 15 * time.Second,
 		ReadTimeout:  15 * time.Second,
 		ErrorLog:     log.New(&fwdToZapWriter{fastlog}, "", 0),
+		// the server answers 431 for anything larger
+		MaxHeaderBytes: cfg.Cfg.Limits.MaxHeaderBytes,
 	}
 
+	if cfg.Cfg.TLS.Cert != "" && cfg.Cfg.TLS.Key != "" {
+		tlsConfig, err := cfg.TLSConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.TLSConfig = tlsConfig
+		logger.Infow("terminating tls", "tls.min_version", cfg.Cfg.TLS.MinVersion)
+		log.Fatal(srv.ListenAndServeTLS(cfg.Cfg.TLS.Cert, cfg.Cfg.TLS.Key))
+	}
 	log.Fatal(srv.ListenAndServe())
 
 }
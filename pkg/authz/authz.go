@@ -0,0 +1,149 @@
+package authz
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/pii"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+// ModeReplace the webhook decision is final and the static whitelists are not consulted
+const ModeReplace = "replace"
+
+// ModeAugment the webhook must allow the user and so must the static whitelists
+const ModeAugment = "augment"
+
+// Request the json body POSTed to `vouch.authz.webhook_url`
+type Request struct {
+	Username string   `json:"username"`
+	Email    string   `json:"email"`
+	Teams    []string `json:"teams"`
+}
+
+// Response the json body expected from `vouch.authz.webhook_url`
+type Response struct {
+	Allow bool `json:"allow"`
+	// Teams are added to the user's TeamMemberships
+	Teams []string `json:"teams,omitempty"`
+	// Claims are added to the custom claims of the jwt
+	Claims map[string]interface{} `json:"claims,omitempty"`
+	// Reason why the user is denied, one of the reasons of `vouch.deniedMessages`
+	Reason string `json:"reason,omitempty"`
+}
+
+// DeniedError the webhook answered that the user is not allowed
+type DeniedError struct {
+	Username string
+	// Reason as the webhook gave it, may be empty
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	return fmt.Sprintf("authz webhook denied user %s", pii.Mask(e.Username))
+}
+
+type cached struct {
+	resp    Response
+	expires time.Time
+}
+
+var (
+	log = cfg.Cfg.Logger
+
+	mu    sync.Mutex
+	cache = make(map[string]cached)
+	now   = time.Now
+)
+
+// Check asks the webhook whether the user is allowed, adding any returned teams and claims
+// on error the user is denied unless `vouch.authz.fail_open` is set
+func Check(user *structs.User, customClaims *structs.CustomClaims) (bool, error) {
+	req := Request{Username: user.Username, Email: user.Email, Teams: user.TeamMemberships}
+	resp, err := lookup(req)
+	if err != nil {
+		if cfg.Cfg.Authz.FailOpen {
+			log.Warnf("authz webhook failed, allowing %s since %s.authz.fail_open is set: %s", pii.Mask(user.Username), cfg.Branding.LCName, err)
+			return true, nil
+		}
+		return false, err
+	}
+
+	user.TeamMemberships = append(user.TeamMemberships, resp.Teams...)
+	if len(resp.Claims) > 0 {
+		if customClaims.Claims == nil {
+			customClaims.Claims = make(map[string]interface{})
+		}
+		for k, v := range resp.Claims {
+			customClaims.Claims[k] = v
+		}
+	}
+	if !resp.Allow {
+		return false, &DeniedError{Username: user.Username, Reason: resp.Reason}
+	}
+	return true, nil
+}
+
+// lookup the cached response or call the webhook
+func lookup(req Request) (Response, error) {
+	key := strings.Join([]string{req.Username, req.Email, strings.Join(req.Teams, ",")}, "\x00")
+	ttl := time.Duration(cfg.Cfg.Authz.CacheTTL) * time.Second
+
+	mu.Lock()
+	c, ok := cache[key]
+	mu.Unlock()
+	if ok && now().Before(c.expires) {
+		log.Debugf("authz webhook cached response for %s", pii.Mask(req.Username))
+		return c.resp, nil
+	}
+
+	resp, err := call(req)
+	if err != nil {
+		return resp, err
+	}
+	if ttl > 0 {
+		mu.Lock()
+		for k, v := range cache {
+			if !now().Before(v.expires) {
+				delete(cache, k)
+			}
+		}
+		cache[key] = cached{resp: resp, expires: now().Add(ttl)}
+		mu.Unlock()
+	}
+	return resp, nil
+}
+
+func call(req Request) (resp Response, rerr error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+	client := &http.Client{Timeout: time.Duration(cfg.Cfg.Authz.Timeout) * time.Second}
+	r, err := client.Post(cfg.Cfg.Authz.WebhookURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return resp, err
+	}
+	defer func() {
+		if err := r.Body.Close(); err != nil {
+			rerr = err
+		}
+	}()
+	data, _ := ioutil.ReadAll(r.Body)
+	if r.StatusCode != http.StatusOK {
+		return resp, errors.New("authz webhook unexpected response status " + r.Status)
+	}
+	if err = json.Unmarshal(data, &resp); err != nil {
+		return resp, err
+	}
+	log.Debugf("authz webhook response for %s: %+v", pii.Mask(req.Username), resp)
+	return resp, nil
+}
@@ -0,0 +1,98 @@
+package authz
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/structs"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+// webhook allows alice and gives her an extra team, denies carol with a reason and everyone else without
+func webhook(t *testing.T, calls *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*calls++
+		req := Request{}
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&req))
+		resp := Response{}
+		if req.Username == "alice" {
+			resp = Response{Allow: true, Teams: []string{"org/extra"}, Claims: map[string]interface{}{"level": "admin"}}
+		}
+		if req.Username == "carol" {
+			resp = Response{Reason: "wrong-tenant"}
+		}
+		assert.Nil(t, json.NewEncoder(w).Encode(resp))
+	}))
+}
+
+func setUp(url string) {
+	cache = make(map[string]cached)
+	cfg.Cfg.Authz.WebhookURL = url
+	cfg.Cfg.Authz.FailOpen = false
+}
+
+func TestCheck(t *testing.T) {
+	calls := 0
+	ts := webhook(t, &calls)
+	defer ts.Close()
+	setUp(ts.URL)
+
+	user := structs.User{Username: "alice", TeamMemberships: []string{"org/team"}}
+	customClaims := structs.CustomClaims{}
+	ok, err := Check(&user, &customClaims)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"org/team", "org/extra"}, user.TeamMemberships)
+	assert.Equal(t, "admin", customClaims.Claims["level"])
+
+	ok, err = Check(&structs.User{Username: "bob"}, &structs.CustomClaims{})
+	assert.False(t, ok)
+	if assert.IsType(t, &DeniedError{}, err) {
+		assert.Equal(t, "", err.(*DeniedError).Reason)
+	}
+
+	ok, err = Check(&structs.User{Username: "carol"}, &structs.CustomClaims{})
+	assert.False(t, ok)
+	if assert.IsType(t, &DeniedError{}, err) {
+		assert.Equal(t, "wrong-tenant", err.(*DeniedError).Reason)
+	}
+}
+
+func TestCheckCached(t *testing.T) {
+	calls := 0
+	ts := webhook(t, &calls)
+	defer ts.Close()
+	setUp(ts.URL)
+
+	for i := 0; i < 3; i++ {
+		ok, _ := Check(&structs.User{Username: "alice"}, &structs.CustomClaims{})
+		assert.True(t, ok)
+	}
+	assert.Equal(t, 1, calls)
+}
+
+func TestCheckFailClosed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "oops", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+	setUp(ts.URL)
+
+	ok, err := Check(&structs.User{Username: "alice"}, &structs.CustomClaims{})
+	assert.False(t, ok)
+	assert.NotNil(t, err)
+
+	cfg.Cfg.Authz.FailOpen = true
+	defer func() { cfg.Cfg.Authz.FailOpen = false }()
+	ok, err = Check(&structs.User{Username: "alice"}, &structs.CustomClaims{})
+	assert.True(t, ok)
+	assert.Nil(t, err)
+}
@@ -8,8 +8,10 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strconv"
 	"strings"
@@ -29,26 +31,222 @@ type config struct {
 	Logger        *zap.SugaredLogger
 	FastLogger    *zap.Logger
 	LogLevel      string   `mapstructure:"logLevel"`
+	MaskPII       bool     `mapstructure:"maskPII"`
 	Listen        string   `mapstructure:"listen"`
 	Port          int      `mapstructure:"port"`
 	HealthCheck   bool     `mapstructure:"healthCheck"`
 	Domains       []string `mapstructure:"domains"`
 	WhiteList     []string `mapstructure:"whitelist"`
 	TeamWhiteList []string `mapstructure:"teamWhitelist"`
+	WhiteListFile string   `mapstructure:"whiteListFile"`
 	AllowAllUsers bool     `mapstructure:"allowAllUsers"`
 	PublicAccess  bool     `mapstructure:"publicAccess"`
+	SingleSession bool     `mapstructure:"singleSession"`
 	JWT           struct {
 		MaxAge   int    `mapstructure:"maxAge"`
 		Issuer   string `mapstructure:"issuer"`
 		Secret   string `mapstructure:"secret"`
 		Compress bool   `mapstructure:"compress"`
-	}
+		// SigningMethod one of HS256, HS384, HS512
+		SigningMethod string `mapstructure:"signingMethod"`
+		// KeyID the `kid` header of the jwt, derived from the secret when unset
+		KeyID string `mapstructure:"kid"`
+		// KeySource where the signing key comes from: file (jwt.secret or config/secret) or vault
+		KeySource string `mapstructure:"key_source"`
+		Vault     struct {
+			Address string `mapstructure:"address"`
+			Path    string `mapstructure:"path"`
+			Token   string `mapstructure:"token"`
+			Field   string `mapstructure:"field"`
+			// Refresh seconds between fetches of the key, 0 fetches it once at startup
+			Refresh int `mapstructure:"refresh"`
+		} `mapstructure:"vault"`
+	}
+	// TeamWhiteListMinMatches the user must be a member of at least this many of the TeamWhiteList
+	TeamWhiteListMinMatches int `mapstructure:"teamWhitelistMinMatches"`
+	// TeamWhiteListIncludeChildTeams a member of a team nested below a TeamWhiteList team is a member of it, GitHub only
+	TeamWhiteListIncludeChildTeams bool `mapstructure:"teamWhitelistIncludeChildTeams"`
+	// WhiteListRegex patterns matched against the whole username and verified emails, alongside the WhiteList
+	WhiteListRegex []string `mapstructure:"whiteListRegex"`
+	// TeamWhiteListRegex patterns matched against the whole `org/team` of a membership, alongside the TeamWhiteList
+	TeamWhiteListRegex []string `mapstructure:"teamWhitelistRegex"`
+	// MembershipCacheTTL seconds the GitHub org and team memberships of a user are kept once looked up, 0 disables
+	MembershipCacheTTL int `mapstructure:"membershipCacheTTL"`
+	// BackChannelLogout accept OIDC logout tokens at /backchannel-logout
+	BackChannelLogout bool `mapstructure:"backChannelLogout"`
+	// GitHubActions authorize GitHub Actions OIDC tokens presented as `Authorization: Bearer <jwt>` at /validate
+	GitHubActions struct {
+		Enabled      bool     `mapstructure:"enabled"`
+		Issuer       string   `mapstructure:"issuer"`
+		JWKSURL      string   `mapstructure:"jwksUrl"`
+		Audience     string   `mapstructure:"audience"`
+		Repositories []string `mapstructure:"repositories"`
+		Workflows    []string `mapstructure:"workflows"`
+	} `mapstructure:"githubActions"`
+	// StepUp /login?step_up=true makes the user log in again at the provider, the app gets a token proving it
+	StepUp struct {
+		Enabled bool `mapstructure:"enabled"`
+		// MaxAge seconds the step up token is valid
+		MaxAge int `mapstructure:"maxAge"`
+		// Param the query parameter of the requested url which carries the token
+		Param string `mapstructure:"param"`
+	} `mapstructure:"stepUp"`
+	// MethodTeams the teams (any one of) which the user must be a member of for the forwarded request method
+	// `unsafe` applies to every method other than GET, HEAD, OPTIONS and TRACE which isn't listed itself
+	MethodTeams map[string][]string `mapstructure:"methodTeams"`
+	// Roles the normalized roles of the user, each given to the members of any one of its teams, groups or roles at the provider
+	Roles map[string][]string `mapstructure:"roles"`
+	// ClaimsWhiteList admits a user whose claim (a name or a dotted path into the claims) has any one of the values
+	ClaimsWhiteList map[string][]string `mapstructure:"claimsWhitelist"`
+	// PathPolicies the teams (any one of) required for the forwarded request path, the first match applies
+	PathPolicies []PathPolicy `mapstructure:"pathPolicies"`
+	// OptionalAuthPaths path prefixes of the original request which are let through anonymously without a valid session
+	OptionalAuthPaths []string `mapstructure:"optionalAuthPaths"`
+	// TrustedProxies the addresses or cidrs of the proxies whose X-Forwarded-For is believed, see clientip.FromRequest
+	TrustedProxies []string `mapstructure:"trustedProxies"`
+	// ForceHTTPS build urls with https whatever the scheme of the request, for TLS terminated in front of Vouch Proxy
+	ForceHTTPS bool `mapstructure:"forceHttps"`
+	// Dev conveniences for running Vouch Proxy on a workstation, see dev.go
+	Dev struct {
+		Enabled bool `mapstructure:"enabled"`
+		// AllowInsecure plain http and cookies without Secure, only with Enabled and loopback callback urls
+		AllowInsecure bool `mapstructure:"allowInsecure"`
+	} `mapstructure:"dev"`
+	// ShowTokenExchangeError tell the user why the provider's token endpoint refused the code, it is always logged
+	ShowTokenExchangeError bool `mapstructure:"showTokenExchangeError"`
+	// LogAuthorizeURL log the url each /login sends the user to at the provider, with any secrets redacted
+	LogAuthorizeURL bool `mapstructure:"logAuthorizeURL"`
+	// LoginRedirect how /validate tells the client where to log in: none (a plain 401), header or redirect
+	LoginRedirect string `mapstructure:"loginRedirect"`
+	// LoginURL the /login of this Vouch Proxy, derived from oauth.callback_url when unset
+	LoginURL string `mapstructure:"loginUrl"`
+	// DefaultPostLoginURL where the user lands after a login at /login without a url, it must be in one of the Domains
+	DefaultPostLoginURL string `mapstructure:"defaultPostLoginUrl"`
+	// AllowBearerToken accept the jwt from `Authorization: Bearer <jwt>`
+	AllowBearerToken bool `mapstructure:"allowBearerToken"`
+	// Lockout returns 429 to clients which repeatedly present an invalid jwt
+	Lockout struct {
+		Failures   int `mapstructure:"failures"`
+		Window     int `mapstructure:"window"`
+		Cooldown   int `mapstructure:"cooldown"`
+		MaxEntries int `mapstructure:"maxEntries"`
+	}
+	// FailureDelay sleeps up to MaxJitter milliseconds before responding to a failed authentication
+	FailureDelay struct {
+		MaxJitter     int `mapstructure:"maxJitter"`
+		MaxConcurrent int `mapstructure:"maxConcurrent"`
+	} `mapstructure:"failureDelay"`
+	// ValidateConcurrency limits the /validate requests handled at once, a Max of 0 is unlimited
+	ValidateConcurrency struct {
+		Max int `mapstructure:"max"`
+		// QueueTimeout milliseconds a request waits for a slot before the 503, 0 responds immediately
+		QueueTimeout int `mapstructure:"queueTimeout"`
+	} `mapstructure:"validateConcurrency"`
+	// ValidateCache keeps the claims of a verified jwt for TTL milliseconds, so the repeated /validate of one
+	// request doesn't verify the same token again, a TTL of 0 disables
+	ValidateCache struct {
+		TTL int `mapstructure:"ttl"`
+		// Max the number of tokens kept at once
+		Max int `mapstructure:"max"`
+	} `mapstructure:"validateCache"`
+	// Prefetch the JWKS at startup rather than when the first token is verified
+	Prefetch struct {
+		Enabled bool `mapstructure:"enabled"`
+		// Retry seconds between attempts while a JWKS can't be fetched
+		Retry int `mapstructure:"retry"`
+		// Refresh fetch the JWKS again in the background, not only when a token names an unknown kid
+		Refresh struct {
+			Enabled bool `mapstructure:"enabled"`
+			// Interval seconds between fetches, 0 follows the max-age of the provider's Cache-Control
+			Interval int `mapstructure:"interval"`
+			// Min and Max seconds bound the time between fetches
+			Min int `mapstructure:"min"`
+			Max int `mapstructure:"max"`
+		} `mapstructure:"refresh"`
+	} `mapstructure:"prefetch"`
+	// CORS answer the preflight of a browser at /validate, /login and /logout for the AllowedOrigins, none by default
+	CORS struct {
+		AllowedOrigins []string `mapstructure:"allowedOrigins"`
+		AllowedMethods []string `mapstructure:"allowedMethods"`
+		AllowedHeaders []string `mapstructure:"allowedHeaders"`
+		// MaxAge seconds the browser may cache the preflight
+		MaxAge int `mapstructure:"maxAge"`
+	} `mapstructure:"cors"`
+	// AccessDenied the response to a user who declined to authorize the login at the provider
+	AccessDenied struct {
+		Message  string `mapstructure:"message"`
+		Redirect string `mapstructure:"redirect"`
+	} `mapstructure:"accessDenied"`
+	// DeniedMessages shown to a user whose login was refused instead of the details of the rule, by denialReasons
+	DeniedMessages map[string]string `mapstructure:"deniedMessages"`
+	// StoreTeams record the user's TeamMemberships in the jwt at login for headers.teams, at the cost of a larger cookie
+	StoreTeams bool `mapstructure:"storeTeams"`
+	// WhiteListRefresh read the whiteListFile again every Interval seconds, plus up to Jitter seconds, 0 reads it once
+	WhiteListRefresh struct {
+		Interval int `mapstructure:"interval"`
+		Jitter   int `mapstructure:"jitter"`
+	} `mapstructure:"whiteListRefresh"`
+	// TeamRecheck look up the team memberships again at /validate once Interval seconds have passed since the last lookup
+	TeamRecheck struct {
+		Interval int `mapstructure:"interval"`
+	} `mapstructure:"teamRecheck"`
+	// Fingerprint bind the session to the client which logged in, Components are userAgent and/or ip
+	// the ip is truncated to IPv4Prefix or IPv6Prefix bits
+	Fingerprint struct {
+		Components []string `mapstructure:"components"`
+		IPv4Prefix int      `mapstructure:"ipv4Prefix"`
+		IPv6Prefix int      `mapstructure:"ipv6Prefix"`
+	} `mapstructure:"fingerprint"`
+	// Limits the largest request accepted, larger headers are answered with a 431 and larger bodies with a 413
+	Limits struct {
+		MaxHeaderBytes int   `mapstructure:"maxHeaderBytes"`
+		MaxBodyBytes   int64 `mapstructure:"maxBodyBytes"`
+		// RequestTimeout seconds a handler may run before the client is answered with a 503, 0 disables it
+		RequestTimeout int `mapstructure:"requestTimeout"`
+	} `mapstructure:"limits"`
+	// Authz an external webhook which authorizes the user at login
+	Authz struct {
+		WebhookURL string `mapstructure:"webhook_url"`
+		Mode       string `mapstructure:"mode"`
+		Timeout    int    `mapstructure:"timeout"`
+		CacheTTL   int    `mapstructure:"cache_ttl"`
+		FailOpen   bool   `mapstructure:"fail_open"`
+	} `mapstructure:"authz"`
+	// TLS terminate https at Vouch Proxy when both cert and key are set
+	TLS struct {
+		Cert         string   `mapstructure:"cert"`
+		Key          string   `mapstructure:"key"`
+		MinVersion   string   `mapstructure:"min_version"`
+		CipherSuites []string `mapstructure:"cipher_suites"`
+	} `mapstructure:"tls"`
+	// DebugAuthz enables /debug/authz which reveals the authorization policy
+	DebugAuthz struct {
+		Enabled  bool   `mapstructure:"enabled"`
+		Secret   string `mapstructure:"secret"`
+		Validate bool   `mapstructure:"validate"`
+	} `mapstructure:"debugAuthz"`
+	// Metrics serve the login and provider metrics at /metrics for Prometheus
+	Metrics struct {
+		Enabled bool `mapstructure:"enabled"`
+	} `mapstructure:"metrics"`
 	Cookie struct {
 		Name     string `mapstructure:"name"`
 		Domain   string `mapstructure:"domain"`
 		Secure   bool   `mapstructure:"secure"`
 		HTTPOnly bool   `mapstructure:"httpOnly"`
 		MaxAge   int    `mapstructure:"maxage"`
+		Path     string `mapstructure:"path"`
+		SameSite string `mapstructure:"sameSite"`
+		// LegacyUserAgents patterns of user agents which also get a cookie without SameSite when SameSite is None
+		LegacyUserAgents []string `mapstructure:"legacyUserAgents"`
+		// OnInvalid what /validate does with a cookie whose jwt doesn't validate: clear or ignore
+		OnInvalid string `mapstructure:"onInvalid"`
+		// Compress the cookie value before it is set: none, gzip or flate
+		Compress string `mapstructure:"compress"`
+		// Duplicates which of several cookies of the same name /validate uses: first or first_valid
+		Duplicates string `mapstructure:"duplicates"`
+		// PerDomain the attributes of the cookie for one of the Domains, in place of those above
+		PerDomain []CookieDomain `mapstructure:"perDomain"`
 	}
 
 	Headers struct {
@@ -61,6 +259,34 @@ type config struct {
 		Claims      []string `mapstructure:"claims"`
 		AccessToken string   `mapstructure:"accesstoken"`
 		IDToken     string   `mapstructure:"idtoken"`
+		Provider    string   `mapstructure:"provider"`
+		LoginURL    string   `mapstructure:"loginurl"`
+		Picture     string   `mapstructure:"picture"`
+		Tenant      string   `mapstructure:"tenant"`
+		Domain      string   `mapstructure:"domain"`
+		Teams       string   `mapstructure:"teams"`
+		ExpiresIn   string   `mapstructure:"expiresin"`
+		Anonymous   string   `mapstructure:"anonymous"`
+		// Roles the user's vouch.roles, comma separated
+		Roles string `mapstructure:"roles"`
+		// ForwardAccessTokenHosts when set the access token is only passed for requests to these hosts
+		// an entry starting with a dot also matches all of its subdomains
+		ForwardAccessTokenHosts []string `mapstructure:"forward_access_token_hosts"`
+		// ClaimTemplates reformat a claim before it is passed as a header
+		ClaimTemplates []ClaimTemplate `mapstructure:"claimtemplates"`
+		// UserTemplate reformat the username passed in the User header, as ClaimTemplates do
+		UserTemplate string `mapstructure:"usertemplate"`
+		// TrustForwarded headers set by the reverse proxy which may be used to reconstruct the requested url
+		TrustForwarded []string `mapstructure:"trustforwarded"`
+		// Encoding of a header value with more than printable ascii, such as a unicode username, one of headerEncodings
+		Encoding string `mapstructure:"encoding"`
+		// Sensitive headers which are only passed while the login is at most MaxAuthAge seconds old
+		Sensitive struct {
+			Headers    []string `mapstructure:"headers"`
+			MaxAuthAge int      `mapstructure:"maxauthage"`
+			// Stale omit leaves out the Headers of an older login, reauth answers 401 so the user logs in again
+			Stale string `mapstructure:"stale"`
+		} `mapstructure:"sensitive"`
 	}
 	DB struct {
 		File string `mapstructure:"file"`
@@ -68,6 +294,36 @@ type config struct {
 	Session struct {
 		Name string `mapstructure:"name"`
 		Key  string `mapstructure:"key"`
+		// Store where the login state is kept between /login and /auth, cookie or filesystem
+		Store string `mapstructure:"store"`
+		// Path the directory of the filesystem store
+		Path string `mapstructure:"path"`
+		// SourcePrecedence which jwt /validate uses when there is both a cookie and a header:
+		// cookie, header or cookie_then_header (the cookie, falling back to the header if it doesn't validate)
+		SourcePrecedence string `mapstructure:"source_precedence"`
+		// StateAttempts how many times /auth reads the login state before it is invalid, for a store with replication lag
+		StateAttempts int `mapstructure:"state_attempts"`
+		// StateBackoff milliseconds before the second read, each further read waits that much longer
+		StateBackoff int `mapstructure:"state_backoff"`
+		// LoginTimeout seconds from /login within which the callback must arrive, whatever the store, 0 leaves it to cookie.maxAge
+		LoginTimeout int `mapstructure:"login_timeout"`
+		// Coalesce seconds in which the logins of one browser share the state and the calls to the provider, 0 disables
+		Coalesce int `mapstructure:"coalesce"`
+		// CallbackHost must the callback arrive on the host which /login was requested on
+		CallbackHost bool `mapstructure:"callback_host"`
+		// CookiesBlockedURL where the callback sends a user whose browser didn't return the session cookie
+		// empty explains it on the page of /auth
+		CookiesBlockedURL string `mapstructure:"cookies_blocked_url"`
+		// Cookie the attributes of the session cookie which carries the login state, apart from vouch.cookie
+		Cookie struct {
+			Secure   bool   `mapstructure:"secure"`
+			HTTPOnly bool   `mapstructure:"httpOnly"`
+			SameSite string `mapstructure:"sameSite"`
+			// MaxAge seconds the user has to complete the login at the provider
+			MaxAge int `mapstructure:"maxAge"`
+			// Path must include /login and the callback
+			Path string `mapstructure:"path"`
+		} `mapstructure:"cookie"`
 	}
 	TestURL  string   `mapstructure:"test_url"`
 	TestURLs []string `mapstructure:"test_urls"`
@@ -75,20 +331,184 @@ type config struct {
 	WebApp   bool     `mapstructure:"webapp"`
 }
 
+// PathPolicy requests for paths starting with Prefix, or matching Regex, require one of the Teams
+type PathPolicy struct {
+	Prefix string   `mapstructure:"prefix"`
+	Regex  string   `mapstructure:"regex"`
+	Teams  []string `mapstructure:"teams"`
+}
+
+// CookieDomain the cookie attributes for the requests to one of the vouch.domains, those left unset are vouch.cookie's
+type CookieDomain struct {
+	Domain   string `mapstructure:"domain"`
+	SameSite string `mapstructure:"sameSite"`
+	Secure   *bool  `mapstructure:"secure"`
+	Path     string `mapstructure:"path"`
+	// MaxAge minutes, as vouch.cookie.maxAge
+	MaxAge int `mapstructure:"maxAge"`
+}
+
+// ClaimTemplate a Go text/template applied to the value of the claim, the result is passed in the header
+type ClaimTemplate struct {
+	Claim    string `mapstructure:"claim"`
+	Header   string `mapstructure:"header"`
+	Template string `mapstructure:"template"`
+}
+
 // oauth config items endoint for access
 type oauthConfig struct {
 	Provider        string   `mapstructure:"provider"`
 	ClientID        string   `mapstructure:"client_id"`
 	ClientSecret    string   `mapstructure:"client_secret"`
 	AuthURL         string   `mapstructure:"auth_url"`
+	RequestTokenURL string   `mapstructure:"request_token_url"`
 	TokenURL        string   `mapstructure:"token_url"`
+	PARURL          string   `mapstructure:"par_url"`
 	RedirectURL     string   `mapstructure:"callback_url"`
 	RedirectURLs    []string `mapstructure:"callback_urls"`
+	CallbackPath    string   `mapstructure:"callback_path"`
 	Scopes          []string `mapstructure:"scopes"`
 	UserInfoURL     string   `mapstructure:"user_info_url"`
 	UserTeamURL     string   `mapstructure:"user_team_url"`
 	UserOrgURL      string   `mapstructure:"user_org_url"`
+	UserEmailsURL   string   `mapstructure:"user_emails_url"`
+	JWKSURL         string   `mapstructure:"jwks_url"`
+	Issuer          string   `mapstructure:"issuer"`
 	PreferredDomain string   `mapstructre:"preferredDomain"`
+	// DiscoveryURL the openid configuration of the provider, which lists the algs it signs id tokens with
+	DiscoveryURL string `mapstructure:"discovery_url"`
+	// IDTokenSigningAlgs the algs an id token may be signed with, one of idTokenSigningAlgs
+	// empty takes the id_token_signing_alg_values_supported of the DiscoveryURL
+	IDTokenSigningAlgs []string `mapstructure:"id_token_signing_algs"`
+	// RedirectURI the redirect_uri sent verbatim to the authorize endpoint and to the token exchange,
+	// in place of callback_url, callback_urls and callback_path, for a gateway which rewrites the path
+	RedirectURI string `mapstructure:"redirect_uri"`
+	// UserOrgMembershipURL the authenticated user's own membership of an org, see GitHub.OwnOrgMembership
+	UserOrgMembershipURL string `mapstructure:"user_org_membership_url"`
+	// UserTeamByIDURL the user's membership of a team by its numeric id, see GitHub.TeamsByID
+	UserTeamByIDURL string `mapstructure:"user_team_by_id_url"`
+	// ChildTeamsURL the teams nested directly below a team, see vouch.teamWhitelistIncludeChildTeams
+	ChildTeamsURL string `mapstructure:"child_teams_url"`
+	// UserTeamsURL the teams of the authenticated user, matched against vouch.teamWhitelistRegex
+	UserTeamsURL string `mapstructure:"user_teams_url"`
+	// InstallationTokenURL where the jwt of the GitHub.App is exchanged for a token of its installation
+	InstallationTokenURL string `mapstructure:"installation_token_url"`
+	// UserInfo whether the oidc handler needs the userinfo endpoint: required, optional or skip
+	// when optional or skip the user is taken from the verified id token
+	UserInfo string `mapstructure:"userinfo"`
+	// OAuth2Only the oidc handler ignores the id token, for a plain OAuth 2.0 provider which never returns one
+	OAuth2Only bool `mapstructure:"oauth2_only"`
+	// RequestObject send the authorize parameters as a signed jwt in `request=` (RFC 9101) rather than in the query
+	RequestObject struct {
+		Enabled bool `mapstructure:"enabled"`
+		// Alg one of requestObjectAlgs, HS256 signs with the client_secret
+		Alg string `mapstructure:"alg"`
+		// SigningKeyFile a PEM private key for the RS and ES algs, whose public key is registered with the provider
+		SigningKeyFile string `mapstructure:"signing_key_file"`
+		// KeyID the kid of the key at the provider
+		KeyID string `mapstructure:"kid"`
+	} `mapstructure:"request_object"`
+	// TokenEndpointAuthMethod how the client authenticates at the token endpoint, one of tokenEndpointAuthMethods
+	// empty leaves it to golang.org/x/oauth2, which tries client_secret_basic and then client_secret_post
+	TokenEndpointAuthMethod string `mapstructure:"token_endpoint_auth_method"`
+	// ClientAssertion the key which signs the client_assertion of private_key_jwt (RFC 7523)
+	ClientAssertion struct {
+		// Alg one of requestObjectAlgs but HS256
+		Alg            string `mapstructure:"alg"`
+		SigningKeyFile string `mapstructure:"signing_key_file"`
+		KeyID          string `mapstructure:"kid"`
+	} `mapstructure:"client_assertion"`
+	// Audience the APIs the access token is requested for, sent to auth_url as `audience` (Auth0 and others)
+	Audience []string `mapstructure:"audience"`
+	// AudienceParam how several audiences are sent, one of audienceParams
+	AudienceParam string `mapstructure:"audience_param"`
+	// RequiredScopes the scopes the provider must grant at the callback, for github those the configuration needs
+	RequiredScopes []string `mapstructure:"required_scopes"`
+	// MissingScopes what to do when the RequiredScopes aren't all granted, one of missingScopes
+	MissingScopes string `mapstructure:"missing_scopes"`
+	// UserInfoError the keys of an error in a userinfo body which came with a 200, empty Field doesn't look for one
+	UserInfoError struct {
+		Field            string `mapstructure:"field"`
+		DescriptionField string `mapstructure:"description_field"`
+	} `mapstructure:"user_info_error"`
+	// SkipAzpCheck accept an id token for several audiences without an azp of the client_id, for non-conformant IdPs
+	SkipAzpCheck bool `mapstructure:"skip_azp_check"`
+	// HTTPProxy the proxy for requests to the provider, in place of the environment's HTTP_PROXY, `none` for direct
+	HTTPProxy string `mapstructure:"http_proxy"`
+	// HTTPClient the reuse of the connections to the provider
+	HTTPClient struct {
+		// MaxIdleConnsPerHost idle connections kept open to each host of the provider
+		MaxIdleConnsPerHost int `mapstructure:"max_idle_conns_per_host"`
+		// IdleConnTimeout seconds before an idle connection is closed
+		IdleConnTimeout int `mapstructure:"idle_conn_timeout"`
+		// HTTP2 negotiate http/2 with a provider which offers it
+		HTTP2 bool `mapstructure:"http2"`
+		// Timeout seconds a request to the provider may take, answer and all, 0 waits on it forever
+		Timeout int `mapstructure:"timeout"`
+		// Retries times a membership or userinfo call is retried after a 5xx or a 429
+		Retries int `mapstructure:"retries"`
+	} `mapstructure:"http_client"`
+	// UserAgent sent on requests to the provider, defaults to vouch-proxy/<version>
+	UserAgent string `mapstructure:"user_agent"`
+	// NameClaim the claim which holds the user's display name
+	NameClaim string `mapstructure:"name_claim"`
+	// ComposeName use given_name and family_name when the NameClaim is absent
+	ComposeName bool `mapstructure:"compose_name"`
+	// AccessTokenGroupsClaim the claim of a jwt access token whose values are added to the user's TeamMemberships
+	AccessTokenGroupsClaim string `mapstructure:"access_token_groups_claim"`
+	// AllowedEmailDomains the user's email must be in one of these domains to log in with this provider, on top of vouch.domains
+	AllowedEmailDomains []string `mapstructure:"allowed_email_domains"`
+	// TenantClaim the claim which names the user's tenant or organization, such as `tid` for Azure AD
+	TenantClaim string `mapstructure:"tenant_claim"`
+	// AllowedTenants the TenantClaim must be one of these to log in, empty allows any tenant
+	AllowedTenants []string `mapstructure:"allowed_tenants"`
+	// TenantFromEmail derive the tenant from the domain of the user's email when there's no TenantClaim: domain or org
+	TenantFromEmail string `mapstructure:"tenant_from_email"`
+	// PictureClaim the claim which holds the url of the user's avatar, avatar_url for github and picture otherwise
+	PictureClaim string `mapstructure:"picture_claim"`
+	// ActiveClaim a claim such as `active` or `account_enabled`, the user is denied when it is present and false
+	ActiveClaim string `mapstructure:"active_claim"`
+	// EmailClaims the claims tried in order for the user's email, the first one present is used
+	EmailClaims []string `mapstructure:"email_claims"`
+	// EmailSources where the user's email is looked up, in order, the first verified one is used, see emailSources
+	EmailSources []string `mapstructure:"email_sources"`
+	// UserInfoFields maps the keys of the provider's userinfo json to the structs.User fields
+	// a value starting with `$` is a jsonpath into nested json, such as `$.data.attributes.email`
+	UserInfoFields struct {
+		Username string `mapstructure:"username"`
+		Email    string `mapstructure:"email"`
+		Name     string `mapstructure:"name"`
+		ID       string `mapstructure:"id"`
+		// Groups are added to the user's TeamMemberships
+		Groups string `mapstructure:"groups"`
+	} `mapstructure:"user_info_fields"`
+	GitHub struct {
+		// AcceptPendingMembership treat a `pending` team invitation as a member
+		AcceptPendingMembership bool `mapstructure:"accept_pending_membership"`
+		// MaxTeamChecks stop looking up team memberships after this many, 0 checks the whole teamWhiteList
+		MaxTeamChecks int `mapstructure:"max_team_checks"`
+		// SecondaryEmails fetch all of the user's verified emails for the whiteList and domains
+		SecondaryEmails bool `mapstructure:"secondary_emails"`
+		// NormalizeTeams compare the teamWhiteList and memberships as lower case org and team slug
+		NormalizeTeams bool `mapstructure:"normalize_teams"`
+		// OwnOrgMembership look up an org at UserOrgMembershipURL, with the members check of UserOrgURL as the fallback
+		OwnOrgMembership bool `mapstructure:"own_org_membership"`
+		// TeamsByID look up a teamWhitelist entry such as `myorg/1234567` at UserTeamByIDURL, which survives renaming the team
+		TeamsByID bool `mapstructure:"teams_by_id"`
+		// APIBaseURL the GitHub API, https://github.yourdomain.com/api/v3 for GitHub Enterprise Server
+		APIBaseURL string `mapstructure:"api_base_url"`
+		// App look up the org and team memberships with a token of this GitHub App's installation rather than the user's
+		App struct {
+			AppID          string `mapstructure:"app_id"`
+			InstallationID string `mapstructure:"installation_id"`
+			// PrivateKeyFile the PEM private key generated for the App, which signs its jwt
+			PrivateKeyFile string `mapstructure:"private_key_file"`
+		} `mapstructure:"app"`
+	} `mapstructure:"github"`
+	Steam struct {
+		// APIKey Steam Web API key, when set the player's profile name is fetched from `oauth.user_info_url`
+		APIKey string `mapstructure:"api_key"`
+	} `mapstructure:"steam"`
 }
 
 // OAuthProviders holds the stings for
@@ -101,6 +521,8 @@ type OAuthProviders struct {
 	HomeAssistant string
 	OpenStax      string
 	Nextcloud     string
+	OAuth1        string
+	Steam         string
 }
 
 type branding struct {
@@ -139,6 +561,8 @@ var (
 		HomeAssistant: "homeassistant",
 		OpenStax:      "openstax",
 		Nextcloud:     "nextcloud",
+		OAuth1:        "oauth1",
+		Steam:         "steam",
 	}
 
 	// RequiredOptions must have these fields set for minimum viable config
@@ -147,6 +571,9 @@ var (
 	// RootDir is where Vouch Proxy looks for ./config/config.yml, ./data, ./static and ./templates
 	RootDir string
 
+	// legacyUserAgentsRx compiled once the configuration is read, see CompileLegacyUserAgents
+	legacyUserAgentsRx []*regexp.Regexp
+
 	secretFile    string
 	cmdLineConfig *string
 	logger        *zap.Logger
@@ -183,6 +610,7 @@ func init() {
 	// from config file
 	port := flag.Int("port", -1, "port")
 	help := flag.Bool("help", false, "show usage")
+	dumpConfig := flag.Bool("dumpconfig", false, "print the effective configuration (with secrets redacted) and exit")
 	cmdLineConfig = flag.String("config", "", "specify alternate .yml file as command line arg")
 	flag.Parse()
 
@@ -231,6 +659,13 @@ func init() {
 		Cfg.Port = *port
 	}
 
+	if *dumpConfig {
+		if err := DumpConfig(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
 	errT := BasicTest()
 	if errT != nil {
 		// log.Fatalf(errT.Error())
@@ -373,7 +808,9 @@ func BasicTest() error {
 		GenOAuth.Provider != Providers.ADFS &&
 		GenOAuth.Provider != Providers.OIDC &&
 		GenOAuth.Provider != Providers.OpenStax &&
-		GenOAuth.Provider != Providers.Nextcloud {
+		GenOAuth.Provider != Providers.Nextcloud &&
+		GenOAuth.Provider != Providers.OAuth1 &&
+		GenOAuth.Provider != Providers.Steam {
 		return errors.New("configuration error: Unkown oauth provider: " + GenOAuth.Provider)
 	}
 
@@ -387,14 +824,19 @@ func BasicTest() error {
 		return fmt.Errorf("configuration error: either one of %s or %s needs to be set (but not both)", Branding.LCName+".domains", Branding.LCName+".allowAllUsers")
 	}
 
+	if err := checkUserRestriction(); err != nil {
+		return err
+	}
+
 	// OAuthconfig Checks
 	switch {
-	case GenOAuth.ClientID == "":
-		// everyone has a clientID
+	case GenOAuth.Provider != Providers.Steam && GenOAuth.ClientID == "":
+		// everyone except Steam (OpenID 2.0) has a clientID
 		return errors.New("configuration error: oauth.client_id not found")
-	case GenOAuth.Provider != Providers.IndieAuth && GenOAuth.Provider != Providers.HomeAssistant && GenOAuth.Provider != Providers.ADFS && GenOAuth.Provider != Providers.OIDC && GenOAuth.ClientSecret == "":
-		// everyone except IndieAuth has a clientSecret
+	case GenOAuth.Provider != Providers.IndieAuth && GenOAuth.Provider != Providers.HomeAssistant && GenOAuth.Provider != Providers.ADFS && GenOAuth.Provider != Providers.OIDC && GenOAuth.Provider != Providers.Steam && GenOAuth.ClientSecret == "" && !clientWithoutSecret():
+		// everyone except IndieAuth and Steam has a clientSecret
 		// ADFS and OIDC providers also do not require this, but can have it optionally set.
+		// nor does a public client, or one which authenticates with private_key_jwt
 		return errors.New("configuration error: oauth.client_secret not found")
 	case GenOAuth.Provider != Providers.Google && GenOAuth.AuthURL == "":
 		// everyone except IndieAuth and Google has an authURL
@@ -402,6 +844,9 @@ func BasicTest() error {
 	case GenOAuth.Provider != Providers.Google && GenOAuth.Provider != Providers.IndieAuth && GenOAuth.Provider != Providers.HomeAssistant && GenOAuth.Provider != Providers.ADFS && GenOAuth.UserInfoURL == "":
 		// everyone except IndieAuth, Google and ADFS has an userInfoURL
 		return errors.New("configuration error: oauth.user_info_url not found")
+	case GenOAuth.Provider == Providers.OAuth1 && (GenOAuth.RequestTokenURL == "" || GenOAuth.TokenURL == ""):
+		// OAuth 1.0a needs both the temporary credential and the token credential endpoints
+		return errors.New("configuration error: oauth.request_token_url and oauth.token_url are required for oauth1")
 	}
 
 	if !viper.IsSet(Branding.LCName + ".allowAllUsers") {
@@ -419,9 +864,26 @@ func BasicTest() error {
 		}
 	}
 
-	// issue a warning if the secret is too small
+	if GenOAuth.CallbackPath != "" && !strings.HasPrefix(GenOAuth.CallbackPath, "/") {
+		return fmt.Errorf("configuration error: oauth.callback_path (%s) must start with '/'", GenOAuth.CallbackPath)
+	}
+	if err := checkRedirectURI(); err != nil {
+		return err
+	}
+
+	switch Cfg.JWT.KeySource {
+	case "file":
+	case "vault":
+		if Cfg.JWT.Vault.Address == "" || Cfg.JWT.Vault.Path == "" || Cfg.JWT.Vault.Token == "" {
+			return fmt.Errorf("configuration error: %s.jwt.key_source vault requires jwt.vault.address, jwt.vault.path and jwt.vault.token (or VAULT_ADDR and VAULT_TOKEN)", Branding.LCName)
+		}
+	default:
+		return fmt.Errorf("configuration error: %s.jwt.key_source must be either file or vault (currently: %s)", Branding.LCName, Cfg.JWT.KeySource)
+	}
+
+	// issue a warning if the secret is too small, a key from vault is checked once it is fetched
 	log.Debugf("vouch.jwt.secret is %d characters long", len(Cfg.JWT.Secret))
-	if len(Cfg.JWT.Secret) < minBase64Length {
+	if Cfg.JWT.KeySource == "file" && len(Cfg.JWT.Secret) < minBase64Length {
 		log.Errorf("Your secret is too short! (%d characters long). Please consider deleting %s to automatically generate a secret of %d characters",
 			len(Cfg.JWT.Secret),
 			Branding.LCName+".jwt.secret",
@@ -435,6 +897,37 @@ func BasicTest() error {
 			Branding.LCName+".session.key",
 			minBase64Length)
 	}
+	switch Cfg.LoginRedirect {
+	case "none", "header", "redirect":
+	default:
+		return fmt.Errorf("configuration error: %s.loginRedirect must be one of none, header or redirect (currently: %s)", Branding.LCName, Cfg.LoginRedirect)
+	}
+	if Cfg.Session.Store != "cookie" && Cfg.Session.Store != "filesystem" {
+		return fmt.Errorf("configuration error: %s.session.store must be either cookie or filesystem (currently: %s)", Branding.LCName, Cfg.Session.Store)
+	}
+	switch Cfg.Session.SourcePrecedence {
+	case "cookie", "header", "cookie_then_header":
+	default:
+		return fmt.Errorf("configuration error: %s.session.source_precedence must be one of cookie, header or cookie_then_header (currently: %s)", Branding.LCName, Cfg.Session.SourcePrecedence)
+	}
+	switch strings.ToLower(Cfg.Session.Cookie.SameSite) {
+	case "", "lax", "strict":
+	default:
+		// the provider's redirect to /auth is a cross site navigation, None would do but isn't needed
+		return fmt.Errorf("configuration error: %s.session.cookie.sameSite must be one of Lax or Strict (currently: %s)", Branding.LCName, Cfg.Session.Cookie.SameSite)
+	}
+	if Cfg.Session.LoginTimeout < 0 {
+		return fmt.Errorf("configuration error: %s.session.login_timeout cannot be lower than 0 (currently: %d)", Branding.LCName, Cfg.Session.LoginTimeout)
+	}
+	if Cfg.Session.Coalesce < 0 || Cfg.Session.Coalesce > Cfg.Session.Cookie.MaxAge {
+		return fmt.Errorf("configuration error: %s.session.coalesce must be between 0 and session.cookie.maxAge (currently: %d)", Branding.LCName, Cfg.Session.Coalesce)
+	}
+	if Cfg.Session.Cookie.MaxAge <= 0 {
+		return fmt.Errorf("configuration error: %s.session.cookie.maxAge must be greater than 0 (currently: %d)", Branding.LCName, Cfg.Session.Cookie.MaxAge)
+	}
+	if Cfg.Session.StateAttempts < 1 || Cfg.Session.StateBackoff < 0 {
+		return fmt.Errorf("configuration error: %s.session.state_attempts must be at least 1 and state_backoff can't be negative (currently: %d and %d)", Branding.LCName, Cfg.Session.StateAttempts, Cfg.Session.StateBackoff)
+	}
 	if Cfg.Cookie.MaxAge < 0 {
 		return fmt.Errorf("configuration error: cookie maxAge cannot be lower than 0 (currently: %d)", Cfg.Cookie.MaxAge)
 	}
@@ -444,20 +937,288 @@ func BasicTest() error {
 	if Cfg.Cookie.MaxAge > Cfg.JWT.MaxAge {
 		return fmt.Errorf("configuration error: Cookie maxAge (%d) cannot be larger than the JWT maxAge (%d)", Cfg.Cookie.MaxAge, Cfg.JWT.MaxAge)
 	}
+	if !Cfg.Cookie.HTTPOnly {
+		log.Warnf("%s.cookie.httpOnly is false, the jwt cookie can be read by javascript and stolen by any XSS in the protected sites", Branding.LCName)
+	}
+	switch strings.ToLower(Cfg.Cookie.SameSite) {
+	case "", "lax", "strict":
+	case "none":
+		if !Cfg.Cookie.Secure {
+			log.Warnf("%s.cookie.sameSite is None but %s.cookie.secure is false, most browsers will reject the cookie", Branding.LCName, Branding.LCName)
+		}
+	default:
+		return fmt.Errorf("configuration error: Cookie sameSite must be one of Lax, Strict or None (currently: %s)", Cfg.Cookie.SameSite)
+	}
+	for _, d := range Cfg.Cookie.PerDomain {
+		found := false
+		for _, domain := range Cfg.Domains {
+			found = found || strings.EqualFold(d.Domain, domain)
+		}
+		if !found {
+			return fmt.Errorf("configuration error: %s.cookie.perDomain %s is not one of the %s.domains %s", Branding.LCName, d.Domain, Branding.LCName, Cfg.Domains)
+		}
+		switch strings.ToLower(d.SameSite) {
+		case "", "lax", "strict", "none":
+		default:
+			return fmt.Errorf("configuration error: %s.cookie.perDomain %s sameSite must be one of Lax, Strict or None (currently: %s)", Branding.LCName, d.Domain, d.SameSite)
+		}
+		if d.MaxAge < 0 {
+			return fmt.Errorf("configuration error: %s.cookie.perDomain %s maxAge cannot be lower than 0 (currently: %d)", Branding.LCName, d.Domain, d.MaxAge)
+		}
+	}
+	if err := CompileLegacyUserAgents(); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(Cfg.Cookie.Path, "/") {
+		return fmt.Errorf("configuration error: Cookie path (%s) must start with '/'", Cfg.Cookie.Path)
+	}
+	switch Cfg.Cookie.Compress {
+	case "none":
+	case "gzip", "flate":
+		if Cfg.JWT.Compress {
+			log.Warnf("both %s.cookie.compress and %s.jwt.compress are set, the compressed jwt will hardly compress any further", Branding.LCName, Branding.LCName)
+		}
+	default:
+		return fmt.Errorf("configuration error: Cookie compress must be one of none, gzip or flate (currently: %s)", Cfg.Cookie.Compress)
+	}
+	if Cfg.Cookie.OnInvalid != "clear" && Cfg.Cookie.OnInvalid != "ignore" {
+		return fmt.Errorf("configuration error: Cookie onInvalid must be one of clear or ignore (currently: %s)", Cfg.Cookie.OnInvalid)
+	}
+	if Cfg.Cookie.Duplicates != "first" && Cfg.Cookie.Duplicates != "first_valid" {
+		return fmt.Errorf("configuration error: Cookie duplicates must be one of first or first_valid (currently: %s)", Cfg.Cookie.Duplicates)
+	}
+	for method := range Cfg.MethodTeams {
+		switch strings.ToUpper(method) {
+		case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "CONNECT", "OPTIONS", "TRACE", "UNSAFE":
+		default:
+			return fmt.Errorf("configuration error: %s.methodTeams %s is not an http method or unsafe", Branding.LCName, method)
+		}
+	}
+	if Cfg.FailureDelay.MaxJitter < 0 || Cfg.FailureDelay.MaxConcurrent < 0 {
+		return fmt.Errorf("configuration error: %s.failureDelay maxJitter (%d) and maxConcurrent (%d) cannot be lower than 0", Branding.LCName, Cfg.FailureDelay.MaxJitter, Cfg.FailureDelay.MaxConcurrent)
+	}
+	if Cfg.ValidateConcurrency.Max < 0 || Cfg.ValidateConcurrency.QueueTimeout < 0 {
+		return fmt.Errorf("configuration error: %s.validateConcurrency max (%d) and queueTimeout (%d) cannot be lower than 0", Branding.LCName, Cfg.ValidateConcurrency.Max, Cfg.ValidateConcurrency.QueueTimeout)
+	}
+	if Cfg.ValidateCache.TTL < 0 || Cfg.ValidateCache.TTL > 1000 {
+		return fmt.Errorf("configuration error: %s.validateCache.ttl must be between 0 and 1000 milliseconds (currently: %d)", Branding.LCName, Cfg.ValidateCache.TTL)
+	}
+	if Cfg.ValidateCache.TTL > 0 && Cfg.ValidateCache.Max <= 0 {
+		return fmt.Errorf("configuration error: %s.validateCache.max must be greater than 0 (currently: %d)", Branding.LCName, Cfg.ValidateCache.Max)
+	}
+	if Cfg.Prefetch.Enabled && Cfg.Prefetch.Retry <= 0 {
+		return fmt.Errorf("configuration error: %s.prefetch.retry must be greater than 0 (currently: %d)", Branding.LCName, Cfg.Prefetch.Retry)
+	}
+	if r := Cfg.Prefetch.Refresh; r.Enabled && (r.Interval < 0 || r.Min <= 0 || r.Max < r.Min) {
+		return fmt.Errorf("configuration error: %s.prefetch.refresh needs an interval of 0 or more and 0 < min <= max (currently: %d, %d, %d)", Branding.LCName, r.Interval, r.Min, r.Max)
+	}
+	if err := CompileWhiteListRegex(); err != nil {
+		return err
+	}
+	if teams := len(Cfg.TeamWhiteList) + len(Cfg.TeamWhiteListRegex); Cfg.TeamWhiteListMinMatches < 0 || Cfg.TeamWhiteListMinMatches > teams {
+		return fmt.Errorf("configuration error: %s.teamWhitelistMinMatches %d must be between 0 and the %d entries of the teamWhitelist and teamWhitelistRegex", Branding.LCName, Cfg.TeamWhiteListMinMatches, teams)
+	}
+	for _, origin := range Cfg.CORS.AllowedOrigins {
+		// the cookie is sent along, which browsers refuse for a wildcard origin
+		if origin == "*" || !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			return fmt.Errorf("configuration error: %s.cors.allowedOrigins must each be a scheme and host such as https://app.yourdomain.com (currently: %s)", Branding.LCName, origin)
+		}
+	}
+	if Cfg.WhiteListRefresh.Interval < 0 || Cfg.WhiteListRefresh.Jitter < 0 {
+		return fmt.Errorf("configuration error: %s.whiteListRefresh interval (%d) and jitter (%d) cannot be lower than 0", Branding.LCName, Cfg.WhiteListRefresh.Interval, Cfg.WhiteListRefresh.Jitter)
+	}
+	if Cfg.WhiteListRefresh.Interval > 0 && Cfg.WhiteListFile == "" {
+		return fmt.Errorf("configuration error: %s.whiteListRefresh requires a %s.whiteListFile", Branding.LCName, Branding.LCName)
+	}
+	switch Cfg.Headers.Encoding {
+	case "none", "rfc8187", "percent", "transliterate":
+	default:
+		return fmt.Errorf("configuration error: %s.headers.encoding must be one of %s (currently: %s)", Branding.LCName, headerEncodings, Cfg.Headers.Encoding)
+	}
+	for reason := range Cfg.DeniedMessages {
+		switch reason {
+		case "no-team", "not-whitelisted", "no-claim", "denylisted", "unverified-email", "wrong-tenant", "wrong-domain":
+		default:
+			return fmt.Errorf("configuration error: %s.deniedMessages may only have the reasons %s (found: %s)", Branding.LCName, denialReasons, reason)
+		}
+	}
+	if sh := Cfg.Headers.Sensitive; len(sh.Headers) > 0 && (sh.MaxAuthAge <= 0 || (sh.Stale != "omit" && sh.Stale != "reauth")) {
+		return fmt.Errorf("configuration error: %s.headers.sensitive requires a maxauthage above 0 and stale either omit or reauth (currently: %d, %s)", Branding.LCName, sh.MaxAuthAge, sh.Stale)
+	}
+	for claim, values := range Cfg.ClaimsWhiteList {
+		if claim == "" || len(values) == 0 {
+			return fmt.Errorf("configuration error: %s.claimsWhitelist %s needs at least one value", Branding.LCName, claim)
+		}
+	}
+	if Cfg.MembershipCacheTTL < 0 {
+		return fmt.Errorf("configuration error: %s.membershipCacheTTL cannot be lower than 0 (currently: %d)", Branding.LCName, Cfg.MembershipCacheTTL)
+	}
+	if app := GenOAuth.GitHub.App; app.AppID != "" || app.InstallationID != "" || app.PrivateKeyFile != "" {
+		if GenOAuth.Provider != Providers.GitHub || app.AppID == "" || app.InstallationID == "" || app.PrivateKeyFile == "" {
+			return fmt.Errorf("configuration error: oauth.github.app requires oauth.provider %s and all of app_id, installation_id and private_key_file", Providers.GitHub)
+		}
+	}
+	if Cfg.TeamRecheck.Interval < 0 {
+		return fmt.Errorf("configuration error: %s.teamRecheck.interval cannot be lower than 0 (currently: %d)", Branding.LCName, Cfg.TeamRecheck.Interval)
+	}
+	// the teamWhitelist only decides who logs in without a whiteList or allowAllUsers, see verifyUser
+	if Cfg.TeamRecheck.Interval > 0 && (GenOAuth.Provider != Providers.GitHub || !HasTeamWhiteList() || HasWhiteList() || Cfg.AllowAllUsers) {
+		return fmt.Errorf("configuration error: %s.teamRecheck requires oauth.provider %s and a %s.teamWhitelist, without a whiteList or allowAllUsers", Branding.LCName, Providers.GitHub, Branding.LCName)
+	}
+	for _, c := range Cfg.Fingerprint.Components {
+		if c != "userAgent" && c != "ip" {
+			return fmt.Errorf("configuration error: %s.fingerprint.components must be userAgent and/or ip (currently: %s)", Branding.LCName, Cfg.Fingerprint.Components)
+		}
+	}
+	if Cfg.Fingerprint.IPv4Prefix < 0 || Cfg.Fingerprint.IPv4Prefix > 32 || Cfg.Fingerprint.IPv6Prefix < 0 || Cfg.Fingerprint.IPv6Prefix > 128 {
+		return fmt.Errorf("configuration error: %s.fingerprint.ipv4Prefix must be between 0 and 32 and ipv6Prefix between 0 and 128 (currently: %d and %d)", Branding.LCName, Cfg.Fingerprint.IPv4Prefix, Cfg.Fingerprint.IPv6Prefix)
+	}
+	if Cfg.Limits.MaxHeaderBytes <= 0 || Cfg.Limits.MaxBodyBytes <= 0 {
+		return fmt.Errorf("configuration error: %s.limits maxHeaderBytes (%d) and maxBodyBytes (%d) must be greater than 0", Branding.LCName, Cfg.Limits.MaxHeaderBytes, Cfg.Limits.MaxBodyBytes)
+	}
+	if Cfg.Limits.RequestTimeout < 0 {
+		return fmt.Errorf("configuration error: %s.limits.requestTimeout (%d) cannot be lower than 0", Branding.LCName, Cfg.Limits.RequestTimeout)
+	}
+	if Cfg.Authz.Mode != "replace" && Cfg.Authz.Mode != "augment" {
+		return fmt.Errorf("configuration error: %s.authz.mode must be either replace or augment (currently: %s)", Branding.LCName, Cfg.Authz.Mode)
+	}
+	if (Cfg.TLS.Cert == "") != (Cfg.TLS.Key == "") {
+		return fmt.Errorf("configuration error: both %s.tls.cert and %s.tls.key must be set to enable tls", Branding.LCName, Branding.LCName)
+	}
+	if _, err := TLSConfig(); err != nil {
+		return err
+	}
+	switch GenOAuth.UserInfo {
+	case "required":
+	case "optional", "skip":
+		if GenOAuth.JWKSURL == "" || GenOAuth.Issuer == "" {
+			return fmt.Errorf("configuration error: oauth.userinfo %s requires oauth.jwks_url and oauth.issuer to verify the id token", GenOAuth.UserInfo)
+		}
+	default:
+		return fmt.Errorf("configuration error: oauth.userinfo must be one of required, optional or skip (currently: %s)", GenOAuth.UserInfo)
+	}
+	if err := checkOAuth2Only(); err != nil {
+		return err
+	}
+	switch GenOAuth.TenantFromEmail {
+	case "", "domain", "org":
+	default:
+		return fmt.Errorf("configuration error: oauth.tenant_from_email must be one of domain or org (currently: %s)", GenOAuth.TenantFromEmail)
+	}
+	if GenOAuth.RequestObject.Enabled {
+		validAlg := false
+		for _, alg := range requestObjectAlgs {
+			validAlg = validAlg || alg == GenOAuth.RequestObject.Alg
+		}
+		if !validAlg {
+			return fmt.Errorf("configuration error: oauth.request_object.alg must be one of %s (currently: %s)", requestObjectAlgs, GenOAuth.RequestObject.Alg)
+		}
+		if GenOAuth.Issuer == "" {
+			return errors.New("configuration error: oauth.request_object requires oauth.issuer, the audience of the request object")
+		}
+		if GenOAuth.RequestObject.Alg == "HS256" && GenOAuth.ClientSecret == "" {
+			return errors.New("configuration error: oauth.request_object.alg HS256 signs with oauth.client_secret, which is not set")
+		}
+		if GenOAuth.RequestObject.Alg != "HS256" && GenOAuth.RequestObject.SigningKeyFile == "" {
+			return fmt.Errorf("configuration error: oauth.request_object.alg %s requires a signing_key_file", GenOAuth.RequestObject.Alg)
+		}
+	}
+	if err := checkTokenEndpointAuthMethod(); err != nil {
+		return err
+	}
+	for _, source := range GenOAuth.EmailSources {
+		if source != "id_token" && source != "userinfo" && source != "api" {
+			return fmt.Errorf("configuration error: oauth.email_sources may only list %s (found: %s)", emailSources, source)
+		}
+	}
+	if hc := GenOAuth.HTTPClient; hc.MaxIdleConnsPerHost < 0 || hc.IdleConnTimeout < 0 {
+		return fmt.Errorf("configuration error: oauth.http_client max_idle_conns_per_host (%d) and idle_conn_timeout (%d) cannot be lower than 0", hc.MaxIdleConnsPerHost, hc.IdleConnTimeout)
+	}
+	if hc := GenOAuth.HTTPClient; hc.Timeout < 0 || hc.Retries < 0 {
+		return fmt.Errorf("configuration error: oauth.http_client timeout (%d) and retries (%d) cannot be lower than 0", hc.Timeout, hc.Retries)
+	}
+	for _, alg := range GenOAuth.IDTokenSigningAlgs {
+		switch alg {
+		case "RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512":
+		default:
+			return fmt.Errorf("configuration error: oauth.id_token_signing_algs may only list %s (found: %s)", idTokenSigningAlgs, alg)
+		}
+	}
+	if m := GenOAuth.MissingScopes; m != "" && m != "warn" && m != "fail" {
+		return fmt.Errorf("configuration error: oauth.missing_scopes must be one of %s (currently: %s)", missingScopes, m)
+	}
+	if p := GenOAuth.AudienceParam; p != "" && p != "space" && p != "repeat" {
+		return fmt.Errorf("configuration error: oauth.audience_param must be one of %s (currently: %s)", audienceParams, p)
+	}
+	if err := checkDevAllowInsecure(); err != nil {
+		return err
+	}
+	if Cfg.BackChannelLogout && (GenOAuth.JWKSURL == "" || GenOAuth.Issuer == "") {
+		return fmt.Errorf("configuration error: %s.backChannelLogout requires oauth.jwks_url and oauth.issuer", Branding.LCName)
+	}
+	if Cfg.GitHubActions.Enabled && (Cfg.GitHubActions.Audience == "" || len(Cfg.GitHubActions.Repositories) == 0) {
+		return fmt.Errorf("configuration error: %s.githubActions requires an audience and at least one of repositories", Branding.LCName)
+	}
+	for _, w := range Cfg.GitHubActions.Workflows {
+		// the workflows were once matched by their name, which the job itself sets
+		if !strings.Contains(w, "/.github/workflows/") {
+			return fmt.Errorf("configuration error: %s.githubActions.workflows %s must be a job_workflow_ref such as myorg/myrepo/.github/workflows/deploy.yml", Branding.LCName, w)
+		}
+	}
+	if Cfg.StepUp.Enabled && (Cfg.StepUp.MaxAge <= 0 || Cfg.StepUp.Param == "") {
+		return fmt.Errorf("configuration error: %s.stepUp requires a maxAge above 0 and a param (currently: %d, %q)", Branding.LCName, Cfg.StepUp.MaxAge, Cfg.StepUp.Param)
+	}
+	if Cfg.DebugAuthz.Enabled && Cfg.DebugAuthz.Secret == "" {
+		return fmt.Errorf("configuration error: %s.debugAuthz.secret must be set when %s.debugAuthz.enabled is true", Branding.LCName, Branding.LCName)
+	}
+	if Cfg.DebugAuthz.Validate && Cfg.DebugAuthz.Secret == "" {
+		return fmt.Errorf("configuration error: %s.debugAuthz.secret must be set when %s.debugAuthz.validate is true", Branding.LCName, Branding.LCName)
+	}
+	switch Cfg.JWT.SigningMethod {
+	case "HS256", "HS384", "HS512":
+	default:
+		return fmt.Errorf("configuration error: JWT signingMethod must be one of HS256, HS384 or HS512 (currently: %s)", Cfg.JWT.SigningMethod)
+	}
 	return nil
 }
 
-func checkCallbackConfig(url string) error {
-	inDomain := false
-	for _, d := range Cfg.Domains {
-		if strings.Contains(url, d) {
-			inDomain = true
-			break
-		}
+// checkUserRestriction refuse to start when nothing restricts who may log in, unless allowAllUsers is explicitly true
+// an empty `domains: []` used to quietly allow everyone
+func checkUserRestriction() error {
+	if Cfg.AllowAllUsers {
+		return nil
+	}
+	if HasWhiteList() || HasTeamWhiteList() || len(Cfg.ClaimsWhiteList) > 0 || len(Cfg.Domains) > 0 {
+		return nil
 	}
-	if !inDomain {
-		return fmt.Errorf("configuration error: oauth.callback_url (%s) must be within the configured domain where the cookie will be set %s", url, Cfg.Domains)
+	if Cfg.Authz.WebhookURL != "" && Cfg.Authz.Mode == "replace" {
+		return nil
+	}
+	return fmt.Errorf("configuration error: oauth.provider %s has no effective restriction, %s.whiteList, %s.teamWhitelist, %s.claimsWhitelist and %s.domains are all empty. Set %s.allowAllUsers: true to allow anyone who can authenticate",
+		GenOAuth.Provider, Branding.LCName, Branding.LCName, Branding.LCName, Branding.LCName, Branding.LCName)
+}
+
+// CompileLegacyUserAgents compile the `vouch.cookie.legacyUserAgents`, matched against the User-Agent of every login
+func CompileLegacyUserAgents() error {
+	compiled := make([]*regexp.Regexp, 0, len(Cfg.Cookie.LegacyUserAgents))
+	for _, p := range Cfg.Cookie.LegacyUserAgents {
+		rx, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("configuration error: Cookie legacyUserAgents pattern %s: %s", p, err)
+		}
+		compiled = append(compiled, rx)
 	}
+	legacyUserAgentsRx = compiled
+	return nil
+}
+
+// LegacyUserAgents the compiled `vouch.cookie.legacyUserAgents`
+func LegacyUserAgents() []*regexp.Regexp {
+	return legacyUserAgentsRx
+}
+
+// checkCallbackConfig the path of a callback_url, whose host is checked against the domains by handlers.checkCallbackURLs
+func checkCallbackConfig(url string) error {
 
 	if !strings.Contains(url, "/auth") {
 		return fmt.Errorf("configuration error: oauth.callback_url (%s) must contain '/auth'", url)
@@ -465,6 +1226,25 @@ func checkCallbackConfig(url string) error {
 	return nil
 }
 
+// checkRedirectURI `oauth.redirect_uri` must be an absolute url, and is the only redirect_uri
+// since the provider compares the one of the token exchange with the one sent to the authorize endpoint
+func checkRedirectURI() error {
+	if GenOAuth.RedirectURI == "" {
+		return nil
+	}
+	u, err := url.Parse(GenOAuth.RedirectURI)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Fragment != "" {
+		return fmt.Errorf("configuration error: oauth.redirect_uri (%s) must be an absolute http or https url without a fragment", GenOAuth.RedirectURI)
+	}
+	if GenOAuth.CallbackPath != "" {
+		return errors.New("configuration error: oauth.redirect_uri and oauth.callback_path both set the redirect_uri, configure one of them")
+	}
+	if len(GenOAuth.RedirectURLs) > 0 {
+		log.Warnf("oauth.callback_urls %s are not used, oauth.redirect_uri %s is", GenOAuth.RedirectURLs, GenOAuth.RedirectURI)
+	}
+	return nil
+}
+
 // SetDefaults set default options for some items
 func SetDefaults() {
 
@@ -494,11 +1274,39 @@ func SetDefaults() {
 	if !viper.IsSet(Branding.LCName + ".publicAccess") {
 		Cfg.PublicAccess = false
 	}
+	if !viper.IsSet(Branding.LCName + ".singleSession") {
+		Cfg.SingleSession = false
+	}
+
+	configuredWhiteList = Cfg.WhiteList
+	if Cfg.WhiteListFile != "" {
+		entries, err := readWhiteListFile(Cfg.WhiteListFile)
+		if err != nil {
+			log.Fatalf("could not read %s.whiteListFile: %s", Branding.LCName, err)
+		}
+		log.Infof("%d whiteList entries read from %s", len(entries), Cfg.WhiteListFile)
+		Cfg.WhiteList = append(append([]string{}, configuredWhiteList...), entries...)
+	}
 
 	// jwt defaults
-	if !viper.IsSet(Branding.LCName + ".jwt.secret") {
+	if !viper.IsSet(Branding.LCName + ".jwt.key_source") {
+		Cfg.JWT.KeySource = "file"
+	}
+	if !viper.IsSet(Branding.LCName+".jwt.secret") && Cfg.JWT.KeySource != "vault" {
 		Cfg.JWT.Secret = getOrGenerateJWTSecret()
 	}
+	if Cfg.JWT.Vault.Address == "" {
+		Cfg.JWT.Vault.Address = os.Getenv("VAULT_ADDR")
+	}
+	if Cfg.JWT.Vault.Token == "" {
+		Cfg.JWT.Vault.Token = os.Getenv("VAULT_TOKEN")
+	}
+	if !viper.IsSet(Branding.LCName + ".jwt.vault.field") {
+		Cfg.JWT.Vault.Field = "key"
+	}
+	if !viper.IsSet(Branding.LCName + ".jwt.vault.refresh") {
+		Cfg.JWT.Vault.Refresh = 300
+	}
 	if !viper.IsSet(Branding.LCName + ".jwt.issuer") {
 		Cfg.JWT.Issuer = Branding.CcName
 	}
@@ -508,6 +1316,91 @@ func SetDefaults() {
 	if !viper.IsSet(Branding.LCName + ".jwt.compress") {
 		Cfg.JWT.Compress = true
 	}
+	if !viper.IsSet(Branding.LCName + ".jwt.signingMethod") {
+		Cfg.JWT.SigningMethod = "HS256"
+	}
+
+	if !viper.IsSet(Branding.LCName + ".loginRedirect") {
+		Cfg.LoginRedirect = "none"
+	}
+
+	// lockout defaults, disabled unless failures is set
+	if !viper.IsSet(Branding.LCName + ".lockout.window") {
+		Cfg.Lockout.Window = 60
+	}
+	if !viper.IsSet(Branding.LCName + ".lockout.cooldown") {
+		Cfg.Lockout.Cooldown = 300
+	}
+	if !viper.IsSet(Branding.LCName + ".lockout.maxEntries") {
+		Cfg.Lockout.MaxEntries = 10000
+	}
+	// failure delay defaults, disabled unless maxJitter is set
+	if !viper.IsSet(Branding.LCName + ".failureDelay.maxConcurrent") {
+		Cfg.FailureDelay.MaxConcurrent = 100
+	}
+
+	// github actions defaults
+	if !viper.IsSet(Branding.LCName + ".githubActions.issuer") {
+		Cfg.GitHubActions.Issuer = "https://token.actions.githubusercontent.com"
+	}
+	if !viper.IsSet(Branding.LCName + ".githubActions.jwksUrl") {
+		Cfg.GitHubActions.JWKSURL = Cfg.GitHubActions.Issuer + "/.well-known/jwks"
+	}
+
+	// authz webhook defaults
+	if !viper.IsSet(Branding.LCName + ".authz.mode") {
+		Cfg.Authz.Mode = "augment"
+	}
+	if !viper.IsSet(Branding.LCName + ".fingerprint.ipv4Prefix") {
+		Cfg.Fingerprint.IPv4Prefix = 24
+	}
+	if !viper.IsSet(Branding.LCName + ".fingerprint.ipv6Prefix") {
+		Cfg.Fingerprint.IPv6Prefix = 64
+	}
+	if !viper.IsSet(Branding.LCName + ".prefetch.retry") {
+		Cfg.Prefetch.Retry = 30
+	}
+	if !viper.IsSet(Branding.LCName + ".prefetch.refresh.min") {
+		Cfg.Prefetch.Refresh.Min = 300
+	}
+	if !viper.IsSet(Branding.LCName + ".prefetch.refresh.max") {
+		Cfg.Prefetch.Refresh.Max = 86400
+	}
+	if !viper.IsSet(Branding.LCName + ".accessDenied.message") {
+		Cfg.AccessDenied.Message = "You declined to authorize the login"
+	}
+	// room for a jwt cookie split into several 4k chunks
+	if !viper.IsSet(Branding.LCName + ".limits.maxHeaderBytes") {
+		Cfg.Limits.MaxHeaderBytes = 64 * 1024
+	}
+	// nothing posted to Vouch Proxy comes anywhere near this
+	if !viper.IsSet(Branding.LCName + ".limits.maxBodyBytes") {
+		Cfg.Limits.MaxBodyBytes = 64 * 1024
+	}
+	if !viper.IsSet(Branding.LCName + ".limits.requestTimeout") {
+		// just inside the server's 15 second WriteTimeout, so the client hears the 503
+		Cfg.Limits.RequestTimeout = 14
+	}
+	if !viper.IsSet(Branding.LCName + ".cors.allowedMethods") {
+		Cfg.CORS.AllowedMethods = []string{"GET"}
+	}
+	if !viper.IsSet(Branding.LCName + ".cors.allowedHeaders") {
+		Cfg.CORS.AllowedHeaders = []string{"Authorization"}
+	}
+	if !viper.IsSet(Branding.LCName + ".cors.maxAge") {
+		Cfg.CORS.MaxAge = 600
+	}
+	if !viper.IsSet(Branding.LCName + ".authz.timeout") {
+		Cfg.Authz.Timeout = 5
+	}
+	if !viper.IsSet(Branding.LCName + ".authz.cache_ttl") {
+		Cfg.Authz.CacheTTL = 60
+	}
+
+	// tls defaults
+	if !viper.IsSet(Branding.LCName + ".tls.min_version") {
+		Cfg.TLS.MinVersion = "1.2"
+	}
 
 	// cookie defaults
 	if !viper.IsSet(Branding.LCName + ".cookie.name") {
@@ -519,6 +1412,18 @@ func SetDefaults() {
 	if !viper.IsSet(Branding.LCName + ".cookie.httpOnly") {
 		Cfg.Cookie.HTTPOnly = true
 	}
+	if !viper.IsSet(Branding.LCName + ".cookie.compress") {
+		Cfg.Cookie.Compress = "none"
+	}
+	if !viper.IsSet(Branding.LCName + ".cookie.onInvalid") {
+		Cfg.Cookie.OnInvalid = "clear"
+	}
+	if !viper.IsSet(Branding.LCName + ".cookie.duplicates") {
+		Cfg.Cookie.Duplicates = "first_valid"
+	}
+	if !viper.IsSet(Branding.LCName + ".cookie.path") {
+		Cfg.Cookie.Path = "/"
+	}
 	if !viper.IsSet(Branding.LCName + ".cookie.maxAge") {
 		Cfg.Cookie.MaxAge = Cfg.JWT.MaxAge
 	} else {
@@ -529,6 +1434,13 @@ func SetDefaults() {
 		}
 	}
 
+	if !viper.IsSet(Branding.LCName + ".stepUp.maxAge") {
+		Cfg.StepUp.MaxAge = 300
+	}
+	if !viper.IsSet(Branding.LCName + ".stepUp.param") {
+		Cfg.StepUp.Param = Branding.LCName + "_step_up"
+	}
+
 	// headers defaults
 	if !viper.IsSet(Branding.LCName + ".headers.jwt") {
 		Cfg.Headers.JWT = "X-" + Branding.CcName + "-Token"
@@ -536,6 +1448,9 @@ func SetDefaults() {
 	if !viper.IsSet(Branding.LCName + ".headers.querystring") {
 		Cfg.Headers.QueryString = "access_token"
 	}
+	if !viper.IsSet(Branding.LCName + ".headers.loginurl") {
+		Cfg.Headers.LoginURL = "X-" + Branding.CcName + "-Login-URL"
+	}
 	if !viper.IsSet(Branding.LCName + ".headers.redirect") {
 		Cfg.Headers.Redirect = "X-" + Branding.CcName + "-Requested-URI"
 	}
@@ -545,9 +1460,36 @@ func SetDefaults() {
 	if !viper.IsSet(Branding.LCName + ".headers.success") {
 		Cfg.Headers.Success = "X-" + Branding.CcName + "-Success"
 	}
+	if !viper.IsSet(Branding.LCName + ".headers.provider") {
+		Cfg.Headers.Provider = "X-" + Branding.CcName + "-Provider"
+	}
+	if !viper.IsSet(Branding.LCName + ".headers.tenant") {
+		Cfg.Headers.Tenant = "X-" + Branding.CcName + "-Tenant"
+	}
+	if !viper.IsSet(Branding.LCName + ".headers.roles") {
+		Cfg.Headers.Roles = "X-" + Branding.CcName + "-Roles"
+	}
+	if !viper.IsSet(Branding.LCName + ".headers.domain") {
+		Cfg.Headers.Domain = "X-" + Branding.CcName + "-Domain"
+	}
+	if !viper.IsSet(Branding.LCName + ".headers.anonymous") {
+		Cfg.Headers.Anonymous = "X-" + Branding.CcName + "-Anonymous"
+	}
+	if !viper.IsSet(Branding.LCName + ".headers.expiresin") {
+		Cfg.Headers.ExpiresIn = "X-" + Branding.CcName + "-Expires-In"
+	}
 	if !viper.IsSet(Branding.LCName + ".headers.claimheader") {
 		Cfg.Headers.ClaimHeader = "X-" + Branding.CcName + "-IdP-Claims-"
 	}
+	if !viper.IsSet(Branding.LCName + ".headers.encoding") {
+		Cfg.Headers.Encoding = "none"
+	}
+	if !viper.IsSet(Branding.LCName + ".headers.sensitive.stale") {
+		Cfg.Headers.Sensitive.Stale = "omit"
+	}
+	if !viper.IsSet(Branding.LCName + ".headers.trustforwarded") {
+		Cfg.Headers.TrustForwarded = []string{Cfg.Headers.Redirect, "X-Forwarded-Proto", "X-Forwarded-Host", "X-Forwarded-Port", "X-Forwarded-Uri"}
+	}
 
 	// db defaults
 	if !viper.IsSet(Branding.LCName + ".db.file") {
@@ -566,6 +1508,39 @@ func SetDefaults() {
 		}
 		Cfg.Session.Key = rstr
 	}
+	if !viper.IsSet(Branding.LCName + ".session.store") {
+		Cfg.Session.Store = "cookie"
+	}
+	if !viper.IsSet(Branding.LCName + ".session.source_precedence") {
+		Cfg.Session.SourcePrecedence = "cookie"
+	}
+	if !viper.IsSet(Branding.LCName + ".session.cookie.httpOnly") {
+		Cfg.Session.Cookie.HTTPOnly = true
+	}
+	if !viper.IsSet(Branding.LCName + ".session.cookie.sameSite") {
+		Cfg.Session.Cookie.SameSite = "Lax"
+	}
+	if !viper.IsSet(Branding.LCName + ".session.cookie.maxAge") {
+		Cfg.Session.Cookie.MaxAge = 300
+	}
+	if !viper.IsSet(Branding.LCName + ".session.cookie.path") {
+		Cfg.Session.Cookie.Path = "/"
+	}
+	if !viper.IsSet(Branding.LCName + ".session.state_attempts") {
+		Cfg.Session.StateAttempts = 1
+	}
+	if !viper.IsSet(Branding.LCName + ".session.state_backoff") {
+		Cfg.Session.StateBackoff = 100
+	}
+	if !viper.IsSet(Branding.LCName + ".session.path") {
+		Cfg.Session.Path = os.TempDir()
+	}
+	if !viper.IsSet(Branding.LCName + ".validateCache.max") {
+		Cfg.ValidateCache.Max = 10000
+	}
+	if !viper.IsSet(Branding.LCName + ".session.callback_host") {
+		Cfg.Session.CallbackHost = true
+	}
 
 	// testing convenience variable
 	if !viper.IsSet(Branding.LCName + ".testing") {
@@ -584,9 +1559,172 @@ func SetDefaults() {
 	if err == nil {
 		setProviderDefaults()
 	}
+	if !viper.IsSet(Branding.LCName + ".session.cookie.secure") {
+		// the login is over https even when vouch.cookie.secure was left at false
+		Cfg.Session.Cookie.Secure = Cfg.Cookie.Secure || (GenOAuth != nil && strings.HasPrefix(GenOAuth.RedirectURL, "https://"))
+	}
+	applyDevAllowInsecure()
+}
+
+// requestObjectAlgs the accepted values of `oauth.request_object.alg`
+var requestObjectAlgs = []string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", "HS256"}
+
+// tokenEndpointAuthMethods the accepted values of `oauth.token_endpoint_auth_method`, as named by OpenID Connect
+var tokenEndpointAuthMethods = []string{"client_secret_basic", "client_secret_post", "private_key_jwt", "none"}
+
+// checkOAuth2Only without an id token the user_info_url is the only source of the user's identity
+func checkOAuth2Only() error {
+	if !GenOAuth.OAuth2Only {
+		return nil
+	}
+	if GenOAuth.Provider != Providers.OIDC {
+		return fmt.Errorf("configuration error: oauth.oauth2_only only applies to oauth.provider %s", Providers.OIDC)
+	}
+	if GenOAuth.UserInfo != "required" {
+		return fmt.Errorf("configuration error: oauth.oauth2_only requires oauth.userinfo required, %s falls back to the id token", GenOAuth.UserInfo)
+	}
+	if Cfg.BackChannelLogout {
+		return fmt.Errorf("configuration error: %s.backChannelLogout matches the sid of the id token, which oauth.oauth2_only ignores", Branding.LCName)
+	}
+	for _, source := range GenOAuth.EmailSources {
+		if source == "id_token" {
+			return errors.New("configuration error: oauth.email_sources lists id_token, which oauth.oauth2_only ignores")
+		}
+	}
+	return nil
+}
+
+// emailSources the accepted values of `oauth.email_sources`
+var emailSources = []string{"id_token", "userinfo", "api"}
+
+// headerEncodings the accepted values of `vouch.headers.encoding`
+// none passes the utf-8 as it is, rfc8187 and percent encode it, the former with the charset in front,
+// and transliterate sends `Jose` for `José`, or the rfc8187 form when there's no ascii for it
+var headerEncodings = []string{"none", "rfc8187", "percent", "transliterate"}
+
+// denialReasons the reasons a login is refused, the keys of `vouch.deniedMessages`
+var denialReasons = []string{"no-team", "not-whitelisted", "no-claim", "denylisted", "unverified-email", "wrong-tenant", "wrong-domain"}
+
+// idTokenSigningAlgs the accepted values of `oauth.id_token_signing_algs`, those a JWKS can verify
+// HMAC is verified with the client_secret and `none` not at all, an id token signed so is never accepted
+var idTokenSigningAlgs = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// missingScopes the accepted values of `oauth.missing_scopes`
+// warn logs the scopes the provider didn't grant and carries on, fail refuses the login
+var missingScopes = []string{"warn", "fail"}
+
+// audienceParams the accepted values of `oauth.audience_param`
+// space joins the audiences into one `audience=a b`, repeat sends `audience=a&audience=b`
+var audienceParams = []string{"space", "repeat"}
+
+// clientWithoutSecret does the client authenticate at the token endpoint without the client_secret
+func clientWithoutSecret() bool {
+	return GenOAuth.TokenEndpointAuthMethod == "none" || GenOAuth.TokenEndpointAuthMethod == "private_key_jwt"
+}
+
+func checkTokenEndpointAuthMethod() error {
+	method := GenOAuth.TokenEndpointAuthMethod
+	if method == "" {
+		return nil
+	}
+	valid := false
+	for _, m := range tokenEndpointAuthMethods {
+		valid = valid || m == method
+	}
+	if !valid {
+		return fmt.Errorf("configuration error: oauth.token_endpoint_auth_method must be one of %s (currently: %s)", tokenEndpointAuthMethods, method)
+	}
+	if strings.HasPrefix(method, "client_secret_") && GenOAuth.ClientSecret == "" {
+		return fmt.Errorf("configuration error: oauth.token_endpoint_auth_method %s requires oauth.client_secret", method)
+	}
+	if method != "private_key_jwt" {
+		return nil
+	}
+	validAlg := false
+	for _, alg := range requestObjectAlgs {
+		validAlg = validAlg || (alg == GenOAuth.ClientAssertion.Alg && alg != "HS256")
+	}
+	if !validAlg {
+		return fmt.Errorf("configuration error: oauth.client_assertion.alg must be one of %s but HS256 (currently: %s)", requestObjectAlgs, GenOAuth.ClientAssertion.Alg)
+	}
+	if GenOAuth.ClientAssertion.SigningKeyFile == "" {
+		return errors.New("configuration error: oauth.token_endpoint_auth_method private_key_jwt requires oauth.client_assertion.signing_key_file")
+	}
+	return nil
+}
+
+// configureTokenEndpointAuth have the OAuthClient authenticate as `oauth.token_endpoint_auth_method` says
+// a public client and private_key_jwt send only the client_id, the client_assertion is added at the exchange
+func configureTokenEndpointAuth() {
+	if OAuthClient == nil {
+		return
+	}
+	switch GenOAuth.TokenEndpointAuthMethod {
+	case "client_secret_basic":
+		OAuthClient.Endpoint.AuthStyle = oauth2.AuthStyleInHeader
+	case "client_secret_post":
+		OAuthClient.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+	case "private_key_jwt", "none":
+		OAuthClient.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+		OAuthClient.ClientSecret = ""
+	}
 }
 
 func setProviderDefaults() {
+	if !viper.IsSet("oauth.client_assertion.alg") {
+		GenOAuth.ClientAssertion.Alg = "RS256"
+	}
+	if !viper.IsSet("oauth.request_object.alg") {
+		GenOAuth.RequestObject.Alg = "RS256"
+	}
+	if GenOAuth.AudienceParam == "" {
+		GenOAuth.AudienceParam = "space"
+	}
+	if !viper.IsSet("oauth.discovery_url") && GenOAuth.Provider == Providers.OIDC && GenOAuth.Issuer != "" {
+		GenOAuth.DiscoveryURL = strings.TrimSuffix(GenOAuth.Issuer, "/") + "/.well-known/openid-configuration"
+	}
+	// http.DefaultTransport keeps only 2 idle connections for each host, too few for the logins of a busy proxy
+	if !viper.IsSet("oauth.http_client.max_idle_conns_per_host") {
+		GenOAuth.HTTPClient.MaxIdleConnsPerHost = 32
+	}
+	if !viper.IsSet("oauth.http_client.idle_conn_timeout") {
+		GenOAuth.HTTPClient.IdleConnTimeout = 90
+	}
+	if !viper.IsSet("oauth.http_client.http2") {
+		GenOAuth.HTTPClient.HTTP2 = true
+	}
+	// a hung connection to the provider otherwise holds the login, and its goroutine, for good
+	if !viper.IsSet("oauth.http_client.timeout") {
+		GenOAuth.HTTPClient.Timeout = 30
+	}
+	if !viper.IsSet("oauth.http_client.retries") {
+		GenOAuth.HTTPClient.Retries = 2
+	}
+	if GenOAuth.MissingScopes == "" {
+		GenOAuth.MissingScopes = "warn"
+	}
+	if !viper.IsSet("oauth.user_info_error.field") {
+		GenOAuth.UserInfoError.Field = "error"
+	}
+	if !viper.IsSet("oauth.user_info_error.description_field") {
+		GenOAuth.UserInfoError.DescriptionField = "error_description"
+	}
+	if GenOAuth.UserInfo == "" {
+		GenOAuth.UserInfo = "required"
+	}
+	if GenOAuth.NameClaim == "" {
+		GenOAuth.NameClaim = "name"
+	}
+	if !viper.IsSet("oauth.picture_claim") {
+		GenOAuth.PictureClaim = "picture"
+		if GenOAuth.Provider == Providers.GitHub {
+			GenOAuth.PictureClaim = "avatar_url"
+		}
+	}
+	if len(GenOAuth.EmailClaims) == 0 {
+		// ADFS and some SAML bridges send `mail` or only the `upn`
+		GenOAuth.EmailClaims = []string{"email", "mail", "upn"}
+	}
 	if GenOAuth.Provider == Providers.Google {
 		setDefaultsGoogle()
 		// setDefaultsGoogle also configures the OAuthClient
@@ -596,10 +1734,20 @@ func setProviderDefaults() {
 	} else if GenOAuth.Provider == Providers.ADFS {
 		setDefaultsADFS()
 		configureOAuthClient()
+	} else if GenOAuth.Provider == Providers.OpenStax {
+		setDefaultsOpenStax()
+		configureOAuthClient()
+	} else if GenOAuth.Provider == Providers.OAuth1 {
+		// OAuth 1.0a signs its own requests and does not use the oauth2 client
+		setDefaultsOAuth1()
+	} else if GenOAuth.Provider == Providers.Steam {
+		// Steam is OpenID 2.0, there is no client to configure
+		setDefaultsSteam()
 	} else {
-		// IndieAuth, OIDC, OpenStax, Nextcloud
+		// IndieAuth, OIDC, Nextcloud, HomeAssistant
 		configureOAuthClient()
 	}
+	configureTokenEndpointAuth()
 }
 
 func setDefaultsGoogle() {
@@ -625,6 +1773,70 @@ func setDefaultsGoogle() {
 func setDefaultsADFS() {
 	log.Info("configuring ADFS OAuth")
 	OAuthopts = oauth2.SetAuthURLParam("resource", GenOAuth.RedirectURL) // Needed or all claims won't be included
+	// an ADFS without claim rules which shorten them sends the claim type uris, they win over the `upn` and `email`
+	if GenOAuth.UserInfoFields.Username == "" {
+		GenOAuth.UserInfoFields.Username = "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/upn"
+	}
+	if GenOAuth.UserInfoFields.Email == "" {
+		GenOAuth.UserInfoFields.Email = "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress"
+	}
+	if GenOAuth.UserInfoFields.Name == "" {
+		GenOAuth.UserInfoFields.Name = "http://schemas.xmlsoap.org/ws/2005/05/identity/claims/name"
+	}
+}
+
+func setDefaultsOpenStax() {
+	// these match the json tags of structs.OpenStaxUser
+	if GenOAuth.UserInfoFields.Username == "" {
+		GenOAuth.UserInfoFields.Username = "username"
+	}
+	if GenOAuth.UserInfoFields.Email == "" {
+		GenOAuth.UserInfoFields.Email = "email"
+	}
+	if GenOAuth.UserInfoFields.Name == "" {
+		GenOAuth.UserInfoFields.Name = "name"
+	}
+}
+
+func setDefaultsOAuth1() {
+	log.Info("configuring OAuth 1.0a")
+	// Twitter style verify_credentials responses
+	if GenOAuth.UserInfoFields.Username == "" {
+		GenOAuth.UserInfoFields.Username = "screen_name"
+	}
+	if GenOAuth.UserInfoFields.Name == "" {
+		GenOAuth.UserInfoFields.Name = "name"
+	}
+	if GenOAuth.UserInfoFields.ID == "" {
+		GenOAuth.UserInfoFields.ID = "id"
+	}
+}
+
+func setDefaultsSteam() {
+	log.Info("configuring Steam OpenID")
+	if GenOAuth.AuthURL == "" {
+		GenOAuth.AuthURL = "https://steamcommunity.com/openid/login"
+	}
+	if GenOAuth.UserInfoURL == "" {
+		GenOAuth.UserInfoURL = "https://api.steampowered.com/ISteamUser/GetPlayerSummaries/v0002/"
+	}
+}
+
+// withoutAccessTokenParam drop the trailing `access_token=` of a GitHub url configured for older versions
+// GitHub no longer takes the token in the query, it is sent in the Authorization header
+func withoutAccessTokenParam(key, u string) string {
+	for _, suffix := range []string{"?access_token=", "&access_token="} {
+		if strings.HasSuffix(u, suffix) {
+			log.Warnf("oauth.%s ends in %s, which GitHub no longer accepts, the access token is sent in the Authorization header", key, suffix)
+			return strings.TrimSuffix(u, suffix)
+		}
+	}
+	return u
+}
+
+// gitHubAPIURL the url of the path of the GitHub API at `oauth.github.api_base_url`, with or without its trailing slash
+func gitHubAPIURL(path string) string {
+	return strings.TrimSuffix(GenOAuth.GitHub.APIBaseURL, "/") + "/" + path
 }
 
 func setDefaultsGitHub() {
@@ -635,24 +1847,109 @@ func setDefaultsGitHub() {
 	if GenOAuth.TokenURL == "" {
 		GenOAuth.TokenURL = github.Endpoint.TokenURL
 	}
+	if GenOAuth.GitHub.APIBaseURL == "" {
+		GenOAuth.GitHub.APIBaseURL = "https://api.github.com"
+	}
 	if GenOAuth.UserInfoURL == "" {
-		GenOAuth.UserInfoURL = "https://api.github.com/user?access_token="
+		GenOAuth.UserInfoURL = gitHubAPIURL("user")
 	}
 	if GenOAuth.UserTeamURL == "" {
-		GenOAuth.UserTeamURL = "https://api.github.com/orgs/:org_id/teams/:team_slug/memberships/:username?access_token="
+		GenOAuth.UserTeamURL = gitHubAPIURL("orgs/:org_id/teams/:team_slug/memberships/:username")
 	}
 	if GenOAuth.UserOrgURL == "" {
-		GenOAuth.UserOrgURL = "https://api.github.com/orgs/:org_id/members/:username?access_token="
+		GenOAuth.UserOrgURL = gitHubAPIURL("orgs/:org_id/members/:username")
+	}
+	GenOAuth.UserInfoURL = withoutAccessTokenParam("user_info_url", GenOAuth.UserInfoURL)
+	GenOAuth.UserTeamURL = withoutAccessTokenParam("user_team_url", GenOAuth.UserTeamURL)
+	GenOAuth.UserOrgURL = withoutAccessTokenParam("user_org_url", GenOAuth.UserOrgURL)
+	if GenOAuth.UserEmailsURL == "" {
+		GenOAuth.UserEmailsURL = gitHubAPIURL("user/emails")
+	}
+	if GenOAuth.UserOrgMembershipURL == "" {
+		GenOAuth.UserOrgMembershipURL = gitHubAPIURL("user/memberships/orgs/:org_id")
+	}
+	if GenOAuth.UserTeamByIDURL == "" {
+		GenOAuth.UserTeamByIDURL = gitHubAPIURL("teams/:team_id/memberships/:username")
+	}
+	if GenOAuth.ChildTeamsURL == "" {
+		GenOAuth.ChildTeamsURL = gitHubAPIURL("orgs/:org_id/teams/:team_slug/teams?per_page=100")
+	}
+	if GenOAuth.UserTeamsURL == "" {
+		GenOAuth.UserTeamsURL = gitHubAPIURL("user/teams?per_page=100")
+	}
+	if GenOAuth.InstallationTokenURL == "" {
+		GenOAuth.InstallationTokenURL = gitHubAPIURL("app/installations/:installation_id/access_tokens")
+	}
+	if !viper.IsSet("oauth.github.normalize_teams") {
+		GenOAuth.GitHub.NormalizeTeams = true
+	}
+	if !viper.IsSet("oauth.required_scopes") {
+		GenOAuth.RequiredScopes = gitHubScopes()
 	}
 	if len(GenOAuth.Scopes) == 0 {
-		// https://github.com/vouch/vouch-proxy/issues/63
-		// https://developer.github.com/apps/building-oauth-apps/understanding-scopes-for-oauth-apps/
-		GenOAuth.Scopes = []string{"read:user"}
+		GenOAuth.Scopes = gitHubScopes()
+		return
+	}
+	// oauth.scopes is requested as configured, but say so if it won't be enough for the configured checks
+	for _, scope := range gitHubScopes() {
+		if !GitHubScopeGranted(scope, GenOAuth.Scopes) {
+			log.Warnf("oauth.scopes %s does not include the %s scope, which the configuration requires", GenOAuth.Scopes, scope)
+		}
+	}
+}
+
+// GitHubApp are the memberships looked up with a token of the `oauth.github.app`
+func GitHubApp() bool {
+	return GenOAuth.GitHub.App.AppID != ""
+}
+
+// gitHubScopes the least the user is asked to consent to for the configuration
+// read:org only to check the vouch.teamWhitelist, unless the oauth.github.app checks it, and user:email only for
+// oauth.github.secondary_emails. The user's own teams of the vouch.teamWhitelistRegex are listed with their token
+// https://github.com/vouch/vouch-proxy/issues/63
+// https://developer.github.com/apps/building-oauth-apps/understanding-scopes-for-oauth-apps/
+func gitHubScopes() []string {
+	scopes := []string{"read:user"}
+	if len(Cfg.TeamWhiteListRegex) > 0 || (len(Cfg.TeamWhiteList) > 0 && !GitHubApp()) {
+		scopes = append(scopes, "read:org")
+	}
+	emailsAPI := GenOAuth.GitHub.SecondaryEmails
+	for _, source := range GenOAuth.EmailSources {
+		emailsAPI = emailsAPI || source == "api"
+	}
+	if emailsAPI {
+		scopes = append(scopes, "user:email")
+	}
+	return scopes
+}
 
-		if len(Cfg.TeamWhiteList) > 0 {
-			GenOAuth.Scopes = append(GenOAuth.Scopes, "read:org")
+// GitHubScopeGranted is scope among the scopes, or implied by a broader one
+// GitHub lists the scopes granted to a token in the X-OAuth-Scopes response header
+func GitHubScopeGranted(scope string, scopes []string) bool {
+	broader := map[string][]string{
+		"read:user":  {"user"},
+		"user:email": {"user"},
+		"read:org":   {"write:org", "admin:org"},
+	}
+	for _, s := range scopes {
+		if s == scope {
+			return true
 		}
+		for _, b := range broader[scope] {
+			if s == b {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// redirectURL the callback_url of the oauth2 config, unless `oauth.redirect_uri` overrides it
+func redirectURL() string {
+	if GenOAuth.RedirectURI != "" {
+		return GenOAuth.RedirectURI
 	}
+	return GenOAuth.RedirectURL
 }
 
 func configureOAuthClient() {
@@ -664,7 +1961,7 @@ func configureOAuthClient() {
 			AuthURL:  GenOAuth.AuthURL,
 			TokenURL: GenOAuth.TokenURL,
 		},
-		RedirectURL: GenOAuth.RedirectURL,
+		RedirectURL: redirectURL(),
 		Scopes:      GenOAuth.Scopes,
 	}
 }
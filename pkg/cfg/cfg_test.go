@@ -1,10 +1,15 @@
 package cfg
 
 import (
+	"bytes"
+	"crypto/tls"
+	"io/ioutil"
+	"os"
 	"testing"
 
 	// "github.com/vouch/vouch-proxy/pkg/structs"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/oauth2"
 )
 
 func init() {
@@ -28,6 +33,7 @@ func TestSetGitHubDefaults(t *testing.T) {
 	InitForTestPurposesWithProvider("github")
 
 	assert.Equal(t, []string{"read:user"}, GenOAuth.Scopes)
+	assert.Equal(t, "avatar_url", GenOAuth.PictureClaim)
 }
 
 func TestSetGitHubDefaultsWithTeamWhitelist(t *testing.T) {
@@ -39,3 +45,354 @@ func TestSetGitHubDefaultsWithTeamWhitelist(t *testing.T) {
 	assert.Contains(t, GenOAuth.Scopes, "read:user")
 	assert.Contains(t, GenOAuth.Scopes, "read:org")
 }
+
+func TestSetGitHubDefaultsWithSecondaryEmails(t *testing.T) {
+	InitForTestPurposesWithProvider("github")
+	Cfg.TeamWhiteList = nil
+	GenOAuth.GitHub.SecondaryEmails = true
+	GenOAuth.Scopes = []string{}
+	defer func() { GenOAuth.GitHub.SecondaryEmails = false }()
+
+	setDefaultsGitHub()
+	assert.Contains(t, GenOAuth.Scopes, "user:email")
+	assert.NotContains(t, GenOAuth.Scopes, "read:org")
+}
+
+func TestSetGitHubDefaultsKeepsConfiguredScopes(t *testing.T) {
+	InitForTestPurposesWithProvider("github")
+	Cfg.TeamWhiteList = []string{"org/team"}
+	GenOAuth.Scopes = []string{"user", "admin:org"}
+	defer func() { Cfg.TeamWhiteList = nil }()
+
+	setDefaultsGitHub()
+	assert.Equal(t, []string{"user", "admin:org"}, GenOAuth.Scopes)
+	assert.True(t, GitHubScopeGranted("read:org", GenOAuth.Scopes))
+	assert.True(t, GitHubScopeGranted("user:email", GenOAuth.Scopes))
+	assert.False(t, GitHubScopeGranted("read:org", []string{"read:user"}))
+}
+
+func TestGitHubApp(t *testing.T) {
+	InitForTestPurposesWithProvider("github")
+	defer InitForTestPurposesWithProvider("github")
+	Cfg.TeamWhiteList = []string{"org/team"}
+	assert.Contains(t, gitHubScopes(), "read:org")
+	assert.Equal(t, "https://api.github.com/app/installations/:installation_id/access_tokens", GenOAuth.InstallationTokenURL)
+
+	// the App looks up the memberships, the user needn't let it
+	GenOAuth.GitHub.App.AppID = "123456"
+	assert.NotContains(t, gitHubScopes(), "read:org")
+	// but their own teams are listed with their token
+	Cfg.TeamWhiteListRegex = []string{"org/team-.*"}
+	assert.Contains(t, gitHubScopes(), "read:org")
+	Cfg.TeamWhiteListRegex = nil
+
+	GenOAuth.ClientSecret = "secret"
+	err := BasicTest()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "oauth.github.app requires")
+	GenOAuth.GitHub.App.InstallationID = "7654321"
+	GenOAuth.GitHub.App.PrivateKeyFile = "/config/github-app.pem"
+	assert.NoError(t, BasicTest())
+}
+
+func TestSetGitHubDefaultsDropsAccessTokenParam(t *testing.T) {
+	InitForTestPurposesWithProvider("github")
+	defer InitForTestPurposesWithProvider("github")
+	assert.Equal(t, "https://api.github.com/user", GenOAuth.UserInfoURL)
+
+	// as configured for GitHub Enterprise by older versions
+	GenOAuth.UserInfoURL = "https://ghe.example.com/api/v3/user?access_token="
+	GenOAuth.UserOrgURL = "https://ghe.example.com/api/v3/orgs/:org_id/members/:username?per_page=1&access_token="
+	setDefaultsGitHub()
+	assert.Equal(t, "https://ghe.example.com/api/v3/user", GenOAuth.UserInfoURL)
+	assert.Equal(t, "https://ghe.example.com/api/v3/orgs/:org_id/members/:username?per_page=1", GenOAuth.UserOrgURL)
+	assert.Equal(t, "https://api.github.com/orgs/:org_id/teams/:team_slug/memberships/:username", GenOAuth.UserTeamURL)
+}
+
+func TestCheckUserRestriction(t *testing.T) {
+	InitForTestPurposes()
+	defer InitForTestPurposes()
+	assert.Nil(t, checkUserRestriction())
+
+	Cfg.WhiteList = nil
+	Cfg.TeamWhiteList = nil
+	Cfg.Domains = []string{}
+	err := checkUserRestriction()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "oauth.provider "+GenOAuth.Provider)
+
+	Cfg.TeamWhiteList = []string{"org/team"}
+	assert.Nil(t, checkUserRestriction())
+	Cfg.TeamWhiteList = nil
+
+	Cfg.Authz.WebhookURL = "https://authz.example.com"
+	Cfg.Authz.Mode = "replace"
+	assert.Nil(t, checkUserRestriction())
+	Cfg.Authz.Mode = "augment"
+	assert.Error(t, checkUserRestriction())
+	Cfg.Authz.WebhookURL = ""
+
+	Cfg.AllowAllUsers = true
+	assert.Nil(t, checkUserRestriction())
+}
+
+func TestTokenEndpointAuthMethod(t *testing.T) {
+	InitForTestPurposes()
+	defer InitForTestPurposes()
+	assert.Nil(t, checkTokenEndpointAuthMethod())
+
+	GenOAuth.TokenEndpointAuthMethod = "client_secret_jwt"
+	assert.Error(t, checkTokenEndpointAuthMethod())
+
+	GenOAuth.TokenEndpointAuthMethod = "private_key_jwt"
+	assert.Error(t, checkTokenEndpointAuthMethod())
+	GenOAuth.ClientAssertion.SigningKeyFile = "/etc/vouch/client_assertion.key"
+	assert.Nil(t, checkTokenEndpointAuthMethod())
+	GenOAuth.ClientAssertion.Alg = "HS256"
+	assert.Error(t, checkTokenEndpointAuthMethod())
+
+	GenOAuth.TokenEndpointAuthMethod = "none"
+	configureTokenEndpointAuth()
+	assert.Equal(t, "", OAuthClient.ClientSecret)
+	assert.Equal(t, oauth2.AuthStyleInParams, OAuthClient.Endpoint.AuthStyle)
+}
+
+func TestOAuth2Only(t *testing.T) {
+	InitForTestPurposesWithProvider("oidc")
+	defer func() {
+		GenOAuth.OAuth2Only = false
+		GenOAuth.EmailSources = nil
+		InitForTestPurposes()
+	}()
+	GenOAuth.OAuth2Only = true
+	GenOAuth.UserInfo = "required"
+	assert.Nil(t, checkOAuth2Only())
+
+	GenOAuth.UserInfo = "optional"
+	assert.Error(t, checkOAuth2Only())
+	GenOAuth.UserInfo = "required"
+
+	GenOAuth.EmailSources = []string{"id_token", "userinfo"}
+	assert.Error(t, checkOAuth2Only())
+	GenOAuth.EmailSources = nil
+
+	GenOAuth.Provider = Providers.GitHub
+	assert.Error(t, checkOAuth2Only())
+}
+
+func TestRedirectURI(t *testing.T) {
+	InitForTestPurposes()
+	defer func() {
+		GenOAuth.RedirectURI = ""
+		GenOAuth.CallbackPath = ""
+		InitForTestPurposes()
+	}()
+	assert.Nil(t, checkRedirectURI())
+
+	GenOAuth.RedirectURI = "https://vouch.example.com/auth"
+	assert.Nil(t, checkRedirectURI())
+	assert.Equal(t, GenOAuth.RedirectURI, redirectURL())
+
+	for _, bad := range []string{"/auth", "vouch.example.com/auth", "ftp://vouch.example.com/auth", "https://vouch.example.com/auth#x"} {
+		GenOAuth.RedirectURI = bad
+		assert.Error(t, checkRedirectURI(), bad)
+	}
+
+	GenOAuth.RedirectURI = "https://vouch.example.com/auth"
+	GenOAuth.CallbackPath = "/auth"
+	assert.Error(t, checkRedirectURI())
+}
+
+func TestDevAllowInsecure(t *testing.T) {
+	InitForTestPurposes()
+	defer func() {
+		Cfg.Dev.Enabled, Cfg.Dev.AllowInsecure = false, false
+		GenOAuth.RedirectURLs = nil
+		InitForTestPurposes()
+	}()
+	Cfg.Cookie.Secure = true
+	Cfg.Session.Cookie.Secure = true
+	GenOAuth.RedirectURL = "http://vouch.localhost:9090/auth"
+	GenOAuth.RedirectURLs = []string{"http://127.0.0.1:9090/auth"}
+
+	Cfg.Dev.AllowInsecure = true
+	assert.Error(t, checkDevAllowInsecure())
+	applyDevAllowInsecure()
+	assert.True(t, Cfg.Cookie.Secure)
+
+	Cfg.Dev.Enabled = true
+	assert.Nil(t, checkDevAllowInsecure())
+	applyDevAllowInsecure()
+	assert.False(t, Cfg.Cookie.Secure)
+	assert.False(t, Cfg.Session.Cookie.Secure)
+
+	// never with a callback anyone else can reach
+	Cfg.Cookie.Secure = true
+	GenOAuth.RedirectURLs = append(GenOAuth.RedirectURLs, "http://vouch.yourdomain.com/auth")
+	assert.Error(t, checkDevAllowInsecure())
+	applyDevAllowInsecure()
+	assert.True(t, Cfg.Cookie.Secure)
+}
+
+func TestDumpConfigRedactsSecrets(t *testing.T) {
+	InitForTestPurposesWithProvider("github")
+	Cfg.JWT.Secret = "jwtsecretvalue"
+	GenOAuth.ClientSecret = "clientsecretvalue"
+
+	var b bytes.Buffer
+	assert.Nil(t, DumpConfig(&b))
+	out := b.String()
+
+	assert.Contains(t, out, "provider: github")
+	assert.Contains(t, out, "secret: "+redacted)
+	assert.Contains(t, out, "client_secret: "+redacted)
+	assert.NotContains(t, out, "jwtsecretvalue")
+	assert.NotContains(t, out, "clientsecretvalue")
+	assert.NotContains(t, out, Cfg.Session.Key)
+}
+
+func TestTLSConfig(t *testing.T) {
+	InitForTestPurposes()
+	defer func() {
+		Cfg.TLS.MinVersion = "1.2"
+		Cfg.TLS.CipherSuites = nil
+	}()
+
+	tlsConfig, err := TLSConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS12), tlsConfig.MinVersion)
+	assert.Empty(t, tlsConfig.CipherSuites)
+
+	Cfg.TLS.CipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}
+	tlsConfig, err = TLSConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, tlsConfig.CipherSuites)
+
+	// named before and since Go 1.16
+	Cfg.TLS.CipherSuites = []string{"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305", "tls_ecdhe_ecdsa_with_chacha20_poly1305_sha256"}
+	tlsConfig, err = TLSConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305}, tlsConfig.CipherSuites)
+
+	Cfg.TLS.CipherSuites = []string{"TLS_MADE_UP_SUITE"}
+	_, err = TLSConfig()
+	assert.NotNil(t, err)
+
+	for _, insecure := range []string{"TLS_RSA_WITH_RC4_128_SHA", "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA"} {
+		Cfg.TLS.CipherSuites = []string{insecure}
+		_, err = TLSConfig()
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "is insecure")
+	}
+
+	Cfg.TLS.CipherSuites = nil
+	Cfg.TLS.MinVersion = "1.3"
+	tlsConfig, err = TLSConfig()
+	assert.Nil(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), tlsConfig.MinVersion)
+
+	Cfg.TLS.MinVersion = "1.4"
+	_, err = TLSConfig()
+	assert.NotNil(t, err)
+}
+
+func TestReadWhiteListFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "whitelist")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("# the admins\nbob@yourdomain.com\n\n  alice@yourdomain.com  \n# joe@yourdomain.com\n\t\n   # indented comment\njoe.smith@yourdomain.com\n")
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	entries, err := readWhiteListFile(f.Name())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"bob@yourdomain.com", "alice@yourdomain.com", "joe.smith@yourdomain.com"}, entries)
+
+	_, err = readWhiteListFile(f.Name() + ".missing")
+	assert.Error(t, err)
+}
+
+func TestCompileWhiteListRegex(t *testing.T) {
+	InitForTestPurposes()
+	defer func() {
+		Cfg.WhiteListRegex, Cfg.TeamWhiteListRegex = nil, nil
+		assert.NoError(t, CompileWhiteListRegex())
+	}()
+
+	Cfg.WhiteListRegex = []string{`.*@yourdomain\.com`}
+	Cfg.TeamWhiteListRegex = []string{"myorg/platform-.*", "myorg/sre"}
+	assert.NoError(t, CompileWhiteListRegex())
+	assert.True(t, MatchesAny(WhiteListRegex(), "bob@yourdomain.com"))
+	assert.False(t, MatchesAny(WhiteListRegex(), "bob@yourdomain.com.evil.com"))
+	assert.True(t, MatchesAny(TeamWhiteListRegex(), "myorg/platform-api"))
+	assert.True(t, MatchesAny(TeamWhiteListRegex(), "myorg/sre"))
+	// the whole team must match
+	assert.False(t, MatchesAny(TeamWhiteListRegex(), "notmyorg/platform-api"))
+	assert.False(t, MatchesAny(TeamWhiteListRegex(), "myorg/sre-oncall"))
+
+	Cfg.TeamWhiteListRegex = []string{"myorg/(platform-.*"}
+	err := CompileWhiteListRegex()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "configuration error: vouch.teamWhitelistRegex[0] myorg/(platform-.*")
+	err = BasicTest()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "teamWhitelistRegex[0]")
+	// the patterns compiled before are kept
+	assert.True(t, MatchesAny(TeamWhiteListRegex(), "myorg/sre"))
+}
+
+func TestCompileLegacyUserAgents(t *testing.T) {
+	InitForTestPurposes()
+	defer func() {
+		Cfg.Cookie.LegacyUserAgents = nil
+		assert.NoError(t, CompileLegacyUserAgents())
+	}()
+
+	Cfg.Cookie.LegacyUserAgents = []string{`Chrom(e|ium)/(5[1-9]|6[0-6])\.`}
+	assert.NoError(t, CompileLegacyUserAgents())
+	assert.True(t, MatchesAny(LegacyUserAgents(), "Mozilla/5.0 Chrome/62.0.3202.94 Safari/537.36"))
+	assert.False(t, MatchesAny(LegacyUserAgents(), "Mozilla/5.0 Chrome/80.0.3987.87 Safari/537.36"))
+
+	// an invalid pattern is refused when the configuration is read, not skipped at each login
+	Cfg.Cookie.LegacyUserAgents = []string{`Chrom(e|ium/`}
+	err := CompileLegacyUserAgents()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "configuration error: Cookie legacyUserAgents pattern Chrom(e|ium/")
+	// the patterns compiled before are kept
+	assert.True(t, MatchesAny(LegacyUserAgents(), "Mozilla/5.0 Chrome/62.0.3202.94 Safari/537.36"))
+}
+
+func TestReloadWhiteListFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "whitelist")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	assert.NoError(t, ioutil.WriteFile(f.Name(), []byte("bob@yourdomain.com\nalice@yourdomain.com\n"), 0600))
+
+	InitForTestPurposes()
+	Cfg.WhiteListFile = f.Name()
+	configuredWhiteList = []string{"joe@yourdomain.com"}
+	defer func() {
+		Cfg.WhiteListFile = ""
+		InitForTestPurposes()
+	}()
+
+	_, _, err = reloadWhiteListFile()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"joe@yourdomain.com", "bob@yourdomain.com", "alice@yourdomain.com"}, CurrentWhiteList())
+
+	assert.NoError(t, ioutil.WriteFile(f.Name(), []byte("alice@yourdomain.com\n# bob@yourdomain.com\ncarol@yourdomain.com\ndave@yourdomain.com\n"), 0600))
+	added, removed, err := reloadWhiteListFile()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, added)
+	assert.Equal(t, 1, removed)
+	assert.Equal(t, []string{"joe@yourdomain.com", "alice@yourdomain.com", "carol@yourdomain.com", "dave@yourdomain.com"}, CurrentWhiteList())
+
+	// an empty or missing file keeps the current entries
+	assert.NoError(t, ioutil.WriteFile(f.Name(), []byte("# nobody\n"), 0600))
+	_, _, err = reloadWhiteListFile()
+	assert.Error(t, err)
+	Cfg.WhiteListFile = f.Name() + ".missing"
+	_, _, err = reloadWhiteListFile()
+	assert.Error(t, err)
+	assert.Len(t, CurrentWhiteList(), 4)
+}
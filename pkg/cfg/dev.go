@@ -0,0 +1,85 @@
+package cfg
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// devCallbackURLs oauth.callback_url and oauth.callback_urls
+func devCallbackURLs() []string {
+	if GenOAuth == nil {
+		return nil
+	}
+	urls := append([]string{}, GenOAuth.RedirectURLs...)
+	if GenOAuth.RedirectURL != "" {
+		urls = append(urls, GenOAuth.RedirectURL)
+	}
+	return urls
+}
+
+// isLoopback is the host of the url this machine, localhost, a name under .localhost (RFC 6761) or a loopback address
+func isLoopback(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// devInsecure is `vouch.dev.allowInsecure` in effect, which takes `vouch.dev.enabled` and callback urls
+// which can only be reached from the machine Vouch Proxy runs on, so that it can't be left on in production
+func devInsecure() bool {
+	if !Cfg.Dev.Enabled || !Cfg.Dev.AllowInsecure {
+		return false
+	}
+	urls := devCallbackURLs()
+	if len(urls) == 0 {
+		return false
+	}
+	for _, u := range urls {
+		if !isLoopback(u) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkDevAllowInsecure refuse to start with `vouch.dev.allowInsecure` where it can't take effect
+func checkDevAllowInsecure() error {
+	if !Cfg.Dev.AllowInsecure {
+		return nil
+	}
+	if !Cfg.Dev.Enabled {
+		return fmt.Errorf("configuration error: %s.dev.allowInsecure requires %s.dev.enabled", Branding.LCName, Branding.LCName)
+	}
+	if !devInsecure() {
+		return fmt.Errorf("configuration error: %s.dev.allowInsecure requires every oauth.callback_url to be localhost or a loopback address (currently: %s)", Branding.LCName, devCallbackURLs())
+	}
+	return nil
+}
+
+// applyDevAllowInsecure drop the Secure attribute of every cookie and stop forcing https, for a login over
+// plain http://localhost
+func applyDevAllowInsecure() {
+	if !devInsecure() {
+		return
+	}
+	log.Warn("**********************************************************************************")
+	log.Warnf("%s.dev.allowInsecure is set: cookies are not Secure and plain http is accepted", Branding.LCName)
+	log.Warn("this is for development on localhost only, NEVER run this configuration in production")
+	log.Warn("**********************************************************************************")
+	Cfg.ForceHTTPS = false
+	Cfg.Cookie.Secure = false
+	Cfg.Session.Cookie.Secure = false
+	insecure := false
+	for i := range Cfg.Cookie.PerDomain {
+		Cfg.Cookie.PerDomain[i].Secure = &insecure
+	}
+}
@@ -0,0 +1,85 @@
+package cfg
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const redacted = "<redacted>"
+
+// redactedKeys are never printed by `-dumpconfig`
+// add any new secret to this list
+var redactedKeys = []string{
+	Branding.LCName + ".jwt.secret",
+	Branding.LCName + ".jwt.vault.token",
+	Branding.LCName + ".session.key",
+	Branding.LCName + ".debugAuthz.secret",
+	"oauth.client_secret",
+	"oauth.steam.api_key",
+	// may carry the proxy credentials
+	"oauth.http_proxy",
+}
+
+// DumpConfig writes the effective configuration as yaml with the secrets redacted
+func DumpConfig(w io.Writer) error {
+	out := yaml.MapSlice{
+		{Key: Branding.LCName, Value: configToMapSlice(reflect.ValueOf(Cfg), Branding.LCName)},
+		{Key: "oauth", Value: configToMapSlice(reflect.ValueOf(GenOAuth), "oauth")},
+	}
+	b, err := yaml.Marshal(out)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// configToMapSlice walks the config struct keyed by the same names used in the config file
+func configToMapSlice(v reflect.Value, prefix string) yaml.MapSlice {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	ms := yaml.MapSlice{}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		// skip the loggers
+		if f.Type.Kind() == reflect.Ptr {
+			continue
+		}
+		name := f.Tag.Get("mapstructure")
+		if name == "" {
+			if f.Name == strings.ToUpper(f.Name) {
+				// JWT, DB
+				name = strings.ToLower(f.Name)
+			} else {
+				name = strings.ToLower(f.Name[:1]) + f.Name[1:]
+			}
+		}
+		key := prefix + "." + name
+		val := v.Field(i).Interface()
+		if f.Type.Kind() == reflect.Struct {
+			val = configToMapSlice(v.Field(i), key)
+		} else if isRedacted(key) && fmt.Sprint(val) != "" {
+			val = redacted
+		}
+		ms = append(ms, yaml.MapItem{Key: name, Value: val})
+	}
+	return ms
+}
+
+func isRedacted(key string) bool {
+	for _, k := range redactedKeys {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package cfg
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// tlsVersions the accepted values of `vouch.tls.min_version`
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// cipherSuiteAliases the ChaCha20 suites were named without their _SHA256 before Go 1.16, either name is accepted
+var cipherSuiteAliases = map[string]string{
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305":          "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305":        "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+	"TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256":   "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305",
+	"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256": "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305",
+}
+
+// TLSConfig the tls.Config of the listener built from `vouch.tls`
+// an empty cipher_suites leaves the choice to crypto/tls, an insecure suite such as RC4 or 3DES is refused
+func TLSConfig() (*tls.Config, error) {
+	minVersion, ok := tlsVersions[Cfg.TLS.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("configuration error: %s.tls.min_version must be one of 1.0, 1.1, 1.2 or 1.3 (currently: %s)", Branding.LCName, Cfg.TLS.MinVersion)
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:               minVersion,
+		PreferServerCipherSuites: true,
+	}
+	for _, name := range Cfg.TLS.CipherSuites {
+		id, err := cipherSuite(strings.ToUpper(strings.TrimSpace(name)))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.CipherSuites = append(tlsConfig.CipherSuites, id)
+	}
+	return tlsConfig, nil
+}
+
+// cipherSuite the id of the suite named as in crypto/tls
+func cipherSuite(name string) (uint16, error) {
+	for _, s := range tls.CipherSuites() {
+		if s.Name == name || s.Name == cipherSuiteAliases[name] {
+			return s.ID, nil
+		}
+	}
+	for _, s := range tls.InsecureCipherSuites() {
+		if s.Name == name {
+			return 0, fmt.Errorf("configuration error: %s.tls.cipher_suites %s is insecure", Branding.LCName, name)
+		}
+	}
+	return 0, fmt.Errorf("configuration error: unknown cipher suite in %s.tls.cipher_suites: %s", Branding.LCName, name)
+}
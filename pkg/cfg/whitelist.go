@@ -0,0 +1,172 @@
+package cfg
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	whiteListMu sync.RWMutex
+	// configuredWhiteList the entries of `vouch.whiteList` itself, kept whenever the whiteListFile is read again
+	configuredWhiteList []string
+)
+
+var (
+	// whiteListRx and teamWhiteListRx compiled once the configuration is read, see CompileWhiteListRegex
+	whiteListRx     []*regexp.Regexp
+	teamWhiteListRx []*regexp.Regexp
+)
+
+// CompileWhiteListRegex compile the `vouch.whiteListRegex` and `vouch.teamWhitelistRegex`
+// a pattern must match the whole of the username or team, `myorg/platform-.*` doesn't match `myorg/platform-x/y`
+func CompileWhiteListRegex() error {
+	wl, err := compileWhiteListPatterns("whiteListRegex", Cfg.WhiteListRegex)
+	if err != nil {
+		return err
+	}
+	twl, err := compileWhiteListPatterns("teamWhitelistRegex", Cfg.TeamWhiteListRegex)
+	if err != nil {
+		return err
+	}
+	whiteListRx, teamWhiteListRx = wl, twl
+	return nil
+}
+
+func compileWhiteListPatterns(key string, patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for i, p := range patterns {
+		rx, err := regexp.Compile("^(?:" + p + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("configuration error: %s.%s[%d] %s is not a valid regular expression: %s", Branding.LCName, key, i, p, err)
+		}
+		compiled = append(compiled, rx)
+	}
+	return compiled, nil
+}
+
+// WhiteListRegex the compiled `vouch.whiteListRegex`
+func WhiteListRegex() []*regexp.Regexp {
+	return whiteListRx
+}
+
+// TeamWhiteListRegex the compiled `vouch.teamWhitelistRegex`
+func TeamWhiteListRegex() []*regexp.Regexp {
+	return teamWhiteListRx
+}
+
+// MatchesAny does s match one of the patterns
+func MatchesAny(patterns []*regexp.Regexp, s string) bool {
+	for _, rx := range patterns {
+		if rx.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// HasWhiteList is the user looked up in the whiteList or whiteListRegex
+func HasWhiteList() bool {
+	return len(CurrentWhiteList()) > 0 || len(Cfg.WhiteListRegex) > 0
+}
+
+// HasTeamWhiteList is the user looked up in the teamWhitelist or teamWhitelistRegex
+func HasTeamWhiteList() bool {
+	return len(Cfg.TeamWhiteList) > 0 || len(Cfg.TeamWhiteListRegex) > 0
+}
+
+// CurrentWhiteList the whiteList entries, including those of the whiteListFile as last read
+func CurrentWhiteList() []string {
+	whiteListMu.RLock()
+	defer whiteListMu.RUnlock()
+	return Cfg.WhiteList
+}
+
+// readWhiteListFile the entries of `vouch.whiteListFile`, one per line
+// surrounding whitespace is trimmed, blank lines and lines starting with # are skipped
+func readWhiteListFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// reloadWhiteListFile read the whiteListFile again and swap it in for the entries read before
+// it returns how many entries were added and removed, an empty file is refused as it's more likely mid write than intended
+func reloadWhiteListFile() (added int, removed int, err error) {
+	entries, err := readWhiteListFile(Cfg.WhiteListFile)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(entries) == 0 {
+		return 0, 0, errors.New("the file has no entries")
+	}
+	next := append(append([]string{}, configuredWhiteList...), entries...)
+
+	whiteListMu.Lock()
+	defer whiteListMu.Unlock()
+	before := make(map[string]bool, len(Cfg.WhiteList))
+	for _, e := range Cfg.WhiteList {
+		before[e] = true
+	}
+	after := make(map[string]bool, len(next))
+	for _, e := range next {
+		after[e] = true
+		if !before[e] {
+			added++
+		}
+	}
+	for e := range before {
+		if !after[e] {
+			removed++
+		}
+	}
+	Cfg.WhiteList = next
+	return added, removed, nil
+}
+
+// RefreshWhiteListFile read the whiteListFile again every `vouch.whiteListRefresh.interval` seconds
+// plus a random wait of up to `jitter` seconds, a failed read keeps the current entries
+func RefreshWhiteListFile() {
+	interval := time.Duration(Cfg.WhiteListRefresh.Interval) * time.Second
+	jitter := int64(Cfg.WhiteListRefresh.Jitter) * int64(time.Second)
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	for {
+		wait := interval
+		if jitter > 0 {
+			wait += time.Duration(rnd.Int63n(jitter + 1))
+		}
+		time.Sleep(wait)
+		added, removed, err := reloadWhiteListFile()
+		if err != nil {
+			log.Errorf("could not refresh %s.whiteListFile %s, keeping the current whiteList: %s", Branding.LCName, Cfg.WhiteListFile, err)
+			continue
+		}
+		if added > 0 || removed > 0 {
+			log.Infof("refreshed the whiteList from %s: %d entries added, %d removed", Cfg.WhiteListFile, added, removed)
+		} else {
+			log.Debugf("refreshed the whiteList from %s, unchanged", Cfg.WhiteListFile)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+var (
+	log = cfg.Cfg.Logger
+	// trusted the `vouch.trustedProxies` parsed by Configure
+	trusted []*net.IPNet
+)
+
+// Configure parse the `vouch.trustedProxies`, a bare address is a network of its own
+func Configure() error {
+	nets := []*net.IPNet{}
+	for _, p := range cfg.Cfg.TrustedProxies {
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return fmt.Errorf("configuration error: %s.trustedProxies %s is not an ip address or cidr", cfg.Branding.LCName, p)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return fmt.Errorf("configuration error: %s.trustedProxies %s is not an ip address or cidr", cfg.Branding.LCName, p)
+		}
+		nets = append(nets, n)
+	}
+	trusted = nets
+	return nil
+}
+
+// FromRequest the address of the client, for the lockout and everything else which keys on it
+// X-Forwarded-For is walked from the right for as long as the hops are trusted proxies, the first hop which isn't
+// is the client. Anything to the left of it was sent by the client and may be spoofed.
+// Without trusted proxies, or from an untrusted peer, the client is the peer.
+func FromRequest(r *http.Request) string {
+	ip := peer(r)
+	if !isTrusted(ip) {
+		return ip
+	}
+	hops := []string{}
+	for _, h := range r.Header["X-Forwarded-For"] {
+		hops = append(hops, strings.Split(h, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			log.Warnf("X-Forwarded-For %s from %s is not an ip address, using %s", hop, peer(r), ip)
+			return ip
+		}
+		ip = hop
+		if !isTrusted(ip) {
+			return ip
+		}
+	}
+	// every hop is a trusted proxy, the left most is as close to the client as we know
+	return ip
+}
+
+// peer the address of the connection without the port
+func peer(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+func isTrusted(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range trusted {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
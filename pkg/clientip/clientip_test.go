@@ -0,0 +1,65 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+func TestFromRequest(t *testing.T) {
+	cfg.Cfg.TrustedProxies = []string{"10.0.0.0/8", "192.168.1.1", "fd00::/8"}
+	defer func() {
+		cfg.Cfg.TrustedProxies = nil
+		assert.Nil(t, Configure())
+	}()
+	assert.Nil(t, Configure())
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		want       string
+	}{
+		{"no forwarded for", "10.1.1.1:1234", nil, "10.1.1.1"},
+		{"untrusted peer is the client", "203.0.113.9:1234", []string{"198.51.100.1"}, "203.0.113.9"},
+		{"one proxy", "10.1.1.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"chain of proxies", "10.1.1.1:1234", []string{"198.51.100.1, 192.168.1.1, 10.2.2.2"}, "198.51.100.1"},
+		{"spoofed entry left of the client", "10.1.1.1:1234", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"spoofed trusted address left of the client", "10.1.1.1:1234", []string{"10.9.9.9, 198.51.100.1, 10.2.2.2"}, "198.51.100.1"},
+		{"several headers", "10.1.1.1:1234", []string{"1.2.3.4", "198.51.100.1"}, "198.51.100.1"},
+		{"garbage stops the walk", "10.1.1.1:1234", []string{"198.51.100.1, not-an-ip"}, "10.1.1.1"},
+		{"all trusted", "10.1.1.1:1234", []string{"10.3.3.3, 10.2.2.2"}, "10.3.3.3"},
+		{"ipv6", "[fd00::1]:1234", []string{"2001:db8::1"}, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "http://vouch.example.com/validate", nil)
+		r.RemoteAddr = tt.remoteAddr
+		for _, h := range tt.xff {
+			r.Header.Add("X-Forwarded-For", h)
+		}
+		assert.Equal(t, tt.want, FromRequest(r), tt.name)
+	}
+}
+
+func TestFromRequestWithoutTrustedProxies(t *testing.T) {
+	assert.Nil(t, Configure())
+	r := httptest.NewRequest("GET", "http://vouch.example.com/validate", nil)
+	r.RemoteAddr = "10.1.1.1:1234"
+	r.Header.Set("X-Forwarded-For", "198.51.100.1")
+	assert.Equal(t, "10.1.1.1", FromRequest(r))
+}
+
+func TestConfigure(t *testing.T) {
+	defer func() { cfg.Cfg.TrustedProxies = nil }()
+	cfg.Cfg.TrustedProxies = []string{"10.0.0.0/33"}
+	assert.NotNil(t, Configure())
+	cfg.Cfg.TrustedProxies = []string{"proxy.example.com"}
+	assert.NotNil(t, Configure())
+}
@@ -0,0 +1,91 @@
+package cookie
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// a compressed cookie value starts with `!` followed by a byte naming the algorithm
+// neither appears at the start of a jwt or of base64, so an uncompressed value is read as is
+const (
+	compressedFlag = '!'
+	gzipFlag       = 'g'
+	flateFlag      = 'f'
+)
+
+// compressValue compress the value as configured in `vouch.cookie.compress`
+// the value is returned unchanged if compression doesn't make it any smaller
+func compressValue(val string) string {
+	var flag byte
+	switch cfg.Cfg.Cookie.Compress {
+	case "gzip":
+		flag = gzipFlag
+	case "flate":
+		flag = flateFlag
+	default:
+		return val
+	}
+	var buf bytes.Buffer
+	w, err := compressor(flag, &buf)
+	if err != nil {
+		log.Error(err)
+		return val
+	}
+	if _, err := w.Write([]byte(val)); err != nil {
+		log.Error(err)
+		return val
+	}
+	if err := w.Close(); err != nil {
+		log.Error(err)
+		return val
+	}
+	compressed := string([]byte{compressedFlag, flag}) + base64.RawURLEncoding.EncodeToString(buf.Bytes())
+	if len(compressed) >= len(val) {
+		log.Debugf("cookie value of %d bytes does not shrink with %s compression, setting it uncompressed", len(val), cfg.Cfg.Cookie.Compress)
+		return val
+	}
+	log.Debugf("%s compressed the cookie value from %d to %d bytes (%d%%)", cfg.Cfg.Cookie.Compress, len(val), len(compressed), 100*len(compressed)/len(val))
+	return compressed
+}
+
+func compressor(flag byte, w io.Writer) (io.WriteCloser, error) {
+	if flag == gzipFlag {
+		return gzip.NewWriter(w), nil
+	}
+	return flate.NewWriter(w, flate.BestCompression)
+}
+
+// decompressValue reverse compressValue, whatever `vouch.cookie.compress` is currently set to
+func decompressValue(val string) (string, error) {
+	if len(val) < 2 || val[0] != compressedFlag {
+		return val, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(val[2:])
+	if err != nil {
+		return "", fmt.Errorf("compressed cookie: %s", err)
+	}
+	var r io.ReadCloser
+	switch val[1] {
+	case gzipFlag:
+		if r, err = gzip.NewReader(bytes.NewReader(data)); err != nil {
+			return "", fmt.Errorf("compressed cookie: %s", err)
+		}
+	case flateFlag:
+		r = flate.NewReader(bytes.NewReader(data))
+	default:
+		return "", fmt.Errorf("compressed cookie: unknown compression %q", val[1])
+	}
+	defer r.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("compressed cookie: %s", err)
+	}
+	return string(out), nil
+}
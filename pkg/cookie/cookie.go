@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 	"unicode/utf8"
@@ -15,15 +16,80 @@ import (
 
 const maxCookieSize = 4000
 
-var log = cfg.Cfg.Logger
+var (
+	log = cfg.Cfg.Logger
+	// the suffix of the parts of a split cookie, `1of3`
+	rxCookiePart = regexp.MustCompile(`^[0-9]+of[0-9]+$`)
+)
 
 // SetCookie http
 func SetCookie(w http.ResponseWriter, r *http.Request, val string) {
-	setCookie(w, r, val, cfg.Cfg.Cookie.MaxAge*60) // convert minutes to seconds
+	setCookie(w, r, val, SessionAttributes(r))
+}
+
+// Attributes of a cookie, MaxAge in seconds
+// the jwt cookie set at the callback and the login state cookie set at /login each have their own,
+// see SessionAttributes and StateAttributes
+type Attributes struct {
+	Path     string
+	MaxAge   int
+	Secure   bool
+	HTTPOnly bool
+	SameSite string
+}
+
+// SessionAttributes those of the jwt cookie from `vouch.cookie`, overridden by the `vouch.cookie.perDomain` entry
+// for the one of the vouch.domains which the request is for
+func SessionAttributes(r *http.Request) Attributes {
+	a := Attributes{
+		Path:     cfg.Cfg.Cookie.Path,
+		MaxAge:   cfg.Cfg.Cookie.MaxAge * 60, // convert minutes to seconds
+		Secure:   cfg.Cfg.Cookie.Secure,
+		HTTPOnly: cfg.Cfg.Cookie.HTTPOnly,
+		SameSite: cfg.Cfg.Cookie.SameSite,
+	}
+	if len(cfg.Cfg.Cookie.PerDomain) == 0 {
+		return a
+	}
+	matched := domains.Matches(r.Host)
+	for _, d := range cfg.Cfg.Cookie.PerDomain {
+		// the entry is one of the vouch.domains, normalized as Matches does
+		if matched == "" || domains.Matches(d.Domain) != matched {
+			continue
+		}
+		log.Debugf("using the %s.cookie.perDomain attributes of %s", cfg.Branding.LCName, d.Domain)
+		if d.Path != "" {
+			a.Path = d.Path
+		}
+		if d.MaxAge > 0 {
+			a.MaxAge = d.MaxAge * 60
+		}
+		if d.Secure != nil {
+			a.Secure = *d.Secure
+		}
+		if d.SameSite != "" {
+			a.SameSite = d.SameSite
+		}
+		break
+	}
+	return a
+}
+
+// StateAttributes those of the short lived cookie which carries the login state from /login to the callback,
+// all from `vouch.session.cookie`. Neither `vouch.cookie` nor its perDomain entries apply to it.
+func StateAttributes() Attributes {
+	return Attributes{
+		Path:     cfg.Cfg.Session.Cookie.Path,
+		MaxAge:   cfg.Cfg.Session.Cookie.MaxAge,
+		Secure:   cfg.Cfg.Session.Cookie.Secure,
+		HTTPOnly: cfg.Cfg.Session.Cookie.HTTPOnly,
+		SameSite: cfg.Cfg.Session.Cookie.SameSite,
+	}
 }
 
-func setCookie(w http.ResponseWriter, r *http.Request, val string, maxAge int) {
-	cookieName := cfg.Cfg.Cookie.Name
+func setCookie(w http.ResponseWriter, r *http.Request, val string, a Attributes) {
+	// compressed before it is split into parts
+	val = compressValue(val)
 	// foreach domain
 	domain := domains.Matches(r.Host)
 	// Allow overriding the cookie domain in the config file
@@ -31,18 +97,30 @@ func setCookie(w http.ResponseWriter, r *http.Request, val string, maxAge int) {
 		domain = cfg.Cfg.Cookie.Domain
 		log.Debugf("setting the cookie domain to %v", domain)
 	}
+	// user agents which drop a `SameSite=None` cookie get a duplicate without the attribute
+	legacy := strings.EqualFold(a.SameSite, "none") && isLegacyUserAgent(r.UserAgent())
+	setCookieParts(w, cfg.Cfg.Cookie.Name, val, domain, a)
+	if legacy {
+		log.Debugf("setting legacy cookie %s for user agent %s", legacyName(), r.UserAgent())
+		a.SameSite = ""
+		setCookieParts(w, legacyName(), val, domain, a)
+	}
+}
+
+func setCookieParts(w http.ResponseWriter, name string, val string, domain string, a Attributes) {
+	cookieName := name
 	cookie := http.Cookie{
-		Name:     cfg.Cfg.Cookie.Name,
+		Name:     name,
 		Value:    val,
-		Path:     "/",
+		Path:     a.Path,
 		Domain:   domain,
-		MaxAge:   maxAge,
-		Secure:   cfg.Cfg.Cookie.Secure,
-		HttpOnly: cfg.Cfg.Cookie.HTTPOnly,
+		MaxAge:   a.MaxAge,
+		Secure:   a.Secure,
+		HttpOnly: a.HTTPOnly,
 	}
 	cookieSize := len(cookie.String())
 	cookie.Value = ""
-	emptyCookieSize := len(cookie.String())
+	emptyCookieSize := len(cookie.String()) + len("; SameSite=") + len(a.SameSite)
 	// Cookies have a max size of 4096 bytes, but to support most browsers, we should stay below 4000 bytes
 	// https://tools.ietf.org/html/rfc6265#section-6.1
 	// http://browsercookielimits.squawky.net/
@@ -52,32 +130,145 @@ func setCookie(w http.ResponseWriter, r *http.Request, val string, maxAge int) {
 		cookieParts := SplitCookie(val, maxCookieSize-emptyCookieSize)
 		for i, cookiePart := range cookieParts {
 			// Cookies are named 1of3, 2of3, 3of3
-			cookieName = fmt.Sprintf("%s_%dof%d", cfg.Cfg.Cookie.Name, i+1, len(cookieParts))
-			http.SetCookie(w, &http.Cookie{
+			cookieName = fmt.Sprintf("%s_%dof%d", name, i+1, len(cookieParts))
+			setCookieWithSameSite(w, &http.Cookie{
 				Name:     cookieName,
 				Value:    cookiePart,
-				Path:     "/",
+				Path:     a.Path,
 				Domain:   domain,
-				MaxAge:   maxAge,
-				Secure:   cfg.Cfg.Cookie.Secure,
-				HttpOnly: cfg.Cfg.Cookie.HTTPOnly,
-			})
+				MaxAge:   a.MaxAge,
+				Secure:   a.Secure,
+				HttpOnly: a.HTTPOnly,
+			}, a.SameSite)
 		}
 	} else {
-		http.SetCookie(w, &http.Cookie{
+		setCookieWithSameSite(w, &http.Cookie{
 			Name:     cookieName,
 			Value:    val,
-			Path:     "/",
+			Path:     a.Path,
 			Domain:   domain,
-			MaxAge:   maxAge,
-			Secure:   cfg.Cfg.Cookie.Secure,
-			HttpOnly: cfg.Cfg.Cookie.HTTPOnly,
-		})
+			MaxAge:   a.MaxAge,
+			Secure:   a.Secure,
+			HttpOnly: a.HTTPOnly,
+		}, a.SameSite)
+	}
+}
+
+// setCookieWithSameSite http.SetCookie adding the SameSite attribute, if any
+// the attribute is written directly since older versions of net/http do not support it
+func setCookieWithSameSite(w http.ResponseWriter, c *http.Cookie, sameSite string) {
+	if sameSite == "" {
+		http.SetCookie(w, c)
+		return
+	}
+	if v := c.String(); v != "" {
+		w.Header().Add("Set-Cookie", v+sameSiteAttribute(sameSite))
+	}
+}
+
+// AppendSameSite add the SameSite attribute to the Set-Cookie headers of w from the one at index `from` on,
+// for cookies set by others such as gorilla sessions, which leaves SameSite to net/http
+func AppendSameSite(w http.ResponseWriter, from int, sameSite string) {
+	if sameSite == "" {
+		return
+	}
+	cookies := w.Header()["Set-Cookie"]
+	for i := from; i < len(cookies); i++ {
+		cookies[i] += sameSiteAttribute(sameSite)
+	}
+}
+
+func sameSiteAttribute(sameSite string) string {
+	return "; SameSite=" + strings.Title(strings.ToLower(sameSite))
+}
+
+// legacyName the name of the duplicate cookie without SameSite
+func legacyName() string {
+	return cfg.Cfg.Cookie.Name + "Legacy"
+}
+
+// sameSiteNone is the cookie of any of the domains set with `SameSite=None`, and so with a legacy cookie
+func sameSiteNone() bool {
+	if strings.EqualFold(cfg.Cfg.Cookie.SameSite, "none") {
+		return true
 	}
+	for _, d := range cfg.Cfg.Cookie.PerDomain {
+		if strings.EqualFold(d.SameSite, "none") {
+			return true
+		}
+	}
+	return false
+}
+
+// isLegacyUserAgent does the user agent match one of `vouch.cookie.legacyUserAgents`
+func isLegacyUserAgent(ua string) bool {
+	return cfg.MatchesAny(cfg.LegacyUserAgents(), ua)
 }
 
 // Cookie get the vouch jwt cookie
+// falling back to the legacy cookie of user agents which dropped the `SameSite=None` cookie
 func Cookie(r *http.Request) (string, error) {
+	val, err := cookieByName(r, cfg.Cfg.Cookie.Name)
+	if err != nil && sameSiteNone() {
+		if lval, lerr := cookieByName(r, legacyName()); lerr == nil {
+			log.Debugf("using legacy cookie %s", legacyName())
+			val, err = lval, nil
+		}
+	}
+	if err != nil {
+		return val, err
+	}
+	return decompressValue(val)
+}
+
+// ValidCookie get the vouch jwt cookie, as Cookie does
+// with `vouch.cookie.duplicates: first_valid` (the default) and more than one of them sent by the browser, the first
+// value which valid accepts is returned, or the first cookie when none is valid
+func ValidCookie(r *http.Request, valid func(string) error) (string, error) {
+	if cfg.Cfg.Cookie.Duplicates != "first_valid" {
+		return Cookie(r)
+	}
+	vals := cookieValues(r, cfg.Cfg.Cookie.Name)
+	if sameSiteNone() {
+		vals = append(vals, cookieValues(r, legacyName())...)
+	}
+	if len(vals) < 2 {
+		return Cookie(r)
+	}
+	for i, val := range vals {
+		val, err := decompressValue(val)
+		if err != nil {
+			log.Debugf("skipping cookie %d of %d named %s: %s", i+1, len(vals), cfg.Cfg.Cookie.Name, err)
+			continue
+		}
+		if err = valid(val); err != nil {
+			log.Debugf("skipping cookie %d of %d named %s: %s", i+1, len(vals), cfg.Cfg.Cookie.Name, err)
+			continue
+		}
+		log.Debugf("using cookie %d of %d named %s", i+1, len(vals), cfg.Cfg.Cookie.Name)
+		return val, nil
+	}
+	return Cookie(r)
+}
+
+// cookieValues every value of the cookie, of which there are several when cookies of overlapping domains
+// or paths share the name. A cookie split into parts is one value.
+func cookieValues(r *http.Request, name string) []string {
+	vals := []string{}
+	for _, c := range r.Cookies() {
+		if c.Name == name {
+			vals = append(vals, c.Value)
+		}
+	}
+	if len(vals) == 0 {
+		if val, err := cookieByName(r, name); err == nil {
+			vals = append(vals, val)
+		}
+	}
+	return vals
+}
+
+func cookieByName(r *http.Request, name string) (string, error) {
 
 	var cookieParts []string
 	var numParts = -1
@@ -88,10 +279,10 @@ func Cookie(r *http.Request) (string, error) {
 	// search for cookie parts in order
 	// this is the hotpath so we're trying to only walk once
 	for _, cookie := range cookies {
-		if cookie.Name == cfg.Cfg.Cookie.Name {
+		if cookie.Name == name {
 			return cookie.Value, nil
 		}
-		if strings.HasPrefix(cookie.Name, fmt.Sprintf("%s_", cfg.Cfg.Cookie.Name)) {
+		if strings.HasPrefix(cookie.Name, fmt.Sprintf("%s_", name)) {
 			log.Debugw("cookie",
 				"cookieName", cookie.Name,
 				"cookieValue", cookie.Value,
@@ -125,9 +316,24 @@ func Cookie(r *http.Request) (string, error) {
 	return combinedCookieStr, err
 }
 
+// isVouchCookieName is the cookie ours, or one of its parts?
+// another cookie which merely starts with the same name may belong to a different Vouch Proxy
+func isVouchCookieName(name string) bool {
+	if name == cfg.Cfg.Cookie.Name || name == legacyName() {
+		return true
+	}
+	for _, n := range []string{cfg.Cfg.Cookie.Name, legacyName()} {
+		if strings.HasPrefix(name, n+"_") && rxCookiePart.MatchString(name[len(n)+1:]) {
+			return true
+		}
+	}
+	return false
+}
+
 // ClearCookie get rid of the existing cookie
 func ClearCookie(w http.ResponseWriter, r *http.Request) {
 	cookies := r.Cookies()
+	a := SessionAttributes(r)
 	domain := domains.Matches(r.Host)
 	// Allow overriding the cookie domain in the config file
 	if cfg.Cfg.Cookie.Domain != "" {
@@ -136,16 +342,16 @@ func ClearCookie(w http.ResponseWriter, r *http.Request) {
 	}
 	// search for cookie parts
 	for _, cookie := range cookies {
-		if strings.HasPrefix(cookie.Name, cfg.Cfg.Cookie.Name) {
+		if isVouchCookieName(cookie.Name) {
 			log.Debugf("deleting cookie: %s", cookie.Name)
 			http.SetCookie(w, &http.Cookie{
 				Name:     cookie.Name,
 				Value:    "delete",
-				Path:     "/",
+				Path:     a.Path,
 				Domain:   domain,
 				MaxAge:   -1,
-				Secure:   cfg.Cfg.Cookie.Secure,
-				HttpOnly: cfg.Cfg.Cookie.HTTPOnly,
+				Secure:   a.Secure,
+				HttpOnly: a.HTTPOnly,
 			})
 		}
 	}
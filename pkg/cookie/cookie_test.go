@@ -1,10 +1,22 @@
 package cookie
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/domains"
 )
 
+func init() {
+	cfg.InitForTestPurposes()
+}
+
 func TestSplitCookie(t *testing.T) {
 	type args struct {
 		longString string
@@ -25,3 +37,164 @@ func TestSplitCookie(t *testing.T) {
 		})
 	}
 }
+
+func TestCookiePath(t *testing.T) {
+	cfg.Cfg.Cookie.Path = "/app"
+	defer func() { cfg.Cfg.Cookie.Path = "/" }()
+
+	r := httptest.NewRequest("GET", "http://vouch.example.com/", nil)
+	w := httptest.NewRecorder()
+	// large enough to be chunked
+	SetCookie(w, r, strings.Repeat("a", maxCookieSize*2))
+	resp := w.Result()
+	assert.True(t, len(resp.Cookies()) > 1)
+	for _, c := range resp.Cookies() {
+		assert.Equal(t, "/app", c.Path)
+		r.AddCookie(&http.Cookie{Name: c.Name, Value: c.Value})
+	}
+
+	w = httptest.NewRecorder()
+	ClearCookie(w, r)
+	cleared := w.Result().Cookies()
+	assert.Equal(t, len(resp.Cookies()), len(cleared))
+	for _, c := range cleared {
+		assert.Equal(t, "/app", c.Path)
+		assert.Equal(t, -1, c.MaxAge)
+	}
+}
+
+func TestCookiePerDomain(t *testing.T) {
+	secure := true
+	cfg.Cfg.Cookie.PerDomain = []cfg.CookieDomain{{Domain: "vouch.github.io", SameSite: "None", Secure: &secure, Path: "/app", MaxAge: 5}}
+	defer func() { cfg.Cfg.Cookie.PerDomain = nil }()
+	domains.Refresh()
+
+	r := httptest.NewRequest("GET", "http://app.vouch.github.io/", nil)
+	w := httptest.NewRecorder()
+	SetCookie(w, r, "value")
+	cookies := w.Result().Cookies()
+	assert.Equal(t, 1, len(cookies))
+	assert.Equal(t, "/app", cookies[0].Path)
+	assert.Equal(t, 300, cookies[0].MaxAge)
+	assert.True(t, cookies[0].Secure)
+	assert.Contains(t, w.Header().Get("Set-Cookie"), "SameSite=None")
+
+	// any other domain keeps vouch.cookie
+	r = httptest.NewRequest("GET", "http://vouch.example.com/", nil)
+	w = httptest.NewRecorder()
+	SetCookie(w, r, "value")
+	cookies = w.Result().Cookies()
+	assert.Equal(t, 1, len(cookies))
+	assert.Equal(t, cfg.Cfg.Cookie.Path, cookies[0].Path)
+	assert.Equal(t, cfg.Cfg.Cookie.MaxAge*60, cookies[0].MaxAge)
+	assert.Equal(t, cfg.Cfg.Cookie.Secure, cookies[0].Secure)
+	assert.NotContains(t, w.Header().Get("Set-Cookie"), "SameSite")
+}
+
+func TestStateAttributes(t *testing.T) {
+	secure := true
+	cfg.Cfg.Cookie.PerDomain = []cfg.CookieDomain{{Domain: "vouch.github.io", SameSite: "None", Secure: &secure, Path: "/app", MaxAge: 5}}
+	sameSite := cfg.Cfg.Cookie.SameSite
+	cfg.Cfg.Cookie.SameSite = "Strict"
+	defer func() {
+		cfg.Cfg.Cookie.PerDomain = nil
+		cfg.Cfg.Cookie.SameSite = sameSite
+	}()
+	domains.Refresh()
+
+	// the jwt cookie's attributes don't reach the login state cookie
+	a := StateAttributes()
+	assert.Equal(t, "/", a.Path)
+	assert.Equal(t, cfg.Cfg.Session.Cookie.MaxAge, a.MaxAge)
+	assert.Equal(t, "Lax", a.SameSite)
+	assert.Equal(t, "Strict", SessionAttributes(httptest.NewRequest("GET", "http://vouch.example.com/", nil)).SameSite)
+	assert.Equal(t, "None", SessionAttributes(httptest.NewRequest("GET", "http://app.vouch.github.io/", nil)).SameSite)
+}
+
+func TestAppendSameSite(t *testing.T) {
+	w := httptest.NewRecorder()
+	http.SetCookie(w, &http.Cookie{Name: "other", Value: "1"})
+	http.SetCookie(w, &http.Cookie{Name: "state", Value: "2"})
+	AppendSameSite(w, 1, "lax")
+	assert.Equal(t, []string{"other=1", "state=2; SameSite=Lax"}, w.Header()["Set-Cookie"])
+
+	AppendSameSite(w, 0, "")
+	assert.Equal(t, []string{"other=1", "state=2; SameSite=Lax"}, w.Header()["Set-Cookie"])
+}
+
+func TestLegacySameSiteCookie(t *testing.T) {
+	cfg.Cfg.Cookie.SameSite = "None"
+	cfg.Cfg.Cookie.LegacyUserAgents = []string{`Chrom(e|ium)/(5[1-9]|6[0-6])\.`}
+	assert.Nil(t, cfg.CompileLegacyUserAgents())
+	defer func() {
+		cfg.Cfg.Cookie.SameSite = ""
+		cfg.Cfg.Cookie.LegacyUserAgents = nil
+		assert.Nil(t, cfg.CompileLegacyUserAgents())
+	}()
+
+	setCookies := func(ua string) []string {
+		r := httptest.NewRequest("GET", "http://vouch.example.com/", nil)
+		r.Header.Set("User-Agent", ua)
+		w := httptest.NewRecorder()
+		SetCookie(w, r, "jwtvalue")
+		return w.Header()["Set-Cookie"]
+	}
+
+	modern := setCookies("Mozilla/5.0 Chrome/80.0.3987.87 Safari/537.36")
+	assert.Equal(t, 1, len(modern))
+	assert.Contains(t, modern[0], "SameSite=None")
+
+	legacy := setCookies("Mozilla/5.0 Chrome/62.0.3202.94 Safari/537.36")
+	assert.Equal(t, 2, len(legacy))
+	assert.Contains(t, legacy[0], "SameSite=None")
+	assert.True(t, strings.HasPrefix(legacy[1], cfg.Cfg.Cookie.Name+"Legacy=jwtvalue"))
+	assert.NotContains(t, legacy[1], "SameSite")
+
+	// a browser which dropped the SameSite=None cookie presents only the legacy cookie
+	r := httptest.NewRequest("GET", "http://vouch.example.com/", nil)
+	r.AddCookie(&http.Cookie{Name: cfg.Cfg.Cookie.Name + "Legacy", Value: "jwtvalue"})
+	val, err := Cookie(r)
+	assert.Nil(t, err)
+	assert.Equal(t, "jwtvalue", val)
+}
+
+func TestCompressedCookie(t *testing.T) {
+	defer func() { cfg.Cfg.Cookie.Compress = "none" }()
+	// large and repetitive, like a jwt with many group claims
+	val := strings.Repeat("group-", maxCookieSize)
+
+	for _, c := range []string{"none", "gzip", "flate"} {
+		cfg.Cfg.Cookie.Compress = c
+		r := httptest.NewRequest("GET", "http://vouch.example.com/", nil)
+		w := httptest.NewRecorder()
+		SetCookie(w, r, val)
+		set := w.Result().Cookies()
+		if c == "none" {
+			assert.True(t, len(set) > 1, c)
+		} else {
+			// small enough for a single cookie
+			assert.Len(t, set, 1, c)
+			assert.True(t, strings.HasPrefix(set[0].Value, "!"), c)
+		}
+		for _, sc := range set {
+			r.AddCookie(&http.Cookie{Name: sc.Name, Value: sc.Value})
+		}
+		// read back whatever is configured now
+		cfg.Cfg.Cookie.Compress = "none"
+		got, err := Cookie(r)
+		assert.Nil(t, err, c)
+		assert.Equal(t, val, got, c)
+	}
+}
+
+func TestCompressValueIncompressible(t *testing.T) {
+	cfg.Cfg.Cookie.Compress = "gzip"
+	defer func() { cfg.Cfg.Cookie.Compress = "none" }()
+	// too short to shrink
+	assert.Equal(t, "abc", compressValue("abc"))
+
+	_, err := decompressValue("!xAAAA")
+	assert.NotNil(t, err)
+	_, err = decompressValue("!g+++")
+	assert.NotNil(t, err)
+}
@@ -2,6 +2,8 @@ package cors
 
 import (
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/vouch/vouch-proxy/pkg/cfg"
 )
@@ -18,3 +20,53 @@ func AllowAll(nextHandler http.Handler) http.HandlerFunc {
 		nextHandler.ServeHTTP(w, r)
 	}
 }
+
+// AllowOrigins is middle ware for the origins of `vouch.cors.allowedOrigins`
+// their preflight is answered with a 204, the preflight of any other origin with a 403, neither reaches nextHandler
+// the other requests of an allowed origin get Access-Control-Allow-Origin
+// without any allowedOrigins every request is passed to nextHandler as is
+func AllowOrigins(nextHandler http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(cfg.Cfg.CORS.AllowedOrigins) == 0 {
+			nextHandler.ServeHTTP(w, r)
+			return
+		}
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && origin != "" && r.Header.Get("Access-Control-Request-Method") != ""
+		w.Header().Add("Vary", "Origin")
+		if !allowedOrigin(origin) {
+			if preflight {
+				log.Debugf("refusing the preflight from %s, not one of %s.cors.allowedOrigins", origin, cfg.Branding.LCName)
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			nextHandler.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(cfg.Cfg.CORS.AllowedMethods, ", "))
+			if len(cfg.Cfg.CORS.AllowedHeaders) > 0 {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(cfg.Cfg.CORS.AllowedHeaders, ", "))
+			}
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(cfg.Cfg.CORS.MaxAge))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		nextHandler.ServeHTTP(w, r)
+	}
+}
+
+// allowedOrigin the scheme and host are case insensitive
+func allowedOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, o := range cfg.Cfg.CORS.AllowedOrigins {
+		if strings.EqualFold(origin, o) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+func TestAllowOrigins(t *testing.T) {
+	reached := false
+	h := AllowOrigins(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	request := func(method, origin string, preflight bool) *httptest.ResponseRecorder {
+		reached = false
+		r := httptest.NewRequest(method, "http://vouch.yourdomain.com/validate", nil)
+		if origin != "" {
+			r.Header.Set("Origin", origin)
+		}
+		if preflight {
+			r.Header.Set("Access-Control-Request-Method", "GET")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	// no origin is allowed by default, the handler answers as before
+	w := request("OPTIONS", "https://app.yourdomain.com", true)
+	assert.True(t, reached)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	cfg.Cfg.CORS.AllowedOrigins = []string{"https://app.yourdomain.com"}
+	defer func() { cfg.Cfg.CORS.AllowedOrigins = nil }()
+
+	w = request("OPTIONS", "https://APP.yourdomain.com", true)
+	assert.False(t, reached)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Equal(t, "https://APP.yourdomain.com", w.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", w.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "GET", w.Header().Get("Access-Control-Allow-Methods"))
+	assert.Equal(t, "Authorization", w.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", w.Header().Get("Access-Control-Max-Age"))
+
+	w = request("OPTIONS", "https://evil.example.com", true)
+	assert.False(t, reached)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	// the request after the preflight
+	w = request("GET", "https://app.yourdomain.com", false)
+	assert.True(t, reached)
+	assert.Equal(t, "https://app.yourdomain.com", w.Header().Get("Access-Control-Allow-Origin"))
+
+	w = request("GET", "https://evil.example.com", false)
+	assert.True(t, reached)
+	assert.Empty(t, w.Header().Get("Access-Control-Allow-Origin"))
+
+	// an OPTIONS which isn't a preflight is the handler's
+	request("OPTIONS", "", false)
+	assert.True(t, reached)
+}
@@ -4,10 +4,20 @@ import (
 	"sort"
 	"strings"
 
+	"golang.org/x/net/idna"
+
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/pii"
 )
 
-var domains = cfg.Cfg.Domains
+// domain a normalized entry of the configured domains
+// subdomainsOnly for an entry written `.example.com` or `*.example.com`, which the name example.com itself doesn't match
+type domain struct {
+	name           string
+	subdomainsOnly bool
+}
+
+var domains = normalized(cfg.Cfg.Domains)
 var log = cfg.Cfg.Logger
 
 func init() {
@@ -15,36 +25,104 @@ func init() {
 }
 
 func Refresh() {
-	domains = cfg.Cfg.Domains
+	domains = normalized(cfg.Cfg.Domains)
 	sort.Sort(ByLengthDesc(domains))
 }
 
+// normalized copy of the configured domains, see normalize
+func normalized(ds []string) []domain {
+	n := make([]domain, len(ds))
+	for i, d := range ds {
+		wildcard := strings.TrimPrefix(strings.TrimPrefix(d, "*."), ".")
+		n[i] = domain{name: normalize(wildcard), subdomainsOnly: wildcard != d}
+	}
+	return n
+}
+
+// normalize a domain to lower case punycode, domain names are case insensitive (RFC 4343)
+// and an international domain (IDN) may be written either in Unicode or as its xn-- ASCII form
+// a name which can't be converted is only lower cased
+func normalize(d string) string {
+	d = strings.ToLower(d)
+	ascii, err := idna.ToASCII(d)
+	if err != nil {
+		log.Debugf("domain %s could not be converted to punycode: %s", d, err)
+		return d
+	}
+	return ascii
+}
+
 // Matches returns one of the domains we're configured for
 // TODO return all matches
 // Matches return the first match of the
+// the match is case insensitive and the domain is returned in lower case punycode
+// the longest of the matching domains wins, and of a wildcard and an exact entry of the same name the exact one
+// a wildcard `.example.com` is returned as example.com, the domain its cookie is set in
 func Matches(s string) string {
+	return match(s, domains)
+}
+
+// Sites the configured domains as they are recorded in the jwt, normalized, a wildcard with its leading `.`
+func Sites() []string {
+	sites := []string{}
+	for _, d := range normalized(cfg.Cfg.Domains) {
+		if d.subdomainsOnly {
+			sites = append(sites, "."+d.name)
+		} else {
+			sites = append(sites, d.name)
+		}
+	}
+	return sites
+}
+
+// InSites is the host s in one of the sites of a jwt, matched as Matches matches the configured domains
+// the sites of a jwt issued before they were normalized are normalized here
+func InSites(s string, sites []string) bool {
+	ds := normalized(sites)
+	sort.Sort(ByLengthDesc(ds))
+	return match(s, ds) != ""
+}
+
+// match the host of s, without its port, to the longest of the sorted ds it's in, see Matches
+func match(s string, ds []domain) string {
 	if strings.Contains(s, ":") {
 		// then we have a port and we just want to check the host
 		split := strings.Split(s, ":")
 		log.Debugf("removing port from %s to test domain %s", s, split[0])
 		s = split[0]
 	}
+	s = normalize(s)
+	// such as the userinfo or path of a url, `evil.com/.example.com` mustn't match .example.com
+	if !isHostName(s) {
+		log.Warnf("domain %s is not a host name", s)
+		return ""
+	}
 
-	for i, v := range domains {
-		if s == v || strings.HasSuffix(s, "."+v) {
-			log.Debugf("domain %s matched array value at [%d]=%v", s, i, v)
-			return v
+	for i, v := range ds {
+		if (s == v.name && !v.subdomainsOnly) || strings.HasSuffix(s, "."+v.name) {
+			log.Debugf("domain %s matched array value at [%d]=%v", s, i, v.name)
+			return v.name
 		}
 	}
-	log.Warnf("domain %s not found in any domains %v", s, domains)
+	log.Warnf("domain %s not found in any domains %v", s, ds)
 	return ""
 }
 
+// isHostName only the letters, digits, `-`, `_` and `.` of a normalized host name
+func isHostName(s string) bool {
+	for _, c := range s {
+		if !(('a' <= c && c <= 'z') || ('0' <= c && c <= '9') || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
 // IsUnderManagement check if an email is under vouch-managed domain
 func IsUnderManagement(email string) bool {
 	split := strings.Split(email, "@")
 	if len(split) != 2 {
-		log.Warnf("not a valid email: %s", email)
+		log.Warnf("not a valid email: %s", pii.Mask(email))
 		return false
 	}
 
@@ -57,7 +135,7 @@ func IsUnderManagement(email string) bool {
 
 // ByLengthDesc sort from
 // https://play.golang.org/p/N6GbEgBffd
-type ByLengthDesc []string
+type ByLengthDesc []domain
 
 func (s ByLengthDesc) Len() int {
 	return len(s)
@@ -66,7 +144,10 @@ func (s ByLengthDesc) Swap(i, j int) {
 	s[i], s[j] = s[j], s[i]
 }
 
-// this differs by offing the longest first
+// this differs by offing the longest first, an exact entry before the wildcard of the same name
 func (s ByLengthDesc) Less(i, j int) bool {
-	return len(s[j]) < len(s[i])
+	if len(s[i].name) == len(s[j].name) {
+		return !s[i].subdomainsOnly && s[j].subdomainsOnly
+	}
+	return len(s[j].name) < len(s[i].name)
 }
@@ -40,3 +40,89 @@ func TestMatches(t *testing.T) {
 	assert.Equal(t, "sub.test.mydomain.com", Matches("subsub.sub.test.mydomain.com"))
 	assert.Equal(t, "test.mydomain.com", Matches("other.test.mydomain.com"))
 }
+
+func TestMatchesCaseInsensitive(t *testing.T) {
+	cfg.Cfg.Domains = []string{"Vouch.GitHub.io", "sub.test.mydomain.com", "test.mydomain.com"}
+	Refresh()
+	defer func() {
+		cfg.Cfg.Domains = []string{"vouch.github.io", "sub.test.mydomain.com", "test.mydomain.com"}
+		Refresh()
+	}()
+
+	assert.Equal(t, "vouch.github.io", Matches("vouch.github.io"))
+	assert.Equal(t, "vouch.github.io", Matches("SUB.Vouch.GitHub.IO:443"))
+	assert.Equal(t, "test.mydomain.com", Matches("Other.Test.MyDomain.com"))
+	assert.Equal(t, "", Matches("Vouch.GitHub.io.com"))
+	// the configuration is left as it is
+	assert.Equal(t, "Vouch.GitHub.io", cfg.Cfg.Domains[0])
+
+	assert.True(t, IsUnderManagement("User@Example.vouch.GITHUB.io"))
+	assert.True(t, IsUnderManagement("test@SUB.TEST.MYDOMAIN.COM"))
+	assert.False(t, IsUnderManagement("User@Example.COM"))
+}
+
+func TestMatchesIDN(t *testing.T) {
+	cfg.Cfg.Domains = []string{"bücher.example", "xn--mnchen-3ya.example"}
+	Refresh()
+	defer func() {
+		cfg.Cfg.Domains = []string{"vouch.github.io", "sub.test.mydomain.com", "test.mydomain.com"}
+		Refresh()
+	}()
+
+	// configured in Unicode, arriving as punycode
+	assert.Equal(t, "xn--bcher-kva.example", Matches("xn--bcher-kva.example"))
+	assert.True(t, IsUnderManagement("robin@XN--BCHER-KVA.example"))
+	// configured as punycode, arriving in Unicode
+	assert.Equal(t, "xn--mnchen-3ya.example", Matches("sub.münchen.example"))
+	assert.True(t, IsUnderManagement("robin@MÜNCHEN.example"))
+
+	assert.False(t, IsUnderManagement("robin@bucher.example"))
+}
+
+func TestMatchesWildcard(t *testing.T) {
+	cfg.Cfg.Domains = []string{".example.com", "app.example.com", "*.Wild.example", "exact.example"}
+	Refresh()
+	defer func() {
+		cfg.Cfg.Domains = []string{"vouch.github.io", "sub.test.mydomain.com", "test.mydomain.com"}
+		Refresh()
+	}()
+
+	assert.Equal(t, "example.com", Matches("a.example.com"))
+	assert.Equal(t, "example.com", Matches("b.example.com:8443"))
+	assert.Equal(t, "example.com", Matches("deep.sub.example.com"))
+	assert.Equal(t, "wild.example", Matches("a.WILD.example"))
+	// the wildcard is for the subdomains, not the domain itself
+	assert.Equal(t, "", Matches("example.com"))
+	assert.Equal(t, "", Matches("wild.example"))
+	// the most specific entry wins
+	assert.Equal(t, "app.example.com", Matches("app.example.com"))
+	assert.Equal(t, "app.example.com", Matches("x.app.example.com"))
+	assert.Equal(t, "example.com", Matches("xapp.example.com"))
+
+	// suffixes which aren't at a label boundary
+	assert.Equal(t, "", Matches("evilexample.com"))
+	assert.Equal(t, "", Matches("example.com.evil.com"))
+	assert.Equal(t, "", Matches("a.example.com.evil.com"))
+	assert.Equal(t, "", Matches("a-example.com"))
+	assert.Equal(t, "", Matches("notexact.example"))
+	assert.Equal(t, "", Matches("evil.com/.example.com"))
+	assert.Equal(t, "", Matches("evil.com@a.example.com"))
+	assert.Equal(t, "", Matches(".example.com.evil.com:443"))
+
+	assert.True(t, IsUnderManagement("robin@mail.example.com"))
+	assert.False(t, IsUnderManagement("robin@example.com"))
+	assert.False(t, IsUnderManagement("robin@example.com.evil.com"))
+}
+
+func TestMatchesExactBeforeWildcard(t *testing.T) {
+	cfg.Cfg.Domains = []string{".example.com", "example.com"}
+	Refresh()
+	defer func() {
+		cfg.Cfg.Domains = []string{"vouch.github.io", "sub.test.mydomain.com", "test.mydomain.com"}
+		Refresh()
+	}()
+
+	assert.False(t, domains[0].subdomainsOnly)
+	assert.Equal(t, "example.com", Matches("example.com"))
+	assert.Equal(t, "example.com", Matches("a.example.com"))
+}
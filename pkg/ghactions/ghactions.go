@@ -0,0 +1,119 @@
+package ghactions
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwks"
+)
+
+// Claims of a GitHub Actions OIDC token
+// https://docs.github.com/en/actions/deployment/security-hardening-your-deployments/about-security-hardening-with-openid-connect
+type Claims struct {
+	// Subject such as repo:octo-org/octo-repo:ref:refs/heads/main
+	Subject    string
+	Repository string
+	Workflow   string
+	// JobWorkflowRef the workflow file which defines the job, such as
+	// octo-org/octo-repo/.github/workflows/deploy.yml@refs/heads/main
+	// unlike the `workflow` name, which is set in the file itself, it can't be changed by a push to another branch
+	JobWorkflowRef string
+	Ref            string
+}
+
+var (
+	log = cfg.Cfg.Logger
+
+	keys     *jwks.Set
+	keysOnce sync.Once
+)
+
+// KeySet the JWKS of the GitHub Actions issuer
+func KeySet() *jwks.Set {
+	keysOnce.Do(func() {
+		if keys == nil {
+			keys = jwks.New(cfg.Cfg.GitHubActions.JWKSURL)
+		}
+	})
+	return keys
+}
+
+// IsActionsToken was the token issued by `vouch.githubActions.issuer`, the signature is not checked
+func IsActionsToken(tokenString string) bool {
+	claims := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(tokenString, claims); err != nil {
+		return false
+	}
+	iss, _ := claims["iss"].(string)
+	return iss == cfg.Cfg.GitHubActions.Issuer
+}
+
+// Verify the token against GitHub's JWKS and authorize its repository and job_workflow_ref
+func Verify(tokenString string) (*Claims, error) {
+	mc := jwt.MapClaims{}
+	parser := &jwt.Parser{ValidMethods: jwks.AsymmetricMethods}
+	if _, err := parser.ParseWithClaims(tokenString, mc, KeySet().Keyfunc); err != nil {
+		return nil, err
+	}
+	if iss, _ := mc["iss"].(string); iss != cfg.Cfg.GitHubActions.Issuer {
+		return nil, errors.New("github actions token has an unexpected issuer")
+	}
+	if !mc.VerifyAudience(cfg.Cfg.GitHubActions.Audience, true) {
+		return nil, errors.New("github actions token has an unexpected audience")
+	}
+	if _, ok := mc["exp"]; !ok {
+		return nil, errors.New("github actions token is missing exp")
+	}
+
+	claims := &Claims{}
+	claims.Subject, _ = mc["sub"].(string)
+	claims.Repository, _ = mc["repository"].(string)
+	claims.Workflow, _ = mc["workflow"].(string)
+	claims.JobWorkflowRef, _ = mc["job_workflow_ref"].(string)
+	claims.Ref, _ = mc["ref"].(string)
+
+	if !matchesAny(claims.Repository, cfg.Cfg.GitHubActions.Repositories) {
+		return nil, fmt.Errorf("github actions repository %s is not allowed", claims.Repository)
+	}
+	if len(cfg.Cfg.GitHubActions.Workflows) > 0 && !workflowAllowed(claims.JobWorkflowRef) {
+		return nil, fmt.Errorf("github actions job_workflow_ref %q of %s is not allowed", claims.JobWorkflowRef, claims.Repository)
+	}
+	log.Debugf("github actions token authorized for %s workflow %s", claims.Repository, claims.JobWorkflowRef)
+	return claims, nil
+}
+
+// workflowAllowed the job_workflow_ref matches one of `vouch.githubActions.workflows`
+// a pattern without an `@ref` allows the workflow file from any ref
+func workflowAllowed(ref string) bool {
+	for _, p := range cfg.Cfg.GitHubActions.Workflows {
+		if !strings.Contains(p, "@") {
+			if i := strings.LastIndex(ref, "@"); i >= 0 && matchesAny(ref[:i], []string{p}) {
+				return true
+			}
+			continue
+		}
+		if matchesAny(ref, []string{p}) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAny the value matches one of the patterns, which may contain `*` such as `myorg/*`
+func matchesAny(value string, patterns []string) bool {
+	if value == "" {
+		return false
+	}
+	for _, p := range patterns {
+		if ok, err := path.Match(p, value); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
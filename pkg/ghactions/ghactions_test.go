@@ -0,0 +1,93 @@
+package ghactions
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/jwks"
+)
+
+var key *rsa.PrivateKey
+
+func init() {
+	cfg.InitForTestPurposes()
+	key, _ = rsa.GenerateKey(rand.Reader, 2048)
+}
+
+func setUp(t *testing.T) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Nil(t, json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA", "kid": "gh1",
+			"n": base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}}))
+	}))
+	keys = jwks.New(ts.URL)
+	cfg.Cfg.GitHubActions.Audience = "https://vouch.example.com"
+	cfg.Cfg.GitHubActions.Repositories = []string{"octo-org/*"}
+	cfg.Cfg.GitHubActions.Workflows = []string{"octo-org/octo-repo/.github/workflows/deploy.yml", "octo-org/*/.github/workflows/release.yml@refs/tags/v1"}
+	return ts
+}
+
+func token(claims jwt.MapClaims) string {
+	mc := jwt.MapClaims{
+		"iss":        cfg.Cfg.GitHubActions.Issuer,
+		"aud":        "https://vouch.example.com",
+		"exp":        time.Now().Add(time.Minute).Unix(),
+		"sub":        "repo:octo-org/octo-repo:ref:refs/heads/main",
+		"repository": "octo-org/octo-repo",
+		"workflow":   "deploy",
+		// the workflow file which defines the job
+		"job_workflow_ref": "octo-org/octo-repo/.github/workflows/deploy.yml@refs/heads/main",
+	}
+	for k, v := range claims {
+		mc[k] = v
+	}
+	t := jwt.NewWithClaims(jwt.SigningMethodRS256, mc)
+	t.Header["kid"] = "gh1"
+	ss, _ := t.SignedString(key)
+	return ss
+}
+
+func TestVerify(t *testing.T) {
+	ts := setUp(t)
+	defer ts.Close()
+
+	assert.True(t, IsActionsToken(token(nil)))
+	assert.False(t, IsActionsToken(token(jwt.MapClaims{"iss": "https://accounts.google.com"})))
+
+	claims, err := Verify(token(nil))
+	assert.Nil(t, err)
+	assert.Equal(t, "octo-org/octo-repo", claims.Repository)
+	assert.Equal(t, "repo:octo-org/octo-repo:ref:refs/heads/main", claims.Subject)
+
+	_, err = Verify(token(jwt.MapClaims{"repository": "evil-org/octo-repo"}))
+	assert.NotNil(t, err)
+	// the workflow name is the branch's to choose, it authorizes nothing
+	_, err = Verify(token(jwt.MapClaims{"workflow": "build"}))
+	assert.Nil(t, err)
+	_, err = Verify(token(jwt.MapClaims{"workflow": "deploy", "job_workflow_ref": "octo-org/octo-repo/.github/workflows/build.yml@refs/heads/main"}))
+	assert.NotNil(t, err)
+	_, err = Verify(token(jwt.MapClaims{"job_workflow_ref": nil}))
+	assert.NotNil(t, err)
+	// a pattern with a ref allows the workflow file of that ref only
+	_, err = Verify(token(jwt.MapClaims{"job_workflow_ref": "octo-org/other-repo/.github/workflows/release.yml@refs/tags/v1"}))
+	assert.Nil(t, err)
+	_, err = Verify(token(jwt.MapClaims{"job_workflow_ref": "octo-org/other-repo/.github/workflows/release.yml@refs/heads/main"}))
+	assert.NotNil(t, err)
+	_, err = Verify(token(jwt.MapClaims{"aud": "https://someone.else.com"}))
+	assert.NotNil(t, err)
+	_, err = Verify(token(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()}))
+	assert.NotNil(t, err)
+}
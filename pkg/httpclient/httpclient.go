@@ -0,0 +1,138 @@
+package httpclient
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/oauth2"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+var log = cfg.Cfg.Logger
+
+// Version is reported in the default User-Agent, set by main from the build
+var Version = "undefined"
+
+// UserAgent `oauth.user_agent` or vouch-proxy/<version>
+func UserAgent() string {
+	if cfg.GenOAuth.UserAgent != "" {
+		return cfg.GenOAuth.UserAgent
+	}
+	return cfg.Branding.LCName + "-proxy/" + Version
+}
+
+// userAgentTransport sets the User-Agent on every request before handing it to base
+type userAgentTransport struct {
+	base http.RoundTripper
+}
+
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the caller's request
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = append([]string(nil), v...)
+	}
+	r.Header.Set("User-Agent", UserAgent())
+	return t.base.RoundTrip(r)
+}
+
+// base the transport to the provider, built by Configure
+var base http.RoundTripper = http.DefaultTransport
+
+// Configure the transport for `oauth.http_proxy`, which overrides the HTTP_PROXY and HTTPS_PROXY of the environment
+// `none` connects directly whatever the environment says
+// the idle connections and http/2 are as `oauth.http_client` configures them
+func Configure() error {
+	base = http.DefaultTransport
+	if cfg.GenOAuth == nil {
+		return nil
+	}
+	proxy := http.ProxyFromEnvironment
+	switch cfg.GenOAuth.HTTPProxy {
+	case "":
+	case "none":
+		proxy = nil
+	default:
+		u, err := ProxyURL(cfg.GenOAuth.HTTPProxy)
+		if err != nil {
+			return err
+		}
+		proxy = http.ProxyURL(u)
+		log.Infof("requests to the provider go through the proxy %s", u.Host)
+	}
+	hc := cfg.GenOAuth.HTTPClient
+	// the settings of http.DefaultTransport
+	t := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			DualStack: true,
+		}).DialContext,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   hc.MaxIdleConnsPerHost,
+		IdleConnTimeout:       time.Duration(hc.IdleConnTimeout) * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+	if t.MaxIdleConns < hc.MaxIdleConnsPerHost {
+		t.MaxIdleConns = hc.MaxIdleConnsPerHost
+	}
+	if hc.HTTP2 {
+		// a Transport with its own DialContext only speaks http/2 once it's configured for it
+		if err := http2.ConfigureTransport(t); err != nil {
+			return err
+		}
+	} else {
+		// a non-nil, empty TLSNextProto turns http/2 off
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	base = t
+	return nil
+}
+
+// ProxyURL parse `oauth.http_proxy`, which must be an http, https or socks5 url with a host
+func ProxyURL(proxy string) (*url.URL, error) {
+	u, err := url.Parse(proxy)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("configuration error: oauth.http_proxy %s is not a url", proxy)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+		return u, nil
+	default:
+		return nil, fmt.Errorf("configuration error: oauth.http_proxy %s must be an http, https or socks5 url", proxy)
+	}
+}
+
+// Transport the http.RoundTripper for requests to the oauth provider
+func Transport() http.RoundTripper {
+	return &userAgentTransport{base: base}
+}
+
+// Client an http.Client using Transport, which gives up on the provider after `oauth.http_client.timeout`
+func Client() *http.Client {
+	return &http.Client{Transport: Transport(), Timeout: Timeout()}
+}
+
+// Timeout `oauth.http_client.timeout`, 0 for none
+func Timeout() time.Duration {
+	if cfg.GenOAuth == nil {
+		return 0
+	}
+	return time.Duration(cfg.GenOAuth.HTTPClient.Timeout) * time.Second
+}
+
+// Context carries Client for the oauth2 package's token exchange and clients
+func Context(ctx context.Context) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, Client())
+}
@@ -0,0 +1,111 @@
+package httpclient
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/http2"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+func TestUserAgent(t *testing.T) {
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("User-Agent")
+	}))
+	defer ts.Close()
+
+	Version = "v1.2.3"
+	defer func() { Version = "undefined" }()
+
+	req, _ := http.NewRequest("GET", ts.URL, nil)
+	_, err := Client().Do(req)
+	assert.Nil(t, err)
+	assert.Equal(t, "vouch-proxy/v1.2.3", got)
+	// the caller's request is left alone
+	assert.Empty(t, req.Header.Get("User-Agent"))
+
+	cfg.GenOAuth.UserAgent = "example/1.0 (+https://example.com)"
+	defer func() { cfg.GenOAuth.UserAgent = "" }()
+	_, err = Client().Get(ts.URL)
+	assert.Nil(t, err)
+	assert.Equal(t, "example/1.0 (+https://example.com)", got)
+}
+
+func TestConfigureHTTPProxy(t *testing.T) {
+	var proxied string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// a proxy is sent the absolute url
+		proxied = r.URL.String()
+	}))
+	defer proxy.Close()
+	defer func() {
+		cfg.GenOAuth.HTTPProxy = ""
+		assert.Nil(t, Configure())
+	}()
+
+	cfg.GenOAuth.HTTPProxy = proxy.URL
+	assert.Nil(t, Configure())
+	_, err := Client().Get("http://provider.example.com/userinfo")
+	assert.Nil(t, err)
+	assert.Equal(t, "http://provider.example.com/userinfo", proxied)
+
+	cfg.GenOAuth.HTTPProxy = "none"
+	assert.Nil(t, Configure())
+	assert.Nil(t, base.(*http.Transport).Proxy)
+}
+
+func TestConfigureHTTPClient(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	// rather than EnableHTTP2, which older versions of httptest lack
+	assert.Nil(t, http2.ConfigureServer(ts.Config, nil))
+	ts.TLS = &tls.Config{NextProtos: []string{"h2"}}
+	ts.StartTLS()
+	defer ts.Close()
+	defer func() {
+		cfg.GenOAuth.HTTPClient.HTTP2 = true
+		assert.Nil(t, Configure())
+	}()
+	proto := func() string {
+		tr := base.(*http.Transport)
+		if tr.TLSClientConfig == nil {
+			tr.TLSClientConfig = &tls.Config{}
+		}
+		tr.TLSClientConfig.RootCAs = ts.Client().Transport.(*http.Transport).TLSClientConfig.RootCAs
+		resp, err := Client().Get(ts.URL)
+		if !assert.Nil(t, err) {
+			return ""
+		}
+		resp.Body.Close()
+		return resp.Proto
+	}
+
+	assert.Nil(t, Configure())
+	assert.Equal(t, 32, base.(*http.Transport).MaxIdleConnsPerHost)
+	assert.Equal(t, 90*time.Second, base.(*http.Transport).IdleConnTimeout)
+	assert.Equal(t, "HTTP/2.0", proto())
+
+	cfg.GenOAuth.HTTPClient.HTTP2 = false
+	assert.Nil(t, Configure())
+	assert.Equal(t, "HTTP/1.1", proto())
+}
+
+func TestProxyURL(t *testing.T) {
+	for _, p := range []string{"http://proxy.example.com:3128", "https://proxy.example.com", "socks5://127.0.0.1:1080"} {
+		_, err := ProxyURL(p)
+		assert.Nil(t, err, p)
+	}
+	for _, p := range []string{"proxy.example.com:3128", "ftp://proxy.example.com", "http://"} {
+		_, err := ProxyURL(p)
+		assert.NotNil(t, err, p)
+	}
+}
@@ -0,0 +1,98 @@
+package inflight
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
+)
+
+// Gate counts the requests being handled and limits how many are handled at once.
+// A request which can't get a slot within the queue timeout is answered with a 503
+// rather than adding to the CPU spent verifying jwts under a spike.
+type Gate struct {
+	// slots is nil when the gate only counts
+	slots chan struct{}
+	wait  time.Duration
+	// inFlight accessed atomically
+	inFlight int64
+}
+
+var (
+	// Default is configured from `vouch.validateConcurrency`
+	Default *Gate
+	log     = cfg.Cfg.Logger
+)
+
+// Configure set up Default from the config
+func Configure() {
+	Default = New(cfg.Cfg.ValidateConcurrency.Max, time.Duration(cfg.Cfg.ValidateConcurrency.QueueTimeout)*time.Millisecond)
+}
+
+func init() {
+	Configure()
+	metrics.GaugeFunc("vouch_validate_in_flight", "Requests to /validate being handled, see vouch.validateConcurrency.", func() float64 {
+		return float64(Default.InFlight())
+	})
+}
+
+// New Gate which lets max requests through at once, waiting up to wait for a slot, a max of 0 is unlimited
+func New(max int, wait time.Duration) *Gate {
+	g := &Gate{wait: wait}
+	if max > 0 {
+		g.slots = make(chan struct{}, max)
+	}
+	return g
+}
+
+// InFlight the number of requests currently being handled
+func (g *Gate) InFlight() int64 {
+	if g == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&g.inFlight)
+}
+
+// Handler wraps next, responding 503 when no slot is available
+func (g *Gate) Handler(next http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !g.acquire() {
+			log.Warnf("%d requests are already being handled, responding 503 to %s", cap(g.slots), r.URL.Path)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		defer g.release()
+		next.ServeHTTP(w, r)
+	}
+}
+
+func (g *Gate) acquire() bool {
+	if g.slots != nil {
+		select {
+		case g.slots <- struct{}{}:
+		default:
+			if g.wait <= 0 {
+				return false
+			}
+			t := time.NewTimer(g.wait)
+			defer t.Stop()
+			select {
+			case g.slots <- struct{}{}:
+			case <-t.C:
+				return false
+			}
+		}
+	}
+	atomic.AddInt64(&g.inFlight, 1)
+	return true
+}
+
+func (g *Gate) release() {
+	atomic.AddInt64(&g.inFlight, -1)
+	if g.slots != nil {
+		<-g.slots
+	}
+}
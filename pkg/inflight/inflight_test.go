@@ -0,0 +1,82 @@
+package inflight
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blocking handler which signals once it is running and returns when released
+func blocking() (http.Handler, chan struct{}, chan struct{}) {
+	running := make(chan struct{})
+	release := make(chan struct{})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		running <- struct{}{}
+		<-release
+	}), running, release
+}
+
+func serve(g *Gate, h http.Handler) int {
+	w := httptest.NewRecorder()
+	g.Handler(h).ServeHTTP(w, httptest.NewRequest("GET", "/validate", nil))
+	return w.Code
+}
+
+func TestGateLimit(t *testing.T) {
+	g := New(1, 0)
+	h, running, release := blocking()
+	done := make(chan int)
+	go func() { done <- serve(g, h) }()
+	<-running
+	assert.Equal(t, int64(1), g.InFlight())
+
+	assert.Equal(t, http.StatusServiceUnavailable, serve(g, h))
+
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, int64(0), g.InFlight())
+}
+
+func TestGateQueueTimeout(t *testing.T) {
+	g := New(1, time.Second)
+	h, running, release := blocking()
+	done := make(chan int)
+	go func() { done <- serve(g, h) }()
+	<-running
+
+	// the queued request gets the slot once the first one is done
+	queued := make(chan int)
+	go func() { queued <- serve(g, h) }()
+	time.Sleep(10 * time.Millisecond)
+	release <- struct{}{}
+	<-running
+	close(release)
+	assert.Equal(t, http.StatusOK, <-done)
+	assert.Equal(t, http.StatusOK, <-queued)
+
+	g = New(1, 10*time.Millisecond)
+	h, running, release = blocking()
+	go func() { done <- serve(g, h) }()
+	<-running
+	assert.Equal(t, http.StatusServiceUnavailable, serve(g, h))
+	close(release)
+	<-done
+}
+
+func TestGateUnlimited(t *testing.T) {
+	g := New(0, 0)
+	h, running, release := blocking()
+	done := make(chan int)
+	for i := 0; i < 3; i++ {
+		go func() { done <- serve(g, h) }()
+		<-running
+	}
+	assert.Equal(t, int64(3), g.InFlight())
+	close(release)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusOK, <-done)
+	}
+}
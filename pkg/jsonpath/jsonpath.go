@@ -0,0 +1,133 @@
+package jsonpath
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// step of a Path, exactly one of key, index or wildcard
+type step struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// Path a compiled expression, a small subset of JSONPath evaluated against decoded json
+//
+//	$.data.attributes.email    member access
+//	$['odd key'].value         bracketed member access, for keys which aren't identifiers
+//	$.emails[0]                array index
+//	$.groups[*].name           every element of an array, or every value of an object
+type Path struct {
+	expr  string
+	steps []step
+}
+
+// IsPath does the expression look like a Path rather than a plain key
+func IsPath(expr string) bool {
+	return strings.HasPrefix(expr, "$")
+}
+
+// Compile parse the expression, which must start at the root `$`
+func Compile(expr string) (*Path, error) {
+	if !IsPath(expr) {
+		return nil, fmt.Errorf("jsonpath %s: must start with $", expr)
+	}
+	p := &Path{expr: expr}
+	s := expr[1:]
+	for len(s) > 0 {
+		switch s[0] {
+		case '.':
+			s = s[1:]
+			if strings.HasPrefix(s, "*") {
+				p.steps = append(p.steps, step{wildcard: true})
+				s = s[1:]
+				continue
+			}
+			end := strings.IndexAny(s, ".[")
+			if end < 0 {
+				end = len(s)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("jsonpath %s: empty member name", expr)
+			}
+			p.steps = append(p.steps, step{key: s[:end]})
+			s = s[end:]
+		case '[':
+			end := strings.Index(s, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("jsonpath %s: unterminated [", expr)
+			}
+			inner := s[1:end]
+			// a quoted key may itself contain a ]
+			if len(inner) > 0 && (inner[0] == '\'' || inner[0] == '"') {
+				q := inner[0]
+				closing := strings.IndexByte(s[2:], q)
+				if closing < 0 || len(s) < closing+4 || s[closing+3] != ']' {
+					return nil, fmt.Errorf("jsonpath %s: unterminated quoted member name", expr)
+				}
+				p.steps = append(p.steps, step{key: s[2 : closing+2]})
+				s = s[closing+4:]
+				continue
+			}
+			switch {
+			case inner == "*":
+				p.steps = append(p.steps, step{wildcard: true})
+			default:
+				i, err := strconv.Atoi(inner)
+				if err != nil || i < 0 {
+					return nil, fmt.Errorf("jsonpath %s: invalid index [%s]", expr, inner)
+				}
+				p.steps = append(p.steps, step{index: i, isIndex: true})
+			}
+			s = s[end+1:]
+		default:
+			return nil, fmt.Errorf("jsonpath %s: unexpected %q", expr, s[0])
+		}
+	}
+	return p, nil
+}
+
+// String the expression as it was compiled
+func (p *Path) String() string {
+	return p.expr
+}
+
+// Root the member name of the first step, "" when the path starts with an index or a wildcard
+func (p *Path) Root() string {
+	if len(p.steps) == 0 {
+		return ""
+	}
+	return p.steps[0].key
+}
+
+// Get the values the path selects from v, as decoded by encoding/json into interface{}
+// nothing is returned if any step along the way doesn't exist
+func (p *Path) Get(v interface{}) []interface{} {
+	current := []interface{}{v}
+	for _, st := range p.steps {
+		next := []interface{}{}
+		for _, c := range current {
+			switch node := c.(type) {
+			case map[string]interface{}:
+				if st.wildcard {
+					for _, child := range node {
+						next = append(next, child)
+					}
+				} else if child, ok := node[st.key]; ok && !st.isIndex {
+					next = append(next, child)
+				}
+			case []interface{}:
+				if st.wildcard {
+					next = append(next, node...)
+				} else if st.isIndex && st.index < len(node) {
+					next = append(next, node[st.index])
+				}
+			}
+		}
+		current = next
+	}
+	return current
+}
@@ -0,0 +1,49 @@
+package jsonpath
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const doc = `{
+	"data": {
+		"attributes": {"email": "bob@example.com", "login": "bob"},
+		"odd key": {"value": 1}
+	},
+	"groups": [{"name": "admins"}, {"name": "writers"}],
+	"emails": ["bob@example.com", "robert@example.org"]
+}`
+
+func TestGet(t *testing.T) {
+	var v interface{}
+	assert.Nil(t, json.Unmarshal([]byte(doc), &v))
+
+	tests := []struct {
+		expr string
+		want []interface{}
+	}{
+		{"$.data.attributes.email", []interface{}{"bob@example.com"}},
+		{"$['data'][\"attributes\"].login", []interface{}{"bob"}},
+		{"$.data['odd key'].value", []interface{}{float64(1)}},
+		{"$.emails[1]", []interface{}{"robert@example.org"}},
+		{"$.groups[*].name", []interface{}{"admins", "writers"}},
+		{"$.groups.*.name", []interface{}{"admins", "writers"}},
+		{"$.emails[5]", []interface{}{}},
+		{"$.data.missing.email", []interface{}{}},
+		{"$.emails.length", []interface{}{}},
+	}
+	for _, tt := range tests {
+		p, err := Compile(tt.expr)
+		assert.Nil(t, err, tt.expr)
+		assert.Equal(t, tt.want, p.Get(v), tt.expr)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, expr := range []string{"data.email", "$.", "$..email", "$.emails[", "$.emails[-1]", "$.emails[x]", "$['email", "$['email'x", "$email"} {
+		_, err := Compile(expr)
+		assert.NotNil(t, err, expr)
+	}
+}
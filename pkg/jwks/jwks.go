@@ -0,0 +1,330 @@
+package jwks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/httpclient"
+)
+
+// AsymmetricMethods the signing methods a JWKS can verify, HMAC and `none` are never accepted
+var AsymmetricMethods = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512"}
+
+// minRefresh limits how often an unknown kid causes the JWKS to be fetched again
+const minRefresh = time.Minute
+
+// Set the public keys of a JSON Web Key Set https://tools.ietf.org/html/rfc7517
+// fetched on first use and again when a token names an unknown kid
+type Set struct {
+	url    string
+	client *http.Client
+
+	mu      sync.Mutex
+	keys    map[string]interface{}
+	fetched time.Time
+	// maxAge of the last response, from its Cache-Control
+	maxAge time.Duration
+	now    func() time.Time
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+var log = cfg.Cfg.Logger
+
+// New Set for the JWKS at url
+func New(url string) *Set {
+	return &Set{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second, Transport: httpclient.Transport()},
+		keys:   make(map[string]interface{}),
+		now:    time.Now,
+	}
+}
+
+// Keyfunc for jwt.Parse, selects the key by the token's kid
+func (s *Set) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	return s.Key(kid)
+}
+
+// Key the public key with the kid
+// with an empty kid the only key of a single key set is returned
+func (s *Set) Key(kid string) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if key, ok := s.lookup(kid); ok {
+		return key, nil
+	}
+	if !s.fetched.IsZero() && s.now().Sub(s.fetched) < minRefresh {
+		return nil, fmt.Errorf("jwks: unknown kid %s", kid)
+	}
+	if err := s.fetch(); err != nil {
+		return nil, err
+	}
+	if key, ok := s.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("jwks: unknown kid %s", kid)
+}
+
+// Fetch the keys now rather than on first use
+// unlike the fetch for an unknown kid, a failure doesn't hold off the next attempt
+func (s *Set) Fetch() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	last := s.fetched
+	err := s.fetch()
+	if err != nil {
+		s.fetched = last
+	}
+	return err
+}
+
+// Prefetch fetch the sets concurrently, so that the first token to be verified doesn't wait on the provider
+// a set which can't be fetched is logged and tried again every retry in the background, until it is
+func Prefetch(retry time.Duration, sets ...*Set) {
+	var wg sync.WaitGroup
+	for _, s := range sets {
+		wg.Add(1)
+		go func(s *Set) {
+			defer wg.Done()
+			if err := s.Fetch(); err != nil {
+				log.Warnf("jwks: could not prefetch %s, trying again in %s: %s", s.url, retry, err)
+				go s.refetchUntilFetched(retry)
+				return
+			}
+			log.Infof("jwks: prefetched %s", s.url)
+		}(s)
+	}
+	wg.Wait()
+}
+
+func (s *Set) refetchUntilFetched(retry time.Duration) {
+	for {
+		time.Sleep(retry)
+		s.mu.Lock()
+		fetched := len(s.keys) > 0
+		s.mu.Unlock()
+		if fetched {
+			// a token came along in the meantime
+			return
+		}
+		err := s.Fetch()
+		if err == nil {
+			log.Infof("jwks: prefetched %s", s.url)
+			return
+		}
+		log.Warnf("jwks: could not prefetch %s, trying again in %s: %s", s.url, retry, err)
+	}
+}
+
+// Refresh fetch the sets again every interval in the background for as long as Vouch Proxy runs, so that a rotated key
+// is known before a token signed with it comes along. An interval of 0 follows the max-age the provider answers with.
+// Either way the wait is kept within min and max. A failed fetch is logged, and the keys of the last fetch stay in use.
+func Refresh(interval, min, max time.Duration, sets ...*Set) {
+	for _, s := range sets {
+		go s.refresh(interval, min, max)
+	}
+}
+
+func (s *Set) refresh(interval, min, max time.Duration) {
+	for {
+		s.mu.Lock()
+		wait := s.nextRefresh(interval, min, max)
+		s.mu.Unlock()
+		time.Sleep(wait)
+		if err := s.Fetch(); err != nil {
+			log.Warnf("jwks: could not refresh %s, keeping the keys fetched before: %s", s.url, err)
+			continue
+		}
+		log.Debugf("jwks: refreshed %s", s.url)
+	}
+}
+
+// nextRefresh how long to wait before the next refresh, s.mu must be held
+func (s *Set) nextRefresh(interval, min, max time.Duration) time.Duration {
+	wait := interval
+	if wait == 0 {
+		wait = s.maxAge
+	}
+	if wait == 0 {
+		// no max-age to go by
+		wait = max
+	}
+	if wait < min {
+		wait = min
+	}
+	if wait > max {
+		wait = max
+	}
+	return wait
+}
+
+// cacheMaxAge the max-age of a Cache-Control header, 0 if there is none
+func cacheMaxAge(header string) time.Duration {
+	for _, directive := range strings.Split(header, ",") {
+		directive = strings.TrimSpace(strings.ToLower(directive))
+		if !strings.HasPrefix(directive, "max-age=") {
+			continue
+		}
+		seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+		if err != nil || seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	return 0
+}
+
+func (s *Set) lookup(kid string) (interface{}, bool) {
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+// fetch replaces the keys with those currently published, s.mu must be held
+func (s *Set) fetch() (rerr error) {
+	s.fetched = s.now()
+	log.Debugf("jwks: fetching %s", s.url)
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			rerr = err
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("jwks: unexpected response status " + resp.Status + " from " + s.url)
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	keys, err := Parse(data)
+	if err != nil {
+		return err
+	}
+	s.keys = keys
+	s.maxAge = cacheMaxAge(resp.Header.Get("Cache-Control"))
+	return nil
+}
+
+// Parse the public signing keys of a JWKS document by kid, keys which can't be used are skipped
+func Parse(data []byte) (map[string]interface{}, error) {
+	doc := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]interface{})
+	for _, k := range doc.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Warnf("jwks: skipping key %s: %s", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (interface{}, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported kty %s", k.Kty)
+	}
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	if s == "" {
+		return nil, errors.New("missing key parameter")
+	}
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// AudienceContains is clientID the `aud` claim or one of its members?
+func AudienceContains(aud interface{}, clientID string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == clientID
+	case []interface{}:
+		for _, v := range a {
+			if s, ok := v.(string); ok && s == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package jwks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+func b64(i *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(i.Bytes())
+}
+
+func rsaJWK(kid string, key *rsa.PrivateKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "use": "sig", "n": b64(key.N), "e": b64(big.NewInt(int64(key.E)))}
+}
+
+func TestParse(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	doc, _ := json.Marshal(map[string]interface{}{"keys": []map[string]string{
+		rsaJWK("rsa1", rsaKey),
+		{"kty": "EC", "kid": "ec1", "crv": "P-256", "x": b64(ecKey.X), "y": b64(ecKey.Y)},
+		{"kty": "RSA", "kid": "enc1", "use": "enc", "n": b64(rsaKey.N), "e": "AQAB"},
+		{"kty": "oct", "kid": "hmac1", "k": "c2VjcmV0"},
+	}})
+
+	keys, err := Parse(doc)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(keys))
+	assert.Equal(t, rsaKey.PublicKey.N, keys["rsa1"].(*rsa.PublicKey).N)
+	assert.Equal(t, rsaKey.PublicKey.E, keys["rsa1"].(*rsa.PublicKey).E)
+	assert.Equal(t, ecKey.PublicKey.X, keys["ec1"].(*ecdsa.PublicKey).X)
+}
+
+func TestKeyfuncRefetchesUnknownKid(t *testing.T) {
+	key1, _ := rsa.GenerateKey(rand.Reader, 2048)
+	key2, _ := rsa.GenerateKey(rand.Reader, 2048)
+	published := []map[string]string{rsaJWK("key1", key1)}
+	fetches := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		assert.Nil(t, json.NewEncoder(w).Encode(map[string]interface{}{"keys": published}))
+	}))
+	defer ts.Close()
+
+	s := New(ts.URL)
+	sign := func(kid string, key *rsa.PrivateKey) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{"sub": "test"})
+		token.Header["kid"] = kid
+		ss, _ := token.SignedString(key)
+		return ss
+	}
+
+	_, err := jwt.Parse(sign("key1", key1), s.Keyfunc)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, fetches)
+
+	// the provider rotates in a new key
+	published = append(published, rsaJWK("key2", key2))
+	s.fetched = s.fetched.Add(-2 * minRefresh)
+	_, err = jwt.Parse(sign("key2", key2), s.Keyfunc)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, fetches)
+
+	// unknown kids don't cause a fetch on every request
+	_, err = jwt.Parse(sign("key3", key2), s.Keyfunc)
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, fetches)
+}
+
+func TestPrefetch(t *testing.T) {
+	key1, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var mu sync.Mutex
+	fetches := 0
+	up := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		if !up {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		assert.Nil(t, json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{rsaJWK("key1", key1)}}))
+	}))
+	defer ts.Close()
+
+	s := New(ts.URL)
+	Prefetch(10*time.Millisecond, s)
+	mu.Lock()
+	assert.Equal(t, 1, fetches)
+	// the failure doesn't stop a token from fetching the keys straight away
+	assert.True(t, s.fetched.IsZero())
+	up = true
+	mu.Unlock()
+
+	// retried in the background
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		s.mu.Lock()
+		fetched := len(s.keys) > 0
+		s.mu.Unlock()
+		if fetched {
+			break
+		}
+	}
+	_, err := s.Key("key1")
+	assert.Nil(t, err)
+}
+
+func TestNextRefresh(t *testing.T) {
+	s := New("https://idp.example.com/jwks")
+	min, max := 5*time.Minute, 24*time.Hour
+	// no max-age to go by
+	assert.Equal(t, max, s.nextRefresh(0, min, max))
+	assert.Equal(t, time.Hour, s.nextRefresh(time.Hour, min, max))
+	assert.Equal(t, min, s.nextRefresh(time.Second, min, max))
+
+	s.maxAge = cacheMaxAge("public, max-age=3600, must-revalidate")
+	assert.Equal(t, time.Hour, s.maxAge)
+	assert.Equal(t, time.Hour, s.nextRefresh(0, min, max))
+	assert.Equal(t, 2*time.Hour, s.nextRefresh(2*time.Hour, min, max))
+	s.maxAge = cacheMaxAge("max-age=30")
+	assert.Equal(t, min, s.nextRefresh(0, min, max))
+	s.maxAge = cacheMaxAge("no-cache")
+	assert.Equal(t, max, s.nextRefresh(0, min, max))
+}
+
+func TestRefreshKeepsKeysOnFailure(t *testing.T) {
+	key1, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var mu sync.Mutex
+	fetches := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		fetches++
+		if fetches > 1 {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=600")
+		assert.Nil(t, json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{rsaJWK("key1", key1)}}))
+	}))
+	defer ts.Close()
+
+	s := New(ts.URL)
+	assert.Nil(t, s.Fetch())
+	assert.Equal(t, 10*time.Minute, s.maxAge)
+	Refresh(0, 10*time.Millisecond, 10*time.Millisecond, s)
+	for i := 0; i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		mu.Lock()
+		n := fetches
+		mu.Unlock()
+		if n > 2 {
+			break
+		}
+	}
+	mu.Lock()
+	assert.True(t, fetches > 2)
+	mu.Unlock()
+	_, err := s.Key("key1")
+	assert.Nil(t, err)
+}
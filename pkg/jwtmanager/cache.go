@@ -0,0 +1,101 @@
+package jwtmanager
+
+import (
+	"crypto/sha256"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/metrics"
+)
+
+// claimsCache the claims of recently verified tokens, see `vouch.validateCache`
+// keyed by a sha256 of the whole token string, any change to the token or its signature is a miss
+type claimsCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]cachedClaims
+}
+
+type cachedClaims struct {
+	claims  VouchClaims
+	expires time.Time
+}
+
+var (
+	validated = &claimsCache{entries: map[[sha256.Size]byte]cachedClaims{}}
+	// accessed atomically
+	cacheHits   int64
+	cacheMisses int64
+)
+
+func init() {
+	metrics.CounterFunc("vouch_validate_cache_hits_total", "Requests to /validate answered from vouch.validateCache.", func() float64 {
+		return float64(atomic.LoadInt64(&cacheHits))
+	})
+	metrics.CounterFunc("vouch_validate_cache_misses_total", "Requests to /validate whose jwt was not in vouch.validateCache.", func() float64 {
+		return float64(atomic.LoadInt64(&cacheMisses))
+	})
+}
+
+// CachedClaims the claims of tokenString if it was verified within `vouch.validateCache.ttl`
+func CachedClaims(tokenString string) (VouchClaims, bool) {
+	if cfg.Cfg.ValidateCache.TTL <= 0 {
+		return VouchClaims{}, false
+	}
+	key := sha256.Sum256([]byte(tokenString))
+	validated.mu.Lock()
+	c, ok := validated.entries[key]
+	if ok && !time.Now().Before(c.expires) {
+		delete(validated.entries, key)
+		ok = false
+	}
+	validated.mu.Unlock()
+	// the token may have expired since it was verified
+	if !ok || c.claims.StandardClaims.Valid() != nil {
+		atomic.AddInt64(&cacheMisses, 1)
+		return VouchClaims{}, false
+	}
+	atomic.AddInt64(&cacheHits, 1)
+	return copyClaims(c.claims), true
+}
+
+// CacheClaims keep the claims of the verified tokenString for `vouch.validateCache.ttl`
+// while the cache holds `vouch.validateCache.max` tokens which haven't expired, nothing more is kept
+func CacheClaims(tokenString string, claims VouchClaims) {
+	if cfg.Cfg.ValidateCache.TTL <= 0 {
+		return
+	}
+	key := sha256.Sum256([]byte(tokenString))
+	now := time.Now()
+	validated.mu.Lock()
+	defer validated.mu.Unlock()
+	if len(validated.entries) >= cfg.Cfg.ValidateCache.Max {
+		for k, c := range validated.entries {
+			if !now.Before(c.expires) {
+				delete(validated.entries, k)
+			}
+		}
+		if len(validated.entries) >= cfg.Cfg.ValidateCache.Max {
+			return
+		}
+	}
+	validated.entries[key] = cachedClaims{
+		claims:  copyClaims(claims),
+		expires: now.Add(time.Duration(cfg.Cfg.ValidateCache.TTL) * time.Millisecond),
+	}
+}
+
+// copyClaims the handlers may change the CustomClaims of a request, such as the teams of `teamRecheck`
+// which mustn't show up in the claims of the next request
+func copyClaims(claims VouchClaims) VouchClaims {
+	c := claims
+	c.Sites = append([]string(nil), claims.Sites...)
+	if claims.CustomClaims != nil {
+		c.CustomClaims = make(map[string]interface{}, len(claims.CustomClaims))
+		for k, v := range claims.CustomClaims {
+			c.CustomClaims[k] = v
+		}
+	}
+	return c
+}
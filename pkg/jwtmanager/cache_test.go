@@ -0,0 +1,65 @@
+package jwtmanager
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func TestClaimsCache(t *testing.T) {
+	defer func() {
+		cfg.Cfg.ValidateCache.TTL = 0
+		cfg.Cfg.ValidateCache.Max = 10000
+		validated.entries = map[[32]byte]cachedClaims{}
+	}()
+	claims := VouchClaims{Username: "test@testing.com", CustomClaims: map[string]interface{}{"groups": "a"}}
+	claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+
+	// disabled
+	CacheClaims("token", claims)
+	_, ok := CachedClaims("token")
+	assert.False(t, ok)
+
+	cfg.Cfg.ValidateCache.TTL = 1000
+	cfg.Cfg.ValidateCache.Max = 2
+	hits, misses := atomic.LoadInt64(&cacheHits), atomic.LoadInt64(&cacheMisses)
+	CacheClaims("token", claims)
+	c, ok := CachedClaims("token")
+	assert.True(t, ok)
+	assert.Equal(t, claims.Username, c.Username)
+	// any other value is a miss
+	_, ok = CachedClaims("token ")
+	assert.False(t, ok)
+	assert.Equal(t, hits+1, atomic.LoadInt64(&cacheHits))
+	assert.Equal(t, misses+1, atomic.LoadInt64(&cacheMisses))
+
+	// a change to the claims of one request isn't seen by the next
+	c.CustomClaims["groups"] = "b"
+	c, _ = CachedClaims("token")
+	assert.Equal(t, "a", c.CustomClaims["groups"])
+
+	// full
+	CacheClaims("token2", claims)
+	CacheClaims("token3", claims)
+	_, ok = CachedClaims("token3")
+	assert.False(t, ok)
+
+	// a token which has expired since it was kept
+	validated.entries = map[[32]byte]cachedClaims{}
+	claims.ExpiresAt = time.Now().Add(-time.Second).Unix()
+	CacheClaims("token", claims)
+	_, ok = CachedClaims("token")
+	assert.False(t, ok)
+
+	// past the ttl
+	claims.ExpiresAt = time.Now().Add(time.Hour).Unix()
+	cfg.Cfg.ValidateCache.TTL = 1
+	CacheClaims("token4", claims)
+	time.Sleep(5 * time.Millisecond)
+	_, ok = CachedClaims("token4")
+	assert.False(t, ok)
+}
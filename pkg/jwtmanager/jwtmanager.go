@@ -11,6 +11,9 @@ import (
 	"time"
 
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/domains"
+	"github.com/vouch/vouch-proxy/pkg/model"
+	"github.com/vouch/vouch-proxy/pkg/pii"
 	"github.com/vouch/vouch-proxy/pkg/structs"
 
 	jwt "github.com/dgrijalva/jwt-go"
@@ -26,6 +29,12 @@ type VouchClaims struct {
 	PAccessToken string
 	PIdToken     string
 	jwt.StandardClaims
+	// SessionVersion see cfg.Cfg.SingleSession
+	SessionVersion int `json:"sv,omitempty"`
+	// TeamsCheckedAt the unix time the team memberships were looked up, see cfg.Cfg.TeamRecheck
+	TeamsCheckedAt int64 `json:"tca,omitempty"`
+	// AuthTime the unix time the user authenticated at the provider, see cfg.Cfg.Headers.Sensitive
+	AuthTime int64 `json:"auth_time,omitempty"`
 }
 
 // StandardClaims jwt.StandardClaims implementation
@@ -46,17 +55,25 @@ func init() {
 }
 
 func populateSites() {
-	Sites = make([]string, 0)
 	// TODO: the Sites that end up in the JWT come from here
 	// if we add fine grain ability (ACL?) to the equation
 	// then we're going to have to add something fancier here
-	for i := 0; i < len(cfg.Cfg.Domains); i++ {
-		Sites = append(Sites, cfg.Cfg.Domains[i])
-	}
+	Sites = domains.Sites()
 }
 
-// CreateUserTokenString converts user to signed jwt
+// CreateUserTokenString converts user to signed jwt, "" when it could not be issued
 func CreateUserTokenString(u structs.User, customClaims structs.CustomClaims, ptokens structs.PTokens) string {
+	ss, err := CreateUserToken(u, customClaims, ptokens)
+	if err != nil {
+		log.Error(err)
+	}
+	return ss
+}
+
+// CreateUserToken converts user to signed jwt
+// with singleSession the login fails if the session version can't be bumped, a jwt with the version of an earlier
+// session would leave that session valid
+func CreateUserToken(u structs.User, customClaims structs.CustomClaims, ptokens structs.PTokens) (string, error) {
 	// User`token`
 	// u.PrepareUserData()
 	claims := VouchClaims{
@@ -66,28 +83,73 @@ func CreateUserTokenString(u structs.User, customClaims structs.CustomClaims, pt
 		ptokens.PAccessToken,
 		ptokens.PIdToken,
 		StandardClaims,
+		0,
+		0,
+		0,
+	}
+
+	if cfg.Cfg.SingleSession {
+		// a new login invalidates all prior sessions of the user
+		sv, err := model.IncrSessionVersion(u.Username)
+		if err != nil {
+			return "", fmt.Errorf("could not increment session version for %s: %s", pii.Mask(u.Username), err)
+		}
+		claims.SessionVersion = sv
+	} else if cfg.Cfg.BackChannelLogout {
+		// the version is bumped when the IdP logs the user out
+		sv, err := model.SessionVersion(u.Username)
+		if err != nil {
+			log.Errorf("could not lookup session version for %s: %s", pii.Mask(u.Username), err)
+		}
+		claims.SessionVersion = sv
 	}
 
+	if cfg.Cfg.TeamRecheck.Interval > 0 {
+		// the memberships were just looked up by the provider's handler
+		claims.TeamsCheckedAt = time.Now().Unix()
+	}
+
+	if cfg.Cfg.Headers.Sensitive.MaxAuthAge > 0 {
+		claims.AuthTime = authTime(ptokens.PIdToken)
+	}
+
+	claims.StandardClaims.Issuer = cfg.Cfg.JWT.Issuer
 	claims.StandardClaims.ExpiresAt = time.Now().Add(time.Minute * time.Duration(cfg.Cfg.JWT.MaxAge)).Unix()
 
 	// https://godoc.org/github.com/dgrijalva/jwt-go#NewWithClaims
-	token := jwt.NewWithClaims(jwt.GetSigningMethod("HS256"), claims)
-	log.Debugf("token: %v", token)
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(cfg.Cfg.JWT.SigningMethod), claims)
+	token.Header["kid"] = KeyID()
+	log.Debugf("token: %v", pii.Dump(token))
 
 	// log.Debugf("token: %v", token)
 	log.Debugf("token expires: %d", claims.StandardClaims.ExpiresAt)
 	log.Debugf("diff from now: %d", claims.StandardClaims.ExpiresAt-time.Now().Unix())
 
 	// token -> string. Only server knows this secret (foobar).
-	ss, err := token.SignedString([]byte(cfg.Cfg.JWT.Secret))
+	key, _ := currentKeys()
+	ss, err := token.SignedString(key)
 	// ss, err := token.SignedString([]byte("testing"))
 	if ss == "" || err != nil {
-		log.Errorf("signed token error: %s", err)
+		return "", fmt.Errorf("signed token error: %s", err)
 	}
 	if cfg.Cfg.JWT.Compress {
-		return compressAndEncodeTokenString(ss)
+		return compressAndEncodeTokenString(ss), nil
 	}
-	return ss
+	return ss, nil
+}
+
+// authTime the auth_time of the provider's id token, which is earlier than now when the IdP remembered the user
+// there's no signature to check, the id token was verified by the provider's handler
+func authTime(idToken string) int64 {
+	if idToken != "" {
+		claims := jwt.MapClaims{}
+		if _, _, err := new(jwt.Parser).ParseUnverified(idToken, claims); err == nil {
+			if at, ok := claims["auth_time"].(float64); ok && at > 0 {
+				return int64(at)
+			}
+		}
+	}
+	return time.Now().Unix()
 }
 
 // TokenIsValid gett better error reporting
@@ -109,10 +171,28 @@ func TokenIsValid(token *jwt.Token, err error) bool {
 	return false
 }
 
+// SessionIsCurrent is the session version of the claims the most recent one issued for the user?
+// always true unless cfg.Cfg.SingleSession or cfg.Cfg.BackChannelLogout is set
+func SessionIsCurrent(claims *VouchClaims) bool {
+	if !cfg.Cfg.SingleSession && !cfg.Cfg.BackChannelLogout {
+		return true
+	}
+	sv, err := model.SessionVersion(claims.Username)
+	if err != nil {
+		log.Errorf("could not lookup session version for %s: %s", pii.Mask(claims.Username), err)
+		return false
+	}
+	if sv != claims.SessionVersion {
+		log.Debugf("session version %d for %s has been superseded by %d", claims.SessionVersion, pii.Mask(claims.Username), sv)
+		return false
+	}
+	return true
+}
+
 // SiteInToken searches does the token contain the site?
 func SiteInToken(site string, token *jwt.Token) bool {
 	if claims, ok := token.Claims.(*VouchClaims); ok {
-		log.Debugf("site %s claim %v", site, claims)
+		log.Debugf("site %s claim %v", site, pii.Dump(claims))
 		if SiteInClaims(site, claims) {
 			return true
 		}
@@ -123,31 +203,53 @@ func SiteInToken(site string, token *jwt.Token) bool {
 
 // ParseTokenString converts signed token to jwt struct
 func ParseTokenString(tokenString string) (*jwt.Token, error) {
-	log.Debugf("tokenString %s", tokenString)
+	log.Debugf("tokenString %s", pii.Dump(tokenString))
 	if cfg.Cfg.JWT.Compress {
 		tokenString = decodeAndDecompressTokenString(tokenString)
-		log.Debugf("decompressed tokenString %s", tokenString)
+		log.Debugf("decompressed tokenString %s", pii.Dump(tokenString))
 	}
 
-	return jwt.ParseWithClaims(tokenString, &VouchClaims{}, func(token *jwt.Token) (interface{}, error) {
-		// return jwt.ParseWithClaims(tokenString, &VouchClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if token.Method != jwt.GetSigningMethod("HS256") {
+	// only ever accept the configured signing method, which protects against `alg: none` and alg confusion
+	parser := &jwt.Parser{ValidMethods: []string{cfg.Cfg.JWT.SigningMethod}}
+	return parser.ParseWithClaims(tokenString, &VouchClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if alg, _ := token.Header["alg"].(string); strings.EqualFold(alg, "none") {
+			return nil, errors.New("signing method 'none' is not accepted")
+		}
+		if token.Method != jwt.GetSigningMethod(cfg.Cfg.JWT.SigningMethod) {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 		}
+		// a token of another Vouch Proxy is rejected by its `iss` before its signature fails to verify against our key
+		if claims, ok := token.Claims.(*VouchClaims); ok && claims.Issuer != cfg.Cfg.JWT.Issuer {
+			return nil, fmt.Errorf("token issued by %q, expected jwt.issuer %q", claims.Issuer, cfg.Cfg.JWT.Issuer)
+		}
 
-		return []byte(cfg.Cfg.JWT.Secret), nil
+		return keyForToken(token)
 	})
 
 }
 
-// SiteInClaims does the claim contain the value?
-func SiteInClaims(site string, claims *VouchClaims) bool {
-	for _, s := range claims.Sites {
-		if strings.Contains(site, s) {
-			log.Debugf("site %s is found for claims.Site %s", site, s)
-			return true
+// UnverifiedIssuer the iss of the token, without checking its signature
+// only to tell apart a token issued by another Vouch Proxy, never to trust the token
+func UnverifiedIssuer(tokenString string) (string, error) {
+	if cfg.Cfg.JWT.Compress {
+		// the other Vouch Proxy may not compress its tokens
+		if ss := decodeAndDecompressTokenString(tokenString); ss != "" {
+			tokenString = ss
 		}
 	}
+	claims := &VouchClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(tokenString, claims); err != nil {
+		return "", err
+	}
+	return claims.Issuer, nil
+}
+
+// SiteInClaims is the host of site in one of the claims' Sites, as the domains of the cookie are matched
+func SiteInClaims(site string, claims *VouchClaims) bool {
+	if domains.InSites(site, claims.Sites) {
+		log.Debugf("site %s is found in claims.Sites %s", site, claims.Sites)
+		return true
+	}
 	return false
 }
 
@@ -160,10 +262,10 @@ func PTokenClaims(ptoken *jwt.Token) (VouchClaims, error) {
 	// return ptoken.Claims.(*VouchClaims), nil
 	ptokenClaims, ok := ptoken.Claims.(*VouchClaims)
 	if !ok {
-		log.Debugf("failed claims: %v %v", ptokenClaims, ptoken.Claims)
+		log.Debugf("failed claims: %v %v", pii.Dump(ptokenClaims), pii.Dump(ptoken.Claims))
 		return *ptokenClaims, errors.New("cannot parse claims")
 	}
-	log.Debugf("*ptokenCLaims: %v", *ptokenClaims)
+	log.Debugf("*ptokenCLaims: %v", pii.Dump(*ptokenClaims))
 	return *ptokenClaims, nil
 }
 
@@ -214,6 +316,6 @@ func compressAndEncodeTokenString(ss string) string {
 
 	ret := base64.URLEncoding.EncodeToString(buf.Bytes())
 	// ret := url.QueryEscape(buf.String())
-	log.Debugf("compressed string: %s", ret)
+	log.Debugf("compressed string: %s", pii.Dump(ret))
 	return ret
 }
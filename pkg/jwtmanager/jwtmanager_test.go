@@ -1,13 +1,25 @@
 package jwtmanager
 
 import (
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
 	"testing"
 
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/model"
 	"github.com/vouch/vouch-proxy/pkg/structs"
 
+	"github.com/boltdb/bolt"
+	jwt "github.com/dgrijalva/jwt-go"
 	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 var (
@@ -36,6 +48,8 @@ func init() {
 	// log.SetLevel(log.DebugLevel)
 
 	cfg.InitForTestPurposes()
+	// package init ran before the test config was loaded
+	StandardClaims.Issuer = cfg.Cfg.JWT.Issuer
 
 	lc = VouchClaims{
 		u1.Username,
@@ -44,6 +58,9 @@ func init() {
 		t1.PAccessToken,
 		t1.PIdToken,
 		StandardClaims,
+		0,
+		0,
+		0,
 	}
 	json.Unmarshal([]byte(claimjson), &customClaims.Claims)
 }
@@ -64,6 +81,58 @@ func TestCreateUserTokenStringAndParseToUsername(t *testing.T) {
 
 }
 
+func TestCreateUserTokenSingleSession(t *testing.T) {
+	testdb := "/tmp/jwtmanager-test.db"
+	os.Remove(testdb)
+	defer os.Remove(testdb)
+	db, err := model.OpenDB(testdb)
+	assert.Nil(t, err)
+	defer func(d *bolt.DB) { model.Db, cfg.Cfg.SingleSession = d, false }(model.Db)
+	model.Db = db
+	cfg.Cfg.SingleSession = true
+
+	var sessions []VouchClaims
+	for sv := 1; sv <= 2; sv++ {
+		uts, err := CreateUserToken(u1, customClaims, t1)
+		assert.Nil(t, err)
+		ptoken, err := ParseTokenString(uts)
+		assert.Nil(t, err)
+		claims, err := PTokenClaims(ptoken)
+		assert.Nil(t, err)
+		assert.Equal(t, sv, claims.SessionVersion)
+		sessions = append(sessions, claims)
+	}
+	// the second login invalidates the first
+	assert.False(t, SessionIsCurrent(&sessions[0]))
+	assert.True(t, SessionIsCurrent(&sessions[1]))
+
+	// the session version can't be bumped, no jwt is issued which would leave the earlier session valid
+	assert.Nil(t, db.Close())
+	uts, err := CreateUserToken(u1, customClaims, t1)
+	assert.NotNil(t, err)
+	assert.Empty(t, uts)
+}
+
+func TestMaskPIIToken(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	defer func(l *zap.SugaredLogger, m bool, c bool) {
+		log, cfg.Cfg.MaskPII, cfg.Cfg.JWT.Compress = l, m, c
+	}(log, cfg.Cfg.MaskPII, cfg.Cfg.JWT.Compress)
+	log = zap.New(core).Sugar()
+	cfg.Cfg.MaskPII = true
+	cfg.Cfg.JWT.Compress = true
+
+	uts := CreateUserTokenString(u1, customClaims, t1)
+	_, err := ParseTokenString(uts)
+	assert.Nil(t, err)
+	assert.NotZero(t, logs.Len())
+	for _, e := range logs.All() {
+		assert.NotContains(t, e.Message, u1.Username)
+		assert.NotContains(t, e.Message, uts)
+		assert.NotContains(t, e.Message, strings.Split(t1.PIdToken, ".")[1])
+	}
+}
+
 func TestClaims(t *testing.T) {
 	populateSites()
 	log.Debugf("jwt config %s %d", string(cfg.Cfg.JWT.Secret), cfg.Cfg.JWT.MaxAge)
@@ -82,3 +151,152 @@ func TestClaims(t *testing.T) {
 	assert.True(t, SiteInToken(cfg.Cfg.Domains[0], utsParsed))
 
 }
+
+func TestParseTokenStringRejectsNoneAlg(t *testing.T) {
+	token := jwt.NewWithClaims(jwt.SigningMethodNone, lc)
+	ss, err := token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+	assert.Nil(t, err)
+	if cfg.Cfg.JWT.Compress {
+		ss = compressAndEncodeTokenString(ss)
+	}
+
+	_, err = ParseTokenString(ss)
+	assert.NotNil(t, err)
+}
+
+func TestParseTokenStringRejectsUnexpectedAlg(t *testing.T) {
+	// an RS256 token whose signature is otherwise valid
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.Nil(t, err)
+	ss, err := jwt.NewWithClaims(jwt.SigningMethodRS256, lc).SignedString(key)
+	assert.Nil(t, err)
+	if cfg.Cfg.JWT.Compress {
+		ss = compressAndEncodeTokenString(ss)
+	}
+	_, err = ParseTokenString(ss)
+	assert.NotNil(t, err)
+
+	// a token signed with the right secret but a different HMAC than configured
+	ss, err = jwt.NewWithClaims(jwt.SigningMethodHS512, lc).SignedString([]byte(cfg.Cfg.JWT.Secret))
+	assert.Nil(t, err)
+	if cfg.Cfg.JWT.Compress {
+		ss = compressAndEncodeTokenString(ss)
+	}
+	_, err = ParseTokenString(ss)
+	assert.NotNil(t, err)
+}
+
+func TestParseTokenStringIssuer(t *testing.T) {
+	uts := CreateUserTokenString(u1, customClaims, t1)
+	parsed, err := ParseTokenString(uts)
+	assert.Nil(t, err)
+	assert.Equal(t, cfg.Cfg.JWT.Issuer, parsed.Claims.(*VouchClaims).Issuer)
+
+	// minted by a Vouch Proxy with a different jwt.issuer
+	issuer := cfg.Cfg.JWT.Issuer
+	cfg.Cfg.JWT.Issuer = "another-vouch"
+	foreign := CreateUserTokenString(u1, customClaims, t1)
+	cfg.Cfg.JWT.Issuer = issuer
+
+	_, err = ParseTokenString(foreign)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "another-vouch")
+}
+
+func TestKeyID(t *testing.T) {
+	uts := CreateUserTokenString(u1, customClaims, t1)
+	utsParsed, err := ParseTokenString(uts)
+	assert.Nil(t, err)
+	assert.Equal(t, KeyID(), utsParsed.Header["kid"])
+
+	// a token without a kid is verified with the current key
+	ss, err := jwt.NewWithClaims(jwt.GetSigningMethod(cfg.Cfg.JWT.SigningMethod), lc).SignedString([]byte(cfg.Cfg.JWT.Secret))
+	assert.Nil(t, err)
+	if cfg.Cfg.JWT.Compress {
+		ss = compressAndEncodeTokenString(ss)
+	}
+	_, err = ParseTokenString(ss)
+	assert.Nil(t, err)
+
+	// an unknown kid is rejected
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(cfg.Cfg.JWT.SigningMethod), lc)
+	token.Header["kid"] = "unknown"
+	ss, err = token.SignedString([]byte(cfg.Cfg.JWT.Secret))
+	assert.Nil(t, err)
+	if cfg.Cfg.JWT.Compress {
+		ss = compressAndEncodeTokenString(ss)
+	}
+	_, err = ParseTokenString(ss)
+	assert.NotNil(t, err)
+
+	cfg.Cfg.JWT.KeyID = "configured"
+	defer func() { cfg.Cfg.JWT.KeyID = "" }()
+	assert.Equal(t, "configured", KeyID())
+}
+
+func TestVaultKeySource(t *testing.T) {
+	body := ""
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		assert.Equal(t, "/v1/secret/data/vouch", r.URL.Path)
+		w.Write([]byte(body))
+	}))
+	defer ts.Close()
+	src := &VaultKeySource{Address: ts.URL + "/", Path: "/secret/data/vouch", Token: "s.token", Field: "key", Client: http.DefaultClient}
+
+	// kv version 2
+	body = `{"data": {"data": {"key": "v2secret"}, "metadata": {"version": 3}}}`
+	key, err := src.Key()
+	assert.Nil(t, err)
+	assert.Equal(t, "v2secret", key)
+
+	// kv version 1
+	body = `{"data": {"key": "v1secret"}}`
+	key, err = src.Key()
+	assert.Nil(t, err)
+	assert.Equal(t, "v1secret", key)
+
+	src.Field = "missing"
+	_, err = src.Key()
+	assert.NotNil(t, err)
+
+	src.Token = "wrong"
+	_, err = src.Key()
+	assert.NotNil(t, err)
+}
+
+type staticKeySource string
+
+func (s staticKeySource) Key() (string, error) {
+	return string(s), nil
+}
+
+func TestLoadKeyRotation(t *testing.T) {
+	defer func() {
+		signingKey, previousKey = nil, nil
+	}()
+
+	assert.Nil(t, LoadKey(staticKeySource("first-key-first-key-first-key-first-key-1234")))
+	before := CreateUserTokenString(u1, customClaims, t1)
+
+	assert.Nil(t, LoadKey(staticKeySource("second-key-second-key-second-key-second-key-")))
+	after := CreateUserTokenString(u1, customClaims, t1)
+
+	// jwts signed before and after the rotation are both accepted
+	_, err := ParseTokenString(before)
+	assert.Nil(t, err)
+	_, err = ParseTokenString(after)
+	assert.Nil(t, err)
+
+	// two rotations later the first key is forgotten
+	assert.Nil(t, LoadKey(staticKeySource("third-key-third-key-third-key-third-key-1234")))
+	_, err = ParseTokenString(before)
+	assert.NotNil(t, err)
+	_, err = ParseTokenString(after)
+	assert.Nil(t, err)
+
+	assert.NotNil(t, LoadKey(staticKeySource("")))
+}
@@ -0,0 +1,53 @@
+package jwtmanager
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// KeyID the `kid` placed in the header of each jwt Vouch Proxy signs
+// `vouch.jwt.kid` if set, otherwise derived from the signing key so that it changes when the key does
+func KeyID() string {
+	key, _ := currentKeys()
+	return kidFor(key)
+}
+
+func kidFor(key []byte) string {
+	if cfg.Cfg.JWT.KeyID != "" {
+		return cfg.Cfg.JWT.KeyID
+	}
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// verificationKeys the known keys by kid which a jwt may have been signed with
+// the key replaced by the last rotation is only kept when the kid is derived from the key, a fixed `vouch.jwt.kid` can't tell them apart
+func verificationKeys() map[string][]byte {
+	current, previous := currentKeys()
+	keys := map[string][]byte{}
+	if previous != nil {
+		keys[kidFor(previous)] = previous
+	}
+	keys[kidFor(current)] = current
+	return keys
+}
+
+// keyForToken select the key named by the token's `kid`
+// tokens minted before the `kid` was added are verified with the current key
+func keyForToken(token *jwt.Token) ([]byte, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok || kid == "" {
+		current, _ := currentKeys()
+		return current, nil
+	}
+	key, ok := verificationKeys()[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %s", kid)
+	}
+	return key, nil
+}
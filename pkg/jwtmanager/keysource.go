@@ -0,0 +1,154 @@
+package jwtmanager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// KeySource provides the key the jwt is signed with, see `vouch.jwt.key_source`
+type KeySource interface {
+	Key() (string, error)
+}
+
+// fileKeySource `vouch.jwt.secret`, or the key cfg read from (or generated into) config/secret
+type fileKeySource struct{}
+
+func (fileKeySource) Key() (string, error) {
+	return cfg.Cfg.JWT.Secret, nil
+}
+
+// VaultKeySource reads the key from a HashiCorp Vault KV secret, either version 1 or 2 of the secrets engine
+type VaultKeySource struct {
+	Address string
+	Path    string
+	Token   string
+	Field   string
+	Client  *http.Client
+}
+
+// vaultSecret the response of a KV read, v2 nests the fields one level deeper in data.data
+type vaultSecret struct {
+	Data map[string]interface{} `json:"data"`
+}
+
+// Key GET <address>/v1/<path>
+func (v *VaultKeySource) Key() (key string, rerr error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(v.Address, "/")+"/v1/"+strings.TrimLeft(v.Path, "/"), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	resp, err := v.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			rerr = err
+		}
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault returned %s for %s", resp.Status, v.Path)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	secret := vaultSecret{}
+	if err := json.Unmarshal(body, &secret); err != nil {
+		return "", err
+	}
+	fields := secret.Data
+	if nested, ok := fields["data"].(map[string]interface{}); ok {
+		fields = nested
+	}
+	key, _ = fields[v.Field].(string)
+	if key == "" {
+		return "", fmt.Errorf("vault secret %s has no field %s", v.Path, v.Field)
+	}
+	return key, nil
+}
+
+func newKeySource() KeySource {
+	if cfg.Cfg.JWT.KeySource == "vault" {
+		return &VaultKeySource{
+			Address: cfg.Cfg.JWT.Vault.Address,
+			Path:    cfg.Cfg.JWT.Vault.Path,
+			Token:   cfg.Cfg.JWT.Vault.Token,
+			Field:   cfg.Cfg.JWT.Vault.Field,
+			Client:  &http.Client{Timeout: 10 * time.Second},
+		}
+	}
+	return fileKeySource{}
+}
+
+// minKeyLength the length of the secret cfg generates
+const minKeyLength = 44
+
+var (
+	keyMu sync.RWMutex
+	// signingKey the current key, previousKey the one it replaced which still verifies jwts issued before the rotation
+	signingKey  []byte
+	previousKey []byte
+)
+
+// LoadKey fetches the key from the source, keeping the current key as the previous one if it changed
+func LoadKey(src KeySource) error {
+	key, err := src.Key()
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return errors.New("the jwt signing key is empty")
+	}
+	if len(key) < minKeyLength {
+		log.Warnf("the jwt signing key is only %d characters long, use at least %d", len(key), minKeyLength)
+	}
+	keyMu.Lock()
+	defer keyMu.Unlock()
+	if signingKey != nil && string(signingKey) != key {
+		log.Infof("the jwt signing key was rotated, jwts signed with the previous key %s are still accepted", kidFor(signingKey))
+		previousKey = signingKey
+	}
+	signingKey = []byte(key)
+	return nil
+}
+
+// refreshKey fetches the key from src every interval, a failed fetch keeps the current key
+func refreshKey(src KeySource, interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := LoadKey(src); err != nil {
+			log.Errorf("could not refresh the jwt signing key, keeping the current key: %s", err)
+		}
+	}
+}
+
+// Configure loads the signing key from `vouch.jwt.key_source` and keeps refreshing it from vault
+func Configure() error {
+	src := newKeySource()
+	if err := LoadKey(src); err != nil {
+		return fmt.Errorf("could not load the jwt signing key from %s: %s", cfg.Cfg.JWT.KeySource, err)
+	}
+	if cfg.Cfg.JWT.KeySource == "vault" && cfg.Cfg.JWT.Vault.Refresh > 0 {
+		go refreshKey(src, time.Duration(cfg.Cfg.JWT.Vault.Refresh)*time.Second)
+	}
+	return nil
+}
+
+// currentKeys until Configure has loaded a key `vouch.jwt.secret` is used
+func currentKeys() (current []byte, previous []byte) {
+	keyMu.RLock()
+	defer keyMu.RUnlock()
+	if signingKey == nil {
+		return []byte(cfg.Cfg.JWT.Secret), nil
+	}
+	return signingKey, previousKey
+}
@@ -0,0 +1,84 @@
+package jwtmanager
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	securerandom "github.com/theckman/go-securerandom"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// StepUpClaims a short lived proof that the user just logged in again at the provider, see cfg.Cfg.StepUp
+// it is signed with a key derived from the jwt key, so that it can't pass for a session and a session can't pass for it
+type StepUpClaims struct {
+	Username string `json:"username"`
+	// AuthTime the unix time the user authenticated at the provider
+	AuthTime int64 `json:"auth_time"`
+	jwt.StandardClaims
+}
+
+func stepUpKey(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("step-up"))
+	return mac.Sum(nil)
+}
+
+// CreateStepUpTokenString the step up token of the user for the host it is sent to, valid for `vouch.stepUp.maxAge` seconds
+// its `jti` lets /stepup/verify accept it only once
+func CreateStepUpTokenString(username string, idToken string, host string) (string, error) {
+	jti, err := securerandom.URLBase64InBytes(32)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := StepUpClaims{
+		Username: username,
+		AuthTime: authTime(idToken),
+		StandardClaims: jwt.StandardClaims{
+			Id:        jti,
+			Audience:  strings.ToLower(host),
+			Issuer:    cfg.Cfg.JWT.Issuer,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(time.Duration(cfg.Cfg.StepUp.MaxAge) * time.Second).Unix(),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(cfg.Cfg.JWT.SigningMethod), claims)
+	token.Header["kid"] = KeyID()
+	key, _ := currentKeys()
+	return token.SignedString(stepUpKey(key))
+}
+
+// ParseStepUpToken verify the step up token, its signature, issuer, expiry and that it was issued for the host
+func ParseStepUpToken(tokenString string, host string) (*StepUpClaims, error) {
+	claims := &StepUpClaims{}
+	parser := &jwt.Parser{ValidMethods: []string{cfg.Cfg.JWT.SigningMethod}}
+	_, err := parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		key, err := keyForToken(token)
+		if err != nil {
+			return nil, err
+		}
+		return stepUpKey(key), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if claims.Issuer != cfg.Cfg.JWT.Issuer {
+		return nil, fmt.Errorf("step up token issued by %q, expected jwt.issuer %q", claims.Issuer, cfg.Cfg.JWT.Issuer)
+	}
+	if claims.Username == "" {
+		return nil, errors.New("step up token has no username")
+	}
+	if claims.Audience == "" || !strings.EqualFold(claims.Audience, host) {
+		return nil, fmt.Errorf("step up token issued for %q, not %q", claims.Audience, host)
+	}
+	if claims.Id == "" {
+		return nil, errors.New("step up token has no jti")
+	}
+	return claims, nil
+}
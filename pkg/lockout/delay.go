@@ -0,0 +1,66 @@
+package lockout
+
+import (
+	"crypto/rand"
+	"math/big"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// Delayer sleeps for a random duration before a failure response is written.
+// At most maxConcurrent callers sleep at once, any others return immediately so that
+// a flood of failing requests can't tie up an unbounded number of goroutines.
+type Delayer struct {
+	maxJitter time.Duration
+	slots     chan struct{}
+	sleep     func(time.Duration)
+}
+
+// DefaultDelayer is configured from `vouch.failureDelay`, nil when disabled
+var DefaultDelayer *Delayer
+
+func configureDelayer() {
+	DefaultDelayer = nil
+	if cfg.Cfg.FailureDelay.MaxJitter > 0 && cfg.Cfg.FailureDelay.MaxConcurrent > 0 {
+		DefaultDelayer = NewDelayer(time.Duration(cfg.Cfg.FailureDelay.MaxJitter)*time.Millisecond, cfg.Cfg.FailureDelay.MaxConcurrent)
+	}
+}
+
+// NewDelayer which sleeps for up to maxJitter, for at most maxConcurrent callers at once
+func NewDelayer(maxJitter time.Duration, maxConcurrent int) *Delayer {
+	return &Delayer{
+		maxJitter: maxJitter,
+		slots:     make(chan struct{}, maxConcurrent),
+		sleep:     time.Sleep,
+	}
+}
+
+// Delay sleeps for a random duration up to maxJitter, returns false without sleeping if all slots are taken
+func (d *Delayer) Delay() bool {
+	if d == nil {
+		return false
+	}
+	select {
+	case d.slots <- struct{}{}:
+	default:
+		log.Debugf("%d failure responses are already delayed, responding immediately", cap(d.slots))
+		return false
+	}
+	defer func() { <-d.slots }()
+	d.sleep(d.jitter())
+	return true
+}
+
+func (d *Delayer) jitter() time.Duration {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(d.maxJitter)+1))
+	if err != nil {
+		return d.maxJitter
+	}
+	return time.Duration(n.Int64())
+}
+
+// Delay see Delayer.Delay for the DefaultDelayer
+func Delay() bool {
+	return DefaultDelayer.Delay()
+}
@@ -0,0 +1,134 @@
+package lockout
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// Limiter counts failures per key (the client ip) and locks the key out once too many occur within the window.
+// The number of tracked keys is bounded, the least recently seen key is evicted first.
+type Limiter struct {
+	failures   int
+	window     time.Duration
+	cooldown   time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	ll      *list.List
+	entries map[string]*list.Element
+	now     func() time.Time
+}
+
+type entry struct {
+	key         string
+	failures    int
+	first       time.Time
+	lockedUntil time.Time
+}
+
+var (
+	// Default is configured from `vouch.lockout`, nil when disabled
+	Default *Limiter
+	log     = cfg.Cfg.Logger
+)
+
+// Configure set up Default and DefaultDelayer from the config
+func Configure() {
+	configureDelayer()
+	Default = nil
+	if cfg.Cfg.Lockout.Failures > 0 {
+		Default = New(cfg.Cfg.Lockout.Failures,
+			time.Duration(cfg.Cfg.Lockout.Window)*time.Second,
+			time.Duration(cfg.Cfg.Lockout.Cooldown)*time.Second,
+			cfg.Cfg.Lockout.MaxEntries)
+	}
+}
+
+func init() {
+	Configure()
+}
+
+// New Limiter which locks out a key for cooldown after failures within window, tracking at most maxEntries keys
+func New(failures int, window, cooldown time.Duration, maxEntries int) *Limiter {
+	return &Limiter{
+		failures:   failures,
+		window:     window,
+		cooldown:   cooldown,
+		maxEntries: maxEntries,
+		ll:         list.New(),
+		entries:    make(map[string]*list.Element),
+		now:        time.Now,
+	}
+}
+
+// Locked is the key currently locked out?
+func (l *Limiter) Locked(key string) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	el, ok := l.entries[key]
+	if !ok {
+		return false
+	}
+	return l.now().Before(el.Value.(*entry).lockedUntil)
+}
+
+// Fail records a failure for the key, returns true if the key is now locked out
+func (l *Limiter) Fail(key string) bool {
+	if l == nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+
+	var e *entry
+	if el, ok := l.entries[key]; ok {
+		l.ll.MoveToFront(el)
+		e = el.Value.(*entry)
+	} else {
+		e = &entry{key: key}
+		l.entries[key] = l.ll.PushFront(e)
+		l.evict()
+	}
+
+	if now.Before(e.lockedUntil) {
+		return true
+	}
+	if e.failures == 0 || now.Sub(e.first) > l.window {
+		// start a new window
+		e.failures = 0
+		e.first = now
+	}
+	e.failures++
+	if e.failures >= l.failures {
+		log.Warnf("%d failed validations from %s within %s, locking out for %s", e.failures, key, l.window, l.cooldown)
+		e.lockedUntil = now.Add(l.cooldown)
+		e.failures = 0
+		return true
+	}
+	return false
+}
+
+func (l *Limiter) evict() {
+	for l.maxEntries > 0 && l.ll.Len() > l.maxEntries {
+		el := l.ll.Back()
+		l.ll.Remove(el)
+		delete(l.entries, el.Value.(*entry).key)
+	}
+}
+
+// Locked see Limiter.Locked for the Default Limiter
+func Locked(key string) bool {
+	return Default.Locked(key)
+}
+
+// Fail see Limiter.Fail for the Default Limiter
+func Fail(key string) bool {
+	return Default.Fail(key)
+}
@@ -0,0 +1,96 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+func TestLockoutAfterFailures(t *testing.T) {
+	l := New(3, time.Minute, time.Minute, 10)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	assert.False(t, l.Fail("1.2.3.4"))
+	assert.False(t, l.Fail("1.2.3.4"))
+	assert.False(t, l.Locked("1.2.3.4"))
+	assert.True(t, l.Fail("1.2.3.4"))
+	assert.True(t, l.Locked("1.2.3.4"))
+	assert.False(t, l.Locked("5.6.7.8"))
+
+	// cooldown over
+	now = now.Add(2 * time.Minute)
+	assert.False(t, l.Locked("1.2.3.4"))
+}
+
+func TestLockoutWindowExpires(t *testing.T) {
+	l := New(2, time.Minute, time.Minute, 10)
+	now := time.Now()
+	l.now = func() time.Time { return now }
+
+	assert.False(t, l.Fail("1.2.3.4"))
+	now = now.Add(2 * time.Minute)
+	assert.False(t, l.Fail("1.2.3.4"))
+	assert.False(t, l.Locked("1.2.3.4"))
+}
+
+func TestLockoutBounded(t *testing.T) {
+	l := New(1, time.Minute, time.Minute, 2)
+	l.Fail("a")
+	l.Fail("b")
+	l.Fail("c")
+	assert.Len(t, l.entries, 2)
+	assert.False(t, l.Locked("a"))
+	assert.True(t, l.Locked("c"))
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	assert.False(t, l.Fail("a"))
+	assert.False(t, l.Locked("a"))
+}
+
+func TestDelayer(t *testing.T) {
+	d := NewDelayer(100*time.Millisecond, 1)
+	var slept []time.Duration
+	d.sleep = func(j time.Duration) { slept = append(slept, j) }
+
+	assert.True(t, d.Delay())
+	assert.True(t, d.Delay())
+	assert.Len(t, slept, 2)
+	for _, j := range slept {
+		assert.True(t, j >= 0 && j <= 100*time.Millisecond, "jitter %s out of range", j)
+	}
+}
+
+func TestDelayerConcurrencyCap(t *testing.T) {
+	d := NewDelayer(time.Second, 1)
+	release := make(chan struct{})
+	sleeping := make(chan struct{})
+	d.sleep = func(time.Duration) {
+		close(sleeping)
+		<-release
+	}
+
+	done := make(chan bool)
+	go func() { done <- d.Delay() }()
+	<-sleeping
+
+	// the only slot is taken, respond without delay
+	assert.False(t, d.Delay())
+
+	close(release)
+	assert.True(t, <-done)
+}
+
+func TestDelayDisabled(t *testing.T) {
+	assert.Nil(t, DefaultDelayer)
+	assert.False(t, Delay())
+}
@@ -0,0 +1,211 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// the results of a login, the label `result` of vouch_logins_total
+const (
+	ResultSuccess = "success"
+	ResultDenied  = "denied"
+	ResultError   = "error"
+)
+
+// buckets of vouch_provider_request_duration_seconds in seconds, the defaults of the Prometheus client libraries
+var buckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	logins = &counter{
+		name:   "vouch_logins_total",
+		help:   "Logins at /auth by provider, result and the reason a login was denied or failed.",
+		labels: []string{"provider", "result", "reason"},
+		values: map[string]float64{},
+	}
+	providerLatency = &histogram{
+		name:   "vouch_provider_request_duration_seconds",
+		help:   "Time taken by the calls to the provider during a login, by provider and call.",
+		labels: []string{"provider", "call"},
+		series: map[string]*series{},
+	}
+)
+
+// Login count a login at /auth, reason is empty for a success
+func Login(result string, reason string) {
+	logins.inc(cfg.GenOAuth.Provider, result, reason)
+}
+
+// Logins how many logins have been counted with the result and reason
+func Logins(result string, reason string) float64 {
+	return logins.value(cfg.GenOAuth.Provider, result, reason)
+}
+
+// ObserveProviderCall record the time since start taken by the call to the provider
+//
+//	defer metrics.ObserveProviderCall("team_membership", time.Now())
+func ObserveProviderCall(call string, start time.Time) {
+	providerLatency.observe(time.Since(start).Seconds(), cfg.GenOAuth.Provider, call)
+}
+
+// funcs the metrics of the other packages, whose values are read as they're scraped
+var (
+	funcsMu sync.Mutex
+	funcs   []funcMetric
+)
+
+// funcMetric a gauge or counter without labels, for a value kept by another package
+type funcMetric struct {
+	name string
+	help string
+	kind string
+	f    func() float64
+}
+
+// GaugeFunc serve the value of f as the gauge name, such as the requests in flight
+func GaugeFunc(name string, help string, f func() float64) {
+	register(funcMetric{name: name, help: help, kind: "gauge", f: f})
+}
+
+// CounterFunc serve the value of f as the counter name, f must never go down
+func CounterFunc(name string, help string, f func() float64) {
+	register(funcMetric{name: name, help: help, kind: "counter", f: f})
+}
+
+func register(m funcMetric) {
+	funcsMu.Lock()
+	defer funcsMu.Unlock()
+	funcs = append(funcs, m)
+}
+
+// Handler /metrics in the Prometheus text exposition format
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+func Handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	logins.write(w)
+	providerLatency.write(w)
+	funcsMu.Lock()
+	defer funcsMu.Unlock()
+	for _, m := range funcs {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", m.name, m.help, m.name, m.kind, m.name, formatFloat(m.f()))
+	}
+}
+
+// counter of each combination of the label values, keyed by labelKey
+type counter struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+func (c *counter) inc(labelValues ...string) {
+	key := labelKey(c.labels, labelValues)
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counter) value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelKey(c.labels, labelValues)]
+}
+
+func (c *counter) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s{%s} %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	series map[string]*series
+}
+
+// series the observations of one combination of the label values, counts[i] those up to buckets[i]
+type series struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64, labelValues ...string) {
+	key := labelKey(h.labels, labelValues)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[key]
+	if !ok {
+		s = &series{counts: make([]uint64, len(buckets))}
+		h.series[key] = s
+	}
+	for i, le := range buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		for i, le := range buckets {
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", h.name, key, formatFloat(le), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, key, s.count)
+		fmt.Fprintf(w, "%s_sum{%s} %s\n", h.name, key, formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count{%s} %d\n", h.name, key, s.count)
+	}
+}
+
+// labelKey the labels as they are written, `provider="github",result="denied"`
+func labelKey(labels []string, values []string) string {
+	pairs := make([]string, len(labels))
+	for i, l := range labels {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		pairs[i] = l + `="` + escaper.Replace(v) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+var escaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func init() {
+	cfg.InitForTestPurposesWithProvider("github")
+}
+
+func TestLogins(t *testing.T) {
+	before := Logins(ResultDenied, "no-team")
+	Login(ResultDenied, "no-team")
+	Login(ResultDenied, "no-team")
+	Login(ResultSuccess, "")
+	assert.Equal(t, before+2, Logins(ResultDenied, "no-team"))
+	assert.Equal(t, float64(0), Logins(ResultDenied, "wrong-domain"))
+}
+
+func TestHandler(t *testing.T) {
+	Login(ResultDenied, `a "quoted" reason`)
+	providerLatency.observe(0.03, "github", "team_membership")
+	ObserveProviderCall("emails", time.Now())
+
+	w := httptest.NewRecorder()
+	Handler(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain; version=0.0.4")
+	assert.Contains(t, body, "# TYPE vouch_logins_total counter\n")
+	assert.Contains(t, body, `vouch_logins_total{provider="github",result="denied",reason="a \"quoted\" reason"} 1`+"\n")
+	assert.Contains(t, body, "# TYPE vouch_provider_request_duration_seconds histogram\n")
+	assert.Contains(t, body, `vouch_provider_request_duration_seconds_bucket{provider="github",call="team_membership",le="0.025"} 0`+"\n")
+	assert.Contains(t, body, `vouch_provider_request_duration_seconds_bucket{provider="github",call="team_membership",le="0.05"} 1`+"\n")
+	assert.Contains(t, body, `vouch_provider_request_duration_seconds_bucket{provider="github",call="team_membership",le="+Inf"} 1`+"\n")
+	assert.Contains(t, body, `vouch_provider_request_duration_seconds_sum{provider="github",call="team_membership"} 0.03`+"\n")
+	assert.Contains(t, body, `vouch_provider_request_duration_seconds_count{provider="github",call="emails"} 1`+"\n")
+}
+
+func TestFuncMetrics(t *testing.T) {
+	inFlight := 3.0
+	GaugeFunc("vouch_test_in_flight", "Requests in flight.", func() float64 { return inFlight })
+	CounterFunc("vouch_test_hits_total", "Hits.", func() float64 { return 7 })
+
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		Handler(w, httptest.NewRequest("GET", "/metrics", nil))
+		return w.Body.String()
+	}
+	body := scrape()
+	assert.Contains(t, body, "# HELP vouch_test_in_flight Requests in flight.\n# TYPE vouch_test_in_flight gauge\nvouch_test_in_flight 3\n")
+	assert.Contains(t, body, "# TYPE vouch_test_hits_total counter\nvouch_test_hits_total 7\n")
+	// read as it's scraped
+	inFlight = 0
+	assert.Contains(t, scrape(), "vouch_test_in_flight 0\n")
+}
@@ -30,7 +30,13 @@ var (
 	userBucket = []byte("users")
 	teamBucket = []byte("teams")
 	siteBucket = []byte("sites")
-	dbpath     = filepath.Join(cfg.RootDir, cfg.Cfg.DB.File)
+	// sessionBucket holds the session version per user, see cfg.Cfg.SingleSession
+	sessionBucket = []byte("sessions")
+	// subjectBucket maps the IdP's `sub` and `sid` to the username, see cfg.Cfg.BackChannelLogout
+	subjectBucket = []byte("subjects")
+	// stepUpBucket the jtis of the step up tokens already verified, see cfg.Cfg.StepUp
+	stepUpBucket = []byte("stepups")
+	dbpath       = filepath.Join(cfg.RootDir, cfg.Cfg.DB.File)
 
 	log = cfg.Cfg.Logger
 )
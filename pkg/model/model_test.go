@@ -6,6 +6,7 @@ package model
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
@@ -121,3 +122,43 @@ func TestPutTeamGetTeamDeleteTeam(t *testing.T) {
 	assert.NoError(t, err)
 
 }
+
+func TestIncrSessionVersion(t *testing.T) {
+	os.Remove(testdb)
+	Db, _ = OpenDB(testdb)
+
+	sv, err := SessionVersion("test@testing.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, sv)
+
+	IncrSessionVersion("test@testing.com")
+	sv, err = IncrSessionVersion("test@testing.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, sv)
+
+	sv, err = SessionVersion("test@testing.com")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, sv)
+}
+
+func TestUseStepUpToken(t *testing.T) {
+	os.Remove(testdb)
+	Db, _ = OpenDB(testdb)
+
+	exp := time.Now().Add(time.Minute).Unix()
+	fresh, err := UseStepUpToken("jti1", exp)
+	assert.Nil(t, err)
+	assert.True(t, fresh)
+	fresh, err = UseStepUpToken("jti1", exp)
+	assert.Nil(t, err)
+	assert.False(t, fresh)
+
+	// the jti of an expired token is dropped
+	_, err = UseStepUpToken("jti2", time.Now().Add(-time.Minute).Unix())
+	assert.Nil(t, err)
+	_, err = UseStepUpToken("jti3", exp)
+	assert.Nil(t, err)
+	fresh, err = UseStepUpToken("jti2", exp)
+	assert.Nil(t, err)
+	assert.True(t, fresh)
+}
@@ -0,0 +1,66 @@
+package model
+
+import (
+	"strconv"
+
+	"github.com/boltdb/bolt"
+
+	"github.com/vouch/vouch-proxy/pkg/pii"
+)
+
+// IncrSessionVersion bumps the session version for the user, invalidating any jwt issued with a prior version
+func IncrSessionVersion(username string) (int, error) {
+	var version int
+	err := Db.Update(func(tx *bolt.Tx) error {
+		b := getBucket(tx, sessionBucket)
+		if val := b.Get([]byte(username)); val != nil {
+			v, err := strconv.Atoi(string(val))
+			if err != nil {
+				return err
+			}
+			version = v
+		}
+		version++
+		log.Debugf("session version for %s set to %d", pii.Mask(username), version)
+		return b.Put([]byte(username), []byte(strconv.Itoa(version)))
+	})
+	return version, err
+}
+
+// SessionVersion lookup the current session version for the user
+func SessionVersion(username string) (int, error) {
+	var version int
+	err := Db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(sessionBucket); b != nil {
+			if val := b.Get([]byte(username)); val != nil {
+				v, err := strconv.Atoi(string(val))
+				if err != nil {
+					return err
+				}
+				version = v
+			}
+		}
+		return nil
+	})
+	return version, err
+}
+
+// PutSubject remember the user an IdP subject (`sub:<sub>` or `sid:<sid>`) belongs to
+func PutSubject(subject string, username string) error {
+	return Db.Update(func(tx *bolt.Tx) error {
+		b := getBucket(tx, subjectBucket)
+		return b.Put([]byte(subject), []byte(username))
+	})
+}
+
+// Subject lookup the username of an IdP subject, "" if unknown
+func Subject(subject string) (string, error) {
+	var username string
+	err := Db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(subjectBucket); b != nil {
+			username = string(b.Get([]byte(subject)))
+		}
+		return nil
+	})
+	return username, err
+}
@@ -0,0 +1,32 @@
+package model
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// UseStepUpToken record the jti of a step up token checked at /stepup/verify, false when it was used before
+// the jtis of expired tokens are dropped, those tokens are refused anyway
+func UseStepUpToken(jti string, expiresAt int64) (bool, error) {
+	fresh := false
+	err := Db.Update(func(tx *bolt.Tx) error {
+		b := getBucket(tx, stepUpBucket)
+		now := time.Now().Unix()
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			if exp, err := strconv.ParseInt(string(v), 10, 64); err != nil || exp < now {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		if b.Get([]byte(jti)) != nil {
+			return nil
+		}
+		fresh = true
+		return b.Put([]byte(jti), []byte(strconv.FormatInt(expiresAt, 10)))
+	})
+	return fresh, err
+}
@@ -4,9 +4,11 @@ import (
 	"bytes"
 	"encoding/gob"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/vouch/vouch-proxy/pkg/pii"
 	"github.com/vouch/vouch-proxy/pkg/structs"
 )
 
@@ -22,8 +24,8 @@ func PutUser(u structs.User) error {
 			log.Errorw("PutUser userexists lookup error",
 				"error", err.Error(),
 				"userexists", userexists,
-				"u", u,
-				"curu", curu,
+				"u", pii.Dump(u),
+				"curu", pii.Dump(curu),
 			)
 		}
 	}
@@ -38,7 +40,7 @@ func PutUser(u structs.User) error {
 		} else {
 			u.CreatedOn = u.LastUpdate
 			id, _ := b.NextSequence()
-			u.ID = int(id)
+			u.ID = structs.ID(strconv.FormatUint(id, 10))
 			log.Debugf("new user.. setting created on to %v", u.CreatedOn)
 		}
 
@@ -53,24 +55,24 @@ func PutUser(u structs.User) error {
 			log.Error(err)
 			return err
 		}
-		log.Debugf("user created %v", u)
+		log.Debugf("user created %v", pii.Dump(u))
 		return nil
 	})
 }
 
 // User lookup user from key
 func User(key []byte, u *structs.User) error {
-	log.Debugf("looking up User %s", key)
+	log.Debugf("looking up User %s", pii.Mask(string(key)))
 	return Db.View(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(userBucket); b != nil {
-			log.Debugf("key is %s", key)
+			log.Debugf("key is %s", pii.Mask(string(key)))
 			val := b.Get([]byte(key))
 			user, err := gobDecodeUser(val)
 			if err != nil {
 				return err
 			}
 			*u = *user
-			log.Debugf("retrieved %s from db", u.Username)
+			log.Debugf("retrieved %s from db", pii.Mask(u.Username))
 			return nil
 		}
 		return fmt.Errorf("no bucket for %s", userBucket)
@@ -82,7 +84,7 @@ func AllUsers(users *[]structs.User) error {
 	return Db.View(func(tx *bolt.Tx) error {
 		if b := tx.Bucket(userBucket); b != nil {
 			if err := b.ForEach(func(k, v []byte) error {
-				log.Debugf("key=%s, value=%s\n", k, v)
+				log.Debugf("key=%s, value=%s\n", pii.Mask(string(k)), pii.Dump(v))
 				u := structs.User{}
 				if err := User(k, &u); err != nil {
 					log.Error(err)
@@ -92,7 +94,7 @@ func AllUsers(users *[]structs.User) error {
 			}); err != nil {
 				log.Error(err)
 			}
-			log.Debugf("users %v", users)
+			log.Debugf("users %v", pii.Dump(users))
 			return nil
 		}
 		return fmt.Errorf("no bucket for %s", userBucket)
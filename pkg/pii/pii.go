@@ -0,0 +1,57 @@
+package pii
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+// masked what Dump logs in place of a value which may hold anything about the user
+const masked = "(masked, see vouch.maskPII)"
+
+// Mask an email or username for the log when `vouch.maskPII` is set
+// the first character and the domain of an email are kept, along with a short hash of the whole value
+// so that the log lines of the same user can still be told apart and correlated
+//
+//	alice@example.com -> a***@example.com#ff8d9819
+//	robin             -> r***#287782ef
+func Mask(s string) string {
+	if !cfg.Cfg.MaskPII || s == "" {
+		return s
+	}
+	sum := sha256.Sum256([]byte(s))
+	hash := hex.EncodeToString(sum[:4])
+	local, domain := s, ""
+	if at := strings.LastIndex(s, "@"); at >= 0 {
+		local, domain = s[:at], s[at:]
+	}
+	first := ""
+	for _, c := range local {
+		first = string(c)
+		break
+	}
+	return first + "***" + domain + "#" + hash
+}
+
+// MaskAll Mask each of the emails or usernames
+func MaskAll(ss []string) []string {
+	if !cfg.Cfg.MaskPII {
+		return ss
+	}
+	m := make([]string, len(ss))
+	for i, s := range ss {
+		m[i] = Mask(s)
+	}
+	return m
+}
+
+// Dump a value such as the user, the claims or a provider's response, which is left out of the log entirely
+// when `vouch.maskPII` is set
+func Dump(v interface{}) interface{} {
+	if cfg.Cfg.MaskPII {
+		return masked
+	}
+	return v
+}
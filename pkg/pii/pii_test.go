@@ -0,0 +1,30 @@
+package pii
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/vouch/vouch-proxy/pkg/cfg"
+)
+
+func init() {
+	cfg.InitForTestPurposes()
+}
+
+func TestMask(t *testing.T) {
+	assert.Equal(t, "alice@example.com", Mask("alice@example.com"))
+	assert.Equal(t, "robin", Dump("robin"))
+
+	cfg.Cfg.MaskPII = true
+	defer func() { cfg.Cfg.MaskPII = false }()
+	assert.Regexp(t, `^a\*\*\*@example\.com#[0-9a-f]{8}$`, Mask("alice@example.com"))
+	assert.Regexp(t, `^r\*\*\*#[0-9a-f]{8}$`, Mask("robin"))
+	assert.Regexp(t, `^ü\*\*\*#[0-9a-f]{8}$`, Mask("ünal"))
+	assert.Equal(t, "", Mask(""))
+	// the same user can be correlated, another can't be mistaken for them
+	assert.Equal(t, Mask("alice@example.com"), Mask("alice@example.com"))
+	assert.NotEqual(t, Mask("alice@example.com"), Mask("anna@example.com"))
+	assert.Equal(t, []string{Mask("alice@example.com"), Mask("robin")}, MaskAll([]string{"alice@example.com", "robin"}))
+	assert.Equal(t, masked, Dump(map[string]string{"email": "alice@example.com"}))
+}
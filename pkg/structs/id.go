@@ -0,0 +1,65 @@
+package structs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ID the user's identifier at the provider in its canonical string form, so that it is a stable key whichever
+// provider issued it. GitHub sends a number, an OIDC `sub` is a string and some providers use UUIDs.
+type ID string
+
+var rxUUID = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// NewID the canonical form of an id, a UUID is lower cased and loses its braces or `urn:uuid:` prefix
+// any other string is kept as it is, ids such as `auth0|5f7c8ec7c33c6c004bbafe82` are case sensitive
+func NewID(s string) ID {
+	s = strings.TrimSpace(s)
+	u := strings.TrimPrefix(strings.TrimPrefix(s, "urn:uuid:"), "{")
+	u = strings.TrimSuffix(u, "}")
+	if rxUUID.MatchString(u) {
+		return ID(strings.ToLower(u))
+	}
+	return ID(s)
+}
+
+// UnmarshalJSON accept the id as a json number or a string, `null` leaves it empty
+func (id *ID) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 || bytes.Equal(b, []byte("null")) {
+		return nil
+	}
+	if b[0] == '"' {
+		var s string
+		if err := json.Unmarshal(b, &s); err != nil {
+			return err
+		}
+		*id = NewID(s)
+		return nil
+	}
+	var n json.Number
+	if err := json.Unmarshal(b, &n); err != nil {
+		return fmt.Errorf("id is neither a number nor a string: %s", b)
+	}
+	// 42.0 and 4.2e1 are the same id as 42
+	if f, err := strconv.ParseFloat(n.String(), 64); err == nil && f == float64(int64(f)) && !isInteger(n.String()) {
+		*id = ID(strconv.FormatInt(int64(f), 10))
+		return nil
+	}
+	*id = ID(n.String())
+	return nil
+}
+
+func isInteger(s string) bool {
+	_, err := strconv.ParseInt(s, 10, 64)
+	return err == nil
+}
+
+// String implement fmt.Stringer
+func (id ID) String() string {
+	return string(id)
+}
@@ -0,0 +1,44 @@
+package structs
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIDUnmarshalJSON(t *testing.T) {
+	tests := []struct {
+		json string
+		want ID
+	}{
+		{`{"id": 1234567}`, "1234567"},
+		{`{"id": "1234567"}`, "1234567"},
+		{`{"id": 4.2e1}`, "42"},
+		{`{"id": "auth0|5f7c8ec7c33c6c004bbafe82"}`, "auth0|5f7c8ec7c33c6c004bbafe82"},
+		{`{"id": "{6F9619FF-8B86-D011-B42D-00C04FC964FF}"}`, "6f9619ff-8b86-d011-b42d-00c04fc964ff"},
+		{`{"id": "urn:uuid:6F9619FF-8B86-D011-B42D-00C04FC964FF"}`, "6f9619ff-8b86-d011-b42d-00c04fc964ff"},
+		{`{"id": null}`, ""},
+		{`{}`, ""},
+	}
+	for _, tt := range tests {
+		u := struct {
+			ID ID `json:"id"`
+		}{}
+		assert.NoError(t, json.Unmarshal([]byte(tt.json), &u), tt.json)
+		assert.Equal(t, tt.want, u.ID, tt.json)
+	}
+
+	u := struct {
+		ID ID `json:"id"`
+	}{}
+	assert.Error(t, json.Unmarshal([]byte(`{"id": {"value": 1}}`), &u))
+}
+
+func TestGitHubUserID(t *testing.T) {
+	// https://github.com/vouch/vouch-proxy/issues/185 the numeric id no longer refuses the whole user
+	gh := GitHubUser{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"login": "octocat", "id": 583231}`), &gh))
+	assert.Equal(t, ID("583231"), gh.ID)
+	assert.Equal(t, "octocat", gh.Login)
+}
@@ -5,6 +5,24 @@ type CustomClaims struct {
 	Claims map[string]interface{}
 }
 
+// ProviderClaim the key of the CustomClaims which holds the oauth.provider that authenticated the user
+const ProviderClaim = "vouch_provider"
+
+// TeamsClaim the key of the CustomClaims which holds the user's TeamMemberships, see cfg.Cfg.MethodTeams and cfg.Cfg.StoreTeams
+const TeamsClaim = "vouch_teams"
+
+// FingerprintClaim the key of the CustomClaims which holds the hash of the client which logged in, see cfg.Cfg.Fingerprint
+const FingerprintClaim = "vouch_fp"
+
+// PictureClaim the key of the CustomClaims which holds the user's Picture, see cfg.Cfg.Headers.Picture
+const PictureClaim = "vouch_picture"
+
+// RolesClaim the key of the CustomClaims which holds the user's normalized roles, see cfg.Cfg.Roles
+const RolesClaim = "vouch_roles"
+
+// TenantClaim the key of the CustomClaims which holds the user's Tenant, see cfg.GenOAuth.TenantClaim
+const TenantClaim = "vouch_tenant"
+
 // UserI each *User struct must prepare the data for being placed in the JWT
 type UserI interface {
 	PrepareUserData()
@@ -20,11 +38,17 @@ type User struct {
 	Email      string `json:"email" mapstructure:"email"`
 	CreatedOn  int64  `json:"createdon"`
 	LastUpdate int64  `json:"lastupdate"`
-	// don't populate ID from json https://github.com/vouch/vouch-proxy/issues/185
-	ID int `json:"-" mapstructure:"id"`
+	// ID is populated from a numeric or a string `id`, see structs.ID and https://github.com/vouch/vouch-proxy/issues/185
+	ID ID `json:"id,omitempty" mapstructure:"id"`
 	// jwt.StandardClaims
 
 	TeamMemberships []string
+	// Emails all of the user's verified addresses, Email stays the primary
+	Emails []string `json:"-"`
+	// Picture the url of the user's avatar, see oauth.picture_claim
+	Picture string `json:"picture,omitempty"`
+	// Tenant the user's tenant or organization, see oauth.tenant_claim
+	Tenant string `json:"tenant,omitempty"`
 }
 
 // PrepareUserData implement PersonalData interface
@@ -40,7 +64,7 @@ func (u *User) PrepareUserData() {
 // https://golang.org/doc/effective_go.html#embedding
 type GoogleUser struct {
 	User
-	Sub           string `json:"sub"`
+	Sub           ID     `json:"sub"`
 	GivenName     string `json:"given_name"`
 	FamilyName    string `json:"family_name"`
 	Profile       string `json:"profile"`
@@ -59,7 +83,7 @@ func (u *GoogleUser) PrepareUserData() {
 // ADFSUser Active Directory user record
 type ADFSUser struct {
 	User
-	Sub string `json:"sub"`
+	Sub ID     `json:"sub"`
 	UPN string `json:"upn"`
 	// UniqueName string `json:"unique_name"`
 	// PwdExp     string `json:"pwd_exp"`
@@ -81,10 +105,26 @@ type GitHubUser struct {
 	// jwt.StandardClaims
 }
 
+// GitHubEmail an entry of https://api.github.com/user/emails
+type GitHubEmail struct {
+	Email    string `json:"email"`
+	Primary  bool   `json:"primary"`
+	Verified bool   `json:"verified"`
+}
+
 type GitHubTeamMembershipState struct {
 	State string `json:"state"`
 }
 
+// GitHubTeam a team of an org, as listed among the child teams of its parent or the teams of the user
+type GitHubTeam struct {
+	ID           int    `json:"id"`
+	Slug         string `json:"slug"`
+	Organization struct {
+		Login string `json:"login"`
+	} `json:"organization"`
+}
+
 // PrepareUserData implement PersonalData interface
 func (u *GitHubUser) PrepareUserData() {
 	// always use the u.Login as the u.Username
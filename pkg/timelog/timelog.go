@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/vouch/vouch-proxy/pkg/cfg"
+	"github.com/vouch/vouch-proxy/pkg/clientip"
 	"github.com/vouch/vouch-proxy/pkg/response"
 )
 
@@ -48,6 +49,7 @@ func TimeLog(nextHandler http.Handler) func(http.ResponseWriter, *http.Request)
 			"latency", time.Duration(latency),
 			"avgLatency", time.Duration(avgLatency),
 			"ipPort", clientIP,
+			"clientIP", clientip.FromRequest(r),
 			"method", method,
 			"host", host,
 			"path", path,